@@ -0,0 +1,339 @@
+// Package client is a Go client for a SummitDB cluster. It finds the leader
+// of the cluster and sends the commands to it, following the TRY redirects
+// of the followers, and retries commands across leader elections.
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrClosed is returned when the client is closed.
+	ErrClosed = errors.New("client closed")
+	// ErrNoServers is returned when no server of the cluster can be reached.
+	ErrNoServers = errors.New("no servers")
+	// ErrLeaderNotKnown is returned when the servers don't know the leader,
+	// such as during an election, until the retry timeout.
+	ErrLeaderNotKnown = errors.New("leader not known")
+	// ErrTooManyRedirects is returned when a command was redirected more
+	// than the maximum number of redirects.
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+const (
+	defaultDialTimeout  = time.Second * 5
+	defaultMaxRedirects = 16
+	defaultRetryTimeout = time.Second * 10
+	retryDelay          = time.Millisecond * 100
+)
+
+// Options are the options of a client.
+type Options struct {
+	// Username and Password authenticate the connections with AUTH. The
+	// username is optional.
+	Username string
+	Password string
+	// TLSConfig connects to the servers with tls, nil for tcp.
+	TLSConfig *tls.Config
+	// DialTimeout is the timeout for connecting to a server.
+	DialTimeout time.Duration
+	// MaxRedirects is the maximum number of TRY redirects of a command.
+	MaxRedirects int
+	// RetryTimeout is how long a command is retried while the cluster has
+	// no leader, such as during an election.
+	RetryTimeout time.Duration
+}
+
+// Client is a client of a SummitDB cluster. It's safe for concurrent use.
+type Client struct {
+	opts Options
+
+	mu      sync.Mutex
+	closed  bool
+	servers []string               // the known servers of the cluster
+	leader  string                 // the leader, or empty when not known
+	pools   map[string]*redis.Pool // connections by server
+}
+
+// New returns a client of the cluster of the servers. Only one server of
+// the cluster is needed, the other servers are discovered with RAFTPEERS.
+func New(servers []string, opts *Options) (*Client, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	c := &Client{pools: make(map[string]*redis.Pool)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.DialTimeout == 0 {
+		c.opts.DialTimeout = defaultDialTimeout
+	}
+	if c.opts.MaxRedirects == 0 {
+		c.opts.MaxRedirects = defaultMaxRedirects
+	}
+	if c.opts.RetryTimeout == 0 {
+		c.opts.RetryTimeout = defaultRetryTimeout
+	}
+	c.servers = append(c.servers, servers...)
+	if err := c.Discover(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connections of the client.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	for _, pool := range c.pools {
+		pool.Close()
+	}
+	c.pools = nil
+	return nil
+}
+
+// Servers returns the known servers of the cluster.
+func (c *Client) Servers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.servers...)
+}
+
+// Leader returns the leader of the cluster, or an empty string when the
+// leader is not known.
+func (c *Client) Leader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+func (c *Client) setLeader(leader string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+	if leader != "" && !contains(c.servers, leader) {
+		c.servers = append(c.servers, leader)
+	}
+}
+
+// Discover finds the leader and the servers of the cluster. It's called by
+// New and when the leader is lost, and doesn't need to be called by the
+// user.
+func (c *Client) Discover() error {
+	var lerr error
+	for _, server := range c.Servers() {
+		leader, err := redis.String(c.doServer(server, "RAFTLEADER"))
+		if err != nil {
+			if err == redis.ErrNil {
+				err = ErrLeaderNotKnown
+			}
+			lerr = err
+			continue
+		}
+		// the leader knows every peer of the cluster.
+		peers, err := redis.Strings(c.doServer(leader, "RAFTPEERS"))
+		if err != nil {
+			lerr = err
+			continue
+		}
+		c.mu.Lock()
+		// RAFTPEERS returns the address, the state, and the role of each
+		// peer.
+		for i := 0; i+2 < len(peers); i += 3 {
+			if !contains(c.servers, peers[i]) {
+				c.servers = append(c.servers, peers[i])
+			}
+		}
+		c.mu.Unlock()
+		c.setLeader(leader)
+		return nil
+	}
+	if lerr == nil {
+		lerr = ErrNoServers
+	}
+	return lerr
+}
+
+// Do sends a command to the leader and returns the reply. The TRY
+// redirects of the followers are followed. When the leader is lost, the
+// command is retried on the new leader until the retry timeout. A command
+// that may have been applied before the connection was lost is only
+// retried when it's a read, such as GET. Use DoRetry for writes that are
+// safe to apply twice.
+func (c *Client) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(readOnly(strings.ToLower(cmd)), cmd, args...)
+}
+
+// DoRetry is like Do, but the command is also retried when it may have
+// been applied before the connection was lost, so it may be applied twice.
+// It's for writes that have the same result when applied twice, such as a
+// SET without NX, XX, or IFVER.
+func (c *Client) DoRetry(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(true, cmd, args...)
+}
+
+func (c *Client) do(retry bool, cmd string, args ...interface{}) (interface{}, error) {
+	deadline := time.Now().Add(c.opts.RetryTimeout)
+	var redirects int
+	for {
+		leader := c.Leader()
+		if leader == "" {
+			if err := c.Discover(); err != nil {
+				if err == ErrClosed || time.Now().After(deadline) {
+					return nil, err
+				}
+				time.Sleep(retryDelay)
+				continue
+			}
+			leader = c.Leader()
+		}
+		reply, err := c.doServer(leader, cmd, args...)
+		if err == nil {
+			return reply, nil
+		}
+		if err == ErrClosed {
+			return nil, err
+		}
+		if rerr, ok := err.(redis.Error); ok {
+			msg := rerr.Error()
+			switch {
+			case strings.HasPrefix(msg, "TRY "):
+				// the command was not applied by the follower.
+				redirects++
+				if redirects > c.opts.MaxRedirects {
+					return nil, ErrTooManyRedirects
+				}
+				c.setLeader(strings.TrimSpace(msg[4:]))
+				continue
+			case msg == "ERR leader not known":
+				// the command was not applied, and can be retried.
+				err = ErrLeaderNotKnown
+			case strings.HasPrefix(msg, "TRYAGAIN "):
+				// the leadership is being transferred, and the command
+				// was not applied.
+			case uncertain(msg):
+				// the leader was lost while the command was applied.
+				if !retry {
+					c.setLeader("")
+					return nil, err
+				}
+			default:
+				// an error of the command.
+				return reply, err
+			}
+		} else if oerr, ok := err.(*net.OpError); ok && oerr.Op == "dial" {
+			// the server can't be reached, and the command was not sent.
+		} else if !retry {
+			// the connection was lost and the command may have been
+			// applied.
+			c.setLeader("")
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		c.setLeader("")
+		time.Sleep(retryDelay)
+	}
+}
+
+// doServer sends a command to a server.
+func (c *Client) doServer(server, cmd string, args ...interface{}) (interface{}, error) {
+	pool, err := c.pool(server)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// pool returns the connection pool of a server.
+func (c *Client) pool(server string) (*redis.Pool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	pool, ok := c.pools[server]
+	if !ok {
+		pool = &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: time.Minute,
+			Dial:        func() (redis.Conn, error) { return c.dial(server) },
+		}
+		c.pools[server] = pool
+	}
+	return pool, nil
+}
+
+// dial connects to a server and authenticates the connection.
+func (c *Client) dial(server string) (redis.Conn, error) {
+	opts := []redis.DialOption{redis.DialConnectTimeout(c.opts.DialTimeout)}
+	if c.opts.TLSConfig != nil {
+		opts = append(opts, redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: c.opts.DialTimeout}
+			return tls.DialWithDialer(dialer, network, addr, c.opts.TLSConfig)
+		}))
+	}
+	conn, err := redis.Dial("tcp", server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Password != "" {
+		args := []interface{}{c.opts.Password}
+		if c.opts.Username != "" {
+			args = []interface{}{c.opts.Username, c.opts.Password}
+		}
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// uncertain returns true for the errors of a command that may have been
+// applied by the cluster.
+func uncertain(msg string) bool {
+	switch msg {
+	case "leadership lost while committing log", "raft is already shutdown",
+		"timed out enqueuing operation":
+		return true
+	}
+	return false
+}
+
+// readOnly returns true for the commands that don't change the database,
+// which are retried when the leader is lost.
+func readOnly(name string) bool {
+	switch name {
+	case "get", "mget", "exists", "getver", "strlen", "getrange", "getbit",
+		"bitcount", "bitpos", "ttl", "pttl", "type", "dump", "keys", "dbsize",
+		"jget", "iter", "rect", "indexes", "fenceget", "schemas",
+		"raftleader", "raftpeers":
+		return true
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/redlog"
+	"github.com/tidwall/summitdb/machine"
+)
+
+// testServer is a server of a test cluster, which runs in the process.
+type testServer struct {
+	addr string
+	n    *finn.Node
+	m    *machine.Machine
+}
+
+func (s *testServer) Close() {
+	s.n.Close()
+	s.m.Close()
+}
+
+// testOpenServer opens a server in the directory, which joins the server at
+// the join address.
+func testOpenServer(dir, join string) (*testServer, error) {
+	port := rand.Int()%20000 + 20000
+	addr := fmt.Sprintf(":%d", port)
+	m, err := machine.New(redlog.New(ioutil.Discard).Sub('M'), addr)
+	if err != nil {
+		return nil, err
+	}
+	var opts finn.Options
+	opts.Backend = finn.FastLog
+	opts.Durability = finn.High
+	opts.Consistency = finn.High
+	opts.LogOutput = ioutil.Discard
+	opts.ConnAccept = func(conn redcon.Conn) bool { return m.ConnAccept(conn) }
+	opts.ConnClosed = func(conn redcon.Conn, err error) { m.ConnClosed(conn, err) }
+	n, err := finn.Open(filepath.Join(dir, fmt.Sprintf("%d", port)), addr, join, m, &opts)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	s := &testServer{addr: addr, n: n, m: m}
+	// wait for the server to join the cluster.
+	for start := time.Now(); time.Since(start) < time.Second*5; time.Sleep(time.Millisecond * 100) {
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			continue
+		}
+		leader, err := redis.String(conn.Do("RAFTLEADER"))
+		conn.Close()
+		if err == nil && leader != "" {
+			return s, nil
+		}
+	}
+	s.Close()
+	return nil, fmt.Errorf("server %v did not start", addr)
+}
+
+// testOpenCluster opens a cluster of three servers. The first server is the
+// leader.
+func testOpenCluster(t *testing.T) ([]*testServer, func()) {
+	rand.Seed(time.Now().UnixNano())
+	dir, err := ioutil.TempDir("", "summitdb-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ss []*testServer
+	closeAll := func() {
+		for _, s := range ss {
+			if s != nil {
+				s.Close()
+			}
+		}
+		os.RemoveAll(dir)
+	}
+	for i := 0; i < 3; i++ {
+		var join string
+		if i > 0 {
+			join = ss[0].addr
+		}
+		s, err := testOpenServer(dir, join)
+		if err != nil {
+			closeAll()
+			t.Fatal(err)
+		}
+		ss = append(ss, s)
+	}
+	return ss, closeAll
+}
+
+func TestClient(t *testing.T) {
+	ss, closeAll := testOpenCluster(t)
+	defer closeAll()
+
+	// connect to a follower, which finds the leader.
+	c, err := New([]string{ss[2].addr}, &Options{RetryTimeout: time.Second * 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Leader() != ss[0].addr {
+		t.Fatalf("expected leader '%v', got '%v'", ss[0].addr, c.Leader())
+	}
+	// the peers of RAFTPEERS are refreshed by the servers every second.
+	for start := time.Now(); len(c.Servers()) != 3 && time.Since(start) < time.Second*5; {
+		time.Sleep(time.Millisecond * 100)
+		if err := c.Discover(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if servers := c.Servers(); len(servers) != 3 {
+		t.Fatalf("expected '3' servers, got '%v'", servers)
+	}
+
+	t.Run("redirect", func(t *testing.T) {
+		// a stale leader is followed to the leader with TRY.
+		c.setLeader(ss[1].addr)
+		if err := c.Set("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if c.Leader() != ss[0].addr {
+			t.Fatalf("expected leader '%v', got '%v'", ss[0].addr, c.Leader())
+		}
+		if v, err := c.Get("key"); err != nil || v != "value" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "value", v, err)
+		}
+		if _, err := c.Get("missing"); err != ErrNil {
+			t.Fatalf("expected '%v', got '%v'", ErrNil, err)
+		}
+		if _, err := c.Do("INCR", "key"); err == nil || err.Error() != "ERR value is not an integer or out of range" {
+			t.Fatalf("expected an error, got '%v'", err)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		if err := c.Set("user:1", `{"name":"Tom","age":38}`); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.JSet("user:1", "name", "Andy"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.JSetRaw("user:1", "tags", `["a","b"]`); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.JGet("user:1", "name"); err != nil || v != "Andy" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "Andy", v, err)
+		}
+		if v, err := c.JGet("user:1", "tags.1"); err != nil || v != "b" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "b", v, err)
+		}
+		if ok, err := c.JDel("user:1", "tags"); err != nil || !ok {
+			t.Fatalf("expected '%v', got '%v' (%v)", true, ok, err)
+		}
+		if _, err := c.JGet("user:1", "tags"); err != ErrNil {
+			t.Fatalf("expected '%v', got '%v'", ErrNil, err)
+		}
+	})
+
+	t.Run("indexes", func(t *testing.T) {
+		for i, age := range []string{"38", "22", "51"} {
+			if err := c.Set(fmt.Sprintf("person:%d", i), `{"age":`+age+`}`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.SetIndex("ages", "person:*", "JSON", "age"); err != nil {
+			t.Fatal(err)
+		}
+		if names, err := c.Indexes("*"); err != nil || !reflect.DeepEqual(names, []string{"ages"}) {
+			t.Fatalf("expected '%v', got '%v' (%v)", []string{"ages"}, names, err)
+		}
+		kvs, err := c.Iter("ages", "LIMIT", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []KeyValue{{"person:1", `{"age":22}`}, {"person:0", `{"age":38}`}}
+		if !reflect.DeepEqual(kvs, expect) {
+			t.Fatalf("expected '%v', got '%v'", expect, kvs)
+		}
+		if ok, err := c.DelIndex("ages"); err != nil || !ok {
+			t.Fatalf("expected '%v', got '%v' (%v)", true, ok, err)
+		}
+	})
+
+	t.Run("spatial", func(t *testing.T) {
+		if err := c.Set("fleet:1", "[-112.27 33.46]"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set("fleet:2", "[-104.99 39.74]"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetIndex("fleet", "fleet:*", "SPATIAL"); err != nil {
+			t.Fatal(err)
+		}
+		kvs, err := c.Rect("fleet", "[-113 33],[-111 34]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []KeyValue{{"fleet:1", "[-112.27 33.46]"}}
+		if !reflect.DeepEqual(kvs, expect) {
+			t.Fatalf("expected '%v', got '%v'", expect, kvs)
+		}
+	})
+
+	t.Run("fence", func(t *testing.T) {
+		if n, err := c.Fence("lock"); err != nil || n != 1 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 1, n, err)
+		}
+		if n, err := c.FenceRange("lock", 10); err != nil || n != 2 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 2, n, err)
+		}
+		if n, err := c.FenceGet("lock"); err != nil || n != 11 {
+			t.Fatalf("expected '%v', got '%v' (%v)", 11, n, err)
+		}
+	})
+
+	t.Run("election", func(t *testing.T) {
+		// the leader is closed, and the commands are retried on the new
+		// leader after the election.
+		old := ss[0]
+		old.Close()
+		ss[0] = nil
+		if v, err := c.Get("key"); err != nil || v != "value" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "value", v, err)
+		}
+		if c.Leader() == old.addr || c.Leader() == "" {
+			t.Fatalf("expected a new leader, got '%v'", c.Leader())
+		}
+		if err := c.Set("key", "value2"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := c.Get("key"); err != nil || v != "value2" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "value2", v, err)
+		}
+		if v, err := redis.String(c.DoRetry("SET", "key", "value3")); err != nil || v != "OK" {
+			t.Fatalf("expected '%v', got '%v' (%v)", "OK", v, err)
+		}
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	for name, expect := range map[string]bool{
+		"get": true, "iter": true, "getver": true, "set": false, "mset": false,
+		"del": false, "jset": false, "incr": false, "append": false,
+		"fence": false, "eval": false,
+	} {
+		if readOnly(name) != expect {
+			t.Fatalf("expected '%v' for '%v', got '%v'", expect, name, !expect)
+		}
+	}
+}
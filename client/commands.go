@@ -0,0 +1,137 @@
+package client
+
+import (
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNil is returned when a key or a JSON path does not exist.
+var ErrNil = redis.ErrNil
+
+// KeyValue is a key and its value, which is returned by ITER and RECT.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// keyValues returns the key and value pairs of a reply.
+func keyValues(reply interface{}, err error) ([]KeyValue, error) {
+	values, err := redis.Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]KeyValue, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		kvs = append(kvs, KeyValue{Key: values[i], Value: values[i+1]})
+	}
+	return kvs, nil
+}
+
+// Get returns the value of a key, or ErrNil when the key does not exist.
+func (c *Client) Get(key string) (string, error) {
+	return redis.String(c.Do("GET", key))
+}
+
+// Set sets the value of a key.
+func (c *Client) Set(key, value string) error {
+	_, err := c.Do("SET", key, value)
+	return err
+}
+
+// Del deletes the keys and returns the number of keys that were deleted.
+func (c *Client) Del(keys ...string) (int, error) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	return redis.Int(c.Do("DEL", args...))
+}
+
+// JGet returns the value at the path of the JSON document of a key, or
+// ErrNil when the key or the path does not exist.
+func (c *Client) JGet(key, path string) (string, error) {
+	return redis.String(c.Do("JGET", key, path))
+}
+
+// JSet sets the value at the path of the JSON document of a key. The value
+// is stored as a JSON string, number, boolean, or null, like JSET.
+func (c *Client) JSet(key, path, value string) error {
+	_, err := c.Do("JSET", key, path, value)
+	return err
+}
+
+// JSetRaw sets the value at the path of the JSON document of a key to raw
+// JSON, such as an object or an array.
+func (c *Client) JSetRaw(key, path, json string) error {
+	_, err := c.Do("JSET", key, path, json, "RAW")
+	return err
+}
+
+// JDel deletes the value at the path of the JSON document of a key, and
+// returns true when the value was deleted.
+func (c *Client) JDel(key, path string) (bool, error) {
+	n, err := redis.Int(c.Do("JDEL", key, path))
+	return n == 1, err
+}
+
+// SetIndex creates an index of the keys that match the pattern. The args
+// are the type and the options of the index, such as "JSON", "age", or
+// "SPATIAL".
+func (c *Client) SetIndex(name, pattern string, args ...interface{}) error {
+	_, err := c.Do("SETINDEX", append([]interface{}{name, pattern}, args...)...)
+	return err
+}
+
+// DelIndex deletes an index, and returns true when the index was deleted.
+func (c *Client) DelIndex(name string) (bool, error) {
+	n, err := redis.Int(c.Do("DELINDEX", name))
+	return n == 1, err
+}
+
+// Indexes returns the names of the indexes that match the pattern.
+func (c *Client) Indexes(pattern string) ([]string, error) {
+	return redis.Strings(c.Do("INDEXES", pattern))
+}
+
+// Iter returns the keys and values of an index in order. The args are the
+// options of ITER, such as "LIMIT", 10 or "DESC".
+func (c *Client) Iter(index string, args ...interface{}) ([]KeyValue, error) {
+	return keyValues(c.Do("ITER", append([]interface{}{index}, args...)...))
+}
+
+// Rect returns the keys and values of a spatial index that intersect the
+// bounds, such as "[-112 33],[-111 34]". The args are the options of RECT,
+// such as "LIMIT", 10.
+func (c *Client) Rect(index, bounds string, args ...interface{}) ([]KeyValue, error) {
+	return keyValues(c.Do("RECT", append([]interface{}{index, bounds}, args...)...))
+}
+
+// Fence increments the fencing token and returns the new value, which is
+// unique and always greater than the previous values.
+func (c *Client) Fence(token string) (uint64, error) {
+	return fenceReply(c.Do("FENCE", token))
+}
+
+// FenceRange increments the fencing token by n and returns the first value
+// of the range of n values.
+func (c *Client) FenceRange(token string, n uint64) (uint64, error) {
+	last, err := fenceReply(c.Do("FENCE", token, n))
+	if err != nil {
+		return 0, err
+	}
+	return last - n + 1, nil
+}
+
+// FenceGet returns the current value of the fencing token.
+func (c *Client) FenceGet(token string) (uint64, error) {
+	return fenceReply(c.Do("FENCEGET", token))
+}
+
+func fenceReply(reply interface{}, err error) (uint64, error) {
+	s, err := redis.String(reply, err)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
@@ -4,8 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tidwall/finn"
 	"github.com/tidwall/redcon"
@@ -15,6 +20,10 @@ import (
 
 var version = "0.0.1"
 
+// drainTimeout is the time that the running client commands have to finish
+// when the server shuts down.
+const drainTimeout = time.Second * 30
+
 func main() {
 	var port int
 	var host string
@@ -22,8 +31,21 @@ func main() {
 	var consistency string
 	var loglevel string
 	var join string
+	var nonvoter bool
 	var dir string
 	var high, medium, low bool
+	var scriptTimeLimit time.Duration
+	var tlsCert, tlsKey, tlsCA string
+	var keyFile, oldKeyFile string
+	var secretFile string
+	var decryptBackup string
+	var metricsAddr string
+	var slowlogSlowerThan int64
+	var slowlogMaxLen int
+	var maxMemory string
+	var maxMemoryPolicy string
+	var maxClients int
+	var configFile string
 
 	flag.IntVar(&port, "p", 7481, "Bind port")
 	flag.StringVar(&host, "h", "localhost", "Bind host")
@@ -32,6 +54,22 @@ func main() {
 	flag.StringVar(&loglevel, "loglevel", "notice", "Log level [quiet,warning,notice,verbose,debug]")
 	flag.StringVar(&dir, "dir", "data", "Data directory")
 	flag.StringVar(&join, "join", "", "Join a cluster by providing an address")
+	flag.BoolVar(&nonvoter, "nonvoter", false, "Join the cluster as a nonvoter, which receives the log but doesn't vote")
+	flag.DurationVar(&scriptTimeLimit, "scripttimelimit", time.Second*5, "Time limit for read-only scripts, 0 for no limit")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, enables TLS for client and peer connections")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file")
+	flag.StringVar(&tlsCA, "tls-ca", "", "TLS CA file for verifying the certificates of peers and clients")
+	flag.StringVar(&keyFile, "encryption-key-file", "", "Hex encoded AES key file, enables encryption at rest. Or use $SUMMITDB_ENCRYPTION_KEY")
+	flag.StringVar(&oldKeyFile, "encryption-old-key-file", "", "Hex encoded previous AES key file, used while rotating keys. Or use $SUMMITDB_ENCRYPTION_OLD_KEY")
+	flag.StringVar(&secretFile, "cluster-secret-file", "", "File with a secret that is shared by all servers and required for the raft RPCs between them. Or use $SUMMITDB_CLUSTER_SECRET")
+	flag.StringVar(&decryptBackup, "decrypt-backup", "", "Decrypt an encrypted backup file to stdout and exit")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics at /metrics on this address, such as :9481")
+	flag.Int64Var(&slowlogSlowerThan, "slowlog-log-slower-than", 10000, "Log commands that take longer than this many microseconds in the SLOWLOG, -1 to disable")
+	flag.IntVar(&slowlogMaxLen, "slowlog-max-len", 128, "Maximum number of entries in the SLOWLOG")
+	flag.StringVar(&maxMemory, "maxmemory", "0", "Maximum memory of the database, such as 100mb, 0 for no limit. Must be the same on all servers")
+	flag.StringVar(&maxMemoryPolicy, "maxmemory-policy", "noeviction", "How keys are evicted over maxmemory [noeviction,allkeys-lru,volatile-lru,volatile-ttl,allkeys-random]. Must be the same on all servers")
+	flag.IntVar(&maxClients, "maxclients", 0, "Maximum number of client connections, 0 for no limit")
+	flag.StringVar(&configFile, "config", "", "Config file of 'name value' lines with the same names as the flags, written by CONFIG REWRITE")
 	flag.BoolVar(&high, "high", false, "Set durability and consistency to high")
 	flag.BoolVar(&medium, "medium", false, "Set durability and consistency to medium")
 	flag.BoolVar(&low, "low", false, "Set durability and consistency to low")
@@ -40,8 +78,44 @@ func main() {
 	// create a logger that matches the redcon defaults
 	log := redlog.New(os.Stderr)
 
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+	}
+	maxMemoryBytes, err := machine.ParseMemory(maxMemory)
+	if err != nil {
+		log.Warningf("invalid maxmemory '%v'", maxMemory)
+		os.Exit(1)
+	}
+
+	cipher, err := loadCipher(keyFile, oldKeyFile)
+	if err != nil {
+		log.Warningf("%v", err)
+		os.Exit(1)
+	}
+	if decryptBackup != "" {
+		if cipher == nil {
+			log.Warningf("-decrypt-backup requires an encryption key")
+			os.Exit(1)
+		}
+		f, err := os.Open(decryptBackup)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		if err := machine.DecryptBackup(os.Stdout, f, cipher); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var opts finn.Options
 	opts.Backend = finn.FastLog
+	opts.Nonvoter = nonvoter
 
 	switch strings.ToLower(durability) {
 	default:
@@ -94,7 +168,7 @@ func main() {
 	addr := fmt.Sprintf("%s:%d", host, port)
 
 	// set the log level
-	log.SetLevel(int(opts.LogLevel))
+	log.SetLevel(redlogLevel(opts.LogLevel))
 
 	log.Printf("SummitDB %s", version)
 
@@ -104,6 +178,53 @@ func main() {
 		log.Warningf("%v", err)
 		os.Exit(1)
 	}
+	m.SetVersion(version)
+	m.SetScriptTimeLimit(scriptTimeLimit)
+	m.SetSlowlogLimits(slowlogSlowerThan, slowlogMaxLen)
+	m.SetMaxMemory(maxMemoryBytes)
+	if err := m.SetMaxMemoryPolicy(strings.ToLower(maxMemoryPolicy)); err != nil {
+		log.Warningf("invalid maxmemory-policy '%v'", maxMemoryPolicy)
+		os.Exit(1)
+	}
+	m.SetMaxClients(maxClients)
+	m.SetConfigFile(configFile)
+
+	if cipher != nil {
+		if err := m.SetCipher(cipher); err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		opts.Cipher = cipher
+	}
+
+	opts.ClusterSecret, err = loadClusterSecret(secretFile)
+	if err != nil {
+		log.Warningf("%v", err)
+		os.Exit(1)
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		config, peerConfig, err := machine.LoadTLSConfig(tlsCert, tlsKey, tlsCA)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		opts.TLSConfig = config
+		opts.PeerTLSConfig = peerConfig
+		m.SetTLSConfig(peerConfig)
+	} else if tlsCA != "" {
+		log.Warningf("-tls-ca requires -tls-cert and -tls-key")
+		os.Exit(1)
+	}
+
+	if metricsAddr != "" {
+		ln, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			log.Warningf("%v", err)
+			os.Exit(1)
+		}
+		go http.Serve(ln, m.MetricsHandler())
+	}
 
 	// setup the connection events
 	opts.ConnAccept = func(conn redcon.Conn) bool {
@@ -113,8 +234,41 @@ func main() {
 		m.ConnClosed(conn, err)
 	}
 
+	// changes the log level with CONFIG SET loglevel
+	var n *finn.Node
+	m.OnLogLevel(strings.ToLower(loglevel), func(level string) error {
+		if opts.LogOutput == ioutil.Discard {
+			return fmt.Errorf("the log is disabled by -loglevel quiet")
+		}
+		var lvl finn.LogLevel
+		switch level {
+		case "warning":
+			lvl = finn.Warning
+		case "notice":
+			lvl = finn.Notice
+		case "verbose":
+			lvl = finn.Verbose
+		case "debug":
+			lvl = finn.Debug
+		}
+		log.SetLevel(redlogLevel(lvl))
+		if n != nil {
+			n.SetLogLevel(lvl)
+		}
+		return nil
+	})
+
+	// stops the server with SHUTDOWN
+	done := make(chan bool, 1)
+	m.OnShutdown(func(drain bool) {
+		select {
+		case done <- drain:
+		default:
+		}
+	})
+
 	// open the raft machine
-	n, err := finn.Open(dir, addr, join, m, &opts)
+	n, err = finn.Open(dir, addr, join, m, &opts)
 	if err != nil {
 		if opts.LogOutput == ioutil.Discard {
 			log.Warningf("%v", err)
@@ -126,7 +280,114 @@ func main() {
 	defer func() {
 		n.Close()
 		m.Close()
+		log.Noticef("Server shutdown")
 	}()
-	// run forever
-	select {}
+
+	// run until SHUTDOWN or a signal, a second signal exits right away
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	var drain bool
+	select {
+	case drain = <-done:
+	case sig := <-sigs:
+		log.Warningf("Received %v, shutting down", sig)
+		drain = true
+	}
+	if drain {
+		go func() {
+			sig := <-sigs
+			log.Warningf("Received %v, exiting now", sig)
+			os.Exit(1)
+		}()
+		// hand the leadership to another voter, and wait for the running
+		// client commands.
+		if n.IsLeader() {
+			if err := n.TransferLeadership(""); err != nil {
+				log.Warningf("Leadership transfer failed: %v", err)
+			}
+		}
+		m.Drain(drainTimeout)
+	}
+}
+
+// redlogLevel returns the redlog level of a finn level.
+func redlogLevel(level finn.LogLevel) int {
+	switch level {
+	case finn.Debug:
+		return 0
+	case finn.Verbose:
+		return 1
+	case finn.Warning:
+		return 3
+	}
+	return 2
+}
+
+// loadConfigFile sets the flags from a config file. The flags that are on
+// the command line take precedence over the file.
+func loadConfigFile(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the file is created by CONFIG REWRITE
+			return nil
+		}
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for i, line := range strings.Split(string(data), "\n") {
+		name, value := machine.ParseConfigLine(line)
+		if name == "" || set[name] {
+			continue
+		}
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown config '%s'", file, i+1, name)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid config '%s': %v", file, i+1, name, err)
+		}
+	}
+	return nil
+}
+
+// loadCipher loads the encryption keys from the files or the environment.
+// Returns nil when encryption at rest is not enabled.
+func loadCipher(keyFile, oldKeyFile string) (*machine.Cipher, error) {
+	key, err := machine.LoadKey(keyFile, "SUMMITDB_ENCRYPTION_KEY")
+	if err != nil {
+		return nil, err
+	}
+	oldKey, err := machine.LoadKey(oldKeyFile, "SUMMITDB_ENCRYPTION_OLD_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		if oldKey != nil {
+			return nil, fmt.Errorf("an old encryption key requires an encryption key")
+		}
+		return nil, nil
+	}
+	if oldKey != nil {
+		return machine.NewCipher(key, oldKey)
+	}
+	return machine.NewCipher(key)
+}
+
+// loadClusterSecret loads the cluster secret from the file, or from the
+// environment when the file is empty. Returns an empty string when neither
+// is set.
+func loadClusterSecret(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("SUMMITDB_CLUSTER_SECRET"), nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("the cluster secret file '%v' is empty", file)
+	}
+	return secret, nil
 }
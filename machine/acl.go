@@ -0,0 +1,786 @@
+package machine
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// Users are stored in the database by name, so they are replicated and
+// included in snapshots. A connection is authenticated as the default user,
+// which has no password and can run every command, until the default user
+// is changed with ACL SETUSER:
+//
+//	ACL SETUSER default on >secret
+//
+// Commands are allowed or denied by category, or by name, and the rules are
+// applied in order. The categories are read, write, admin, scripting, and
+// raft. Users may also be restricted to keys that match a pattern.
+//
+//	ACL SETUSER alice on >pass +@read +@write -del ~user:*
+const aclUserKeyPrefix = sdbMetaPrefix + "user:"
+
+// aclDefaultUser is the user of new connections.
+const aclDefaultUser = "default"
+
+// aclInternalUser is the user of the connection that the server opens to
+// itself for expiring keys. It can't be created with ACL SETUSER.
+const aclInternalUser = "!internal"
+
+// internalCommand returns true for the commands that the servers create for
+// the raft log. They are applied from the log, but a client connection must
+// be the internal user to send them, or a client could fake them.
+func internalCommand(name string) bool {
+	switch name {
+	case "scriptenv", "expired", "evicted":
+		return true
+	}
+	return false
+}
+
+// internalOnly returns true for a command that only the servers can send,
+// which are the internal commands, and a PLWMULTI or PLRMULTI that contains
+// an internal command or a SETTRIGGER with the user of the trigger. A
+// SETTRIGGER with a user from a client is rejected by SETTRIGGER.
+func internalOnly(cmd redcon.Command) bool {
+	name := qcmdlower(cmd.Args[0])
+	if name == "plwmulti" || name == "plrmulti" {
+		for _, arg := range cmd.Args[1:] {
+			pcmd, err := parseCommand(arg)
+			if err != nil || len(pcmd.Args) == 0 {
+				continue
+			}
+			pname := qcmdlower(pcmd.Args[0])
+			if internalCommand(pname) || (pname == "settrigger" && len(pcmd.Args) > 7) {
+				return true
+			}
+		}
+	}
+	return internalCommand(name)
+}
+
+var errNoAuth = errors.New("NOAUTH Authentication required.")
+var errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+var errNoPermKeys = errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+
+// aclCategories are the command categories.
+var aclCategories = []string{"read", "write", "admin", "scripting", "raft"}
+
+// aclCommandCategories maps each command to its category. The commands that
+// are missing can be run by every user, such as AUTH, or are checked by their
+// queued commands, such as EXEC.
+var aclCommandCategories = map[string]string{}
+
+func init() {
+	for category, names := range map[string][]string{
+		"read": {"get", "getver", "mget", "strlen", "getrange", "bitcount",
+			"getbit", "bitpos", "keys", "iter", "rect", "indexes", "schemas",
+			"triggers", "type", "dump", "exists", "ttl", "pttl", "time",
+			"dbsize", "fenceget", "jget", "jmget", "smembers", "hget", "llen",
+			"lrange", "zcard", "zrangebyscore", "plrmulti"},
+		"write": {"append", "decr", "incr", "decrby", "incrby", "incrbyfloat",
+			"getset", "setrange", "setbit", "bitop", "set", "setex", "setnx",
+			"psetex", "msetnx", "mset", "del", "pdel", "restore", "expire",
+			"expireat", "pexpire", "pexpireat", "persist", "rename",
+			"renamenx", "fence", "jset", "jdel", "jpatch", "sadd", "srem",
+			"hset", "hmset", "lpush", "lpop", "rpoplpush", "lrem", "zadd",
+			"zrem", "plwmulti"},
+		"admin": {"setindex", "delindex", "setschema", "delschema",
+			"settrigger", "deltrigger", "flushdb", "flushall", "backup",
+			"massinsert", "expired", "evicted", "acl", "info", "slowlog", "client", "config",
+			"shutdown"},
+		"scripting": {"eval", "evalro", "evalsha", "evalsharo", "fcall",
+			"fcall_ro", "script", "function", "scriptenv"},
+		"raft": {"raftaddpeer", "raftremovepeer", "raftpromote",
+			"raftdemote", "raftleader", "raftsnapshot", "raftshrinklog",
+			"raftstats", "raftpeers", "rafttransferleader",
+			"raftappendentries", "raftrequestvote", "rafttimeoutnow",
+			"raftinstallsnapshot"},
+	} {
+		for _, name := range names {
+			aclCommandCategories[name] = category
+		}
+	}
+}
+
+// aclKeySpec is the position of the keys in the arguments of a command.
+// A negative last is counted from the end.
+type aclKeySpec struct {
+	first, last, step int
+}
+
+var aclCommandKeys = map[string]aclKeySpec{}
+
+// aclKeyspaceCommands work on keys that are not in their arguments, so
+// they can only be run by users that can access all keys.
+var aclKeyspaceCommands = map[string]bool{
+	"keys": true, "iter": true, "rect": true, "pdel": true, "flushdb": true,
+	"flushall": true, "massinsert": true, "expired": true, "evicted": true,
+}
+
+func init() {
+	for spec, names := range map[aclKeySpec][]string{
+		{1, 1, 1}: {"get", "getver", "strlen", "getrange", "bitcount", "getbit",
+			"bitpos", "set", "setex", "setnx", "psetex", "append", "decr",
+			"incr", "decrby", "incrby", "incrbyfloat", "getset", "setrange",
+			"setbit", "type", "dump", "restore", "ttl", "pttl", "expire",
+			"expireat", "pexpire", "pexpireat", "persist", "jget", "jset",
+			"jdel", "jpatch", "sadd", "smembers", "srem", "hget", "hset",
+			"hmset", "llen", "lpush", "lpop", "lrem", "lrange", "zadd", "zcard",
+			"zrangebyscore", "zrem"},
+		{1, -1, 1}: {"del", "mget", "exists", "plget", "watch"},
+		{1, -1, 2}: {"mset", "msetnx", "plset", "pljget"},
+		{2, -1, 1}: {"jmget", "bitop"},
+		{1, 2, 1}:  {"rename", "renamenx", "rpoplpush"},
+	} {
+		for _, name := range names {
+			aclCommandKeys[name] = spec
+		}
+	}
+}
+
+// aclUser is a stored user.
+type aclUser struct {
+	Name      string   `json:"name"`
+	Enabled   bool     `json:"enabled"`
+	NoPass    bool     `json:"nopass"`
+	Passwords []string `json:"passwords"` // sha256 of the passwords
+	Commands  []string `json:"commands"`  // rules such as "+@read" or "-del"
+	Keys      []string `json:"keys"`      // key patterns
+}
+
+// aclDefault is the default user before it's changed with ACL SETUSER.
+var aclDefault = &aclUser{
+	Name:     aclDefaultUser,
+	Enabled:  true,
+	NoPass:   true,
+	Commands: []string{"+@all"},
+	Keys:     []string{"*"},
+}
+
+// validUserName returns true if the name can be used for a user.
+func validUserName(name string) bool {
+	if name == "" || name[0] == '!' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPasswordRules replaces the ">password" and "<password" rules with the
+// hashed "#hash" and "!hash" rules, so that the passwords are not stored in
+// the raft log.
+func hashPasswordRules(rules [][]byte) [][]byte {
+	hashed := make([][]byte, len(rules))
+	for i, rule := range rules {
+		switch {
+		case len(rule) > 0 && rule[0] == '>':
+			hashed[i] = []byte("#" + hashPassword(string(rule[1:])))
+		case len(rule) > 0 && rule[0] == '<':
+			hashed[i] = []byte("!" + hashPassword(string(rule[1:])))
+		default:
+			hashed[i] = rule
+		}
+	}
+	return hashed
+}
+
+func validCategory(category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range aclCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRules applies ACL SETUSER rules to a user.
+func (u *aclUser) applyRules(rules [][]byte) error {
+	for _, r := range rules {
+		rule := string(r)
+		lrule := strings.ToLower(rule)
+		switch {
+		case lrule == "on":
+			u.Enabled = true
+		case lrule == "off":
+			u.Enabled = false
+		case lrule == "nopass":
+			u.NoPass = true
+			u.Passwords = nil
+		case lrule == "resetpass":
+			u.NoPass = false
+			u.Passwords = nil
+		case lrule == "allkeys":
+			u.Keys = []string{"*"}
+		case lrule == "resetkeys":
+			u.Keys = nil
+		case lrule == "allcommands":
+			u.Commands = []string{"+@all"}
+		case lrule == "nocommands":
+			u.Commands = nil
+		case lrule == "reset":
+			*u = aclUser{Name: u.Name}
+		case strings.HasPrefix(rule, "~"):
+			if len(u.Keys) == 1 && u.Keys[0] == "*" {
+				break
+			}
+			if rule[1:] == "*" {
+				u.Keys = []string{"*"}
+			} else {
+				u.Keys = append(u.Keys, rule[1:])
+			}
+		case strings.HasPrefix(rule, "#"), strings.HasPrefix(rule, "!"):
+			hash := strings.ToLower(rule[1:])
+			if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+				return errors.New("ERR The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+			var passwords []string
+			for _, p := range u.Passwords {
+				if p != hash {
+					passwords = append(passwords, p)
+				}
+			}
+			if rule[0] == '#' {
+				passwords = append(passwords, hash)
+				u.NoPass = false
+			}
+			u.Passwords = passwords
+		case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+			if strings.HasPrefix(lrule[1:], "@") {
+				if !validCategory(lrule[2:]) {
+					return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Unknown command or category name in ACL", rule)
+				}
+				if lrule[2:] == "all" {
+					// all of the previous rules are replaced
+					u.Commands = nil
+				}
+			} else if _, ok := aclCommandCategories[lrule[1:]]; !ok {
+				return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Unknown command or category name in ACL", rule)
+			}
+			u.Commands = append(u.Commands, lrule)
+		default:
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': Syntax error", rule)
+		}
+	}
+	return nil
+}
+
+// allowed returns true if the user can run the command. The rules are
+// applied in order, so a later rule overrides an earlier rule.
+func (u *aclUser) allowed(name string) bool {
+	category, ok := aclCommandCategories[name]
+	if !ok {
+		return true
+	}
+	var allowed bool
+	for _, rule := range u.Commands {
+		target := rule[1:]
+		if target == "@all" || target == "@"+category || target == name {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// allKeys returns true if the user can access every key.
+func (u *aclUser) allKeys() bool {
+	return len(u.Keys) == 1 && u.Keys[0] == "*"
+}
+
+// allowedKey returns true if the user can access the key. The meta keys
+// can't be accessed by any user.
+func (u *aclUser) allowedKey(key string) bool {
+	if isMercMetaKey(key) {
+		return false
+	}
+	for _, pattern := range u.Keys {
+		if match.Match(key, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPassword returns true if the password is one of the passwords of
+// the user.
+func (u *aclUser) checkPassword(pass string) bool {
+	if u.NoPass {
+		return true
+	}
+	hash := hashPassword(pass)
+	for _, p := range u.Passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the user as ACL SETUSER rules, like ACL LIST.
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.Name}
+	if u.Enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.NoPass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.Passwords {
+		parts = append(parts, "#"+p)
+	}
+	if u.allKeys() {
+		parts = append(parts, "~*")
+	} else {
+		for _, pattern := range u.Keys {
+			parts = append(parts, "~"+pattern)
+		}
+	}
+	if len(u.Commands) == 0 {
+		parts = append(parts, "-@all")
+	}
+	parts = append(parts, u.Commands...)
+	return strings.Join(parts, " ")
+}
+
+// aclCache holds parsed users keyed by their stored definition.
+type aclCache struct {
+	mu    sync.Mutex
+	users map[string]*aclUser
+}
+
+func (ac *aclCache) get(def string) (*aclUser, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if u, ok := ac.users[def]; ok {
+		return u, nil
+	}
+	var u aclUser
+	if err := json.Unmarshal([]byte(def), &u); err != nil {
+		return nil, err
+	}
+	if ac.users == nil {
+		ac.users = make(map[string]*aclUser)
+	}
+	ac.users[def] = &u
+	return &u, nil
+}
+
+// txUser returns a user, or nil if the user does not exist.
+func (m *Machine) txUser(tx *buntdb.Tx, name string) (*aclUser, error) {
+	if name == aclInternalUser {
+		return aclDefault, nil
+	}
+	def, err := tx.Get(aclUserKeyPrefix + name)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			if name == aclDefaultUser {
+				return aclDefault, nil
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+	return m.acl.get(def)
+}
+
+// connUser returns the user of a connection. Returns nil if the connection
+// is not authenticated, or if its user was deleted or disabled.
+func (m *Machine) connUser(conn redcon.Conn) (*aclUser, error) {
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return nil, nil
+	}
+	name := ctx.user
+	if name == "" {
+		name = aclDefaultUser
+	}
+	var u *aclUser
+	if err := m.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		u, err = m.txUser(tx, name)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if u == nil || !u.Enabled || (ctx.user == "" && !u.NoPass) {
+		return nil, nil
+	}
+	return u, nil
+}
+
+// connUserName returns the name of the user that the commands on the conn
+// are checked as, or an empty string when they're not checked, such as for
+// the commands that are applied from the raft log.
+func connUserName(conn redcon.Conn) string {
+	switch conn := conn.(type) {
+	case nil:
+		return ""
+	case *passiveConn:
+		return conn.user
+	}
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return ""
+	}
+	if ctx.user == "" {
+		return aclDefaultUser
+	}
+	return ctx.user
+}
+
+// aclCheck returns an error if the user of the connection can't run the
+// command. The commands that are run by scripts are checked when they're
+// run, as the user of the script.
+func (m *Machine) aclCheck(conn redcon.Conn, cmd redcon.Command) error {
+	name := qcmdlower(cmd.Args[0])
+	switch name {
+	case "auth", "quit", "raftstate", "consistency", "readonly", "readwrite":
+		return nil
+	case "acl":
+		if len(cmd.Args) == 2 && qcmdlower(cmd.Args[1]) == "whoami" {
+			return nil
+		}
+	case "client":
+		if len(cmd.Args) >= 2 {
+			switch qcmdlower(cmd.Args[1]) {
+			case "id", "setname", "getname":
+				return nil
+			}
+		}
+	}
+	u, err := m.connUser(conn)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return errNoAuth
+	}
+	return u.check(name, cmd)
+}
+
+// aclPipelineCommands are the commands that pipelined commands are merged
+// into, and the commands that they are checked as.
+var aclPipelineCommands = map[string]string{
+	"plget": "get", "plset": "set", "pljget": "jget",
+}
+
+// Authorize checks the commands that are handled by finn, such as
+// RAFTADDPEER, and the raft RPCs of the peers when the cluster has no
+// secret.
+func (m *Machine) Authorize(conn redcon.Conn, cmd redcon.Command) error {
+	return m.aclCheck(conn, cmd)
+}
+
+func (u *aclUser) check(name string, cmd redcon.Command) error {
+	perm := name
+	if pname, ok := aclPipelineCommands[name]; ok {
+		perm = pname
+	}
+	if !u.allowed(perm) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", name)
+	}
+	if u.allKeys() {
+		// the meta keys are still denied
+		for _, key := range commandKeys(name, cmd) {
+			if isMercMetaKeyBytes(key) {
+				return errNoPermKeys
+			}
+		}
+	} else {
+		if aclKeyspaceCommands[name] {
+			return errNoPermKeys
+		}
+		for _, key := range commandKeys(name, cmd) {
+			if !u.allowedKey(string(key)) {
+				return errNoPermKeys
+			}
+		}
+	}
+	// the commands of a PLWMULTI or PLRMULTI are checked too
+	if name == "plwmulti" || name == "plrmulti" {
+		for _, arg := range cmd.Args[1:] {
+			pcmd, err := parseCommand(arg)
+			if err != nil || len(pcmd.Args) == 0 {
+				continue
+			}
+			if err := u.check(qcmdlower(pcmd.Args[0]), pcmd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commandKeys returns the keys in the arguments of a command.
+func commandKeys(name string, cmd redcon.Command) [][]byte {
+	args := cmd.Args
+	switch name {
+	case "scriptenv":
+		// SCRIPTENV now seed [USER name] command [arg ...]
+		i, _ := scriptEnvInner(args)
+		if i == len(args) {
+			return nil
+		}
+		return commandKeys(qcmdlower(args[i]), buildCommand(args[i:]))
+	case "eval", "evalro", "evalsha", "evalsharo", "fcall", "fcall_ro":
+		// EVAL [DEBUG] script numkeys [key ...] [arg ...]
+		if len(args) > 1 && qcmdlower(args[1]) == "debug" {
+			args = append([][]byte{args[0]}, args[2:]...)
+		}
+		if len(args) < 3 {
+			return nil
+		}
+		n, err := strconv.ParseUint(string(args[2]), 10, 64)
+		if err != nil || int(n) > len(args)-3 {
+			return nil
+		}
+		return args[3 : 3+n]
+	}
+	spec, ok := aclCommandKeys[name]
+	if !ok {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys [][]byte
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// newInternalPass returns the password of the internal user.
+func newInternalPass() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic("random err: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (m *Machine) doAuth(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// AUTH [username] password
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	var name, pass string
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 2:
+		name, pass = aclDefaultUser, string(cmd.Args[1])
+	case 3:
+		name, pass = string(cmd.Args[1]), string(cmd.Args[2])
+	}
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return nil, errWrongPass
+	}
+	if name == aclInternalUser {
+		if pass != m.internalPass {
+			return nil, errWrongPass
+		}
+	} else {
+		var u *aclUser
+		if err := m.db.View(func(tx *buntdb.Tx) error {
+			var err error
+			u, err = m.txUser(tx, name)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if u == nil || !u.Enabled || !u.checkPassword(pass) {
+			return nil, errWrongPass
+		}
+	}
+	ctx.user = name
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+func (m *Machine) doACL(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	v, err := func() (interface{}, error) {
+		switch qcmdlower(cmd.Args[1]) {
+		default:
+			return nil, finn.ErrWrongNumberOfArguments
+		case "setuser":
+			// ACL SETUSER username [rule ...]
+			return m.doACLSetUser(a, conn, cmd, tx)
+		case "deluser":
+			// ACL DELUSER username [username ...]
+			return m.doACLDelUser(a, conn, cmd, tx)
+		case "list":
+			// ACL LIST
+			return m.doACLList(a, conn, cmd, tx)
+		case "whoami":
+			// ACL WHOAMI
+			return m.doACLWhoami(a, conn, cmd, tx)
+		}
+	}()
+	if err != nil {
+		if err == finn.ErrWrongNumberOfArguments {
+			err = errors.New("ERR Unknown ACL subcommand or wrong # of args.")
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *Machine) doACLSetUser(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ACL SETUSER username [rule ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := string(cmd.Args[2])
+	if !validUserName(name) {
+		return nil, errors.New("ERR Usernames can't contain spaces or null characters and can't start with '!'")
+	}
+	rules := hashPasswordRules(cmd.Args[3:])
+	// check the rules before they are applied
+	if err := (&aclUser{Name: name}).applyRules(rules); err != nil {
+		return nil, err
+	}
+	wrapped := buildCommand(append([][]byte{cmd.Args[0], cmd.Args[1], cmd.Args[2]}, rules...))
+	return m.writeDoApply(a, conn, wrapped, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		// the rules are applied to the existing user, and a new user starts
+		// disabled with no permissions.
+		u := &aclUser{Name: name}
+		if prev, err := m.txUser(tx, name); err != nil {
+			return nil, err
+		} else if prev != nil {
+			*u = *prev
+			u.Passwords = append([]string(nil), prev.Passwords...)
+			u.Commands = append([]string(nil), prev.Commands...)
+			u.Keys = append([]string(nil), prev.Keys...)
+		}
+		if err := u.applyRules(rules); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(u)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := tx.Set(aclUserKeyPrefix+name, string(data), nil); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doACLDelUser(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ACL DELUSER username [username ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	for _, name := range cmd.Args[2:] {
+		if string(name) == aclDefaultUser {
+			return nil, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		var n int
+		for _, name := range cmd.Args[2:] {
+			if _, err := tx.Delete(aclUserKeyPrefix + string(name)); err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return nil, err
+			}
+			n++
+		}
+		return n, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doACLList(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ACL LIST
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		users := map[string]*aclUser{aclDefaultUser: aclDefault}
+		var ierr error
+		if err := tx.AscendGreaterOrEqual("", aclUserKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, aclUserKeyPrefix) {
+				return false
+			}
+			u, err := m.acl.get(val)
+			if err != nil {
+				ierr = fmt.Errorf("parsing user '%v': %v", key[len(aclUserKeyPrefix):], err)
+				return false
+			}
+			users[u.Name] = u
+			return true
+		}); err != nil {
+			return err
+		}
+		if ierr != nil {
+			return ierr
+		}
+		names := make([]string, 0, len(users))
+		for name := range users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			conn.WriteBulkString(users[name].describe())
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doACLWhoami(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// ACL WHOAMI
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	name := aclDefaultUser
+	if ctx, ok := conn.Context().(*connContext); ok && ctx.user != "" {
+		name = ctx.user
+	}
+	conn.WriteBulkString(name)
+	return nil, nil
+}
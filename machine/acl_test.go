@@ -0,0 +1,134 @@
+package machine
+
+import (
+	"fmt"
+	"testing"
+)
+
+func subTestACL(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "SETUSER", acl_SETUSER_test)
+	runStep(t, mc, "AUTH", acl_AUTH_test)
+	runStep(t, mc, "default", acl_DEFAULT_test)
+	runStep(t, mc, "scripts", acl_SCRIPTS_test)
+	runStep(t, mc, "DELUSER", acl_DELUSER_test)
+}
+
+func acl_SETUSER_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ACL", "WHOAMI"}, {"default"},
+		{"ACL", "LIST"}, {"[user default on nopass ~* +@all]"},
+		{"ACL", "SETUSER", "bad user"}, {"ERR Usernames can't contain spaces or null characters and can't start with '!'"},
+		{"ACL", "SETUSER", "bob", "on", ">pw", "+@bogus"}, {"ERR Error in ACL SETUSER modifier '+@bogus': Unknown command or category name in ACL"},
+		{"ACL", "SETUSER", "bob", "on", ">pw", "+nothing"}, {"ERR Error in ACL SETUSER modifier '+nothing': Unknown command or category name in ACL"},
+		{"ACL", "SETUSER", "bob", "on", "#abc"}, {"ERR The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"},
+		{"ACL", "SETUSER", "bob", "enable"}, {"ERR Error in ACL SETUSER modifier 'enable': Syntax error"},
+		{"ACL", "SETUSER", "alice", "on", ">pass", "+@read", "+@write", "-del", "~user:*"}, {"OK"},
+		{"ACL", "SETUSER", "bob", ">pw"}, {"OK"},
+		{"ACL", "LIST"}, {fmt.Sprintf("[user alice on #%s ~user:* +@read +@write -del user bob off #%s -@all user default on nopass ~* +@all]",
+			hashPassword("pass"), hashPassword("pw"))},
+		{"ACL", "SETUSER", "bob", "on", "<pw", ">pw2", "+@all", "-@raft", "allkeys"}, {"OK"},
+		{"ACL", "LIST"}, {fmt.Sprintf("[user alice on #%s ~user:* +@read +@write -del user bob on #%s ~* +@all -@raft user default on nopass ~* +@all]",
+			hashPassword("pass"), hashPassword("pw2"))},
+		{"ACL", "UNKNOWN"}, {"ERR Unknown ACL subcommand or wrong # of args."},
+	})
+}
+
+func acl_AUTH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "user:1", "Tom"}, {"OK"},
+		{"AUTH", "alice", "wrong"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "nobody", "pass"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "!internal", "pass"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "alice", "pass"}, {"OK"},
+		{"ACL", "WHOAMI"}, {"alice"},
+		{"GET", "user:1"}, {"Tom"},
+		{"SET", "user:2", "Jane"}, {"OK"},
+		{"MGET", "user:1", "user:2"}, {"[Tom Jane]"},
+		{"SET", "other", "Andy"}, {"NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"MGET", "user:1", "other"}, {"NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"DEL", "user:1"}, {"NOPERM this user has no permissions to run the 'del' command"},
+		{"KEYS", "user:*"}, {"NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"SETINDEX", "names", "user:*", "TEXT"}, {"NOPERM this user has no permissions to run the 'setindex' command"},
+		{"EVAL", "return 1", 0}, {"NOPERM this user has no permissions to run the 'eval' command"},
+		{"RAFTLEADER"}, {"NOPERM this user has no permissions to run the 'raftleader' command"},
+		{"ACL", "LIST"}, {"NOPERM this user has no permissions to run the 'acl' command"},
+		{"MULTI"}, {"OK"},
+		{"SET", "user:3", "Sam"}, {"QUEUED"},
+		{"DEL", "user:3"}, {"NOPERM this user has no permissions to run the 'del' command"},
+		{"DISCARD"}, {"OK"},
+		{"PLWMULTI", "*3\r\n$3\r\nSET\r\n$5\r\nother\r\n$1\r\n1\r\n"}, {"NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"AUTH", "bob", "pw"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "bob", "pw2"}, {"OK"},
+		{"ACL", "WHOAMI"}, {"bob"},
+		{"DEL", "user:1", "user:2", "other"}, {2},
+		{"RAFTLEADER"}, {"NOPERM this user has no permissions to run the 'raftleader' command"},
+		{"GET", sdbMetaPrefix + "user:alice"}, {"NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{"ACL", "SETUSER", "bob", "off"}, {"OK"},
+		{"GET", "user:1"}, {"NOAUTH Authentication required."},
+		{"AUTH", "bob", "pw2"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "default", "anything"}, {"OK"},
+		{"ACL", "WHOAMI"}, {"default"},
+	})
+}
+
+func acl_DEFAULT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ACL", "SETUSER", "default", ">secret"}, {"OK"},
+		{"GET", "key"}, {"NOAUTH Authentication required."},
+		{"PING"}, {"NOAUTH Authentication required."},
+		{"ACL", "WHOAMI"}, {"default"},
+		{"AUTH", "wrong"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH", "secret"}, {"OK"},
+		{"GET", "key"}, {nil},
+		{"ACL", "SETUSER", "default", "nopass"}, {"OK"},
+		{"ACL", "LIST"}, {"[user alice on #" + hashPassword("pass") + " ~user:* +@read +@write -del user bob off #" + hashPassword("pw2") + " ~* +@all -@raft user default on nopass ~* +@all]"},
+	})
+}
+
+func acl_SCRIPTS_test(mc *mockCluster) error {
+	audit := `return sdb.call("set", "audit", TRIGGER.key)`
+	lib := "#!js name=acllib\n" +
+		"sdb.registerFunction('peek', function(keys, args){\n" +
+		"	return sdb.call('get', 'secret');\n" +
+		"});\n"
+	scriptenv := string(buildCommand([][]byte{
+		[]byte("SCRIPTENV"), []byte("0"), []byte("0"), []byte("EVAL"), []byte("return 1"), []byte("0"),
+	}).Raw)
+	noKeys := "NOPERM this user has no permissions to access one of the keys used as arguments"
+	return mc.DoBatch([][]interface{}{
+		{"ACL", "SETUSER", "carol", "on", ">pw", "+@all", "-del", "~doc:*"}, {"OK"},
+		{"SET", "secret", "x"}, {"OK"},
+		{"SCRIPT", "LOAD", audit}, {scriptSha(audit)},
+		{"SETTRIGGER", "audit", "doc:*", "ON", "set", "SCRIPT", scriptSha(audit)}, {"OK"},
+		{"SETTRIGGER", "audit", "doc:*", "ON", "set", "SCRIPT", scriptSha(audit), "USER", "carol"}, {"ERR wrong number of arguments for 'SETTRIGGER' command"},
+		{"PLWMULTI", scriptenv}, {"ERR unknown command 'PLWMULTI'"},
+		{"FUNCTION", "LOAD", lib}, {"acllib"},
+
+		// the commands of scripts are checked as the user
+		{"AUTH", "carol", "pw"}, {"OK"},
+		{"EVAL", `return sdb.call("get", "secret")`, 0}, {noKeys},
+		{"EVAL", `return sdb.call("del", "doc:1")`, 0}, {"NOPERM this user has no permissions to run the 'del' command"},
+		{"EVAL", `return sdb.call("get", "` + sdbMetaPrefix + `user:carol")`, 0}, {noKeys},
+		{"EVAL", `return sdb.jget("secret")`, 0}, {noKeys},
+		{"EVAL", `return sdb.iter("").length`, 0}, {noKeys},
+		{"FCALL", "peek", 0}, {noKeys},
+
+		// the trigger runs as the user that set it
+		{"EVAL", `return sdb.call("set", "doc:1", "a")`, 0}, {"OK"},
+		{"SET", "doc:2", "b"}, {"OK"},
+		{"AUTH", "default", "x"}, {"OK"},
+		{"GET", "audit"}, {"doc:2"},
+		{"DELTRIGGER", "audit"}, {1},
+		{"FUNCTION", "DELETE", "acllib"}, {"OK"},
+		{"ACL", "DELUSER", "carol"}, {1},
+	})
+}
+
+func acl_DELUSER_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ACL", "DELUSER", "default"}, {"ERR The 'default' user cannot be removed"},
+		{"ACL", "DELUSER", "alice", "bob", "nobody"}, {2},
+		{"AUTH", "alice", "pass"}, {"WRONGPASS invalid username-password pair or user is disabled."},
+		{"ACL", "LIST"}, {"[user default on nopass ~* +@all]"},
+	})
+}
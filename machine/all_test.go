@@ -43,9 +43,24 @@ func TestAll(t *testing.T) {
 	runSubTest(t, "keys", mc, subTestKeys)
 	runSubTest(t, "json", mc, subTestJSON)
 	runSubTest(t, "indexes", mc, subTestIndexes)
+	runSubTest(t, "schemas", mc, subTestSchemas)
 	runSubTest(t, "transactions", mc, subTestTransactions)
 	runSubTest(t, "scripts", mc, subTestScripts)
+	runSubTest(t, "triggers", mc, subTestTriggers)
+	runSubTest(t, "goja", mc, subTestGoja)
+	runSubTest(t, "acl", mc, subTestACL)
+	runSubTest(t, "secret", mc, subTestSecret)
+	runSubTest(t, "info", mc, subTestInfo)
+	runSubTest(t, "metrics", mc, subTestMetrics)
+	runSubTest(t, "slowlog", mc, subTestSlowlog)
+	runSubTest(t, "client", mc, subTestClient)
+	runSubTest(t, "config", mc, subTestConfig)
+	runSubTest(t, "evict", mc, subTestEvict)
+	runSubTest(t, "consistency", mc, subTestConsistency)
+	runSubTest(t, "shutdown", mc, subTestShutdown)
 	runSubTest(t, "raft", mc, subTestRaft)
+	runSubTest(t, "tls", mc, subTestTLS)
+	runSubTest(t, "encryption", mc, subTestEncryption)
 }
 
 func runSubTest(t *testing.T, name string, mc *mockCluster, test func(t *testing.T, mc *mockCluster)) {
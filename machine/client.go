@@ -0,0 +1,362 @@
+package machine
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+var errNoSuchClient = errors.New("ERR No such client")
+
+// clientInfo is the metadata of a connection that is read by other
+// connections, such as with CLIENT LIST.
+type clientInfo struct {
+	name   string    // set by CLIENT SETNAME
+	active time.Time // when the last command started
+	cmd    string    // last command
+	user   string    // authenticated user, or empty for the default user
+	multi  int       // number of queued commands, or -1 when not in a MULTI
+}
+
+// clientPause pauses the commands of the clients with CLIENT PAUSE.
+type clientPause struct {
+	mu    sync.Mutex
+	until time.Time
+	all   bool // pause all commands, otherwise only the writes
+}
+
+// ConnAccept is called when a client connects.
+func (m *Machine) ConnAccept(conn redcon.Conn) bool {
+	now := time.Now()
+	ctx := &connContext{created: now}
+	ctx.info.active = now
+	ctx.info.multi = -1
+	m.connsMu.Lock()
+	m.lastConnID++
+	ctx.id = m.lastConnID
+	conn.SetContext(ctx)
+	if m.draining() {
+		// the server is shutting down. the connection may be from a peer,
+		// whose raft rpcs are handled by the transport, so only the client
+		// commands are refused by the first command.
+		ctx.draining = true
+	} else if max := atomic.LoadInt64(&m.maxClients); max > 0 && int64(len(m.conns)) >= max {
+		// the error is written by the first command.
+		ctx.rejected = true
+	} else {
+		m.conns[ctx.id] = conn
+	}
+	m.connsMu.Unlock()
+	return true
+}
+
+// ConnClosed is called when a client connection is closed.
+func (m *Machine) ConnClosed(conn redcon.Conn, err error) {
+	if ctx, ok := conn.Context().(*connContext); ok {
+		m.connsMu.Lock()
+		delete(m.conns, ctx.id)
+		m.connsMu.Unlock()
+	}
+}
+
+// clientCount returns the number of client connections.
+func (m *Machine) clientCount() int {
+	m.connsMu.Lock()
+	defer m.connsMu.Unlock()
+	return len(m.conns)
+}
+
+// clientCommandStarted is called before a command runs on a connection.
+func (ctx *connContext) clientCommandStarted(name string) {
+	ctx.mu.Lock()
+	ctx.info.cmd = name
+	ctx.info.active = time.Now()
+	ctx.mu.Unlock()
+}
+
+// clientCommandDone is called after a command runs on a connection.
+func (ctx *connContext) clientCommandDone() {
+	ctx.mu.Lock()
+	ctx.info.user = ctx.user
+	ctx.info.multi = -1
+	if ctx.multi != nil {
+		ctx.info.multi = len(ctx.multi.cmds)
+	}
+	ctx.mu.Unlock()
+}
+
+func (ctx *connContext) clientInfo() clientInfo {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.info
+}
+
+// waitForPause waits while the command is paused by CLIENT PAUSE.
+func (m *Machine) waitForPause(name string) {
+	if name == "client" {
+		return
+	}
+	for {
+		m.pause.mu.Lock()
+		paused := time.Now().Before(m.pause.until) && (m.pause.all || clientPauseWrite(name))
+		m.pause.mu.Unlock()
+		if !paused {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// clientPauseWrite returns true for the commands that are paused by
+// CLIENT PAUSE WRITE, which are the commands that may change the database.
+func clientPauseWrite(name string) bool {
+	if aclCommandCategories[name] == "write" {
+		return true
+	}
+	switch name {
+	case "eval", "evalsha", "fcall", "scriptenv", "function", "exec",
+		"setindex", "delindex", "setschema", "delschema", "settrigger",
+		"deltrigger", "flushdb", "flushall", "massinsert", "expired", "evicted",
+		"plset":
+		return true
+	}
+	return false
+}
+
+func (m *Machine) doClient(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CLIENT ID
+	// CLIENT LIST
+	// CLIENT SETNAME name
+	// CLIENT GETNAME
+	// CLIENT KILL addr
+	// CLIENT KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+	// CLIENT PAUSE timeout [WRITE|ALL]
+	// CLIENT UNPAUSE
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	// The clients are the connections to this server, so the commands do
+	// not go through the raft log.
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return nil, errors.New("ERR invalid connection")
+	}
+	errSyntax := errors.New("ERR Unknown CLIENT subcommand or wrong # of args.")
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errSyntax
+	case "id":
+		if len(cmd.Args) != 2 {
+			return nil, errSyntax
+		}
+		conn.WriteInt64(ctx.id)
+	case "list":
+		if len(cmd.Args) != 2 {
+			return nil, errSyntax
+		}
+		conn.WriteBulkString(m.clientList())
+	case "setname":
+		if len(cmd.Args) != 3 {
+			return nil, errSyntax
+		}
+		name := string(cmd.Args[2])
+		for _, c := range name {
+			if c <= ' ' || c > '~' {
+				return nil, errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+		}
+		ctx.mu.Lock()
+		ctx.info.name = name
+		ctx.mu.Unlock()
+		conn.WriteString("OK")
+	case "getname":
+		if len(cmd.Args) != 2 {
+			return nil, errSyntax
+		}
+		if name := ctx.clientInfo().name; name != "" {
+			conn.WriteBulkString(name)
+		} else {
+			conn.WriteNull()
+		}
+	case "kill":
+		return m.doClientKill(conn, ctx, cmd)
+	case "pause":
+		if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+			return nil, errSyntax
+		}
+		ms, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+		if err != nil || ms < 0 {
+			return nil, errors.New("ERR timeout is not an integer or out of range")
+		}
+		all := true
+		if len(cmd.Args) == 4 {
+			switch strings.ToLower(string(cmd.Args[3])) {
+			default:
+				return nil, errSyntax
+			case "all":
+			case "write":
+				all = false
+			}
+		}
+		m.pause.mu.Lock()
+		m.pause.until = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		m.pause.all = all
+		m.pause.mu.Unlock()
+		conn.WriteString("OK")
+	case "unpause":
+		if len(cmd.Args) != 2 {
+			return nil, errSyntax
+		}
+		m.pause.mu.Lock()
+		m.pause.until = time.Time{}
+		m.pause.mu.Unlock()
+		conn.WriteString("OK")
+	}
+	return nil, nil
+}
+
+// clientList returns the connections in the format of CLIENT LIST, ordered
+// by id.
+func (m *Machine) clientList() string {
+	m.connsMu.Lock()
+	ids := make([]int64, 0, len(m.conns))
+	for id := range m.conns {
+		ids = append(ids, id)
+	}
+	conns := make([]redcon.Conn, 0, len(ids))
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		conns = append(conns, m.conns[id])
+	}
+	m.connsMu.Unlock()
+	now := time.Now()
+	var buf []byte
+	for _, conn := range conns {
+		ctx := conn.Context().(*connContext)
+		info := ctx.clientInfo()
+		flags := "N"
+		if info.multi != -1 {
+			flags = "x"
+		}
+		user := info.user
+		if user == "" {
+			user = aclDefaultUser
+		}
+		buf = append(buf, "id="+strconv.FormatInt(ctx.id, 10)+
+			" addr="+conn.RemoteAddr()+
+			" name="+info.name+
+			" age="+strconv.FormatInt(int64(now.Sub(ctx.created)/time.Second), 10)+
+			" idle="+strconv.FormatInt(int64(now.Sub(info.active)/time.Second), 10)+
+			" flags="+flags+
+			" db=0"+
+			" multi="+strconv.Itoa(info.multi)+
+			" cmd="+info.cmd+
+			" user="+user+"\n"...)
+	}
+	return string(buf)
+}
+
+// killConn closes the target of CLIENT KILL. Another connection is served
+// by another goroutine, so only its network connection is closed, which is
+// safe for concurrent use, and its server loop ends it when the read fails.
+func killConn(conn, target redcon.Conn) {
+	if target == conn {
+		target.Close()
+	} else if nc := target.NetConn(); nc != nil {
+		nc.Close()
+	}
+}
+
+func (m *Machine) doClientKill(conn redcon.Conn, ctx *connContext, cmd redcon.Command) (interface{}, error) {
+	if len(cmd.Args) == 3 {
+		// CLIENT KILL addr
+		addr := string(cmd.Args[2])
+		m.connsMu.Lock()
+		var target redcon.Conn
+		for _, c := range m.conns {
+			if c.RemoteAddr() == addr {
+				target = c
+				break
+			}
+		}
+		m.connsMu.Unlock()
+		if target == nil {
+			return nil, errNoSuchClient
+		}
+		conn.WriteString("OK")
+		killConn(conn, target)
+		return nil, nil
+	}
+	// CLIENT KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		return nil, errSyntaxError
+	}
+	var id int64
+	var addr, user string
+	var hasID, hasAddr, hasUser bool
+	skipme := true
+	for i := 2; i < len(cmd.Args); i += 2 {
+		val := string(cmd.Args[i+1])
+		switch strings.ToLower(string(cmd.Args[i])) {
+		default:
+			return nil, errSyntaxError
+		case "id":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, errors.New("ERR client-id should be greater than 0")
+			}
+			id, hasID = n, true
+		case "addr":
+			addr, hasAddr = val, true
+		case "user":
+			user, hasUser = val, true
+		case "skipme":
+			switch strings.ToLower(val) {
+			default:
+				return nil, errSyntaxError
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			}
+		}
+	}
+	var targets []redcon.Conn
+	m.connsMu.Lock()
+	for cid, c := range m.conns {
+		if (hasID && cid != id) || (hasAddr && c.RemoteAddr() != addr) {
+			continue
+		}
+		if hasUser {
+			cuser := c.Context().(*connContext).clientInfo().user
+			if cuser == "" {
+				cuser = aclDefaultUser
+			}
+			if cuser != user {
+				continue
+			}
+		}
+		if skipme && cid == ctx.id {
+			continue
+		}
+		targets = append(targets, c)
+	}
+	m.connsMu.Unlock()
+	conn.WriteInt(len(targets))
+	for _, c := range targets {
+		killConn(conn, c)
+	}
+	return nil, nil
+}
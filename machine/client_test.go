@@ -0,0 +1,279 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestClient(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "NAME", client_NAME_test)
+	runStep(t, mc, "LIST", client_LIST_test)
+	runStep(t, mc, "KILL", client_KILL_test)
+	runStep(t, mc, "KILL busy", client_KILLBUSY_test)
+	runStep(t, mc, "PAUSE", client_PAUSE_test)
+}
+
+// mockClientConn opens another connection to the current server, which is
+// the leader after the FLUSHDB of the step.
+func mockClientConn(mc *mockCluster) (redis.Conn, error) {
+	return redis.Dial("tcp", mc.cs.addr())
+}
+
+// clientLine returns the line of CLIENT LIST that contains the text.
+func clientLine(mc *mockCluster, text string) (string, error) {
+	list, err := redis.String(mc.Do("CLIENT", "LIST"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(list, "\n") {
+		if strings.Contains(line, text) {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("expected a client with '%v', got '%v'", text, list)
+}
+
+func client_NAME_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "GETNAME"}, {nil},
+		{"CLIENT", "SETNAME", "my name"}, {"ERR Client names cannot contain spaces, newlines or special characters."},
+		{"CLIENT", "SETNAME", "worker"}, {"OK"},
+		{"CLIENT", "GETNAME"}, {"worker"},
+		{"CLIENT", "ID"}, {func(v interface{}) (resp, expect interface{}) {
+			id, _ := v.(int64)
+			return id > 0, true
+		}},
+		{"CLIENT", "UNKNOWN"}, {"ERR Unknown CLIENT subcommand or wrong # of args."},
+	}); err != nil {
+		return err
+	}
+	line, err := clientLine(mc, "name=worker")
+	if err != nil {
+		return err
+	}
+	id, err := redis.Int64(mc.Do("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{fmt.Sprintf("id=%d ", id), " db=0 ", " flags=N ",
+		" multi=-1 ", " cmd=client ", " user=default"} {
+		if !strings.Contains(line, field) {
+			return fmt.Errorf("expected '%v' in '%v'", field, line)
+		}
+	}
+	return nil
+}
+
+func client_LIST_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{{"CLIENT", "SETNAME", "main"}, {"OK"}}); err != nil {
+		return err
+	}
+	conn, err := mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("CLIENT", "SETNAME", "queued"); err != nil {
+		return err
+	}
+	if _, err := conn.Do("MULTI"); err != nil {
+		return err
+	}
+	if _, err := conn.Do("SET", "key", "value"); err != nil {
+		return err
+	}
+	line, err := clientLine(mc, "name=queued")
+	if err != nil {
+		return err
+	}
+	for _, field := range []string{" flags=x ", " multi=1 ", " cmd=set "} {
+		if !strings.Contains(line, field) {
+			return fmt.Errorf("expected '%v' in '%v'", field, line)
+		}
+	}
+	if _, err := conn.Do("DISCARD"); err != nil {
+		return err
+	}
+	if line, err = clientLine(mc, "name=queued"); err != nil {
+		return err
+	}
+	if !strings.Contains(line, " multi=-1 ") {
+		return fmt.Errorf("expected '%v' in '%v'", " multi=-1 ", line)
+	}
+	return nil
+}
+
+func client_KILL_test(mc *mockCluster) error {
+	// kill by id
+	conn, err := mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "KILL", "ID", id}, {1},
+		{"CLIENT", "KILL", "ID", id}, {0},
+		{"CLIENT", "KILL", "ID", 0}, {"ERR client-id should be greater than 0"},
+		{"CLIENT", "KILL", "NOPE", 1}, {"ERR syntax error"},
+	}); err != nil {
+		return err
+	}
+	if _, err := conn.Do("PING"); err == nil {
+		return errors.New("expected a closed connection")
+	}
+	// kill by addr
+	conn, err = mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("CLIENT", "SETNAME", "victim"); err != nil {
+		return err
+	}
+	line, err := clientLine(mc, "name=victim")
+	if err != nil {
+		return err
+	}
+	addr := strings.Split(strings.Split(line, " addr=")[1], " ")[0]
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "KILL", addr}, {"OK"},
+		{"CLIENT", "KILL", addr}, {"ERR No such client"},
+	}); err != nil {
+		return err
+	}
+	if _, err := conn.Do("PING"); err == nil {
+		return errors.New("expected a closed connection")
+	}
+	// kill by user
+	if err := mc.DoBatch([][]interface{}{
+		{"ACL", "SETUSER", "alice", "on", ">secret", "+@all", "~*"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	defer mc.Do("ACL", "DELUSER", "alice")
+	conn, err = mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("AUTH", "alice", "secret"); err != nil {
+		return err
+	}
+	if _, err := clientLine(mc, "user=alice"); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "KILL", "USER", "alice"}, {1},
+		{"CLIENT", "KILL", "USER", "alice"}, {0},
+	}); err != nil {
+		return err
+	}
+	if _, err := conn.Do("PING"); err == nil {
+		return errors.New("expected a closed connection")
+	}
+	// the current connection is skipped
+	me, err := redis.Int64(mc.Do("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"CLIENT", "SETNAME", "me"}, {"OK"},
+		{"CLIENT", "KILL", "ID", me}, {0},
+		{"CLIENT", "KILL", "ID", me, "SKIPME", "yes"}, {0},
+		{"CLIENT", "KILL", "ID", me, "SKIPME", "maybe"}, {"ERR syntax error"},
+		{"CLIENT", "GETNAME"}, {"me"},
+	})
+}
+
+func client_KILLBUSY_test(mc *mockCluster) error {
+	// the connection is killed while it's running commands
+	conn, err := mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		for {
+			for i := 0; i < 100; i++ {
+				conn.Send("PING")
+			}
+			if _, err := conn.Do(""); err != nil {
+				done <- nil
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 50)
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "KILL", "ID", id}, {1},
+	}); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		return errors.New("expected a closed connection")
+	}
+	return mc.DoBatch([][]interface{}{
+		{"CLIENT", "KILL", "ID", id}, {0},
+	})
+}
+
+func client_PAUSE_test(mc *mockCluster) error {
+	conn, err := mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// pause the writes
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key", "value"}, {"OK"},
+		{"CLIENT", "PAUSE", 300, "WRITE"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	start := time.Now()
+	if v, err := redis.String(conn.Do("GET", "key")); err != nil || v != "value" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "value", v, err)
+	}
+	if time.Since(start) > time.Millisecond*200 {
+		return errors.New("expected the read to not be paused")
+	}
+	if _, err := conn.Do("SET", "key", "value2"); err != nil {
+		return err
+	}
+	if time.Since(start) < time.Millisecond*250 {
+		return errors.New("expected the write to be paused")
+	}
+	// unpause
+	if err := mc.DoBatch([][]interface{}{
+		{"CLIENT", "PAUSE", 10000}, {"OK"},
+		{"CLIENT", "UNPAUSE"}, {"OK"},
+		{"CLIENT", "PAUSE", -1}, {"ERR timeout is not an integer or out of range"},
+		{"CLIENT", "PAUSE", 100, "SOME"}, {"ERR Unknown CLIENT subcommand or wrong # of args."},
+	}); err != nil {
+		return err
+	}
+	start = time.Now()
+	if _, err := conn.Do("GET", "key"); err != nil {
+		return err
+	}
+	if time.Since(start) > time.Millisecond*200 {
+		return errors.New("expected the read to not be paused")
+	}
+	return nil
+}
@@ -0,0 +1,470 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+const configKeyPrefix = sdbMetaPrefix + "config:"
+
+var errNoConfigFile = errors.New("ERR The server is running without a config file")
+
+// configParam is a setting of CONFIG GET and CONFIG SET. The name of a param
+// is the same as the name of its command line flag, so that the config file
+// has the same settings as the flags.
+//
+// A replicated param is set through the raft log and is the same on every
+// server, and the other params are for the server that they're set on. A
+// param without a flag is only set with CONFIG SET, and it's not written to
+// the config file.
+type configParam struct {
+	replicated bool
+	noflag     bool
+	get        func(m *Machine) string
+	parse      func(value string) (interface{}, error)
+	apply      func(m *Machine, v interface{}) error
+	// applyTx is used instead of apply by CONFIG SET of a replicated param
+	// that changes the database.
+	applyTx func(m *Machine, tx *buntdb.Tx, v interface{}) error
+}
+
+// configState is the config of a machine.
+type configState struct {
+	mu         sync.Mutex
+	file       string             // config file, for CONFIG REWRITE
+	logLevel   string             // current log level
+	onLogLevel func(string) error // changes the log level
+	base       map[string]string  // replicated params before they were set
+}
+
+var configParams = map[string]configParam{
+	"loglevel": {
+		get: func(m *Machine) string {
+			m.config.mu.Lock()
+			defer m.config.mu.Unlock()
+			return m.config.logLevel
+		},
+		parse: func(value string) (interface{}, error) {
+			switch strings.ToLower(value) {
+			case "warning", "notice", "verbose", "debug":
+				return strings.ToLower(value), nil
+			}
+			return nil, errors.New("argument must be one of the following: warning, notice, verbose, debug")
+		},
+		apply: func(m *Machine, v interface{}) error {
+			m.config.mu.Lock()
+			defer m.config.mu.Unlock()
+			if m.config.onLogLevel == nil {
+				return errors.New("the log level can't be changed")
+			}
+			if err := m.config.onLogLevel(v.(string)); err != nil {
+				return err
+			}
+			m.config.logLevel = v.(string)
+			return nil
+		},
+	},
+	"slowlog-log-slower-than": {
+		get: func(m *Machine) string {
+			m.slowlog.mu.Lock()
+			defer m.slowlog.mu.Unlock()
+			return strconv.FormatInt(m.slowlog.slowerThan, 10)
+		},
+		parse: configParseInt(-1),
+		apply: func(m *Machine, v interface{}) error {
+			m.slowlog.mu.Lock()
+			maxLen := m.slowlog.maxLen
+			m.slowlog.mu.Unlock()
+			m.SetSlowlogLimits(v.(int64), maxLen)
+			return nil
+		},
+	},
+	"slowlog-max-len": {
+		get: func(m *Machine) string {
+			m.slowlog.mu.Lock()
+			defer m.slowlog.mu.Unlock()
+			return strconv.Itoa(m.slowlog.maxLen)
+		},
+		parse: configParseInt(0),
+		apply: func(m *Machine, v interface{}) error {
+			m.slowlog.mu.Lock()
+			slowerThan := m.slowlog.slowerThan
+			m.slowlog.mu.Unlock()
+			m.SetSlowlogLimits(slowerThan, int(v.(int64)))
+			return nil
+		},
+	},
+	"scripttimelimit": {
+		get: func(m *Machine) string {
+			m.sm.mu.Lock()
+			defer m.sm.mu.Unlock()
+			return m.sm.timeLimit.String()
+		},
+		parse: func(value string) (interface{}, error) {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, errors.New("argument must be a duration, such as 5s")
+			}
+			return d, nil
+		},
+		apply: func(m *Machine, v interface{}) error {
+			m.sm.mu.Lock()
+			defer m.sm.mu.Unlock()
+			m.sm.timeLimit = v.(time.Duration)
+			return nil
+		},
+	},
+	"scriptoplimit": {
+		replicated: true,
+		noflag:     true,
+		get: func(m *Machine) string {
+			m.sm.mu.Lock()
+			defer m.sm.mu.Unlock()
+			return strconv.FormatInt(m.sm.opLimit, 10)
+		},
+		parse: configParseInt(0),
+		apply: func(m *Machine, v interface{}) error {
+			m.sm.mu.Lock()
+			defer m.sm.mu.Unlock()
+			m.sm.opLimit = v.(int64)
+			return nil
+		},
+	},
+	"scriptengine": {
+		replicated: true,
+		noflag:     true,
+		get: func(m *Machine) string {
+			return m.sm.getEngineName()
+		},
+		parse: func(value string) (interface{}, error) {
+			name := strings.ToLower(value)
+			for _, engine := range scriptEngineNames {
+				if name == engine {
+					return name, nil
+				}
+			}
+			return nil, errors.New("argument must be one of the following: " + strings.Join(scriptEngineNames, ", "))
+		},
+		apply: func(m *Machine, v interface{}) error {
+			return m.sm.setEngine(v.(string))
+		},
+		applyTx: func(m *Machine, tx *buntdb.Tx, v interface{}) error {
+			return m.txSetScriptEngine(tx, v.(string))
+		},
+	},
+	"maxmemory": {
+		replicated: true,
+		get: func(m *Machine) string {
+			return strconv.FormatInt(atomic.LoadInt64(&m.maxMemory), 10)
+		},
+		parse: func(value string) (interface{}, error) {
+			return ParseMemory(value)
+		},
+		apply: func(m *Machine, v interface{}) error {
+			m.SetMaxMemory(v.(int64))
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		replicated: true,
+		get: func(m *Machine) string {
+			return m.maxMemoryPolicy()
+		},
+		parse: func(value string) (interface{}, error) {
+			policy := strings.ToLower(value)
+			if !evictPolicy(policy) {
+				return nil, errors.New("argument must be one of the following: noeviction, allkeys-lru, volatile-lru, volatile-ttl, allkeys-random")
+			}
+			return policy, nil
+		},
+		apply: func(m *Machine, v interface{}) error {
+			return m.SetMaxMemoryPolicy(v.(string))
+		},
+	},
+	"maxclients": {
+		get: func(m *Machine) string {
+			return strconv.FormatInt(atomic.LoadInt64(&m.maxClients), 10)
+		},
+		parse: configParseInt(0),
+		apply: func(m *Machine, v interface{}) error {
+			m.SetMaxClients(int(v.(int64)))
+			return nil
+		},
+	},
+}
+
+// configParseInt returns a parse function for an integer param.
+func configParseInt(min int64) func(value string) (interface{}, error) {
+	return func(value string) (interface{}, error) {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < min {
+			return nil, fmt.Errorf("argument must be greater than or equal to %d", min)
+		}
+		return n, nil
+	}
+}
+
+// ParseMemory parses a number of bytes, such as "100mb" or "1gb". The units
+// are powers of 1024, like redis.
+func ParseMemory(s string) (int64, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000},
+		{"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}} {
+		if strings.HasSuffix(ls, unit.suffix) {
+			ls, mult = ls[:len(ls)-len(unit.suffix)], unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(ls, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mult, nil
+}
+
+// SetConfigFile sets the config file that is written by CONFIG REWRITE.
+func (m *Machine) SetConfigFile(file string) {
+	m.config.mu.Lock()
+	defer m.config.mu.Unlock()
+	m.config.file = file
+}
+
+// OnLogLevel sets the current log level, and the function that changes the
+// log level with CONFIG SET loglevel.
+func (m *Machine) OnLogLevel(level string, fn func(level string) error) {
+	m.config.mu.Lock()
+	defer m.config.mu.Unlock()
+	m.config.logLevel = level
+	m.config.onLogLevel = fn
+}
+
+// SetMaxMemory sets the maximum number of bytes of the database, zero for no
+// limit. It's replaced by CONFIG SET maxmemory, which is the same on every
+// server in the cluster.
+func (m *Machine) SetMaxMemory(bytes int64) {
+	atomic.StoreInt64(&m.maxMemory, bytes)
+}
+
+// SetMaxClients sets the maximum number of client connections, zero for no
+// limit.
+func (m *Machine) SetMaxClients(n int) {
+	atomic.StoreInt64(&m.maxClients, int64(n))
+}
+
+func (m *Machine) doConfig(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CONFIG GET pattern
+	// CONFIG SET parameter value
+	// CONFIG REWRITE
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "get":
+		if len(cmd.Args) != 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if conn == nil {
+			// this is not a replicated command.
+			return nil, nil
+		}
+		pattern := strings.ToLower(string(cmd.Args[2]))
+		var names []string
+		for name := range configParams {
+			if match.Match(name, pattern) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		conn.WriteArray(len(names) * 2)
+		for _, name := range names {
+			conn.WriteBulkString(name)
+			conn.WriteBulkString(configParams[name].get(m))
+		}
+		return nil, nil
+	case "set":
+		return m.doConfigSet(a, conn, cmd, tx)
+	case "rewrite":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if conn == nil {
+			// this is not a replicated command.
+			return nil, nil
+		}
+		if err := m.configRewrite(); err != nil {
+			return nil, err
+		}
+		conn.WriteString("OK")
+		return nil, nil
+	}
+	return nil, fmt.Errorf("ERR Unknown subcommand or wrong number of arguments for '%s'. Try CONFIG HELP.", cmd.Args[1])
+}
+
+func (m *Machine) doConfigSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CONFIG SET parameter value
+	if len(cmd.Args) != 4 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	name := strings.ToLower(string(cmd.Args[2]))
+	value := string(cmd.Args[3])
+	p, ok := configParams[name]
+	if !ok {
+		return nil, fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", cmd.Args[2])
+	}
+	v, err := p.parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("ERR Invalid argument '%s' for CONFIG SET '%s' - %v", value, name, err)
+	}
+	if !p.replicated {
+		if conn == nil {
+			// this is not a replicated command.
+			return nil, nil
+		}
+		if err := p.apply(m, v); err != nil {
+			return nil, fmt.Errorf("ERR Invalid argument '%s' for CONFIG SET '%s' - %v", value, name, err)
+		}
+		conn.WriteString("OK")
+		return nil, nil
+	}
+	return m.writeDoApply(a, conn, cmd, tx,
+		func(tx *buntdb.Tx) (interface{}, error) {
+			m.config.mu.Lock()
+			if _, ok := m.config.base[name]; !ok {
+				m.config.base[name] = p.get(m)
+			}
+			m.config.mu.Unlock()
+			if p.applyTx != nil {
+				if err := p.applyTx(m, tx, v); err != nil {
+					return nil, fmt.Errorf("ERR Invalid argument '%s' for CONFIG SET '%s' - %v", value, name, err)
+				}
+			} else if err := p.apply(m, v); err != nil {
+				return nil, err
+			}
+			if _, _, err := tx.Set(configKeyPrefix+name, value, nil); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		},
+		func(v interface{}) error {
+			if conn != nil {
+				conn.WriteString("OK")
+			}
+			return nil
+		},
+	)
+}
+
+// loadConfig applies the replicated params that are stored in the database,
+// which is called when a snapshot is restored. The params that are not in
+// the database are set back to their values from before they were set.
+func (m *Machine) loadConfig(db *buntdb.DB) error {
+	return db.View(func(tx *buntdb.Tx) error {
+		for name, p := range configParams {
+			if !p.replicated {
+				continue
+			}
+			value, err := tx.Get(configKeyPrefix + name)
+			if err != nil {
+				if err != buntdb.ErrNotFound {
+					return err
+				}
+				m.config.mu.Lock()
+				base, ok := m.config.base[name]
+				m.config.mu.Unlock()
+				if !ok {
+					continue
+				}
+				value = base
+			}
+			v, err := p.parse(value)
+			if err != nil {
+				return fmt.Errorf("parsing config '%v': %v", name, err)
+			}
+			if err := p.apply(m, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// configRewrite writes the params to the config file. The params that are
+// in the file are replaced, the missing params are added to the end, and
+// the other lines are kept.
+func (m *Machine) configRewrite() error {
+	m.config.mu.Lock()
+	file := m.config.file
+	m.config.mu.Unlock()
+	if file == "" {
+		return errNoConfigFile
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	written := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		name, _ := ParseConfigLine(line)
+		if p, ok := configParams[name]; ok {
+			if written[name] || p.noflag {
+				continue
+			}
+			line = name + " " + p.get(m)
+			written[name] = true
+		}
+		lines = append(lines, line)
+	}
+	var names []string
+	for name, p := range configParams {
+		if !written[name] && !p.noflag {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := configParams[name].get(m); value != "" {
+			lines = append(lines, name+" "+value)
+		}
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// ParseConfigLine parses a line of a config file, which is a name followed by
+// a value, such as "loglevel notice". The name is empty for a blank line or a
+// comment, which starts with a '#'.
+func ParseConfigLine(line string) (name, value string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", ""
+	}
+	i := strings.IndexAny(line, " \t")
+	if i == -1 {
+		return strings.ToLower(line), ""
+	}
+	return strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+}
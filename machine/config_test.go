@@ -0,0 +1,185 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestConfig(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "GET", config_GET_test)
+	runStep(t, mc, "SET", config_SET_test)
+	runStep(t, mc, "replicated", config_REPLICATED_test)
+	runStep(t, mc, "maxclients", config_MAXCLIENTS_test)
+	runStep(t, mc, "loglevel", config_LOGLEVEL_test)
+	runStep(t, mc, "REWRITE", config_REWRITE_test)
+}
+
+func config_GET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"CONFIG", "GET", "slowlog-*"}, {"[slowlog-log-slower-than 10000 slowlog-max-len 128]"},
+		{"CONFIG", "GET", "MAXCLIENTS"}, {"[maxclients 0]"},
+		{"CONFIG", "GET", "unknown"}, {"[]"},
+		{"CONFIG", "GET"}, {"ERR wrong number of arguments for 'CONFIG' command"},
+		{"CONFIG", "UNKNOWN"}, {"ERR Unknown subcommand or wrong number of arguments for 'UNKNOWN'. Try CONFIG HELP."},
+	})
+}
+
+func config_SET_test(mc *mockCluster) error {
+	defer mockSlowlogLimits(mc, defaultSlowlogSlowerThan, defaultSlowlogMaxLen)
+	return mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "slowlog-max-len", 64}, {"OK"},
+		{"CONFIG", "GET", "slowlog-max-len"}, {"[slowlog-max-len 64]"},
+		{"CONFIG", "SET", "slowlog-max-len", "many"}, {"ERR Invalid argument 'many' for CONFIG SET 'slowlog-max-len' - argument couldn't be parsed into an integer"},
+		{"CONFIG", "SET", "slowlog-max-len", -1}, {"ERR Invalid argument '-1' for CONFIG SET 'slowlog-max-len' - argument must be greater than or equal to 0"},
+		{"CONFIG", "SET", "scripttimelimit", "2s"}, {"OK"},
+		{"CONFIG", "GET", "scripttimelimit"}, {"[scripttimelimit 2s]"},
+		{"CONFIG", "SET", "scripttimelimit", "500ms"}, {"OK"},
+		{"CONFIG", "SET", "maxmemory", "abc"}, {"ERR Invalid argument 'abc' for CONFIG SET 'maxmemory' - argument must be a memory value"},
+		{"CONFIG", "SET", "unknown", 1}, {"ERR Unknown option or number of arguments for CONFIG SET - 'unknown'"},
+		{"CONFIG", "SET", "maxclients"}, {"ERR wrong number of arguments for 'CONFIG' command"},
+	})
+}
+
+// configExpect waits for every server to have the value of a param.
+func configExpect(mc *mockCluster, name, value string) error {
+	for _, s := range mc.ss {
+		var got string
+		for i := 0; i < 50; i++ {
+			v, err := redis.Strings(s.Do("CONFIG", "GET", name))
+			if err != nil {
+				return err
+			}
+			if len(v) == 2 {
+				got = v[1]
+			}
+			if got == value {
+				break
+			}
+			time.Sleep(time.Millisecond * 20)
+		}
+		if got != value {
+			return fmt.Errorf("expected '%v' on %v, got '%v'", value, s.addr(), got)
+		}
+	}
+	return nil
+}
+
+func config_REPLICATED_test(mc *mockCluster) error {
+	defer mc.Do("CONFIG", "SET", "scriptoplimit", 1000000)
+	defer mc.Do("CONFIG", "SET", "maxmemory", 0)
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "scriptoplimit", 50}, {"OK"},
+		{"EVAL", "for (var i = 0; i < 100; i++) { sdb.call('set', 'key', i) } return 1", 0}, {"ERR Script exceeded the limit of 50 operations"},
+		{"CONFIG", "SET", "maxmemory", "2mb"}, {"OK"},
+		{"INFO", "memory"}, {infoContains("maxmemory:2097152", "maxmemory_human:2.00M")},
+	}); err != nil {
+		return err
+	}
+	if err := configExpect(mc, "scriptoplimit", "50"); err != nil {
+		return err
+	}
+	return configExpect(mc, "maxmemory", "2097152")
+}
+
+func config_MAXCLIENTS_test(mc *mockCluster) error {
+	defer mc.Do("CONFIG", "SET", "maxclients", 0)
+	n, err := mc.Do("CLIENT", "LIST")
+	if err != nil {
+		return err
+	}
+	clients := strings.Count(string(n.([]byte)), "\n")
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "maxclients", clients}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	conn, err := mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("GET", "key"); err == nil || err.Error() != "ERR max number of clients reached" {
+		return fmt.Errorf("expected '%v', got '%v'", "ERR max number of clients reached", err)
+	}
+	if _, err := conn.Do("GET", "key"); err == nil {
+		return errors.New("expected a closed connection")
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "maxclients", clients + 1}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	conn, err = mockClientConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Do("SET", "key", "value"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func config_LOGLEVEL_test(mc *mockCluster) error {
+	var level string
+	mc.cs.m.OnLogLevel("notice", func(l string) error {
+		level = l
+		return nil
+	})
+	defer mc.cs.m.OnLogLevel("", nil)
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "GET", "loglevel"}, {"[loglevel notice]"},
+		{"CONFIG", "SET", "loglevel", "DEBUG"}, {"OK"},
+		{"CONFIG", "GET", "loglevel"}, {"[loglevel debug]"},
+		{"CONFIG", "SET", "loglevel", "loud"}, {"ERR Invalid argument 'loud' for CONFIG SET 'loglevel' - argument must be one of the following: warning, notice, verbose, debug"},
+	}); err != nil {
+		return err
+	}
+	if level != "debug" {
+		return fmt.Errorf("expected '%v', got '%v'", "debug", level)
+	}
+	return nil
+}
+
+func config_REWRITE_test(mc *mockCluster) error {
+	dir, err := ioutil.TempDir("", "summitdb-config")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "summitdb.conf")
+	if err := ioutil.WriteFile(file, []byte("# my config\nslowlog-max-len 10\nmaxclients 5\nmaxclients 6\nscriptoplimit 5\n"), 0600); err != nil {
+		return err
+	}
+	defer mc.cs.m.SetConfigFile("")
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "REWRITE"}, {"ERR The server is running without a config file"},
+	}); err != nil {
+		return err
+	}
+	mc.cs.m.SetConfigFile(file)
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "REWRITE"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	expect := "# my config\nslowlog-max-len 128\nmaxclients 0\n" +
+		"maxmemory 0\nmaxmemory-policy noeviction\nscripttimelimit 500ms\n" +
+		"slowlog-log-slower-than 10000\n"
+	if string(data) != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, string(data))
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// readConsistency is the consistency of the reads of a connection, which is
+// set with CONSISTENCY, READONLY, and READWRITE. The zero value uses the
+// consistency of the server.
+type readConsistency struct {
+	set      bool
+	level    finn.Level
+	bounded  bool          // bounded staleness, instead of the level
+	maxLag   uint64        // log entries that a follower may lag the leader
+	maxStale time.Duration // time since a follower heard from the leader
+}
+
+func (rc readConsistency) String() string {
+	switch {
+	case !rc.set:
+		return "default"
+	case rc.bounded:
+		return "bounded " + strconv.FormatUint(rc.maxLag, 10) + " " +
+			strconv.FormatInt(int64(rc.maxStale/time.Millisecond), 10)
+	}
+	return rc.level.String()
+}
+
+// readGuard checks that a read of the connection can be processed by this
+// server. The reads of a connection without a consistency are checked by
+// finn with the consistency of the server.
+func (m *Machine) readGuard(a finn.Applier, conn redcon.Conn) (checked bool, err error) {
+	if conn == nil {
+		return false, nil
+	}
+	ctx, ok := conn.Context().(*connContext)
+	if !ok || !ctx.read.set {
+		return false, nil
+	}
+	rg, ok := a.(finn.ReadGuard)
+	if !ok {
+		return false, nil
+	}
+	if ctx.read.bounded {
+		return true, rg.RaftStaleGuard(ctx.read.maxLag, ctx.read.maxStale)
+	}
+	return true, rg.RaftLevelGuard(ctx.read.level)
+}
+
+func (m *Machine) doConsistency(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// CONSISTENCY
+	// CONSISTENCY low|medium|high|default
+	// CONSISTENCY bounded maxlag maxms
+	// READONLY
+	// READWRITE
+	name := qcmdlower(cmd.Args[0])
+	switch name {
+	case "readonly", "readwrite":
+		if len(cmd.Args) != 1 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	default:
+		if len(cmd.Args) != 1 && len(cmd.Args) != 2 && len(cmd.Args) != 4 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	// The consistency is for the reads of the connection, so the command
+	// does not go through the raft log.
+	ctx, ok := conn.Context().(*connContext)
+	if !ok {
+		return nil, errors.New("ERR invalid connection")
+	}
+	switch name {
+	case "readonly":
+		// the reads may be stale, like a redis replica.
+		ctx.read = readConsistency{set: true, level: finn.Low}
+		conn.WriteString("OK")
+		return nil, nil
+	case "readwrite":
+		ctx.read = readConsistency{}
+		conn.WriteString("OK")
+		return nil, nil
+	}
+	if len(cmd.Args) == 1 {
+		conn.WriteBulkString(ctx.read.String())
+		return nil, nil
+	}
+	var rc readConsistency
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errSyntaxError
+	case "low":
+		rc = readConsistency{set: true, level: finn.Low}
+	case "medium":
+		rc = readConsistency{set: true, level: finn.Medium}
+	case "high":
+		rc = readConsistency{set: true, level: finn.High}
+	case "default":
+	case "bounded":
+		if len(cmd.Args) != 4 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		maxLag, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+		if err != nil {
+			return nil, errors.New("ERR max lag is not an integer or out of range")
+		}
+		ms, err := strconv.ParseUint(string(cmd.Args[3]), 10, 32)
+		if err != nil || ms == 0 {
+			return nil, errors.New("ERR max staleness is not an integer or out of range")
+		}
+		rc = readConsistency{set: true, bounded: true, maxLag: maxLag,
+			maxStale: time.Duration(ms) * time.Millisecond}
+	}
+	if !rc.bounded && len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	ctx.read = rc
+	conn.WriteString("OK")
+	return nil, nil
+}
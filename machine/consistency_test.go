@@ -0,0 +1,186 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestConsistency(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "CONSISTENCY", consistency_CONSISTENCY_test)
+	runStep(t, mc, "READONLY", consistency_READONLY_test)
+	runStep(t, mc, "bounded", consistency_BOUNDED_test)
+	runStep(t, mc, "bounded lag", consistency_BOUNDEDLAG_test)
+}
+
+// mockFollower returns a follower.
+func mockFollower(mc *mockCluster) (*mockServer, error) {
+	for _, s := range mc.ss {
+		if s != mc.cs {
+			return s, nil
+		}
+	}
+	return nil, errors.New("no followers")
+}
+
+// mockFollowerConn opens a connection to a follower.
+func mockFollowerConn(mc *mockCluster) (redis.Conn, error) {
+	s, err := mockFollower(mc)
+	if err != nil {
+		return nil, err
+	}
+	return redis.Dial("tcp", s.addr())
+}
+
+// followerGet reads a key from a follower, and waits for the write to be
+// applied by the follower.
+func followerGet(conn redis.Conn, key, expect string) error {
+	var v string
+	var err error
+	for i := 0; i < 50; i++ {
+		v, err = redis.String(conn.Do("GET", key))
+		if err == nil && v == expect {
+			return nil
+		}
+		if err != nil && strings.HasPrefix(err.Error(), "TRY ") {
+			return err
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return fmt.Errorf("expected '%v', got '%v' (%v)", expect, v, err)
+}
+
+func consistency_CONSISTENCY_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"CONSISTENCY"}, {"default"},
+		{"CONSISTENCY", "medium"}, {"OK"},
+		{"CONSISTENCY"}, {"medium"},
+		{"SET", "key", "value"}, {"OK"},
+		{"GET", "key"}, {"value"},
+		{"CONSISTENCY", "bounded", 10, 500}, {"OK"},
+		{"CONSISTENCY"}, {"bounded 10 500"},
+		{"GET", "key"}, {"value"},
+		{"CONSISTENCY", "bounded", 10, 0}, {"ERR max staleness is not an integer or out of range"},
+		{"CONSISTENCY", "bounded", -1, 500}, {"ERR max lag is not an integer or out of range"},
+		{"CONSISTENCY", "bounded", 10}, {"ERR wrong number of arguments for 'CONSISTENCY' command"},
+		{"CONSISTENCY", "high", 10, 500}, {"ERR wrong number of arguments for 'CONSISTENCY' command"},
+		{"CONSISTENCY", "some"}, {"ERR syntax error"},
+		{"CONSISTENCY", "default"}, {"OK"},
+		{"CONSISTENCY"}, {"default"},
+	})
+}
+
+func consistency_READONLY_test(mc *mockCluster) error {
+	conn, err := mockFollowerConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := mc.DoBatch([][]interface{}{{"SET", "key", "value"}, {"OK"}}); err != nil {
+		return err
+	}
+	// the follower redirects to the leader with the consistency of the
+	// server.
+	if _, err := conn.Do("GET", "key"); err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return fmt.Errorf("expected '%v', got '%v'", "TRY", err)
+	}
+	if v, err := redis.String(conn.Do("READONLY")); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if err := followerGet(conn, "key", "value"); err != nil {
+		return err
+	}
+	// the writes still go to the leader.
+	if _, err := conn.Do("SET", "key", "value2"); err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return fmt.Errorf("expected '%v', got '%v'", "TRY", err)
+	}
+	if v, err := redis.String(conn.Do("READWRITE")); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if _, err := conn.Do("GET", "key"); err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return fmt.Errorf("expected '%v', got '%v'", "TRY", err)
+	}
+	return nil
+}
+
+func consistency_BOUNDED_test(mc *mockCluster) error {
+	conn, err := mockFollowerConn(mc)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := mc.DoBatch([][]interface{}{{"SET", "key", "value"}, {"OK"}}); err != nil {
+		return err
+	}
+	if v, err := redis.String(conn.Do("CONSISTENCY", "bounded", 1000, 10000)); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if err := followerGet(conn, "key", "value"); err != nil {
+		return err
+	}
+	// a medium read is redirected to the leader.
+	if v, err := redis.String(conn.Do("CONSISTENCY", "medium")); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if _, err := conn.Do("GET", "key"); err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return fmt.Errorf("expected '%v', got '%v'", "TRY", err)
+	}
+	return nil
+}
+
+func consistency_BOUNDEDLAG_test(mc *mockCluster) error {
+	s, err := mockFollower(mc)
+	if err != nil {
+		return err
+	}
+	conn, err := redis.Dial("tcp", s.addr(), redis.DialReadTimeout(time.Second*5))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := mc.DoBatch([][]interface{}{{"SET", "key", "value"}, {"OK"}}); err != nil {
+		return err
+	}
+	if v, err := redis.String(conn.Do("CONSISTENCY", "bounded", 2, 10000)); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if err := followerGet(conn, "key", "value"); err != nil {
+		return err
+	}
+	// holding the scripts of the follower stops it from applying the
+	// EVAL writes, which are still committed by the other servers.
+	s.m.sm.mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			s.m.sm.mu.Unlock()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := mc.DoBatch([][]interface{}{
+			{"EVAL", `return sdb.call("set", "key", ARGV[0])`, 0, fmt.Sprintf("value%d", i)}, {"OK"},
+		}); err != nil {
+			return err
+		}
+	}
+	// the follower lags more than 2 entries behind the leader.
+	if _, err := conn.Do("GET", "key"); err == nil || !strings.HasPrefix(err.Error(), "TRY ") {
+		return fmt.Errorf("expected '%v', got '%v'", "TRY", err)
+	}
+	s.m.sm.mu.Unlock()
+	locked = false
+	// the follower is refused until it catches up.
+	var v string
+	for i := 0; i < 50; i++ {
+		v, err = redis.String(conn.Do("GET", "key"))
+		if err == nil && v == "value9" {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return fmt.Errorf("expected '%v', got '%v' (%v)", "value9", v, err)
+}
@@ -41,10 +41,13 @@ func (m *Machine) writeDoApply(
 		ctx, ok := conn.Context().(*connContext)
 		if ok && ctx.multi != nil {
 			ctx.multi.cmds = append(ctx.multi.cmds, cmd)
-			ctx.multi.writable = wrdo != nil
+			ctx.multi.writable = ctx.multi.writable || wrdo != nil
 			conn.WriteString("QUEUED")
 			return nil, nil
 		}
+		if ok {
+			ctx.path = slowlogPathApply
+		}
 	}
 	return a.Apply(conn, cmd, func() (v interface{}, err error) {
 		if tx != nil {
@@ -76,26 +79,42 @@ func (m *Machine) readDoApply(
 			conn.WriteString("QUEUED")
 			return nil, nil
 		}
+		if ok {
+			ctx.path = slowlogPathRead
+		}
 	}
-	return a.Apply(conn, cmd, nil, func(v interface{}) (interface{}, error) {
+	respond := func(v interface{}) (interface{}, error) {
 		if tx != nil {
 			return nil, rddo(tx)
 		}
 		return nil, m.db.View(func(tx *buntdb.Tx) error {
 			return rddo(tx)
 		})
-	})
+	}
+	// the connection may have its own read consistency.
+	if checked, err := m.readGuard(a, conn); checked {
+		if err != nil {
+			return nil, err
+		}
+		return respond(nil)
+	}
+	return a.Apply(conn, cmd, nil, respond)
 }
 
 // flushAllButMeta removes all data from the database except meta keys.
+// The versions of the removed keys are removed too.
 func flushAllButMeta(tx *buntdb.Tx) ([]string, int, error) {
 	// backup the meta keys
 	var metas []string
-	if err := tx.AscendGreaterOrEqual("", sdbMetaPrefix, func(key, val string) bool {
-		if !isMercMetaKey(key) {
-			return false
+	nmetas, err := versionKeysLen(tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := ascendMeta(tx, func(key, val string) bool {
+		nmetas++
+		if key != versionKeysLenKey && key != tombstonesLenKey {
+			metas = append(metas, key, val)
 		}
-		metas = append(metas, key, val)
 		return true
 	}); err != nil {
 		return nil, 0, err
@@ -114,5 +133,8 @@ func flushAllButMeta(tx *buntdb.Tx) ([]string, int, error) {
 			return nil, 0, err
 		}
 	}
-	return metas, n - (len(metas) / 2), nil
+	if err := flushVersions(tx); err != nil {
+		return nil, 0, err
+	}
+	return metas, n - nmetas, nil
 }
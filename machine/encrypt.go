@@ -0,0 +1,270 @@
+package machine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// The data at rest is encrypted with AES-GCM. Each encrypted message is the
+// id of the key, a random nonce, and the sealed data. The id is the first
+// four bytes of the sha256 of the key, so that the messages that were
+// encrypted with an old key can be decrypted while the key is rotated.
+//
+// Snapshots and backups are streams of encrypted chunks. The stream starts
+// with encryptedStreamMagic, and each chunk is its length followed by the
+// encrypted message of the chunk number and the data. The stream ends with
+// a chunk that has no data, so a truncated stream is detected.
+
+// encryptedStreamMagic is the start of an encrypted stream.
+const encryptedStreamMagic = "SDBENC1\n"
+
+// encryptedChunkSize is the size of the data in a chunk.
+const encryptedChunkSize = 64 * 1024
+
+var errWrongKey = errors.New("encryption key is wrong: unable to decrypt the data")
+var errNotEncrypted = errors.New("data is not encrypted")
+var errTruncated = errors.New("encrypted data is truncated")
+
+type cipherKey struct {
+	id   [4]byte
+	aead cipher.AEAD
+}
+
+// Cipher encrypts and decrypts data at rest. The first key encrypts, and
+// every key decrypts.
+type Cipher struct {
+	keys []cipherKey
+}
+
+// NewCipher returns a cipher that encrypts with key, and decrypts with key
+// or any of the old keys. The keys are 16, 24, or 32 bytes.
+func NewCipher(key []byte, oldKeys ...[]byte) (*Cipher, error) {
+	c := &Cipher{}
+	for _, key := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		var ck cipherKey
+		sum := sha256.Sum256(key)
+		copy(ck.id[:], sum[:])
+		ck.aead = aead
+		c.keys = append(c.keys, ck)
+	}
+	return c, nil
+}
+
+// ParseKey parses a hex encoded key, such as the output of
+// "openssl rand -hex 32".
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("encryption key must be hex encoded")
+	}
+	switch len(key) {
+	default:
+		return nil, errors.New("encryption key must be 16, 24, or 32 bytes")
+	case 16, 24, 32:
+	}
+	return key, nil
+}
+
+// LoadKey loads a hex encoded key from a file, or from the environment
+// variable when the file is empty. Returns nil when neither is set.
+func LoadKey(file, env string) ([]byte, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKey(string(data))
+	}
+	if s := os.Getenv(env); s != "" {
+		return ParseKey(s)
+	}
+	return nil, nil
+}
+
+// Encrypt encrypts a message with the current key.
+func (c *Cipher) Encrypt(plaintext []byte) []byte {
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("random err: " + err.Error())
+	}
+	msg := make([]byte, 0, len(key.id)+len(nonce)+len(plaintext)+key.aead.Overhead())
+	msg = append(msg, key.id[:]...)
+	msg = append(msg, nonce...)
+	return key.aead.Seal(msg, nonce, plaintext, key.id[:])
+}
+
+// Decrypt decrypts a message that was encrypted with any of the keys.
+func (c *Cipher) Decrypt(msg []byte) ([]byte, error) {
+	if len(msg) < 4 {
+		return nil, errWrongKey
+	}
+	for _, key := range c.keys {
+		if !bytes.Equal(msg[:4], key.id[:]) {
+			continue
+		}
+		n := key.aead.NonceSize()
+		if len(msg) < 4+n {
+			return nil, errWrongKey
+		}
+		plaintext, err := key.aead.Open(nil, msg[4:4+n], msg[4+n:], key.id[:])
+		if err != nil {
+			return nil, errWrongKey
+		}
+		return plaintext, nil
+	}
+	return nil, errWrongKey
+}
+
+// NewWriter returns a writer that encrypts a stream. The stream is not
+// complete until the writer is closed.
+func (c *Cipher) NewWriter(wr io.Writer) io.WriteCloser {
+	return &encryptWriter{c: c, wr: wr}
+}
+
+type encryptWriter struct {
+	c       *Cipher
+	wr      io.Writer
+	buf     []byte
+	seq     uint64
+	started bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= encryptedChunkSize {
+		if err := w.flush(w.buf[:encryptedChunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[encryptedChunkSize:]
+	}
+	return len(p), nil
+}
+
+// Close writes the remaining data and the end of the stream.
+func (w *encryptWriter) Close() error {
+	if len(w.buf) > 0 {
+		if err := w.flush(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	return w.flush(nil)
+}
+
+func (w *encryptWriter) flush(data []byte) error {
+	var out []byte
+	if !w.started {
+		out = append(out, encryptedStreamMagic...)
+		w.started = true
+	}
+	chunk := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint64(chunk, w.seq)
+	chunk = append(chunk, data...)
+	w.seq++
+	msg := w.c.Encrypt(chunk)
+	var num [4]byte
+	binary.LittleEndian.PutUint32(num[:], uint32(len(msg)))
+	out = append(out, num[:]...)
+	out = append(out, msg...)
+	_, err := w.wr.Write(out)
+	return err
+}
+
+// NewReader returns a reader that decrypts a stream. It returns
+// errNotEncrypted when the stream does not start like an encrypted stream.
+func (c *Cipher) NewReader(rd io.Reader) (io.Reader, error) {
+	brd := bufio.NewReader(rd)
+	magic, err := brd.Peek(len(encryptedStreamMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != encryptedStreamMagic {
+		return brd, errNotEncrypted
+	}
+	brd.Discard(len(encryptedStreamMagic))
+	return &decryptReader{c: c, rd: brd}, nil
+}
+
+type decryptReader struct {
+	c    *Cipher
+	rd   io.Reader
+	buf  []byte
+	seq  uint64
+	done bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		var num [4]byte
+		if _, err := io.ReadFull(r.rd, num[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, errTruncated
+			}
+			return 0, err
+		}
+		msg := make([]byte, binary.LittleEndian.Uint32(num[:]))
+		if _, err := io.ReadFull(r.rd, msg); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, errTruncated
+			}
+			return 0, err
+		}
+		chunk, err := r.c.Decrypt(msg)
+		if err != nil {
+			return 0, err
+		}
+		if len(chunk) < 8 || binary.LittleEndian.Uint64(chunk) != r.seq {
+			return 0, errors.New("encrypted data is corrupted")
+		}
+		r.seq++
+		r.buf = chunk[8:]
+		if len(r.buf) == 0 {
+			r.done = true
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// SetCipher encrypts the snapshots and backups of the machine. The database
+// is kept in memory instead of in a temporary file, so that it's not stored
+// in plaintext. It must be called before the machine is used, and the
+// servers in a cluster must use the same keys.
+func (m *Machine) SetCipher(c *Cipher) error {
+	m.cipher = c
+	return m.reopenBlankDB(nil, func(keys []string) { m.onExpired(keys) })
+}
+
+// DecryptBackup decrypts a backup that was made with the BACKUP command.
+func DecryptBackup(wr io.Writer, rd io.Reader, c *Cipher) error {
+	drd, err := c.NewReader(rd)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(wr, drd)
+	return err
+}
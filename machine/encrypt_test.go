@@ -0,0 +1,164 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const encryptSecret = "the-secret-value"
+
+func subTestEncryption(t *testing.T, _ *mockCluster) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	c1, err := NewCipher(key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := mockOpenEncryptedCluster(0, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := mc.ss[0].port
+	runStep(t, mc, "write", encrypt_WRITE_test)
+	runStep(t, mc, "files", encrypt_FILES_test)
+	runStep(t, mc, "BACKUP", func(mc *mockCluster) error {
+		return encrypt_BACKUP_test(mc, c1)
+	})
+	mc.Close()
+
+	// open with the wrong key
+	c2, err := NewCipher(key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mockOpenEncryptedCluster(port, c2); err == nil || err.Error() != errWrongKey.Error() {
+		t.Fatalf("expected '%v', got '%v'", errWrongKey, err)
+	}
+	fmt.Printf("[" + green + "ok" + clear + "]: wrong key\n")
+
+	// rotate the key with a snapshot and a log rewrite
+	c21, err := NewCipher(key2, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err = mockOpenEncryptedCluster(port, c21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runStep(t, mc, "rotate", encrypt_ROTATE_test)
+	mc.Close()
+
+	mc, err = mockOpenEncryptedCluster(port, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	// the data from before the rotation is read without flushing the database
+	if err := encrypt_ROTATED_test(mc); err != nil {
+		fmt.Printf("[" + red + "fail" + clear + "]: rotated\n")
+		t.Fatal(err)
+	}
+	fmt.Printf("[" + green + "ok" + clear + "]: rotated\n")
+}
+
+// mockOpenEncryptedCluster opens a single server that encrypts its data.
+func mockOpenEncryptedCluster(port int, c *Cipher) (*mockCluster, error) {
+	s, err := mockOpenServerOptions(nil, mockOptions{port: port, cipher: c})
+	if err != nil {
+		return nil, err
+	}
+	return &mockCluster{ss: []*mockServer{s}}, nil
+}
+
+func encrypt_WRITE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key1", encryptSecret}, {"OK"},
+		{"RAFTSNAPSHOT"}, {"OK"},
+		{"SET", "key2", encryptSecret}, {"OK"},
+		{"GET", "key1"}, {encryptSecret},
+	})
+}
+
+func encrypt_FILES_test(mc *mockCluster) error {
+	dir := fmt.Sprintf("data-mock-%d", mc.ss[0].port)
+	var files int
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte(encryptSecret)) {
+			return fmt.Errorf("found plaintext in '%v'", path)
+		}
+		if strings.HasSuffix(path, "state.bin") {
+			if !bytes.HasPrefix(data, []byte(encryptedStreamMagic)) {
+				return fmt.Errorf("expected an encrypted snapshot in '%v'", path)
+			}
+			files++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if files == 0 {
+		return errors.New("expected a snapshot")
+	}
+	if mc.ss[0].m.file != "" {
+		return errors.New("expected an in-memory database")
+	}
+	return nil
+}
+
+func encrypt_BACKUP_test(mc *mockCluster, c *Cipher) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key1", encryptSecret}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	resp, err := mc.Do("BACKUP")
+	if err != nil {
+		return err
+	}
+	data := resp.([]byte)
+	if !bytes.HasPrefix(data, []byte(encryptedStreamMagic)) || bytes.Contains(data, []byte(encryptSecret)) {
+		return errors.New("expected an encrypted backup")
+	}
+	var buf bytes.Buffer
+	if err := DecryptBackup(&buf, bytes.NewReader(data), c); err != nil {
+		return err
+	}
+	if !strings.Contains(buf.String(), encryptSecret) {
+		return errors.New("expected the value in the backup")
+	}
+	// truncated
+	if err := DecryptBackup(&buf, bytes.NewReader(data[:len(data)-1]), c); err != errTruncated {
+		return fmt.Errorf("expected '%v', got '%v'", errTruncated, err)
+	}
+	return nil
+}
+
+func encrypt_ROTATE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key3", encryptSecret}, {"OK"},
+		{"RAFTSNAPSHOT"}, {"OK"},
+		{"SET", "key4", encryptSecret}, {"OK"},
+		{"RAFTSNAPSHOT"}, {"OK"},
+		{"RAFTSHRINKLOG"}, {"OK"},
+	})
+}
+
+func encrypt_ROTATED_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"GET", "key3"}, {encryptSecret},
+		{"GET", "key4"}, {encryptSecret},
+	})
+}
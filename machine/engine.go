@@ -0,0 +1,169 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A scriptEngine runs the javascript of scripts, function libraries,
+// triggers, and eval indexes. The engine is selected with CONFIG SET
+// scriptengine, which goes through the raft log, because write scripts and
+// eval indexes must give the same results on every server.
+//
+// The engines are:
+//
+//	otto - ES5, the default
+//	goja - ES2015+, and much faster
+type scriptEngine interface {
+	// newRuntime returns a new runtime that has the sdb api.
+	newRuntime() (scriptRuntime, error)
+	// compileLess compiles the function of an eval index. The function is
+	// safe for concurrent use.
+	compileLess(script string) (func(a, b string) bool, error)
+}
+
+// A scriptRuntime is a single javascript vm. It's not safe for concurrent
+// use, so each script has its own runtime which is locked while it runs.
+type scriptRuntime interface {
+	// compile compiles the body of a function. The function is called when
+	// the program runs, so that the script can return a value.
+	compile(src string) (scriptProgram, error)
+	// run runs a compiled program.
+	run(prog scriptProgram) (scriptValue, error)
+	// exec runs code, such as the code of a function library.
+	exec(src string) error
+	// get returns a global.
+	get(name string) scriptValue
+	// set sets a global to a Go value or to a scriptValue.
+	set(name string, v interface{})
+	// setFunc sets a host function on a global object, such as "sdb".
+	setFunc(obj, name string, fn hostFunc)
+	// toValue converts a Go value, or a scriptValue, into a runtime value.
+	// Maps become objects, slices become arrays, and the reply types become
+	// the reply objects of sdb.statusReply and sdb.errorReply.
+	toValue(v interface{}) scriptValue
+	// parseJSON is JSON.parse.
+	parseJSON(s string) (scriptValue, error)
+	// setRandom sets the source of Math.random.
+	setRandom(fn func() float64)
+	// setLimiter sets the function that is called for each operation of a
+	// script. The function panics to abort the script. Nil removes it.
+	setLimiter(fn func())
+	// id returns the vm, which is the same for every host function call
+	// from the runtime.
+	id() interface{}
+}
+
+// scriptProgram is a compiled program of a runtime.
+type scriptProgram interface{}
+
+// A scriptValue is a javascript value of a runtime.
+type scriptValue interface {
+	isUndefined() bool
+	isNull() bool
+	isBoolean() bool
+	isNumber() bool
+	isString() bool
+	isObject() bool
+	isArray() bool
+	isFunction() bool
+	toBoolean() bool
+	toFloat() float64
+	String() string
+	// get returns a property of an object.
+	get(name string) scriptValue
+	// length returns the length of an array.
+	length() int
+	// index returns an item of an array.
+	index(i int) scriptValue
+	// call calls a function with the Go values or scriptValues as args.
+	call(args ...interface{}) (scriptValue, error)
+	// json is JSON.stringify.
+	json() (string, error)
+	// export converts the value into a Go value.
+	export() interface{}
+}
+
+// hostFunc is a Go function that is called from javascript. The function
+// panics with a scriptErrPrefix string to throw an error that the script
+// can't catch.
+type hostFunc func(rt scriptRuntime, args []scriptValue) scriptValue
+
+// argument returns an argument of a host function, or undefined when the
+// argument is missing.
+func argument(rt scriptRuntime, args []scriptValue, i int) scriptValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return rt.toValue(undefined{})
+}
+
+// scriptHost is the host functions of an engine. The names are "object.name",
+// such as "sdb.call" or "console.log". The sdb.now function is the clock.
+type scriptHost map[string]hostFunc
+
+// statusReply and errorReply are converted to the reply objects of
+// sdb.statusReply and sdb.errorReply.
+type statusReply string
+type errorReply string
+
+// undefined is converted to the undefined value. Nil is converted to null.
+type undefined struct{}
+
+// scriptPrelude is the javascript that is run on every new runtime.
+const scriptPrelude = `
+	var SummitDB = (function(){
+		var ErrorReply = function(err){
+			this.err = err;
+		}
+		var StatusReply = function(ok){
+			this.ok = ok;
+		}
+		ErrorReply.prototype.toString = function(){
+			return this.err.toString();
+		}
+		StatusReply.prototype.toString = function(){
+			return this.ok.toString();
+		}
+		var SummitDB = function(){}
+		SummitDB.prototype.errorReply = function(err){
+			return new ErrorReply(err);
+		}
+		SummitDB.prototype.statusReply = function(ok){
+			return new StatusReply(ok);
+		}
+		SummitDB.prototype.toString = function(){
+			return "[object SummitDB]";
+		}
+		return SummitDB;
+	}())
+	var sdb = new SummitDB();
+	var redis = sdb;
+`
+
+// scriptEngineNames are the names of the engines.
+var scriptEngineNames = []string{"otto", "goja"}
+
+// newScriptEngine returns the engine with the name.
+func newScriptEngine(name string, host scriptHost) (scriptEngine, error) {
+	switch strings.ToLower(name) {
+	case "otto":
+		return newOttoEngine(host)
+	case "goja":
+		return newGojaEngine(host), nil
+	}
+	return nil, fmt.Errorf("unknown script engine '%s', expected %s", name,
+		strings.Join(scriptEngineNames, " or "))
+}
+
+// splitHostName splits "object.name" into the object and the name.
+func splitHostName(path string) (obj, name string) {
+	idx := strings.IndexByte(path, '.')
+	if idx == -1 {
+		return "", path
+	}
+	return path[:idx], path[idx+1:]
+}
+
+var errExpectingFunction = errors.New("ERR expecting a function")
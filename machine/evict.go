@@ -0,0 +1,393 @@
+package machine
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// The eviction policies of maxmemory-policy, like redis.
+const (
+	evictNoEviction    = "noeviction"     // reject the writes
+	evictAllKeysLRU    = "allkeys-lru"    // least recently used keys
+	evictVolatileLRU   = "volatile-lru"   // least recently used keys with a ttl
+	evictVolatileTTL   = "volatile-ttl"   // keys with the shortest ttl
+	evictAllKeysRandom = "allkeys-random" // random keys
+)
+
+const (
+	// evictSamples is the number of keys that are compared to choose a key
+	// to evict.
+	evictSamples = 16
+	// evictMaxKeys is the maximum number of keys that are evicted before a
+	// single write.
+	evictMaxKeys = 1024
+	// evictMinPrune is the number of accesses that are recorded for the lru
+	// before the keys that don't exist are removed.
+	evictMinPrune = 1024
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// evictState chooses the keys that are evicted when the memory is over
+// maxmemory.
+type evictState struct {
+	mu      sync.Mutex
+	policy  string
+	clock   int64            // increased for every access
+	access  map[string]int64 // the last access of the keys, for lru
+	pruneAt int              // size of access that removes the missing keys
+	evicted int64            // number of evicted keys, for INFO
+}
+
+// datasetSize returns the memory that is compared to maxmemory, which is the
+// size of the keys and values of the database. Unlike the go heap, it's the
+// same on every server, and it goes down as soon as keys are evicted.
+func (m *Machine) datasetSize() int64 {
+	var size int64
+	m.db.View(func(tx *buntdb.Tx) error {
+		size, _ = tx.Size()
+		return nil
+	})
+	return size
+}
+
+// evictPolicy returns true for a valid maxmemory-policy.
+func evictPolicy(policy string) bool {
+	switch policy {
+	case evictNoEviction, evictAllKeysLRU, evictVolatileLRU,
+		evictVolatileTTL, evictAllKeysRandom:
+		return true
+	}
+	return false
+}
+
+// SetMaxMemoryPolicy sets how keys are evicted when the memory is over
+// maxmemory. It's replaced by CONFIG SET maxmemory-policy, which is the
+// same on every server in the cluster.
+func (m *Machine) SetMaxMemoryPolicy(policy string) error {
+	if !evictPolicy(policy) {
+		return errors.New("invalid maxmemory-policy")
+	}
+	m.evict.mu.Lock()
+	defer m.evict.mu.Unlock()
+	if policy != m.evict.policy {
+		m.evict.access = make(map[string]int64)
+	}
+	m.evict.policy = policy
+	return nil
+}
+
+func (m *Machine) maxMemoryPolicy() string {
+	m.evict.mu.Lock()
+	defer m.evict.mu.Unlock()
+	return m.evict.policy
+}
+
+// evictTouch records the access of the keys of a command for the lru
+// policies.
+func (m *Machine) evictTouch(name string, cmd redcon.Command) {
+	if atomic.LoadInt64(&m.maxMemory) == 0 {
+		return
+	}
+	m.evict.mu.Lock()
+	defer m.evict.mu.Unlock()
+	if m.evict.policy != evictAllKeysLRU && m.evict.policy != evictVolatileLRU {
+		return
+	}
+	for _, key := range commandKeys(name, cmd) {
+		m.evict.clock++
+		m.evict.access[string(key)] = m.evict.clock
+	}
+	if len(m.evict.access) <= m.evict.pruneAt {
+		return
+	}
+	// the keys that were read but don't exist, or that have expired, are
+	// removed once the lru has grown, so it can't grow without a bound.
+	keys := make([]string, 0, len(m.evict.access))
+	for key := range m.evict.access {
+		keys = append(keys, key)
+	}
+	m.evict.pruneAt = len(keys) * 2
+	m.evict.mu.Unlock()
+	var missing []string
+	m.db.View(func(tx *buntdb.Tx) error {
+		for _, key := range keys {
+			if _, err := tx.Get(key); err == buntdb.ErrNotFound {
+				missing = append(missing, key)
+			}
+		}
+		return nil
+	})
+	m.evict.mu.Lock()
+	for _, key := range missing {
+		delete(m.evict.access, key)
+	}
+	m.evict.pruneAt = len(m.evict.access) * 2
+	if m.evict.pruneAt < evictMinPrune {
+		m.evict.pruneAt = evictMinPrune
+	}
+}
+
+// evictForget removes the deleted keys from the lru.
+func (m *Machine) evictForget(keys [][]byte) {
+	m.evict.mu.Lock()
+	defer m.evict.mu.Unlock()
+	for _, key := range keys {
+		delete(m.evict.access, string(key))
+	}
+}
+
+// evictForgetAll removes all keys from the lru.
+func (m *Machine) evictForgetAll() {
+	m.evict.mu.Lock()
+	defer m.evict.mu.Unlock()
+	m.evict.access = make(map[string]int64)
+}
+
+// evictDenyOOM returns true for the commands that are rejected when the
+// memory is over maxmemory. The commands that only delete keys are allowed.
+func evictDenyOOM(name string) bool {
+	switch name {
+	case "del", "pdel", "expired", "evicted", "flushdb", "flushall",
+		"delindex", "delschema", "deltrigger":
+		return false
+	}
+	return clientPauseWrite(name)
+}
+
+// evictBeforeWrite is called on the leader before a command that may add
+// data. When the memory is over maxmemory, keys are evicted with EVICTED,
+// which goes through the raft log so that every server deletes the same
+// keys. The command is rejected with an OOM error when nothing can be
+// evicted.
+func (m *Machine) evictBeforeWrite(a finn.Applier, conn redcon.Conn, name string) error {
+	max := atomic.LoadInt64(&m.maxMemory)
+	if max == 0 || !evictDenyOOM(name) {
+		return nil
+	}
+	used := m.usedMemory()
+	if used <= max {
+		return nil
+	}
+	// only the leader decides what to evict, the followers redirect the
+	// command to the leader.
+	if ri, ok := a.(finn.RaftInfo); !ok || ri.RaftStats()["state"] != "Leader" {
+		return nil
+	}
+	policy := m.maxMemoryPolicy()
+	if policy == evictNoEviction {
+		return errOOM
+	}
+	keys, err := m.evictKeys(policy, used-max)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errOOM
+	}
+	m.log.Debugf("evict: %v", keys)
+	args := [][]byte{[]byte("evicted")}
+	for _, key := range keys {
+		args = append(args, []byte(key))
+	}
+	_, err = a.Apply(conn, buildCommand(args), func() (interface{}, error) {
+		return nil, nil
+	}, func(v interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return err
+}
+
+// evictKeys chooses the keys to evict with the policy, until the size of
+// the keys and values is at least the number of bytes to free.
+func (m *Machine) evictKeys(policy string, free int64) ([]string, error) {
+	var keys []string
+	err := m.db.View(func(tx *buntdb.Tx) error {
+		chosen := make(map[string]bool)
+		var freed int64
+		for freed < free && len(keys) < evictMaxKeys {
+			key, size, err := evictSample(tx, policy, chosen, func(key string) int64 {
+				m.evict.mu.Lock()
+				defer m.evict.mu.Unlock()
+				return m.evict.access[key]
+			})
+			if err != nil {
+				return err
+			}
+			if key == "" {
+				break
+			}
+			chosen[key] = true
+			keys = append(keys, key)
+			freed += size
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// evictSample compares a sample of keys, starting at a random key, and
+// returns the best key to evict with the policy and its size. The volatile
+// policies only look at the keys that have a ttl, and volatile-ttl returns
+// the key that expires first. An empty key is returned when there are no
+// keys to evict.
+func evictSample(tx *buntdb.Tx, policy string, chosen map[string]bool,
+	lastAccess func(key string) int64) (string, int64, error) {
+	if policy == evictVolatileTTL {
+		return evictSoonest(tx, chosen)
+	}
+	var best string
+	var bestSize, bestScore int64
+	var n int
+	var err error
+	iter := func(key, val string) bool {
+		if isMercMetaKey(key) || chosen[key] {
+			return true
+		}
+		var score int64
+		switch policy {
+		case evictVolatileLRU:
+			if _, terr := tx.TTL(key); terr != nil {
+				if terr != buntdb.ErrNotFound {
+					err = terr
+					return false
+				}
+				// the key has expired, and is deleted by EXPIRED.
+				return true
+			}
+			score = lastAccess(key)
+		case evictAllKeysLRU:
+			score = lastAccess(key)
+		}
+		if best == "" || score < bestScore {
+			best, bestSize, bestScore = key, int64(len(key)+len(val)), score
+		}
+		n++
+		return n < evictSamples
+	}
+	var terr error
+	if policy == evictVolatileLRU {
+		terr = ascendExpiresRandom(tx, iter)
+	} else {
+		terr = ascendKeysRandom(tx, iter)
+	}
+	if terr != nil {
+		return "", 0, terr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return best, bestSize, nil
+}
+
+// evictSoonest returns the key that expires first and its size.
+func evictSoonest(tx *buntdb.Tx, chosen map[string]bool) (string, int64, error) {
+	var best string
+	var bestSize int64
+	var err error
+	if terr := tx.AscendExpires(time.Time{}, func(key, val string, expires time.Time) bool {
+		if isMercMetaKey(key) || chosen[key] {
+			return true
+		}
+		if _, terr := tx.TTL(key); terr != nil {
+			if terr != buntdb.ErrNotFound {
+				err = terr
+				return false
+			}
+			return true
+		}
+		best, bestSize = key, int64(len(key)+len(val))
+		return false
+	}); terr != nil {
+		return "", 0, terr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return best, bestSize, nil
+}
+
+// metaEnd is the first key after the meta keys.
+var metaEnd = sdbMetaPrefix[:len(sdbMetaPrefix)-1] + "\""
+
+// ascendKeysRandom calls the iterator for the user keys, starting at a
+// random key and wrapping around to the first key, until the iterator
+// returns false. The meta keys are skipped as a range, so they don't take
+// from the sample.
+func ascendKeysRandom(tx *buntdb.Tx, iter func(key, val string) bool) error {
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(' ' + rand.Intn('~'-' '))
+	}
+	pivot := string(b[:])
+	if pivot >= sdbMetaPrefix && pivot < metaEnd {
+		pivot = metaEnd
+	}
+	more := true
+	each := func(key, val string) bool {
+		more = iter(key, val)
+		return more
+	}
+	// the ranges of the user keys, from the pivot to the pivot.
+	var ranges [][2]string
+	if pivot < sdbMetaPrefix {
+		ranges = [][2]string{{pivot, sdbMetaPrefix}, {metaEnd, ""}, {"", pivot}}
+	} else {
+		ranges = [][2]string{{pivot, ""}, {"", sdbMetaPrefix}, {metaEnd, pivot}}
+	}
+	for _, r := range ranges {
+		var err error
+		switch {
+		case r[1] == "":
+			err = tx.AscendGreaterOrEqual("", r[0], each)
+		case r[0] == "":
+			err = tx.AscendLessThan("", r[1], each)
+		default:
+			err = tx.AscendRange("", r[0], r[1], each)
+		}
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// ascendExpiresRandom is like ascendKeysRandom, but only for the keys that
+// have a ttl, starting at a random time between the first and the last
+// expiration.
+func ascendExpiresRandom(tx *buntdb.Tx, iter func(key, val string) bool) error {
+	var first, last time.Time
+	if err := tx.AscendExpires(time.Time{}, func(key, val string, expires time.Time) bool {
+		first = expires
+		return false
+	}); err != nil {
+		return err
+	}
+	if first.IsZero() {
+		return nil
+	}
+	if err := tx.DescendExpires(func(key, val string, expires time.Time) bool {
+		last = expires
+		return false
+	}); err != nil {
+		return err
+	}
+	pivot := first.Add(time.Duration(rand.Int63n(int64(last.Sub(first)) + 1)))
+	more := true
+	if err := tx.AscendExpires(pivot, func(key, val string, expires time.Time) bool {
+		more = iter(key, val)
+		return more
+	}); err != nil || !more {
+		return err
+	}
+	return tx.AscendExpires(time.Time{}, func(key, val string, expires time.Time) bool {
+		return expires.Before(pivot) && iter(key, val)
+	})
+}
@@ -0,0 +1,319 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestEvict(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "noeviction", evict_NOEVICTION_test)
+	runStep(t, mc, "allkeys-lru", evict_ALLKEYSLRU_test)
+	runStep(t, mc, "volatile-lru", evict_VOLATILELRU_test)
+	runStep(t, mc, "volatile-ttl", evict_VOLATILETTL_test)
+	runStep(t, mc, "allkeys-random", evict_ALLKEYSRANDOM_test)
+	runStep(t, mc, "dataset", evict_DATASET_test)
+	runStep(t, mc, "lru prune", evict_LRUPRUNE_test)
+}
+
+// mockMaxMemory sets maxmemory and the policy, and returns a function that
+// sets the used memory of the leader. The defaults are restored by the
+// returned reset function.
+func mockMaxMemory(mc *mockCluster, maxmemory int64, policy string) (used func(int64), reset func(), err error) {
+	var usage int64
+	m := mc.cs.m
+	m.usedMemory = func() int64 { return atomic.LoadInt64(&usage) }
+	reset = func() {
+		mc.Do("CONFIG", "SET", "maxmemory", 0)
+		mc.Do("CONFIG", "SET", "maxmemory-policy", "noeviction")
+		m.usedMemory = m.datasetSize
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "maxmemory", maxmemory}, {"OK"},
+		{"CONFIG", "SET", "maxmemory-policy", policy}, {"OK"},
+	}); err != nil {
+		reset()
+		return nil, nil, err
+	}
+	return func(n int64) { atomic.StoreInt64(&usage, n) }, reset, nil
+}
+
+// evictedKeys returns the evicted_keys of INFO on every server.
+func evictedKeys(mc *mockCluster) ([]string, error) {
+	var counts []string
+	for _, s := range mc.ss {
+		info, err := redis.String(s.Do("INFO", "memory"))
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(info, "\r\n") {
+			if strings.HasPrefix(line, "evicted_keys:") {
+				counts = append(counts, line[len("evicted_keys:"):])
+			}
+		}
+	}
+	return counts, nil
+}
+
+// evictExpect waits for every server to have evicted a number of keys.
+func evictExpect(mc *mockCluster, count int) error {
+	expect := strings.TrimSpace(strings.Repeat(fmt.Sprintf("%d ", count), len(mc.ss)))
+	var got string
+	for i := 0; i < 50; i++ {
+		counts, err := evictedKeys(mc)
+		if err != nil {
+			return err
+		}
+		if got = strings.Join(counts, " "); got == expect {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return fmt.Errorf("expected evicted keys '%v', got '%v'", expect, got)
+}
+
+func evict_NOEVICTION_test(mc *mockCluster) error {
+	used, reset, err := mockMaxMemory(mc, 1000, "noeviction")
+	if err != nil {
+		return err
+	}
+	defer reset()
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key1", "value"}, {"OK"},
+		{"SET", "key2", "value"}, {"OK"},
+		// only the servers send EVICTED
+		{"EVICTED", "key2"}, {"ERR unknown command 'EVICTED'"},
+		{"EVAL", "return sdb.call('evicted', 'key2')", 0}, {"ERR command not allowed from script 'evicted'"},
+		{"DBSIZE"}, {2},
+	}); err != nil {
+		return err
+	}
+	used(1001)
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key3", "value"}, {"OOM command not allowed when used memory > 'maxmemory'."},
+		{"EVAL", "return sdb.call('set', 'key3', 'value')", 0}, {"OOM command not allowed when used memory > 'maxmemory'."},
+		{"GET", "key1"}, {"value"},
+		{"DEL", "key1"}, {1},
+		{"DBSIZE"}, {1},
+		{"INFO", "memory"}, {infoContains("maxmemory:1000", "maxmemory_policy:noeviction")},
+		{"CONFIG", "SET", "maxmemory-policy", "some"}, {"ERR Invalid argument 'some' for CONFIG SET 'maxmemory-policy' - argument must be one of the following: noeviction, allkeys-lru, volatile-lru, volatile-ttl, allkeys-random"},
+	})
+}
+
+func evict_ALLKEYSLRU_test(mc *mockCluster) error {
+	counts, err := evictedKeys(mc)
+	if err != nil {
+		return err
+	}
+	var start int
+	fmt.Sscan(counts[0], &start)
+	used, reset, err := mockMaxMemory(mc, 1000, "allkeys-lru")
+	if err != nil {
+		return err
+	}
+	defer reset()
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key1", "value"}, {"OK"},
+		{"SET", "key2", "value"}, {"OK"},
+		{"SET", "key3", "value"}, {"OK"},
+		{"GET", "key1"}, {"value"},
+	}); err != nil {
+		return err
+	}
+	// one key is evicted before each write.
+	used(1001)
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key4", "value"}, {"OK"},
+		{"EXISTS", "key2"}, {0},
+		{"SET", "key5", "value"}, {"OK"},
+		{"EXISTS", "key3"}, {0},
+		{"MGET", "key1", "key4", "key5"}, {"[value value value]"},
+		{"DEL", "key1"}, {1},
+	}); err != nil {
+		return err
+	}
+	return evictExpect(mc, start+2)
+}
+
+// evictPlainKeys returns MSET args for more keys without a ttl than are
+// sampled, so the volatile policies must look at the keys with a ttl.
+func evictPlainKeys() []interface{} {
+	args := []interface{}{"MSET"}
+	for i := 0; i < evictSamples*4; i++ {
+		args = append(args, fmt.Sprintf("plain%d", i), "value")
+	}
+	return args
+}
+
+func evict_VOLATILELRU_test(mc *mockCluster) error {
+	used, reset, err := mockMaxMemory(mc, 1000, "volatile-lru")
+	if err != nil {
+		return err
+	}
+	defer reset()
+	if err := mc.DoBatch([][]interface{}{
+		evictPlainKeys(), {"OK"},
+		{"SET", "key1", "value", "EX", 100}, {"OK"},
+		{"SET", "key2", "value", "EX", 50}, {"OK"},
+		{"GET", "key2"}, {"value"},
+	}); err != nil {
+		return err
+	}
+	used(1001)
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key3", "value"}, {"OK"},
+		{"EXISTS", "key1"}, {0},
+		{"SET", "key4", "value"}, {"OK"},
+		{"EXISTS", "key2"}, {0},
+		{"SET", "key5", "value"}, {"OOM command not allowed when used memory > 'maxmemory'."},
+		{"DBSIZE"}, {evictSamples*4 + 2},
+	})
+}
+
+func evict_VOLATILETTL_test(mc *mockCluster) error {
+	used, reset, err := mockMaxMemory(mc, 1000, "volatile-ttl")
+	if err != nil {
+		return err
+	}
+	defer reset()
+	if err := mc.DoBatch([][]interface{}{
+		evictPlainKeys(), {"OK"},
+		{"SET", "key1", "value", "EX", 100}, {"OK"},
+		{"SET", "key2", "value", "EX", 50}, {"OK"},
+		{"SET", "key3", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	used(1001)
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key4", "value"}, {"OK"},
+		{"EXISTS", "key2"}, {0},
+		{"SET", "key5", "value"}, {"OK"},
+		{"EXISTS", "key1"}, {0},
+		{"SET", "key6", "value"}, {"OOM command not allowed when used memory > 'maxmemory'."},
+		{"MGET", "key3", "key4", "key5"}, {"[value value value]"},
+		{"DBSIZE"}, {evictSamples*4 + 3},
+	})
+}
+
+func evict_ALLKEYSRANDOM_test(mc *mockCluster) error {
+	used, reset, err := mockMaxMemory(mc, 1000, "allkeys-random")
+	if err != nil {
+		return err
+	}
+	defer reset()
+	if err := mc.DoBatch([][]interface{}{
+		{"MSET", "key1", "value", "key2", "value", "key3", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	used(1001)
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key4", "value"}, {"OK"},
+		{"DBSIZE"}, {3},
+		{"EXISTS", "key4"}, {1},
+	}); err != nil {
+		return err
+	}
+	// everything is evicted when the memory stays over the limit.
+	used(1 << 30)
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key5", "value"}, {"OK"},
+		{"DBSIZE"}, {1},
+	})
+}
+
+// datasetSize returns the used_memory_dataset of INFO on the leader.
+func datasetSize(mc *mockCluster) (int64, error) {
+	info, err := redis.String(mc.Do("INFO", "memory"))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(line, "used_memory_dataset:") {
+			return strconv.ParseInt(line[len("used_memory_dataset:"):], 10, 64)
+		}
+	}
+	return 0, errors.New("missing used_memory_dataset")
+}
+
+func evict_DATASET_test(mc *mockCluster) error {
+	// the real memory is used, which is the size of the dataset.
+	base, err := datasetSize(mc)
+	if err != nil {
+		return err
+	}
+	const max, vlen = 10000, 1000
+	value := strings.Repeat("x", vlen)
+	defer func() {
+		mc.Do("CONFIG", "SET", "maxmemory", 0)
+		mc.Do("CONFIG", "SET", "maxmemory-policy", "noeviction")
+	}()
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "maxmemory", base + max}, {"OK"},
+		{"CONFIG", "SET", "maxmemory-policy", "allkeys-random"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	for i := 0; i < 50; i++ {
+		if err := mc.DoBatch([][]interface{}{
+			{"SET", fmt.Sprintf("key%d", i), value}, {"OK"},
+		}); err != nil {
+			return err
+		}
+		size, err := datasetSize(mc)
+		if err != nil {
+			return err
+		}
+		// the size is over the limit by at most the last write, and the
+		// evictions free just enough for it.
+		if size > base+max+vlen*2 || (i > 20 && size < base+max-vlen*2) {
+			return fmt.Errorf("write %d: expected a dataset near %d, got %d", i, base+max, size)
+		}
+	}
+	n, err := redis.Int(mc.Do("DBSIZE"))
+	if err != nil {
+		return err
+	}
+	if n < 3 || n > max/vlen {
+		return fmt.Errorf("expected 3 to %d keys, got %d", max/vlen, n)
+	}
+	return nil
+}
+
+func evict_LRUPRUNE_test(mc *mockCluster) error {
+	m := mc.cs.m
+	defer func() {
+		mc.Do("CONFIG", "SET", "maxmemory", 0)
+		mc.Do("CONFIG", "SET", "maxmemory-policy", "noeviction")
+	}()
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "SET", "maxmemory", "1gb"}, {"OK"},
+		{"CONFIG", "SET", "maxmemory-policy", "allkeys-lru"}, {"OK"},
+		{"SET", "key1", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	// the reads of missing keys are removed from the lru.
+	for i := 0; i < evictMinPrune*3; i++ {
+		if err := mc.DoBatch([][]interface{}{
+			{"GET", fmt.Sprintf("missing%d", i)}, {nil},
+		}); err != nil {
+			return err
+		}
+	}
+	m.evict.mu.Lock()
+	n := len(m.evict.access)
+	_, ok := m.evict.access["key1"]
+	m.evict.mu.Unlock()
+	if n > evictMinPrune || !ok {
+		return fmt.Errorf("expected at most %d accesses with key1, got %d (%v)", evictMinPrune, n, ok)
+	}
+	return nil
+}
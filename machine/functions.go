@@ -0,0 +1,570 @@
+package machine
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// A function library is javascript code that registers one or more named
+// functions. The first line of the code is the library metadata:
+//
+//	#!js name=mylib
+//	sdb.registerFunction('myfunc', function(keys, args){
+//		return sdb.call('get', keys[0]);
+//	});
+//
+// Libraries are stored in the database by name, so they are replicated and
+// included in snapshots. The compiled libraries are cached by the sha of the
+// code.
+const functionKeyPrefix = sdbMetaPrefix + "function:"
+
+var errLibraryNotFound = errors.New("ERR Library not found")
+var errFunctionNotFound = errors.New("ERR Function not found")
+
+// funcLib is a loaded function library.
+type funcLib struct {
+	name  string
+	code  string
+	svm   *scriptVM  // vm that holds the registered functions
+	funcs []*libFunc // in the order they were registered
+}
+
+// libFunc is a function that was registered by a library.
+type libFunc struct {
+	name     string
+	callback scriptValue
+	noWrites bool
+}
+
+func (fn *libFunc) flags() []string {
+	if fn.noWrites {
+		return []string{"no-writes"}
+	}
+	return []string{}
+}
+
+// validFunctionName returns true if the name can be used for a library or
+// a function.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+			!(c >= '0' && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata reads the metadata line of a library. Returns the
+// library name and the code that follows the metadata. The metadata line is
+// replaced with a blank line so that line numbers in errors are unchanged.
+func parseLibraryMetadata(code string) (name, body string, err error) {
+	line := code
+	if idx := strings.IndexByte(code, '\n'); idx != -1 {
+		line, body = code[:idx], code[idx:]
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	parts := strings.Fields(line[2:])
+	if len(parts) == 0 {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	if strings.ToLower(parts[0]) != "js" {
+		return "", "", fmt.Errorf("ERR Engine '%s' not found", parts[0])
+	}
+	for _, part := range parts[1:] {
+		if !strings.HasPrefix(part, "name=") {
+			return "", "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = part[5:]
+	}
+	if name == "" {
+		return "", "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, body, nil
+}
+
+// loadLibrary compiles a library and runs its code, which registers the
+// library functions.
+func (sm *scriptMachine) loadLibrary(code string) (*funcLib, error) {
+	src := sha1.Sum([]byte(code))
+	sha := hex.EncodeToString(src[:])
+	sm.mu.Lock()
+	lib := sm.libs[sha]
+	sm.mu.Unlock()
+	if lib != nil {
+		return lib, nil
+	}
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	rt, err := sm.getEngine().newRuntime()
+	if err != nil {
+		return nil, err
+	}
+	lib = &funcLib{name: name, code: code, svm: &scriptVM{rt: rt}}
+	if err := sm.registerFunctions(lib, body); err != nil {
+		return nil, err
+	}
+	sm.mu.Lock()
+	sm.libs[sha] = lib
+	sm.mu.Unlock()
+	return lib, nil
+}
+
+// forgetLibrary removes a library from the cache.
+func (sm *scriptMachine) forgetLibrary(code string) {
+	src := sha1.Sum([]byte(code))
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.libs, hex.EncodeToString(src[:]))
+}
+
+func (sm *scriptMachine) registerFunctions(lib *funcLib, body string) (err error) {
+	rt := lib.svm.rt
+	loading := true
+	rt.setFunc("sdb", "registerFunction", func(rt scriptRuntime, args []scriptValue) scriptValue {
+		if !loading {
+			panic(scriptErrPrefix + "ERR sdb.registerFunction can only be used while a library is loading")
+		}
+		fn, err := registerFunctionArgs(rt, args)
+		if err != nil {
+			panic(scriptErrPrefix + err.Error())
+		}
+		for _, f := range lib.funcs {
+			if f.name == fn.name {
+				panic(scriptErrPrefix + "ERR Function " + fn.name + " already exists")
+			}
+		}
+		lib.funcs = append(lib.funcs, fn)
+		return nil
+	})
+	defer func() {
+		loading = false
+		if v := recover(); v != nil {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, scriptErrPrefix) {
+				err = errors.New(s[len(scriptErrPrefix):])
+				return
+			}
+			panic(v)
+		}
+	}()
+	// libraries are loaded on every server, so loading is limited like a
+	// write script, and there is no random source.
+	rt.setRandom(func() float64 {
+		panic(scriptErrPrefix + "ERR Math.random can only be used while a script is running")
+	})
+	sm.limitScript(rt, &runContext{writable: true})
+	defer rt.setLimiter(nil)
+	if err := rt.exec(body); err != nil {
+		return fmt.Errorf("ERR Error loading library: %v", err)
+	}
+	if len(lib.funcs) == 0 {
+		return errors.New("ERR No functions registered")
+	}
+	return nil
+}
+
+// registerFunctionArgs reads the arguments of a sdb.registerFunction call,
+// which is either (name, callback) or ({name, callback, flags}).
+func registerFunctionArgs(rt scriptRuntime, args []scriptValue) (*libFunc, error) {
+	var name, callback, flags scriptValue
+	arg, next := argument(rt, args, 0), argument(rt, args, 1)
+	if arg.isObject() && !arg.isFunction() {
+		name = arg.get("name")
+		callback = arg.get("callback")
+		flags = arg.get("flags")
+	} else {
+		name, callback, flags = arg, next, rt.toValue(undefined{})
+	}
+	if !name.isString() || !validFunctionName(name.String()) {
+		return nil, errors.New("ERR Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	fn := &libFunc{name: name.String(), callback: callback}
+	if !callback.isFunction() {
+		return nil, errors.New("ERR The callback for function " + fn.name + " is not a function")
+	}
+	if !flags.isUndefined() {
+		if !flags.isObject() {
+			return nil, errors.New("ERR The flags for function " + fn.name + " must be an array")
+		}
+		n := flags.length()
+		for i := 0; i < n; i++ {
+			switch flags.index(i).String() {
+			default:
+				return nil, errors.New("ERR Unknown flag given")
+			case "no-writes":
+				fn.noWrites = true
+			}
+		}
+	}
+	return fn, nil
+}
+
+// txLibraries returns all of the function libraries in the database.
+func (m *Machine) txLibraries(tx *buntdb.Tx) ([]*funcLib, error) {
+	var codes []string
+	if err := tx.AscendGreaterOrEqual("", functionKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, functionKeyPrefix) {
+			return false
+		}
+		codes = append(codes, val)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	libs := make([]*funcLib, 0, len(codes))
+	for _, code := range codes {
+		lib, err := m.sm.loadLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// checkFunctionNames returns an error if two of the libraries in the
+// database register a function with the same name.
+func (m *Machine) checkFunctionNames(tx *buntdb.Tx) error {
+	libs, err := m.txLibraries(tx)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, lib := range libs {
+		for _, fn := range lib.funcs {
+			if names[fn.name] {
+				return errors.New("ERR Function " + fn.name + " already exists")
+			}
+			names[fn.name] = true
+		}
+	}
+	return nil
+}
+
+// txSetLibrary stores a library in the database.
+func (m *Machine) txSetLibrary(tx *buntdb.Tx, lib *funcLib, replace bool) error {
+	prev, replaced, err := tx.Set(functionKeyPrefix+lib.name, lib.code, nil)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		if !replace {
+			return errors.New("ERR Library '" + lib.name + "' already exists")
+		}
+		if prev != lib.code {
+			m.sm.forgetLibrary(prev)
+		}
+	}
+	return nil
+}
+
+func (m *Machine) doFunction(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	v, err := func() (interface{}, error) {
+		switch qcmdlower(cmd.Args[1]) {
+		default:
+			return nil, finn.ErrWrongNumberOfArguments
+		case "load":
+			// FUNCTION LOAD [REPLACE] code
+			return m.doFunctionLoad(a, conn, cmd, tx)
+		case "delete":
+			// FUNCTION DELETE library
+			return m.doFunctionDelete(a, conn, cmd, tx)
+		case "list":
+			// FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+			return m.doFunctionList(a, conn, cmd, tx)
+		case "dump":
+			// FUNCTION DUMP
+			return m.doFunctionDump(a, conn, cmd, tx)
+		case "restore":
+			// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+			return m.doFunctionRestore(a, conn, cmd, tx)
+		}
+	}()
+	if err != nil {
+		if err == finn.ErrWrongNumberOfArguments {
+			err = errors.New("ERR Unknown FUNCTION subcommand or wrong # of args.")
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *Machine) doFunctionLoad(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FUNCTION LOAD [REPLACE] code
+	var replace bool
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 3:
+	case 4:
+		if qcmdlower(cmd.Args[2]) != "replace" {
+			return nil, errSyntaxError
+		}
+		replace = true
+	}
+	// load the library ahead of time so that bad code is not added to
+	// the raft log.
+	lib, err := m.sm.loadLibrary(string(cmd.Args[len(cmd.Args)-1]))
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if err := m.txSetLibrary(tx, lib, replace); err != nil {
+			return nil, err
+		}
+		if err := m.checkFunctionNames(tx); err != nil {
+			return nil, err
+		}
+		return lib.name, nil
+	}, func(v interface{}) error {
+		conn.WriteBulkString(v.(string))
+		return nil
+	})
+}
+
+func (m *Machine) doFunctionDelete(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FUNCTION DELETE library
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		code, err := tx.Delete(functionKeyPrefix + string(cmd.Args[2]))
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				return nil, errLibraryNotFound
+			}
+			return nil, err
+		}
+		m.sm.forgetLibrary(code)
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doFunctionList(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+	pattern := "*"
+	var withcode bool
+	for i := 2; i < len(cmd.Args); i++ {
+		switch qcmdlower(cmd.Args[i]) {
+		default:
+			return nil, errSyntaxError
+		case "withcode":
+			withcode = true
+		case "libraryname":
+			i++
+			if i == len(cmd.Args) {
+				return nil, errSyntaxError
+			}
+			pattern = string(cmd.Args[i])
+		}
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		libs, err := m.txLibraries(tx)
+		if err != nil {
+			return err
+		}
+		var matched []*funcLib
+		for _, lib := range libs {
+			if match.Match(lib.name, pattern) {
+				matched = append(matched, lib)
+			}
+		}
+		conn.WriteArray(len(matched))
+		for _, lib := range matched {
+			if withcode {
+				conn.WriteArray(8)
+			} else {
+				conn.WriteArray(6)
+			}
+			conn.WriteBulkString("library_name")
+			conn.WriteBulkString(lib.name)
+			conn.WriteBulkString("engine")
+			conn.WriteBulkString("JS")
+			conn.WriteBulkString("functions")
+			conn.WriteArray(len(lib.funcs))
+			for _, fn := range lib.funcs {
+				conn.WriteArray(4)
+				conn.WriteBulkString("name")
+				conn.WriteBulkString(fn.name)
+				conn.WriteBulkString("flags")
+				flags := fn.flags()
+				conn.WriteArray(len(flags))
+				for _, flag := range flags {
+					conn.WriteBulkString(flag)
+				}
+			}
+			if withcode {
+				conn.WriteBulkString("library_code")
+				conn.WriteBulkString(lib.code)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Machine) doFunctionDump(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FUNCTION DUMP
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		// the payload is a json array that contains the code of each library.
+		codes := []string{}
+		if err := tx.AscendGreaterOrEqual("", functionKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, functionKeyPrefix) {
+				return false
+			}
+			codes = append(codes, val)
+			return true
+		}); err != nil {
+			return err
+		}
+		payload, err := json.Marshal(codes)
+		if err != nil {
+			return err
+		}
+		conn.WriteBulk(payload)
+		return nil
+	})
+}
+
+func (m *Machine) doFunctionRestore(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+	policy := "append"
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 3:
+	case 4:
+		policy = qcmdlower(cmd.Args[3])
+		switch policy {
+		default:
+			return nil, errSyntaxError
+		case "flush", "append", "replace":
+		}
+	}
+	var codes []string
+	if err := json.Unmarshal(cmd.Args[2], &codes); err != nil {
+		return nil, errors.New("ERR Invalid payload")
+	}
+	var libs []*funcLib
+	for _, code := range codes {
+		lib, err := m.sm.loadLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if policy == "flush" {
+			existing, err := m.txLibraries(tx)
+			if err != nil {
+				return nil, err
+			}
+			for _, lib := range existing {
+				if _, err := tx.Delete(functionKeyPrefix + lib.name); err != nil {
+					return nil, err
+				}
+				m.sm.forgetLibrary(lib.code)
+			}
+		}
+		for _, lib := range libs {
+			if err := m.txSetLibrary(tx, lib, policy == "replace"); err != nil {
+				return nil, err
+			}
+		}
+		if err := m.checkFunctionNames(tx); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doFcall(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// FCALL function numkeys [key ...] [arg ...]
+	// FCALL_RO function numkeys [key ...] [arg ...]
+	env, user, cmd, wrapped, err := scriptEnvCommand(cmd, connUserName(conn))
+	if err != nil {
+		return nil, err
+	}
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	var writable bool
+	switch qcmdlower(cmd.Args[0]) {
+	default:
+		return nil, finn.ErrUnknownCommand
+	case "fcall":
+		writable = true
+	case "fcall_ro":
+	}
+	name := string(cmd.Args[1])
+	keys, argv, err := scriptKeysAndArgs(cmd)
+	if err != nil {
+		return nil, err
+	}
+	limitAsWrite := writable || tx != nil
+	dowr := func(tx *buntdb.Tx) (scriptValue, error) {
+		libs, err := m.txLibraries(tx)
+		if err != nil {
+			return nil, err
+		}
+		for _, lib := range libs {
+			for _, fn := range lib.funcs {
+				if fn.name != name {
+					continue
+				}
+				if !writable && !fn.noWrites {
+					return nil, errors.New("ERR Can not execute a function with write flag using FCALL_RO.")
+				}
+				return m.runScript(lib.svm, tx, limitAsWrite, callerOf(conn, user), env, nil, func(rt scriptRuntime) (scriptValue, error) {
+					return fn.callback.call(keys, argv)
+				})
+			}
+		}
+		return nil, errFunctionNotFound
+	}
+	if writable {
+		return m.writeDoApply(a, conn, wrapped, tx, func(tx *buntdb.Tx) (interface{}, error) {
+			return dowr(tx)
+		}, func(v interface{}) error {
+			return writeValToConn(v.(scriptValue), conn)
+		})
+	}
+	return m.readDoApply(a, conn, wrapped, tx, func(tx *buntdb.Tx) error {
+		v, err := dowr(tx)
+		if err != nil {
+			return err
+		}
+		return writeValToConn(v, conn)
+	})
+}
@@ -0,0 +1,107 @@
+package machine
+
+import "testing"
+
+func subTestGoja(t *testing.T, mc *mockCluster) {
+	mockScriptEngine(t, mc, "goja")
+	defer mockScriptEngine(t, mc, "otto")
+	runStep(t, mc, "basic", scripts_SIMPLE_test)
+	runStep(t, mc, "set data", scripts_SET_test)
+	runStep(t, mc, "readonly", scripts_READONLY_test)
+	runStep(t, mc, "sha", scripts_EVALSHA_test)
+	runStep(t, mc, "limits", scripts_LIMITS_test)
+	runStep(t, mc, "functions", scripts_FUNCTION_test)
+	runStep(t, mc, "deterministic", scripts_SCRIPTENV_test)
+	runStep(t, mc, "debug", scripts_DEBUG_test)
+	runStep(t, mc, "query helpers", scripts_QUERY_test)
+	runStep(t, mc, "triggers", triggers_SETTRIGGER_test)
+	runStep(t, mc, "trigger events", triggers_EVENTS_test)
+	runStep(t, mc, "es2015", goja_ES2015_test)
+	runStep(t, mc, "operations", goja_OPERATIONS_test)
+	runStep(t, mc, "sandbox", goja_SANDBOX_test)
+	runStep(t, mc, "engine", goja_ENGINE_test)
+}
+
+// mockScriptEngine sets the script engine of the cluster, and waits for
+// every server to use it.
+func mockScriptEngine(t *testing.T, mc *mockCluster, name string) {
+	if _, err := mc.Do("CONFIG", "SET", "scriptengine", name); err != nil {
+		t.Fatal(err)
+	}
+	if err := configExpect(mc, "scriptengine", name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func goja_ES2015_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"EVAL", `const [a, b] = KEYS; let {x = 1, ...rest} = {y: 2}; return a + b + x + rest.y`, 2, "k1", "k2"}, {"k1k212"},
+		{"EVAL", "return `${ARGV[0]}-${ARGV.map(s => s.toUpperCase()).join('')}`", 0, "a", "b"}, {"a-AB"},
+		{"EVAL", `class P { constructor(n){ this.n = n } get twice(){ return this.n * 2 } }; return new P(21).twice`, 0}, {42},
+		{"EVAL", `let s = 0; for (const v of new Set([1, 2, 2, 3])) s += v; return s`, 0}, {6},
+		{"EVAL", `return Array.from(new Map([["a", 1]]).keys())`, 0}, {"[a]"},
+		{"SET", "g1", "10"}, {"OK"},
+		{"SETINDEX", "gidx", "g*", "EVAL", `(a, b) => Number(a) < Number(b)`}, {"OK"},
+		{"SET", "g2", "9"}, {"OK"},
+		{"ITER", "gidx"}, {"[g2 9 g1 10]"},
+		{"DELINDEX", "gidx"}, {1},
+	})
+}
+
+func goja_OPERATIONS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		// loop bodies that are not blocks
+		{"EVAL", `var n = 0; for (var i = 0; i < 10; i++) n++; return n`, 0}, {10},
+		{"EVAL", `var n = 0; while (n < 10) n++
+return n`, 0}, {10},
+		{"EVAL", `var n = 0; do n++; while (n < 10); return n`, 0}, {10},
+		{"EVAL", `var n = 0; for (var k in {a: 1, b: 2}) if (k) n++; else n--; return n`, 0}, {2},
+		{"EVAL", `for (const v of [1, 2, 3]) if (v == 2) return v; return 0`, 0}, {2},
+		{"EVAL", `var f = x => x * 2; var g = function(x){ return f(x) + 1 }; return g(20)`, 0}, {41},
+		{"EVAL", `outer: for (;;) for (;;) break outer; return 1`, 0}, {1},
+		// infinite loops and recursion are aborted
+		{"EVAL", `for (;;);`, 0}, {"ERR Script exceeded the limit of 1000000 operations"},
+		{"EVAL", `do ; while (true)`, 0}, {"ERR Script exceeded the limit of 1000000 operations"},
+		{"EVAL", `var f = () => { f() }; try { f() } catch (e) {}; for (;;) {}`, 0}, {"ERR Script exceeded the limit of 1000000 operations"},
+		{"EVALRO", `for (;;) {}`, 0}, {"ERR Script exceeded the time limit of 500ms"},
+		// the runtime can be used again after a script was aborted
+		{"EVAL", `var i = 0; while (i < 1000) { i++ }; return i`, 0}, {1000},
+	})
+}
+
+func goja_SANDBOX_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"EVAL", `return eval("1")`, 0}, {"Error: eval is not available"},
+		{"EVAL", `return new Function("return 1")()`, 0}, {"Error: Function is not available"},
+		{"EVAL", `return (function(){}).constructor("return 1")()`, 0}, {"Error: Function is not available"},
+		{"EVAL", `return (async function(){}).constructor("return 1")()`, 0}, {"Error: Function is not available"},
+		{"EVAL", `with ({}) {}; return 1`, 0}, {"with statements are not supported"},
+		{"EVAL", `return Object.getOwnPropertyNames(this).filter(function(n){ return n.indexOf("sdbop") != -1 }).length`, 0}, {0},
+		{"EVAL", `var __sdbop = function(){}; while (true) {}`, 0}, {"the name '__sdbop' is reserved"},
+		{"EVAL", `function f(__sdbop) {}; return 1`, 0}, {"the name '__sdbop' is reserved"},
+		{"EVAL", `return typeof __sdbop`, 0}, {"the name '__sdbop' is reserved"},
+	})
+}
+
+func goja_ENGINE_test(mc *mockCluster) error {
+	defer mc.Do("CONFIG", "SET", "scriptengine", "goja")
+	if err := mc.DoBatch([][]interface{}{
+		{"CONFIG", "GET", "scriptengine"}, {"[scriptengine goja]"},
+		{"EVAL", "return typeof Symbol", 0}, {"function"},
+		{"CONFIG", "SET", "scriptengine", "v8"}, {"ERR Invalid argument 'v8' for CONFIG SET 'scriptengine' - argument must be one of the following: otto, goja"},
+		{"SET", "g1", "10"}, {"OK"},
+		{"SET", "g2", "9"}, {"OK"},
+		{"SETINDEX", "gidx", "g*", "EVAL", `(a, b) => Number(a) < Number(b)`}, {"OK"},
+		// otto can't compile the arrow function of the index
+		{"CONFIG", "SET", "scriptengine", "otto"}, {"ERR Invalid argument 'otto' for CONFIG SET 'scriptengine' - the eval index 'gidx' can't be compiled: (anonymous): Line 1:3 Invalid left-hand side in assignment (and 1 more errors)"},
+		{"CONFIG", "GET", "scriptengine"}, {"[scriptengine goja]"},
+		{"SETINDEX", "gidx", "g*", "EVAL", `function(a, b){ return Number(a) < Number(b) }`}, {"OK"},
+		{"CONFIG", "SET", "scriptengine", "otto"}, {"OK"},
+		{"ITER", "gidx"}, {"[g2 9 g1 10]"},
+		{"EVAL", "return typeof Symbol", 0}, {"undefined"},
+		{"DELINDEX", "gidx"}, {1},
+	}); err != nil {
+		return err
+	}
+	return configExpect(mc, "scriptengine", "otto")
+}
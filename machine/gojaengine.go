@@ -0,0 +1,644 @@
+package machine
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/file"
+	"github.com/dop251/goja/parser"
+)
+
+func init() {
+	// the local time of Date must be the same on every server, or write
+	// scripts would produce different values on each replica.
+	goja.DateLocation = time.UTC
+}
+
+// gojaEngine runs javascript with goja, which supports ES2015+ and is much
+// faster than otto.
+//
+// Goja does not have a hook that is called for each operation, so the code
+// of scripts and libraries is instrumented with a call to an op function at
+// the start of every loop body and function body. An operation is then a
+// loop iteration or a function call. Code that is created at runtime can't
+// be instrumented, so eval and the Function constructor are not available,
+// and neither is the with statement, which could hide the op function.
+//
+// The op function is a global constant, which is not a property of the
+// global object, and scripts that use its name are rejected, so scripts
+// can't call, replace, or shadow it. The name is the same on every server.
+type gojaEngine struct {
+	host scriptHost
+}
+
+// gojaOpName is the name of the op function.
+const gojaOpName = "__sdbop"
+
+func newGojaEngine(host scriptHost) *gojaEngine {
+	return &gojaEngine{host: host}
+}
+
+// gojaPrelude removes eval and the Function constructors.
+const gojaPrelude = `
+	(function(global){
+		var deny = function(name){
+			return function(){
+				throw new Error(name + " is not available");
+			}
+		}
+		global.eval = deny("eval");
+		var protos = [
+			Object.getPrototypeOf(function(){}),
+			Object.getPrototypeOf(function*(){}),
+			Object.getPrototypeOf(async function(){})
+		];
+		for (var i = 0; i < protos.length; i++) {
+			var F = deny("Function");
+			F.prototype = protos[i];
+			Object.defineProperty(protos[i], "constructor", {value: F, writable: true, configurable: true});
+		}
+		global.Function = protos[0].constructor;
+	})(this);
+`
+
+// gojaRuntime is a goja vm.
+type gojaRuntime struct {
+	vm      *goja.Runtime
+	limiter func()
+}
+
+func (e *gojaEngine) newRuntime() (scriptRuntime, error) {
+	rt := &gojaRuntime{vm: goja.New()}
+	vm := rt.vm
+	if _, err := vm.RunString(scriptPrelude + gojaPrelude); err != nil {
+		return nil, err
+	}
+	op := vm.ToValue(func(goja.FunctionCall) goja.Value {
+		if rt.limiter != nil {
+			rt.limiter()
+		}
+		return goja.Undefined()
+	})
+	// the op function is passed through a temporary property, because a
+	// constant can only be declared by a script.
+	vm.Set("__sdbopinit", op)
+	if _, err := vm.RunString("const " + gojaOpName + " = __sdbopinit; delete this.__sdbopinit;"); err != nil {
+		return nil, err
+	}
+	proto := vm.Get("SummitDB").ToObject(vm).Get("prototype").ToObject(vm)
+	for path, fn := range e.host {
+		obj, name := splitHostName(path)
+		if obj == "sdb" {
+			if err := proto.Set(name, rt.wrap(fn)); err != nil {
+				return nil, err
+			}
+		} else {
+			rt.setFunc(obj, name, fn)
+		}
+	}
+	if now := e.host["sdb.now"]; now != nil {
+		vm.SetTimeSource(func() time.Time {
+			ms := int64(now(rt, nil).toFloat())
+			return time.Unix(0, ms*int64(time.Millisecond))
+		})
+	}
+	return rt, nil
+}
+
+func (e *gojaEngine) compileLess(script string) (func(a, b string) bool, error) {
+	vm := goja.New()
+	v, err := vm.RunString("(" + script + ")")
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(v)
+	if !ok {
+		return nil, errExpectingFunction
+	}
+	var mu sync.Mutex
+	return func(a, b string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		res, err := fn(goja.Undefined(), vm.ToValue(a), vm.ToValue(b))
+		if err != nil {
+			return false
+		}
+		return res.ToBoolean()
+	}, nil
+}
+
+func (rt *gojaRuntime) wrap(fn hostFunc) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		args := make([]scriptValue, len(call.Arguments))
+		for i, arg := range call.Arguments {
+			args[i] = rt.value(arg)
+		}
+		v := fn(rt, args)
+		if v == nil {
+			return goja.Undefined()
+		}
+		return v.(*gojaValue).v
+	}
+}
+
+func (rt *gojaRuntime) value(v goja.Value) *gojaValue {
+	if v == nil {
+		v = goja.Undefined()
+	}
+	return &gojaValue{rt: rt, v: v}
+}
+
+func (rt *gojaRuntime) compile(src string) (scriptProgram, error) {
+	src, err := instrumentScript("(function(){"+src+"})()", gojaOpName)
+	if err != nil {
+		return nil, err
+	}
+	return goja.Compile("", src, false)
+}
+
+func (rt *gojaRuntime) run(prog scriptProgram) (scriptValue, error) {
+	v, err := rt.vm.RunProgram(prog.(*goja.Program))
+	if err != nil {
+		return nil, gojaError(err)
+	}
+	return rt.value(v), nil
+}
+
+func (rt *gojaRuntime) exec(src string) error {
+	src, err := instrumentScript(src, gojaOpName)
+	if err != nil {
+		return err
+	}
+	_, err = rt.vm.RunString(src)
+	return gojaError(err)
+}
+
+// gojaError returns the error of a javascript exception as the thrown value,
+// like otto, instead of with the location of the throw.
+func gojaError(err error) error {
+	if ex, ok := err.(*goja.Exception); ok && ex.Value() != nil {
+		return errors.New(ex.Value().String())
+	}
+	return err
+}
+
+func (rt *gojaRuntime) get(name string) scriptValue {
+	return rt.value(rt.vm.Get(name))
+}
+
+func (rt *gojaRuntime) set(name string, v interface{}) {
+	rt.vm.Set(name, rt.toValue(v).(*gojaValue).v)
+}
+
+func (rt *gojaRuntime) setFunc(obj, name string, fn hostFunc) {
+	v := rt.vm.Get(obj)
+	if v == nil || goja.IsUndefined(v) {
+		v = rt.vm.NewObject()
+		rt.vm.Set(obj, v)
+	}
+	v.ToObject(rt.vm).Set(name, rt.wrap(fn))
+}
+
+func (rt *gojaRuntime) toValue(v interface{}) scriptValue {
+	switch v := v.(type) {
+	case nil:
+		return rt.value(goja.Null())
+	case undefined:
+		return rt.value(goja.Undefined())
+	case *gojaValue:
+		return v
+	case statusReply:
+		return rt.reply("statusReply", string(v))
+	case errorReply:
+		return rt.reply("errorReply", string(v))
+	case []string:
+		vals := make([]interface{}, len(v))
+		for i, s := range v {
+			vals[i] = s
+		}
+		return rt.value(rt.vm.NewArray(vals...))
+	case []interface{}:
+		vals := make([]interface{}, len(v))
+		for i, item := range v {
+			vals[i] = rt.toValue(item).(*gojaValue).v
+		}
+		return rt.value(rt.vm.NewArray(vals...))
+	case map[string]interface{}:
+		// the keys are sorted so that the objects are the same on every
+		// server.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		obj := rt.vm.NewObject()
+		for _, key := range keys {
+			obj.Set(key, rt.toValue(v[key]).(*gojaValue).v)
+		}
+		return rt.value(obj)
+	}
+	return rt.value(rt.vm.ToValue(v))
+}
+
+// reply calls sdb.statusReply or sdb.errorReply.
+func (rt *gojaRuntime) reply(name, s string) scriptValue {
+	sdb := rt.vm.Get("sdb").ToObject(rt.vm)
+	fn, _ := goja.AssertFunction(sdb.Get(name))
+	v, err := fn(sdb, rt.vm.ToValue(s))
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	return rt.value(v)
+}
+
+func (rt *gojaRuntime) parseJSON(s string) (scriptValue, error) {
+	parse, _ := goja.AssertFunction(rt.vm.Get("JSON").ToObject(rt.vm).Get("parse"))
+	v, err := parse(goja.Undefined(), rt.vm.ToValue(s))
+	if err != nil {
+		return nil, err
+	}
+	return rt.value(v), nil
+}
+
+func (rt *gojaRuntime) setRandom(fn func() float64) {
+	rt.vm.SetRandSource(goja.RandSource(fn))
+}
+
+func (rt *gojaRuntime) id() interface{} {
+	return rt.vm
+}
+
+func (rt *gojaRuntime) setLimiter(fn func()) {
+	rt.limiter = fn
+}
+
+// gojaValue is a goja value.
+type gojaValue struct {
+	rt *gojaRuntime
+	v  goja.Value
+}
+
+func (v *gojaValue) isUndefined() bool {
+	return goja.IsUndefined(v.v)
+}
+
+func (v *gojaValue) isNull() bool {
+	return goja.IsNull(v.v)
+}
+
+func (v *gojaValue) isBoolean() bool {
+	_, ok := v.primitive().(bool)
+	return ok
+}
+
+func (v *gojaValue) isNumber() bool {
+	switch v.primitive().(type) {
+	case int64, float64:
+		return true
+	}
+	return false
+}
+
+func (v *gojaValue) isString() bool {
+	_, ok := v.primitive().(string)
+	return ok
+}
+
+// primitive returns the exported value of a primitive, or nil for objects.
+func (v *gojaValue) primitive() interface{} {
+	if v.isObject() {
+		return nil
+	}
+	return v.v.Export()
+}
+
+func (v *gojaValue) isObject() bool {
+	_, ok := v.v.(*goja.Object)
+	return ok
+}
+
+func (v *gojaValue) isArray() bool {
+	obj, ok := v.v.(*goja.Object)
+	return ok && obj.ClassName() == "Array"
+}
+
+func (v *gojaValue) isFunction() bool {
+	_, ok := goja.AssertFunction(v.v)
+	return ok
+}
+
+func (v *gojaValue) toBoolean() bool {
+	return v.v.ToBoolean()
+}
+
+func (v *gojaValue) toFloat() float64 {
+	return v.v.ToFloat()
+}
+
+func (v *gojaValue) String() string {
+	return v.v.String()
+}
+
+func (v *gojaValue) get(name string) scriptValue {
+	obj, ok := v.v.(*goja.Object)
+	if !ok {
+		return v.rt.value(nil)
+	}
+	return v.rt.value(obj.Get(name))
+}
+
+func (v *gojaValue) length() int {
+	return int(v.get("length").(*gojaValue).v.ToInteger())
+}
+
+func (v *gojaValue) index(i int) scriptValue {
+	return v.get(strconv.FormatInt(int64(i), 10))
+}
+
+func (v *gojaValue) call(args ...interface{}) (scriptValue, error) {
+	fn, ok := goja.AssertFunction(v.v)
+	if !ok {
+		return nil, errors.New("not a function")
+	}
+	vals := make([]goja.Value, len(args))
+	for i, arg := range args {
+		vals[i] = v.rt.toValue(arg).(*gojaValue).v
+	}
+	res, err := fn(goja.Undefined(), vals...)
+	if err != nil {
+		return nil, gojaError(err)
+	}
+	return v.rt.value(res), nil
+}
+
+func (v *gojaValue) json() (string, error) {
+	vm := v.rt.vm
+	stringify, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	res, err := stringify(goja.Undefined(), v.v)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func (v *gojaValue) export() interface{} {
+	return v.v.Export()
+}
+
+// instrumentScript inserts a call to the op function at the start of every
+// loop body and function body. Loop bodies that are not blocks are wrapped
+// in a block. Scripts that use the name of the op function are rejected.
+func instrumentScript(src, opName string) (string, error) {
+	prg, err := parser.ParseFile(nil, "", src, 0)
+	if err != nil {
+		// the compiler reports the error
+		return src, nil
+	}
+	call := opName + "();"
+	type insertion struct {
+		pos   int
+		text  string
+		close bool
+	}
+	var ins []insertion
+	var werr error
+	// loopBody instruments the body of a loop. The file.Idx of a node is the
+	// byte offset plus one, and the body follows the header at offset after.
+	loopBody := func(after int, body ast.Statement) {
+		switch body := body.(type) {
+		case *ast.BlockStatement:
+			ins = append(ins, insertion{pos: int(body.LeftBrace), text: call})
+			return
+		case *ast.EmptyStatement:
+			ins = append(ins, insertion{pos: int(body.Semicolon) - 1, text: "{" + call})
+			ins = append(ins, insertion{pos: int(body.Semicolon), text: "}", close: true})
+			return
+		}
+		// the parser does not record the start of some statements, such as
+		// an if statement, so the body starts after the rest of the header.
+		start := skipSource(src, after, ");")
+		ins = append(ins, insertion{pos: start, text: "{" + call})
+		ins = append(ins, insertion{pos: stmtEnd(src, body), text: "}", close: true})
+	}
+	walkAST(reflect.ValueOf(prg), func(n ast.Node) {
+		switch n := n.(type) {
+		case *ast.WithStatement:
+			werr = errors.New("with statements are not supported")
+		case *ast.Identifier:
+			if string(n.Name) == opName {
+				werr = errors.New("the name '" + opName + "' is reserved")
+			}
+		case *ast.FunctionLiteral:
+			if n.Body != nil {
+				ins = append(ins, insertion{pos: int(n.Body.LeftBrace), text: call})
+			}
+		case *ast.ArrowFunctionLiteral:
+			if block, ok := n.Body.(*ast.BlockStatement); ok {
+				ins = append(ins, insertion{pos: int(block.LeftBrace), text: call})
+			}
+		case *ast.ForStatement:
+			after := astEnd(n.Initializer)
+			if end := astEnd(n.Test); end > after {
+				after = end
+			}
+			if end := astEnd(n.Update); end > after {
+				after = end
+			}
+			if after == 0 {
+				// for(;;) skips the keyword and the paren
+				after = skipSource(src, int(n.For)+2, "") + 1
+			} else {
+				after--
+			}
+			loopBody(after, n.Body)
+		case *ast.ForInStatement:
+			loopBody(astEnd(n.Source)-1, n.Body)
+		case *ast.ForOfStatement:
+			loopBody(astEnd(n.Source)-1, n.Body)
+		case *ast.WhileStatement:
+			loopBody(astEnd(n.Test)-1, n.Body)
+		case *ast.DoWhileStatement:
+			if _, ok := n.Body.(*ast.BlockStatement); ok {
+				loopBody(0, n.Body)
+				break
+			}
+			// the parser does not record the start of a do statement, so
+			// the call goes into the test, as in "while (op(), test)".
+			i := skipSource(src, stmtEnd(src, n.Body), "")
+			if strings.HasPrefix(src[i:], "while") {
+				i = skipSource(src, i+5, "")
+			}
+			if i == len(src) || src[i] != '(' {
+				werr = errors.New("unable to instrument the do statement")
+				break
+			}
+			ins = append(ins, insertion{pos: i + 1, text: opName + "(),"})
+		}
+	})
+	if werr != nil {
+		return "", werr
+	}
+	// blocks that end at the same position as others start are closed first.
+	sort.SliceStable(ins, func(i, j int) bool {
+		if ins[i].pos != ins[j].pos {
+			return ins[i].pos < ins[j].pos
+		}
+		return ins[i].close && !ins[j].close
+	})
+	var out strings.Builder
+	var pos int
+	for _, in := range ins {
+		out.WriteString(src[pos:in.pos])
+		out.WriteString(in.text)
+		pos = in.pos
+	}
+	out.WriteString(src[pos:])
+	return out.String(), nil
+}
+
+// walkAST calls fn for every node in the tree.
+func walkAST(v reflect.Value, fn func(n ast.Node)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || !isASTType(v.Type().Elem()) {
+			return
+		}
+		if n, ok := v.Interface().(ast.Node); ok {
+			fn(n)
+		}
+		walkAST(v.Elem(), fn)
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkAST(v.Elem(), fn)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkAST(v.Index(i), fn)
+		}
+	case reflect.Struct:
+		if !isASTType(v.Type()) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			// the declaration lists repeat the nodes of the body.
+			if f.PkgPath != "" || f.Name == "DeclarationList" {
+				continue
+			}
+			walkAST(v.Field(i), fn)
+		}
+	}
+}
+
+func isASTType(t reflect.Type) bool {
+	return strings.HasSuffix(t.PkgPath(), "dop251/goja/ast")
+}
+
+// astEnd returns the file.Idx that follows a node. The Idx1 of some nodes
+// is not the end of the node, such as a return statement with an argument,
+// so this is the greatest end of the node and of its children.
+func astEnd(n interface{}) int {
+	var end int
+	if n == nil {
+		return 0
+	}
+	walkAST(reflect.ValueOf(n), func(n ast.Node) {
+		if idx := astIdx1(n); idx > end {
+			end = idx
+		}
+	})
+	walkIdx(reflect.ValueOf(n), func(idx file.Idx) {
+		if int(idx)+1 > end {
+			end = int(idx) + 1
+		}
+	})
+	return end
+}
+
+// stmtEnd returns the offset that follows a statement, including the
+// closing parens and the semicolon of the statement.
+func stmtEnd(src string, n ast.Statement) int {
+	end := astEnd(n) - 1
+	for i := skipSource(src, end, ""); i < len(src) && src[i] == ')'; i = skipSource(src, end, "") {
+		end = i + 1
+	}
+	if i := skipSource(src, end, ""); i < len(src) && src[i] == ';' {
+		end = i + 1
+	}
+	return end
+}
+
+// skipSource returns the offset of the first character at or after i that
+// is not whitespace, a comment, or one of the chars.
+func skipSource(src string, i int, chars string) int {
+	for i < len(src) {
+		switch {
+		case strings.IndexByte(" \t\r\n\v\f", src[i]) != -1,
+			strings.IndexByte(chars, src[i]) != -1:
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return len(src)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// astIdx1 returns the Idx1 of a node, which panics for some empty nodes.
+func astIdx1(n ast.Node) (idx int) {
+	defer func() {
+		if recover() != nil {
+			idx = 0
+		}
+	}()
+	return int(n.Idx1())
+}
+
+// walkIdx calls fn for every file.Idx field in the tree.
+func walkIdx(v reflect.Value, fn func(idx file.Idx)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() && isASTType(v.Type().Elem()) {
+			walkIdx(v.Elem(), fn)
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkIdx(v.Elem(), fn)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkIdx(v.Index(i), fn)
+		}
+	case reflect.Struct:
+		if !isASTType(v.Type()) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" || f.Name == "DeclarationList" {
+				continue
+			}
+			if idx, ok := v.Field(i).Interface().(file.Idx); ok {
+				fn(idx)
+				continue
+			}
+			walkIdx(v.Field(i), fn)
+		}
+	}
+}
@@ -55,7 +55,7 @@ func (m *Machine) doHset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return 0, err
 		}
-		_, _, err = tx.Set(key, json, nil)
+		err = m.txSet(conn, tx, key, json, nil)
 		if err != nil {
 			return 0, err
 		}
@@ -86,7 +86,7 @@ func (m *Machine) doHmset(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				return nil, err
 			}
 		}
-		_, _, err = tx.Set(key, json, nil)
+		err = m.txSet(conn, tx, key, json, nil)
 		if err != nil {
 			return nil, err
 		}
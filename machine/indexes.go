@@ -2,11 +2,9 @@ package machine
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strings"
 
-	"github.com/robertkrimen/otto"
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/collate"
 	"github.com/tidwall/finn"
@@ -160,23 +158,69 @@ func indexRectPath(path string) func(s string) (min, max []float64) {
 	}
 }
 
-func indexEval(script string) (lesser func(a, b string) bool, err error) {
-	vm := otto.New()
-	val, err := vm.Eval("(" + script + ")")
-	if err != nil {
+// txIndexDefs returns the definitions of the indexes.
+func txIndexDefs(tx *buntdb.Tx) ([]indexArgs, error) {
+	var metas []string
+	if err := tx.AscendGreaterOrEqual("", indexKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, indexKeyPrefix) {
+			return false
+		}
+		metas = append(metas, key, val)
+		return true
+	}); err != nil {
 		return nil, err
 	}
-	if !val.IsFunction() {
-		return nil, errors.New("ERR expecting a function")
+	var defs []indexArgs
+	for i := 0; i < len(metas); i += 2 {
+		var rargs indexArgs
+		if err := json.Unmarshal([]byte(metas[i+1]), &rargs); err != nil {
+			return nil, fmt.Errorf("parsing index '%v': %v", metas[i][len(indexKeyPrefix):], err)
+		}
+		defs = append(defs, rargs)
+	}
+	return defs, nil
+}
+
+// txSetScriptEngine replaces the script engine and rebuilds the eval
+// indexes with it. Nothing is changed when the function of an eval index
+// can't be compiled with the new engine.
+func (m *Machine) txSetScriptEngine(tx *buntdb.Tx, name string) error {
+	engine, err := newScriptEngine(name, m.sm.host)
+	if err != nil {
+		return err
+	}
+	defs, err := txIndexDefs(tx)
+	if err != nil {
+		return err
+	}
+	var evals []indexArgs
+	for _, rargs := range defs {
+		var eval bool
+		for _, idx := range rargs.Indexes {
+			if idx.Kind != "eval" {
+				continue
+			}
+			if _, err := engine.compileLess(idx.Script); err != nil {
+				return fmt.Errorf("the eval index '%s' can't be compiled: %v", rargs.Name, err)
+			}
+			eval = true
+		}
+		if eval {
+			evals = append(evals, rargs)
+		}
+	}
+	m.sm.useEngine(name, engine)
+	for _, rargs := range evals {
+		if err := m.dbSetIndex(tx, rargs); err != nil {
+			return err
+		}
 	}
-	return func(a, b string) bool {
-		res, _ := val.Call(otto.Value{}, a, b)
-		t, _ := res.ToBoolean()
-		return t
-	}, nil
+	return nil
 }
 
-func dbSetIndex(tx *buntdb.Tx, rargs indexArgs) error {
+// dbSetIndex creates the index. The function of an eval index is compiled
+// with the script engine.
+func (m *Machine) dbSetIndex(tx *buntdb.Tx, rargs indexArgs) error {
 	// execute
 	if err := tx.DropIndex(rargs.Name); err != nil && err != buntdb.ErrNotFound {
 		return err
@@ -218,7 +262,7 @@ func dbSetIndex(tx *buntdb.Tx, rargs indexArgs) error {
 				}
 			case "eval":
 				var err error
-				lesser, err = indexEval(idx.Script)
+				lesser, err = m.sm.getEngine().compileLess(idx.Script)
 				if err != nil {
 					return err
 				}
@@ -260,7 +304,7 @@ func (m *Machine) doSetIndex(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 		return nil, err
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-		if err := dbSetIndex(tx, rargs); err != nil {
+		if err := m.dbSetIndex(tx, rargs); err != nil {
 			return nil, err
 		}
 		return nil, nil
@@ -0,0 +1,281 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// infoSections are the sections of INFO in the order that they're written.
+var infoSections = []string{
+	"server", "clients", "memory", "persistence", "replication", "keyspace",
+}
+
+// SetVersion sets the server version that is reported by INFO.
+func (m *Machine) SetVersion(version string) {
+	m.version = version
+}
+
+func (m *Machine) doInfo(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// INFO [section ...]
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	sections := make(map[string]bool)
+	if len(cmd.Args) == 1 {
+		sections["default"] = true
+	}
+	for _, arg := range cmd.Args[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	all := sections["all"] || sections["default"] || sections["everything"]
+	var buf []byte
+	for _, section := range infoSections {
+		if !all && !sections[section] {
+			continue
+		}
+		var fields [][2]string
+		var err error
+		switch section {
+		case "server":
+			fields = m.infoServer()
+		case "clients":
+			fields = m.infoClients()
+		case "memory":
+			fields = m.infoMemory()
+		case "persistence":
+			fields, err = m.infoPersistence(a)
+		case "replication":
+			fields = m.infoReplication(a)
+		case "keyspace":
+			fields, err = m.infoKeyspace()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			buf = append(buf, "\r\n"...)
+		}
+		buf = append(buf, "# "+strings.ToUpper(section[:1])+section[1:]+"\r\n"...)
+		for _, field := range fields {
+			buf = append(buf, field[0]+":"+field[1]+"\r\n"...)
+		}
+	}
+	conn.WriteBulk(buf)
+	return nil, nil
+}
+
+func (m *Machine) infoServer() [][2]string {
+	uptime := time.Now().Sub(m.start)
+	var port string
+	if _, p, err := net.SplitHostPort(m.addr); err == nil {
+		port = p
+	}
+	return [][2]string{
+		{"summitdb_version", m.version},
+		{"go_version", runtime.Version()},
+		{"os", runtime.GOOS},
+		{"arch", runtime.GOARCH},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", port},
+		{"uptime_in_seconds", strconv.FormatInt(int64(uptime/time.Second), 10)},
+		{"uptime_in_days", strconv.FormatInt(int64(uptime/(time.Hour*24)), 10)},
+	}
+}
+
+func (m *Machine) infoClients() [][2]string {
+	return [][2]string{
+		{"connected_clients", strconv.Itoa(m.clientCount())},
+	}
+}
+
+func (m *Machine) infoMemory() [][2]string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	maxMemory := uint64(atomic.LoadInt64(&m.maxMemory))
+	dataset := uint64(m.datasetSize())
+	return [][2]string{
+		{"used_memory", strconv.FormatUint(ms.HeapAlloc, 10)},
+		{"used_memory_human", humanBytes(ms.HeapAlloc)},
+		{"used_memory_sys", strconv.FormatUint(ms.Sys, 10)},
+		{"used_memory_sys_human", humanBytes(ms.Sys)},
+		{"used_memory_dataset", strconv.FormatUint(dataset, 10)},
+		{"used_memory_dataset_human", humanBytes(dataset)},
+		{"maxmemory", strconv.FormatUint(maxMemory, 10)},
+		{"maxmemory_human", humanBytes(maxMemory)},
+		{"maxmemory_policy", m.maxMemoryPolicy()},
+		{"evicted_keys", strconv.FormatInt(atomic.LoadInt64(&m.evict.evicted), 10)},
+		{"mem_allocator", "go"},
+		{"num_gc", strconv.FormatUint(uint64(ms.NumGC), 10)},
+	}
+}
+
+func (m *Machine) infoPersistence(a finn.Applier) ([][2]string, error) {
+	m.mu.RLock()
+	file := m.file
+	m.mu.RUnlock()
+	var aofEnabled, aofSize int64
+	if file != "" {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		aofEnabled, aofSize = 1, fi.Size()
+	}
+	var encryption int
+	if m.cipher != nil {
+		encryption = 1
+	}
+	fields := [][2]string{
+		{"aof_enabled", strconv.FormatInt(aofEnabled, 10)},
+		{"aof_current_size", strconv.FormatInt(aofSize, 10)},
+		{"encryption_enabled", strconv.Itoa(encryption)},
+	}
+	if ri, ok := a.(finn.RaftInfo); ok {
+		stats := ri.RaftStats()
+		fields = append(fields,
+			[2]string{"last_snapshot_index", stats["last_snapshot_index"]},
+			[2]string{"last_snapshot_term", stats["last_snapshot_term"]},
+		)
+	}
+	return fields, nil
+}
+
+func (m *Machine) infoReplication(a finn.Applier) [][2]string {
+	ri, ok := a.(finn.RaftInfo)
+	if !ok {
+		return [][2]string{{"role", "master"}}
+	}
+	stats := ri.RaftStats()
+	// the raft leader is reported as a master, like redis.
+	role := "slave"
+	if stats["state"] == "Leader" {
+		role = "master"
+	}
+	fields := [][2]string{
+		{"role", role},
+		{"raft_state", stats["state"]},
+		{"raft_leader", ri.RaftLeader()},
+		{"raft_term", stats["term"]},
+		{"raft_commit_index", stats["commit_index"]},
+		{"raft_applied_index", stats["applied_index"]},
+		{"raft_last_log_index", stats["last_log_index"]},
+		{"raft_suffrage", stats["suffrage"]},
+		{"raft_nonvoters", stats["num_nonvoters"]},
+	}
+	peers := ri.RaftPeers()
+	sort.Strings(peers)
+	fields = append(fields, [2]string{"raft_peers", strconv.Itoa(len(peers))})
+	for i, peer := range peers {
+		fields = append(fields, [2]string{"raft_peer" + strconv.Itoa(i), peer})
+	}
+	return fields
+}
+
+func (m *Machine) infoKeyspace() ([][2]string, error) {
+	ks, err := m.keyspaceStats()
+	if err != nil {
+		return nil, err
+	}
+	fields := [][2]string{{"db0",
+		fmt.Sprintf("keys=%d,expires=%d", ks.keys, ks.expires)}}
+	for _, idx := range ks.indexes {
+		fields = append(fields, [2]string{"index_" + idx.name,
+			fmt.Sprintf("pattern=%s,keys=%d", idx.pattern, idx.keys)})
+	}
+	return fields, nil
+}
+
+// keyspace are the counts of the keys in the database.
+type keyspace struct {
+	keys    int
+	expires int
+	indexes []keyspaceIndex
+}
+
+type keyspaceIndex struct {
+	name    string
+	pattern string
+	keys    int // number of keys that match the index pattern
+}
+
+// keyspaceStats returns the number of keys and expiring keys, and the number
+// of keys in each index. The meta keys are not counted.
+func (m *Machine) keyspaceStats() (keyspace, error) {
+	var ks keyspace
+	err := m.db.View(func(tx *buntdb.Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		expires, err := tx.ExpiresLen()
+		if err != nil {
+			return err
+		}
+		var indexes []indexArgs
+		var ierr error
+		nversions, err := versionKeysLen(tx)
+		if err != nil {
+			return err
+		}
+		n -= nversions
+		if err := ascendMeta(tx, func(key, val string) bool {
+			n--
+			if strings.HasPrefix(key, indexKeyPrefix) {
+				var iargs indexArgs
+				if err := json.Unmarshal([]byte(val), &iargs); err != nil {
+					ierr = fmt.Errorf("parsing index '%v': %v", key[len(indexKeyPrefix):], err)
+					return false
+				}
+				indexes = append(indexes, iargs)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if ierr != nil {
+			return ierr
+		}
+		ks.keys, ks.expires = n, expires
+		for _, iargs := range indexes {
+			count, err := tx.IndexLen(iargs.Name)
+			if err != nil {
+				if err == buntdb.ErrNotFound {
+					continue
+				}
+				return err
+			}
+			ks.indexes = append(ks.indexes,
+				keyspaceIndex{name: iargs.Name, pattern: iargs.Pattern, keys: count})
+		}
+		return nil
+	})
+	return ks, err
+}
+
+// humanBytes returns a size like redis, such as "1.50M".
+func humanBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	return strconv.FormatFloat(f, 'f', 2, 64) + units[i]
+}
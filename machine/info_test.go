@@ -0,0 +1,68 @@
+package machine
+
+import (
+	"strings"
+	"testing"
+)
+
+func subTestInfo(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "sections", info_SECTIONS_test)
+	runStep(t, mc, "keyspace", info_KEYSPACE_test)
+	runStep(t, mc, "replication", info_REPLICATION_test)
+}
+
+// infoContains expects an INFO response that contains all of the lines.
+func infoContains(lines ...string) func(v interface{}) (resp, expect interface{}) {
+	return func(v interface{}) (resp, expect interface{}) {
+		s, _ := v.(string)
+		for _, line := range lines {
+			if !strings.Contains(s, line) {
+				return s, line
+			}
+		}
+		return true, true
+	}
+}
+
+// infoSectionNames returns the section names of an INFO response.
+func infoSectionNames(v interface{}) (resp, expect interface{}) {
+	s, _ := v.(string)
+	var names []string
+	for _, line := range strings.Split(s, "\r\n") {
+		if strings.HasPrefix(line, "# ") {
+			names = append(names, line[2:])
+		}
+	}
+	return strings.Join(names, ","), "Server,Clients,Memory,Persistence,Replication,Keyspace"
+}
+
+func info_SECTIONS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"INFO"}, {infoSectionNames},
+		{"INFO", "ALL"}, {infoSectionNames},
+		{"INFO", "server"}, {infoContains("# Server\r\n", "summitdb_version:", "uptime_in_seconds:", "process_id:")},
+		{"INFO", "clients"}, {infoContains("# Clients\r\n", "connected_clients:")},
+		{"INFO", "memory"}, {infoContains("# Memory\r\n", "used_memory:", "used_memory_human:")},
+		{"INFO", "persistence"}, {infoContains("# Persistence\r\n", "aof_enabled:1", "aof_current_size:", "encryption_enabled:0", "last_snapshot_index:")},
+		{"INFO", "unknown"}, {""},
+	})
+}
+
+func info_KEYSPACE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"INFO", "keyspace"}, {"# Keyspace\r\ndb0:keys=0,expires=0\r\n"},
+		{"SET", "user:1", "Tom"}, {"OK"},
+		{"SET", "user:2", "Jane", "EX", 100}, {"OK"},
+		{"SET", "item:1", "Pen"}, {"OK"},
+		{"SETINDEX", "users", "user:*", "TEXT"}, {"OK"},
+		{"INFO", "keyspace"}, {"# Keyspace\r\ndb0:keys=3,expires=1\r\nindex_users:pattern=user:*,keys=2\r\n"},
+		{"DELINDEX", "users"}, {1},
+	})
+}
+
+func info_REPLICATION_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key", "value"}, {"OK"}, // moves to the leader
+		{"INFO", "replication"}, {infoContains("# Replication\r\n", "role:master\r\n", "raft_state:Leader\r\n", "raft_peers:3\r\n", "raft_commit_index:")},
+	})
+}
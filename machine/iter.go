@@ -152,7 +152,18 @@ func parseIterArgs(bargs [][]byte) (
 
 func (m *Machine) iterateIndex(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx) (results []string, err error) {
 	// ITER index [PIVOT value] [RANGE min max] [LIMIT limit] [DESC|ASC]
+	err = m.walkIndex(rargs, tx, func(key, val string) bool {
+		results = append(results, key, val)
+		return true
+	})
+	return
+}
+
+// walkIndex calls fn for each item of the index that matches the iter args.
+// Returning false from fn stops the iteration.
+func (m *Machine) walkIndex(rargs *iterArgs, tx *buntdb.Tx, fn func(key, val string) bool) (err error) {
 	//var min, max string
+	var n int // number of items passed to fn
 	var l less.Less
 	var pivoton bool
 	var pivot string
@@ -163,7 +174,7 @@ func (m *Machine) iterateIndex(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx)
 		if isMercMetaKey(key) {
 			return true
 		}
-		if rargs.limiton && len(results) >= rargs.limit*2 {
+		if rargs.limiton && n >= rargs.limit {
 			return false
 		}
 
@@ -258,8 +269,8 @@ func (m *Machine) iterateIndex(rargs *iterArgs, conn redcon.Conn, tx *buntdb.Tx)
 			return true
 		}
 
-		results = append(results, key, val)
-		return true
+		n++
+		return fn(key, val)
 	}
 
 	err = func() error {
@@ -1,6 +1,8 @@
 package machine
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -12,8 +14,8 @@ import (
 )
 
 func (m *Machine) doJget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	// JGET key path
-	if len(cmd.Args) != 3 {
+	// JGET key path [path ...]
+	if len(cmd.Args) < 3 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
@@ -25,30 +27,153 @@ func (m *Machine) doJget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			}
 			return err
 		}
-		res := gjson.Get(val, string(cmd.Args[2]))
-		if !res.Exists() {
-			conn.WriteNull()
+		if len(cmd.Args) == 3 {
+			res := gjson.Get(val, string(cmd.Args[2]))
+			if !res.Exists() {
+				conn.WriteNull()
+				return nil
+			}
+			conn.WriteBulkString(res.String())
 			return nil
 		}
-		conn.WriteBulkString(res.String())
+		// multiple paths are returned as a json object that maps each
+		// path to its result.
+		paths := make([]string, 0, len(cmd.Args)-2)
+		for i := 2; i < len(cmd.Args); i++ {
+			paths = append(paths, string(cmd.Args[i]))
+		}
+		conn.WriteBulk(jsonPathsObject(val, paths))
+		return nil
+	})
+}
+
+// jsonPathsObject returns a json object where each path is mapped to the
+// raw gjson result. Missing results are null.
+func jsonPathsObject(doc string, paths []string) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '{')
+	for i, path := range paths {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, path)
+		buf = append(buf, ':')
+		res := gjson.Get(doc, path)
+		if res.Exists() {
+			buf = append(buf, res.Raw...)
+		} else {
+			buf = append(buf, "null"...)
+		}
+	}
+	buf = append(buf, '}')
+	return buf
+}
+
+// appendJSONString appends a json encoded string.
+func appendJSONString(buf []byte, s string) []byte {
+	data, _ := json.Marshal(s)
+	return append(buf, data...)
+}
+
+func (m *Machine) doJmget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// JMGET path key [key ...]
+	if len(cmd.Args) < 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	path := string(cmd.Args[1])
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		vals := make([]*string, 0, len(cmd.Args)-2)
+		for i := 2; i < len(cmd.Args); i++ {
+			val, err := tx.Get(string(cmd.Args[i]))
+			if err != nil {
+				if err == buntdb.ErrNotFound {
+					vals = append(vals, nil)
+					continue
+				}
+				return err
+			}
+			res := gjson.Get(val, path)
+			if !res.Exists() {
+				vals = append(vals, nil)
+				continue
+			}
+			s := res.String()
+			vals = append(vals, &s)
+		}
+		conn.WriteArray(len(vals))
+		for _, val := range vals {
+			if val == nil {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulkString(*val)
+			}
+		}
 		return nil
 	})
 }
+
+func (m *Machine) doPljget(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// PLJGET key path [key path ...]
+	if len(cmd.Args) < 3 || (len(cmd.Args)-1)%2 == 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		vals := make([]*string, 0, (len(cmd.Args)-1)/2)
+		for i := 1; i < len(cmd.Args); i += 2 {
+			val, err := tx.Get(string(cmd.Args[i]))
+			if err != nil {
+				if err == buntdb.ErrNotFound {
+					vals = append(vals, nil)
+					continue
+				}
+				return err
+			}
+			res := gjson.Get(val, string(cmd.Args[i+1]))
+			if !res.Exists() {
+				vals = append(vals, nil)
+				continue
+			}
+			s := res.String()
+			vals = append(vals, &s)
+		}
+		for _, val := range vals {
+			if val == nil {
+				conn.WriteNull()
+			} else {
+				conn.WriteBulkString(*val)
+			}
+		}
+		return nil
+	})
+}
+
 func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	// JSET key path value [RAW]
-	var raw, str bool
-	switch len(cmd.Args) {
-	default:
+	// JSET key path value [RAW|STR] [IFEQ value] [IFVER version]
+	if len(cmd.Args) < 4 {
 		return nil, finn.ErrWrongNumberOfArguments
-	case 4:
-	case 5:
-		switch qcmdlower(cmd.Args[4]) {
+	}
+	var raw, str bool
+	var cond writeCond
+	for i := 4; i < len(cmd.Args); i++ {
+		switch qcmdlower(cmd.Args[i]) {
 		default:
 			return nil, errSyntaxError
 		case "raw":
+			if raw || str {
+				return nil, errSyntaxError
+			}
 			raw = true
 		case "str":
+			if raw || str {
+				return nil, errSyntaxError
+			}
 			str = true
+		case "ifeq", "ifver":
+			n, err := cond.parse(cmd.Args, i)
+			if err != nil {
+				return nil, err
+			}
+			i += n - 1
 		}
 	}
 	key := string(cmd.Args[1])
@@ -69,6 +194,9 @@ func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		}
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if ok, err := cond.check(tx, key); err != nil || !ok {
+			return nil, err
+		}
 		json, err := tx.Get(key)
 		if err != nil && err != buntdb.ErrNotFound {
 			return nil, err
@@ -83,13 +211,17 @@ func (m *Machine) doJset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return nil, fmt.Errorf("ERR %v", err)
 		}
-		_, _, err = tx.Set(key, json, nil)
+		err = m.txSetJSON(conn, tx, key, json, nil)
 		if err != nil {
 			return nil, err
 		}
-		return nil, nil
+		return "OK", nil
 	}, func(v interface{}) error {
-		conn.WriteString("OK")
+		if v == nil {
+			conn.WriteNull()
+		} else {
+			conn.WriteString(v.(string))
+		}
 		return nil
 	})
 }
@@ -113,7 +245,7 @@ func (m *Machine) doJdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			return nil, fmt.Errorf("ERR %v", err)
 		}
 		if res != json {
-			_, _, err = tx.Set(key, res, nil)
+			err = m.txSetJSON(conn, tx, key, res, nil)
 			if err != nil {
 				return nil, err
 			}
@@ -126,3 +258,40 @@ func (m *Machine) doJdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	})
 	return nil, nil
 }
+
+func (m *Machine) doJpatch(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// JPATCH key patch
+	if len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	key := string(cmd.Args[1])
+	ops, err := parseJSONPatch(cmd.Args[2])
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		val, err := tx.Get(key)
+		if err != nil {
+			if err != buntdb.ErrNotFound {
+				return nil, err
+			}
+			// like JSET, a missing document starts as an empty object
+			val = "{}"
+		}
+		if !json.Valid([]byte(val)) {
+			return nil, errors.New("ERR value is not valid JSON")
+		}
+		// if any operation fails then nothing is written.
+		doc, err := applyJSONPatch(val, ops)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.txSetJSON(conn, tx, key, doc, nil); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
@@ -6,6 +6,8 @@ func subTestJSON(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "JSET", json_JSET_test)
 	runStep(t, mc, "JGET", json_JGET_test)
 	runStep(t, mc, "JDEL", json_JDEL_test)
+	runStep(t, mc, "JMGET", json_JMGET_test)
+	runStep(t, mc, "JPATCH", json_JPATCH_test)
 }
 
 func json_JSET_test(mc *mockCluster) error {
@@ -13,6 +15,13 @@ func json_JSET_test(mc *mockCluster) error {
 		{"JSET", "user:101", "name", "Tom"}, {"OK"},
 		{"JSET", "user:101", "age", 46}, {"OK"},
 		{"GET", "user:101"}, {`{"age":46,"name":"Tom"}`},
+		{"JSET", "user:101", "age", 47, "IFEQ", `{"age":45,"name":"Tom"}`}, {nil},
+		{"JSET", "user:101", "age", 47, "IFEQ", `{"age":46,"name":"Tom"}`}, {"OK"},
+		{"JSET", "user:101", "name", "Tom", "STR", "IFVER", 0}, {nil},
+		{"JSET", "user:102", "name", "Jane", "IFVER", 0}, {"OK"},
+		{"JSET", "user:101", "age", 48, "RAW", "STR"}, {"ERR syntax error"},
+		{"GET", "user:101"}, {`{"age":47,"name":"Tom"}`},
+		{"DEL", "user:102"}, {1},
 	})
 }
 func json_JGET_test(mc *mockCluster) error {
@@ -23,6 +32,8 @@ func json_JGET_test(mc *mockCluster) error {
 		{"JGET", "user:101", "age"}, {"46"},
 		{"JSET", "user:101", "a.b.c", "hello"}, {"OK"},
 		{"GET", "user:101"}, {`{"a":{"b":{"c":"hello"}},"age":46,"name":"Tom"}`},
+		{"JGET", "user:101", "age", "a.b", "name", "missing"}, {`{"age":46,"a.b":{"c":"hello"},"name":"Tom","missing":null}`},
+		{"JGET", "user:102", "age", "name"}, {nil},
 	})
 }
 func json_JDEL_test(mc *mockCluster) error {
@@ -37,3 +48,54 @@ func json_JDEL_test(mc *mockCluster) error {
 		{"GET", "user:101"}, {`{"a":{},"age":46,"name":"Tom"}`},
 	})
 }
+func json_JMGET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"JSET", "user:101", "name", "Tom"}, {"OK"},
+		{"JSET", "user:102", "name", "Janet"}, {"OK"},
+		{"JSET", "user:103", "age", 28}, {"OK"},
+		{"JMGET", "name", "user:101", "user:102", "user:103", "user:104"}, {"[Tom Janet nil nil]"},
+		{"JMGET", "name"}, {"ERR wrong number of arguments for 'JMGET' command"},
+	})
+}
+func json_JPATCH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "user:101", `{"name":"Tom","age":46,"tags":["a","c"],"a/b":{"~c":1}}`}, {"OK"},
+		{"JPATCH", "user:101", `[
+			{"op":"test","path":"/age","value":46.0},
+			{"op":"replace","path":"/age","value":47},
+			{"op":"add","path":"/tags/1","value":"b"},
+			{"op":"add","path":"/tags/-","value":"d"},
+			{"op":"remove","path":"/tags/0"},
+			{"op":"copy","from":"/name","path":"/nick"},
+			{"op":"move","from":"/a~1b/~0c","path":"/c"}
+		]`}, {"OK"},
+		{"GET", "user:101"}, {`{"c":1,"nick":"Tom","name":"Tom","age":47,"tags":["b","c","d"],"a/b":{}}`},
+		{"JPATCH", "user:101", `[
+			{"op":"replace","path":"/age","value":48},
+			{"op":"test","path":"/name","value":"Janet"}
+		]`}, {"ERR patch test failed at operation 1 for path '/name'"},
+		{"JPATCH", "user:101", `[{"op":"remove","path":"/missing"}]`}, {"ERR patch operation 0 (remove '/missing') failed: path not found"},
+		{"JPATCH", "user:101", `[{"op":"add","path":"/tags/9","value":1}]`}, {"ERR patch operation 0 (add '/tags/9') failed: path not found"},
+		{"JPATCH", "user:101", `[{"op":"move","from":"/tags","path":"/tags/0"}]`}, {"ERR patch operation 0 (move '/tags/0') failed: cannot move a value into one of its children"},
+		{"JPATCH", "user:101", `[{"op":"jump","path":"/age"}]`}, {"ERR invalid patch: operation 0 has unknown op 'jump'"},
+		{"JPATCH", "user:101", `{}`}, {"ERR invalid patch: expected an array of operations"},
+		{"JGET", "user:101", "age"}, {"47"},
+		{"JPATCH", "user:102", `[{"op":"add","path":"/name","value":{"first":"Janet"}}]`}, {"OK"},
+		{"GET", "user:102"}, {`{"name":{"first":"Janet"}}`},
+		{"SET", "user:103", "not json"}, {"OK"},
+		{"JPATCH", "user:103", `[]`}, {"ERR value is not valid JSON"},
+		// keys with the characters of gjson paths
+		{"SET", "user:104", `{"a.b":{"c*":[]},"x":{"k":1,"l":[2]}}`}, {"OK"},
+		{"JPATCH", "user:104", `[
+			{"op":"add","path":"/a.b/c*/-","value":1},
+			{"op":"add","path":"/a.b/c*/0","value":0},
+			{"op":"test","path":"/x","value":{"l":[2.0],"k":1}},
+			{"op":"replace","path":"/x/l","value":"#"},
+			{"op":"remove","path":"/x/k"}
+		]`}, {"OK"},
+		{"GET", "user:104"}, {`{"a.b":{"c*":[0,1]},"x":{"l":"#"}}`},
+		{"JPATCH", "user:104", `[{"op":"add","path":"/x/","value":1}]`}, {"ERR invalid patch: operation 0 has an unsupported empty key in pointer '/x/'"},
+		{"JPATCH", "user:104", `[{"op":"replace","path":"","value":[1,3]},{"op":"add","path":"/1","value":2}]`}, {"OK"},
+		{"GET", "user:104"}, {`[1,2,3]`},
+	})
+}
@@ -0,0 +1,352 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// The JSON Pointers of a JPATCH are converted into gjson paths, and the
+// document is changed with sjson, like JSET and JDEL.
+
+// jsonPatchOp is a single RFC 6902 operation.
+type jsonPatchOp struct {
+	op    string
+	path  string
+	from  string
+	value string // raw json
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its unescaped
+// reference tokens.
+func parseJSONPointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer '%s'", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, token := range tokens {
+		if token == "" {
+			// sjson can't set a key without a name.
+			return nil, fmt.Errorf("unsupported empty key in pointer '%s'", ptr)
+		}
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// escapePathKey escapes the characters of an object key that have a meaning
+// in a gjson path.
+func escapePathKey(key string) string {
+	var buf []byte
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\', '.', '*', '?', '#', '|', '@', '!', ':', '=', '<', '>', '%':
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, key[i])
+	}
+	return string(buf)
+}
+
+// joinPath appends a component to a gjson path. An empty path is the root.
+func joinPath(path, part string) string {
+	if path == "" {
+		return part
+	}
+	return path + "." + part
+}
+
+// arrayIndex parses an array index token. The '-' token is only allowed
+// when appending and refers to the position after the last item.
+func arrayIndex(token string, length int, appending bool) (int, bool) {
+	if token == "-" && appending {
+		return length, true
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(token, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	if appending {
+		return int(n), int(n) <= length
+	}
+	return int(n), int(n) < length
+}
+
+func jsonIsArray(res gjson.Result) bool {
+	return res.Type == gjson.JSON && strings.HasPrefix(res.Raw, "[")
+}
+
+func jsonIsObject(res gjson.Result) bool {
+	return res.Type == gjson.JSON && strings.HasPrefix(res.Raw, "{")
+}
+
+var errPatchPathNotFound = errors.New("path not found")
+
+// jsonPointerGet returns the value referenced by the tokens, and its gjson
+// path.
+func jsonPointerGet(doc string, tokens []string) (gjson.Result, string, error) {
+	res := gjson.Parse(doc)
+	var path string
+	for _, token := range tokens {
+		switch {
+		case jsonIsObject(res):
+			part := escapePathKey(token)
+			res = res.Get(part)
+			if !res.Exists() {
+				return res, "", errPatchPathNotFound
+			}
+			path = joinPath(path, part)
+		case jsonIsArray(res):
+			items := res.Array()
+			idx, ok := arrayIndex(token, len(items), false)
+			if !ok {
+				return res, "", errPatchPathNotFound
+			}
+			res = items[idx]
+			path = joinPath(path, strconv.Itoa(idx))
+		default:
+			return res, "", errPatchPathNotFound
+		}
+	}
+	return res, path, nil
+}
+
+// jsonSetRaw sets the raw value at the gjson path. An empty path replaces
+// the document.
+func jsonSetRaw(doc, path, raw string) (string, error) {
+	if path == "" {
+		return raw, nil
+	}
+	return sjson.SetRaw(doc, path, raw)
+}
+
+func jsonPointerAdd(doc string, tokens []string, raw string) (string, error) {
+	if len(tokens) == 0 {
+		return raw, nil
+	}
+	parent, path, err := jsonPointerGet(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return "", err
+	}
+	token := tokens[len(tokens)-1]
+	switch {
+	case jsonIsObject(parent):
+		return sjson.SetRaw(doc, joinPath(path, escapePathKey(token)), raw)
+	case jsonIsArray(parent):
+		items := parent.Array()
+		idx, ok := arrayIndex(token, len(items), true)
+		if !ok {
+			return "", errPatchPathNotFound
+		}
+		if idx == len(items) {
+			return sjson.SetRaw(doc, joinPath(path, "-1"), raw)
+		}
+		// sjson can't insert an item, so the array is set again.
+		arr := []byte{'['}
+		for i, item := range items {
+			if i == idx {
+				arr = append(arr, raw...)
+				arr = append(arr, ',')
+			}
+			arr = append(arr, item.Raw...)
+			if i < len(items)-1 {
+				arr = append(arr, ',')
+			}
+		}
+		arr = append(arr, ']')
+		return jsonSetRaw(doc, path, string(arr))
+	}
+	return "", errPatchPathNotFound
+}
+
+func jsonPointerRemove(doc string, tokens []string) (string, error) {
+	if len(tokens) == 0 {
+		return "", errors.New("cannot remove the root")
+	}
+	_, path, err := jsonPointerGet(doc, tokens)
+	if err != nil {
+		return "", err
+	}
+	return sjson.Delete(doc, path)
+}
+
+func jsonPointerReplace(doc string, tokens []string, raw string) (string, error) {
+	_, path, err := jsonPointerGet(doc, tokens)
+	if err != nil {
+		return "", err
+	}
+	return jsonSetRaw(doc, path, raw)
+}
+
+// equalJSON returns true if both values are equal json values. Objects are
+// compared without regard to key order and numbers are compared by value.
+func equalJSON(a, b gjson.Result) bool {
+	switch {
+	case jsonIsArray(a):
+		if !jsonIsArray(b) {
+			return false
+		}
+		aitems, bitems := a.Array(), b.Array()
+		if len(aitems) != len(bitems) {
+			return false
+		}
+		for i := range aitems {
+			if !equalJSON(aitems[i], bitems[i]) {
+				return false
+			}
+		}
+		return true
+	case jsonIsObject(a):
+		if !jsonIsObject(b) {
+			return false
+		}
+		amap, bmap := a.Map(), b.Map()
+		if len(amap) != len(bmap) {
+			return false
+		}
+		for key, av := range amap {
+			bv, ok := bmap[key]
+			if !ok || !equalJSON(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case gjson.Number:
+		return a.Num == b.Num
+	case gjson.String:
+		return a.Str == b.Str
+	}
+	return true
+}
+
+// parseJSONPatch parses an RFC 6902 JSON Patch document.
+func parseJSONPatch(data []byte) ([]jsonPatchOp, error) {
+	if !json.Valid(data) {
+		return nil, errors.New("ERR invalid patch: not valid JSON")
+	}
+	patch := gjson.Parse(string(data))
+	if !jsonIsArray(patch) {
+		return nil, errors.New("ERR invalid patch: expected an array of operations")
+	}
+	items := patch.Array()
+	ops := make([]jsonPatchOp, 0, len(items))
+	for i, item := range items {
+		if !jsonIsObject(item) {
+			return nil, fmt.Errorf("ERR invalid patch: operation %d is not an object", i)
+		}
+		var op jsonPatchOp
+		var err error
+		member := func(name string, required bool) (string, error) {
+			v := item.Get(name)
+			if !v.Exists() {
+				if required {
+					return "", fmt.Errorf("ERR invalid patch: operation %d is missing '%s'", i, name)
+				}
+				return "", nil
+			}
+			if v.Type != gjson.String {
+				return "", fmt.Errorf("ERR invalid patch: operation %d '%s' must be a string", i, name)
+			}
+			return v.Str, nil
+		}
+		if op.op, err = member("op", true); err != nil {
+			return nil, err
+		}
+		if op.path, err = member("path", true); err != nil {
+			return nil, err
+		}
+		if _, err := parseJSONPointer(op.path); err != nil {
+			return nil, fmt.Errorf("ERR invalid patch: operation %d has an %v", i, err)
+		}
+		switch op.op {
+		default:
+			return nil, fmt.Errorf("ERR invalid patch: operation %d has unknown op '%s'", i, op.op)
+		case "add", "replace", "test":
+			val := item.Get("value")
+			if !val.Exists() {
+				return nil, fmt.Errorf("ERR invalid patch: operation %d is missing 'value'", i)
+			}
+			op.value = val.Raw
+		case "remove":
+		case "move", "copy":
+			if op.from, err = member("from", true); err != nil {
+				return nil, err
+			}
+			if _, err := parseJSONPointer(op.from); err != nil {
+				return nil, fmt.Errorf("ERR invalid patch: operation %d has an %v", i, err)
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// applyJSONPatch applies all operations to the document. If any operation
+// fails then an error is returned and the document should be discarded.
+func applyJSONPatch(doc string, ops []jsonPatchOp) (string, error) {
+	for i, op := range ops {
+		path, _ := parseJSONPointer(op.path)
+		var err error
+		switch op.op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, path, op.value)
+		case "remove":
+			doc, err = jsonPointerRemove(doc, path)
+		case "replace":
+			doc, err = jsonPointerReplace(doc, path, op.value)
+		case "move":
+			if op.from == op.path {
+				break
+			}
+			if strings.HasPrefix(op.path, op.from+"/") {
+				err = errors.New("cannot move a value into one of its children")
+				break
+			}
+			from, _ := parseJSONPointer(op.from)
+			var val gjson.Result
+			if val, _, err = jsonPointerGet(doc, from); err != nil {
+				break
+			}
+			if doc, err = jsonPointerRemove(doc, from); err != nil {
+				break
+			}
+			doc, err = jsonPointerAdd(doc, path, val.Raw)
+		case "copy":
+			from, _ := parseJSONPointer(op.from)
+			var val gjson.Result
+			if val, _, err = jsonPointerGet(doc, from); err != nil {
+				break
+			}
+			doc, err = jsonPointerAdd(doc, path, val.Raw)
+		case "test":
+			var val gjson.Result
+			if val, _, err = jsonPointerGet(doc, path); err != nil {
+				break
+			}
+			if !equalJSON(val, gjson.Parse(op.value)) {
+				return "", fmt.Errorf("ERR patch test failed at operation %d for path '%s'", i, op.path)
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("ERR patch operation %d (%s '%s') failed: %v", i, op.op, op.path, err)
+		}
+	}
+	return doc, nil
+}
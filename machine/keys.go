@@ -73,7 +73,7 @@ func (m *Machine) doPdel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			if isMercMetaKey(key) {
 				continue
 			}
-			_, err := tx.Delete(key)
+			_, err := m.txDelete(conn, tx, key)
 			if err != nil {
 				if err == buntdb.ErrNotFound {
 					continue
@@ -132,7 +132,7 @@ func (m *Machine) doRestore(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 			opts.Expires = true
 			opts.TTL = ttl
 		}
-		_, _, err := tx.Set(key, string(cmd.Args[3]), opts)
+		err := m.txSet(conn, tx, key, string(cmd.Args[3]), opts)
 		if err != nil {
 			return nil, err
 		}
@@ -182,14 +182,14 @@ func (m *Machine) doRename(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				return nil, err
 			}
 		}
-		val, err := tx.Delete(key)
+		val, err := m.txDelete(conn, tx, key)
 		if err != nil {
 			if err == buntdb.ErrNotFound {
 				return nil, errors.New("ERR no such key")
 			}
 			return nil, err
 		}
-		_, _, err = tx.Set(newkey, val, nil)
+		err = m.txSet(conn, tx, newkey, val, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -234,6 +234,9 @@ func (m *Machine) doPersist(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 		if err != nil {
 			return nil, err
 		}
+		if err := m.touchKey(tx, key); err != nil {
+			return nil, err
+		}
 		return 1, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -316,6 +319,9 @@ func (m *Machine) doExpire(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		if err != nil {
 			return nil, err
 		}
+		if err := m.touchKey(tx, key); err != nil {
+			return nil, err
+		}
 		return 1, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -325,13 +331,20 @@ func (m *Machine) doExpire(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 
 func (m *Machine) doDel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
 	// DEL key [key ...]
+	// EXPIRED key [key ...]
 	if len(cmd.Args) < 2 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
+	// EXPIRED is sent by the leader when keys expire, and EVICTED when keys
+	// are evicted for maxmemory.
+	event := "del"
+	if qcmdlower(cmd.Args[0]) == "expired" {
+		event = "expire"
+	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		var n int
 		for i := 1; i < len(cmd.Args); i++ {
-			_, err := tx.Delete(string(cmd.Args[i]))
+			_, err := m.txDeleteEvent(conn, tx, event, string(cmd.Args[i]))
 			if err != nil {
 				if err == buntdb.ErrNotFound {
 					continue
@@ -340,6 +353,7 @@ func (m *Machine) doDel(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 			}
 			n++
 		}
+		m.evictForget(cmd.Args[1:])
 		return n, nil
 	}, func(v interface{}) error {
 		conn.WriteInt(v.(int))
@@ -371,6 +385,7 @@ func (m *Machine) doFlushdb(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 				}
 			}
 		}
+		m.evictForgetAll()
 		return nil, nil
 	}, func(v interface{}) error {
 		conn.WriteString("OK")
@@ -105,7 +105,7 @@ func (m *Machine) doLpush(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			}
 		}
 		result = int(gjson.Get(json, "#").Int())
-		_, _, err = tx.Set(key, json, nil)
+		err = m.txSet(conn, tx, key, json, nil)
 		if err != nil {
 			return result, err
 		}
@@ -136,7 +136,7 @@ func (m *Machine) doLpop(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return nil, err
 		}
-		_, _, err = tx.Set(key, json, nil)
+		err = m.txSet(conn, tx, key, json, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -176,7 +176,7 @@ func (m *Machine) doRpoplpush(a finn.Applier, conn redcon.Conn, cmd redcon.Comma
 		if err != nil {
 			return nil, err
 		}
-		_, _, err = tx.Set(source, sourceJson, nil)
+		err = m.txSet(conn, tx, source, sourceJson, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -193,7 +193,7 @@ func (m *Machine) doRpoplpush(a finn.Applier, conn redcon.Conn, cmd redcon.Comma
 		if err != nil {
 			return nil, err
 		}
-		_, _, err = tx.Set(destination, destJson, nil)
+		err = m.txSet(conn, tx, destination, destJson, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -263,7 +263,7 @@ func (m *Machine) doLrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return effected, fmt.Errorf("ERR: %v", err)
 		}
-		_, _, err = tx.Set(key, string(jsonByte), nil)
+		err = m.txSet(conn, tx, key, string(jsonByte), nil)
 		if err != nil {
 			return effected, err
 		}
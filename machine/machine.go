@@ -2,6 +2,7 @@ package machine
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,8 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
@@ -24,14 +27,51 @@ type Machine struct {
 	mu   sync.RWMutex
 	db   *buntdb.DB
 	file string
+
+	schemas  defCache // compiled schemas
+	triggers defCache // parsed triggers
+	acl      aclCache
+
+	internalPass string      // password of the connection that expires keys
+	tlsConfig    *tls.Config // used to connect to the server, nil for tcp
+	cipher       *Cipher     // encrypts the data at rest, nil for plaintext
+
+	version string    // server version for INFO
+	start   time.Time // when the machine started
+
+	connsMu    sync.Mutex
+	conns      map[int64]redcon.Conn // client connections by id
+	lastConnID int64
+	pause      clientPause
+
+	metrics *metricsRegistry // counters and histograms of the server
+	slowlog slowlog          // slow commands on this server
+
+	config     configState // CONFIG GET and CONFIG SET
+	maxMemory  int64       // maximum bytes of the database, zero for no limit
+	maxClients int64       // maximum client connections, zero for no limit
+
+	evict      evictState   // evicts keys over maxmemory
+	usedMemory func() int64 // memory that is compared to maxmemory
+
+	shutdown shutdownState // SHUTDOWN and the drain of the connections
 }
 
 func New(log finn.Logger, addr string) (*Machine, error) {
-	m := &Machine{log: log, addr: addr}
+	m := &Machine{log: log, addr: addr, internalPass: newInternalPass(),
+		start: time.Now(), metrics: newMetricsRegistry(),
+		conns: make(map[int64]redcon.Conn)}
+	m.config.base = make(map[string]string)
+	m.evict.policy = evictNoEviction
+	m.evict.access = make(map[string]int64)
+	m.evict.pruneAt = evictMinPrune
+	m.usedMemory = m.datasetSize
 	err := m.reopenBlankDB(nil, func(keys []string) { m.onExpired(keys) })
 	if err != nil {
 		return nil, err
 	}
+	m.slowlog.slowerThan = defaultSlowlogSlowerThan
+	m.slowlog.maxLen = defaultSlowlogMaxLen
 	m.sm, err = newScriptMachine(m)
 	if err != nil {
 		m.Close()
@@ -40,6 +80,16 @@ func New(log finn.Logger, addr string) (*Machine, error) {
 	return m, nil
 }
 
+// SetScriptTimeLimit sets the time limit for read-only scripts. Zero means
+// no limit. The operation limit of write scripts must be the same on every
+// server, so it's only changed with CONFIG SET scriptoplimit, which goes
+// through the raft log.
+func (m *Machine) SetScriptTimeLimit(timeLimit time.Duration) {
+	m.sm.mu.Lock()
+	defer m.sm.mu.Unlock()
+	m.sm.timeLimit = timeLimit
+}
+
 func (m *Machine) Close() error {
 	return m.db.Close()
 }
@@ -56,14 +106,24 @@ func (m *Machine) onExpired(keys []string) {
 	// Failures are ignored, but logged.
 	err := func() error {
 		m.log.Debugf("expire: %v", keys)
-		conn, err := net.Dial("tcp", m.addr)
+		var conn net.Conn
+		var err error
+		if m.tlsConfig != nil {
+			conn, err = tls.Dial("tcp", m.addr, m.tlsConfig)
+		} else {
+			conn, err = net.Dial("tcp", m.addr)
+		}
 		if err != nil {
 			return err
 		}
 		defer conn.Close()
 		wr := redcon.NewWriter(conn)
+		wr.WriteArray(3)
+		wr.WriteBulkString("auth")
+		wr.WriteBulkString(aclInternalUser)
+		wr.WriteBulkString(m.internalPass)
 		wr.WriteArray(len(keys) + 1)
-		wr.WriteBulkString("del")
+		wr.WriteBulkString("expired")
 		for i := 0; i < len(keys); i++ {
 			wr.WriteBulkString(keys[i])
 		}
@@ -72,6 +132,14 @@ func (m *Machine) onExpired(keys []string) {
 			return err
 		}
 		rd := bufio.NewReader(conn)
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) != "+OK" {
+			m.log.Debugf("expired: auth failed: %v", strings.TrimSpace(line))
+			return nil
+		}
 		c, err := rd.ReadByte()
 		if err != nil {
 			return err
@@ -102,36 +170,31 @@ func (m *Machine) onExpired(keys []string) {
 }
 
 type connContext struct {
-	multi *multiContext
-}
+	multi     *multiContext
+	watch     map[string]uint64 // watched keys and their versions
+	watchbase uint64            // version counter at the first WATCH
+	user      string            // authenticated user, or empty for the default user
+	path      string            // path of the running command, for the slowlog
+	read      readConsistency   // consistency of the reads, set by CONSISTENCY
 
-func (m *Machine) ConnAccept(conn redcon.Conn) bool {
-	conn.SetContext(&connContext{})
-	return true
-}
-
-func (m *Machine) ConnClosed(conn redcon.Conn, err error) {
+	id       int64     // client id
+	created  time.Time // when the client connected
+	rejected bool      // over the maxclients limit
+	draining bool      // accepted while the server was being drained
 
+	mu   sync.Mutex
+	info clientInfo // read by other connections
 }
+
 func (m *Machine) reopenBlankDB(rd io.Reader, onExpired func(keys []string)) error {
-	dir, err := ioutil.TempDir("", "summitdb")
-	if err != nil {
-		return err
-	}
-	file := path.Join(dir, "data.db")
-	if rd != nil {
-		f, err := os.Create(file)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		if _, err := io.Copy(f, rd); err != nil {
-			os.RemoveAll(file)
-			return err
-		}
-		f.Close()
+	var db *buntdb.DB
+	var file string
+	var err error
+	if m.cipher != nil {
+		db, err = m.openMemoryDB(rd)
+	} else {
+		db, file, err = openFileDB(rd)
 	}
-	db, err := buntdb.Open(file)
 	if err != nil {
 		return err
 	}
@@ -143,6 +206,8 @@ func (m *Machine) reopenBlankDB(rd io.Reader, onExpired func(keys []string)) err
 	if err := db.SetConfig(cfg); err != nil {
 		return err
 	}
+	m.schemas.reset(nil)
+	m.triggers.reset(nil)
 	if m.file != "" {
 		os.RemoveAll(m.file)
 	}
@@ -154,12 +219,61 @@ func (m *Machine) reopenBlankDB(rd io.Reader, onExpired func(keys []string)) err
 	return nil
 }
 
+// openFileDB opens a database in a temporary file.
+func openFileDB(rd io.Reader) (*buntdb.DB, string, error) {
+	dir, err := ioutil.TempDir("", "summitdb")
+	if err != nil {
+		return nil, "", err
+	}
+	file := path.Join(dir, "data.db")
+	if rd != nil {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(f, rd); err != nil {
+			os.RemoveAll(file)
+			return nil, "", err
+		}
+		f.Close()
+	}
+	db, err := buntdb.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	return db, file, nil
+}
+
+// openMemoryDB opens a database in memory, which is used when the data at
+// rest is encrypted. Snapshots that are not encrypted are loaded too, so
+// that a server with encryption can join a cluster without it.
+func (m *Machine) openMemoryDB(rd io.Reader) (*buntdb.DB, error) {
+	db, err := buntdb.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	if rd != nil {
+		drd, err := m.cipher.NewReader(rd)
+		if err != nil && err != errNotEncrypted {
+			db.Close()
+			return nil, err
+		}
+		if err := db.Load(drd); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
 func scriptNotAllowedCommand(cmd string) bool {
 	switch strings.ToLower(cmd) {
-	case "multi", "exec", "discard", "eval", "evalro", "evalsha", "evalsharo", "script":
+	case "multi", "exec", "discard", "watch", "unwatch", "eval", "evalro", "evalsha", "evalsharo", "script",
+		"function", "fcall", "fcall_ro":
 		return true
 	}
-	return false
+	return internalCommand(strings.ToLower(cmd))
 }
 
 func respPipeline(conn redcon.Conn, pn int, err error) (interface{}, error) {
@@ -175,8 +289,54 @@ func respPipeline(conn redcon.Conn, pn int, err error) (interface{}, error) {
 
 // Command processes a command through the Raft pipeline.
 func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
+	if conn == nil {
+		// applied from the raft log.
+		return m.command(a, conn, cmd)
+	}
+	name := qcmdlower(cmd.Args[0])
+	m.waitForPause(name)
+	ctx, _ := conn.Context().(*connContext)
+	if ctx != nil && ctx.rejected {
+		conn.WriteError("ERR max number of clients reached")
+		redcon.BaseWriter(conn).Flush()
+		conn.Close()
+		return nil, nil
+	}
+	if ctx != nil && ctx.draining {
+		conn.WriteError("ERR the server is shutting down")
+		redcon.BaseWriter(conn).Flush()
+		conn.Close()
+		return nil, nil
+	}
+	atomic.AddInt64(&m.shutdown.inflight, 1)
+	defer atomic.AddInt64(&m.shutdown.inflight, -1)
+	if ctx != nil {
+		ctx.path = slowlogPathLocal
+		ctx.clientCommandStarted(name)
+		defer ctx.clientCommandDone()
+	}
+	start := time.Now()
+	v, err := m.command(a, conn, cmd)
+	elapsed := time.Since(start)
+	m.observeCommand(name, elapsed, err)
+	if ctx != nil {
+		m.slowlog.add(conn, cmd, elapsed, ctx.path)
+	}
+	return v, err
+}
+
+func (m *Machine) command(a finn.Applier, conn redcon.Conn, cmd redcon.Command) (interface{}, error) {
 	if conn != nil {
 		ctx, ok := conn.Context().(*connContext)
+		if (!ok || ctx.user != aclInternalUser) && internalOnly(cmd) {
+			return nil, finn.ErrUnknownCommand
+		}
+		if err := m.aclCheck(conn, cmd); err != nil {
+			if ok && ctx.multi != nil {
+				ctx.multi.errs = true
+			}
+			return nil, err
+		}
 		if ok && ctx.multi != nil {
 			// only EXEC, DISCARD, and Scriptable Commands allowed inside a multi
 			switch qcmdlower(cmd.Args[0]) {
@@ -188,12 +348,19 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 				return v, err
 			case "multi":
 				return nil, errors.New("ERR MULTI calls can not be nested")
+			case "watch":
+				return nil, errors.New("ERR WATCH inside MULTI is not allowed")
 			case "exec":
 				return m.doExec(a, conn, cmd, nil)
 			case "discard":
 				return m.doDiscard(a, conn, cmd, nil)
 			}
 		}
+		name := qcmdlower(cmd.Args[0])
+		m.evictTouch(name, cmd)
+		if err := m.evictBeforeWrite(a, conn, name); err != nil {
+			return nil, err
+		}
 	}
 
 	var pn int
@@ -203,6 +370,12 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 	if err != nil {
 		return nil, err
 	}
+	if pn > 0 {
+		// the pipelined commands are checked too.
+		if err := m.aclCheck(conn, cmd); err != nil {
+			return respPipeline(conn, pn, err)
+		}
+	}
 	switch qcmdlower(cmd.Args[0]) {
 	default:
 		return m.doTransactableCommand(a, conn, cmd, nil)
@@ -214,6 +387,10 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 		// PLSET key value [key value ...]
 		_, err := m.doMset(a, conn, cmd, nil)
 		return respPipeline(conn, pn, err)
+	case "pljget":
+		// PLJGET key path [key path ...]
+		_, err := m.doPljget(a, conn, cmd, nil)
+		return respPipeline(conn, pn, err)
 	case "plwmulti", "plrmulti":
 		// PLWMULTI cmd [cmd ...]
 		// PLRMULTI cmd [cmd ...]
@@ -221,9 +398,69 @@ func (m *Machine) Command(a finn.Applier, conn redcon.Conn, cmd redcon.Command)
 	case "massinsert":
 		// MASSINSERT count
 		return m.doMassInsert(a, conn, cmd, nil)
+	case "expired":
+		// EXPIRED key [key ...]
+		if conn == nil {
+			m.metrics.incr("summitdb_expired_keys_total", "", float64(len(cmd.Args)-1))
+		}
+		return m.doDel(a, conn, cmd, nil)
+	case "consistency", "readonly", "readwrite":
+		// CONSISTENCY [low|medium|high|default]
+		// CONSISTENCY bounded maxlag maxms
+		// READONLY
+		// READWRITE
+		return m.doConsistency(a, conn, cmd, nil)
+	case "evicted":
+		// EVICTED key [key ...]
+		if conn == nil {
+			m.metrics.incr("summitdb_evicted_keys_total", "", float64(len(cmd.Args)-1))
+			atomic.AddInt64(&m.evict.evicted, int64(len(cmd.Args)-1))
+		}
+		return m.doDel(a, conn, cmd, nil)
 	case "multi":
 		// MULTI
 		return m.doMulti(a, conn, cmd, nil)
+	case "watch":
+		// WATCH key [key ...]
+		return m.doWatch(a, conn, cmd, nil)
+	case "unwatch":
+		// UNWATCH
+		return m.doUnwatch(a, conn, cmd, nil)
+	case "info":
+		// INFO [section ...]
+		return m.doInfo(a, conn, cmd, nil)
+	case "client":
+		// CLIENT ID
+		// CLIENT LIST
+		// CLIENT SETNAME name
+		// CLIENT GETNAME
+		// CLIENT KILL addr
+		// CLIENT KILL [ID id] [ADDR addr] [USER username] [SKIPME yes|no]
+		// CLIENT PAUSE timeout [WRITE|ALL]
+		// CLIENT UNPAUSE
+		return m.doClient(a, conn, cmd, nil)
+	case "slowlog":
+		// SLOWLOG GET [count]
+		// SLOWLOG LEN
+		// SLOWLOG RESET
+		return m.doSlowlog(a, conn, cmd, nil)
+	case "config":
+		// CONFIG GET pattern
+		// CONFIG SET parameter value
+		// CONFIG REWRITE
+		return m.doConfig(a, conn, cmd, nil)
+	case "shutdown":
+		// SHUTDOWN [DRAIN]
+		return m.doShutdown(a, conn, cmd, nil)
+	case "auth":
+		// AUTH [username] password
+		return m.doAuth(a, conn, cmd, nil)
+	case "acl":
+		// ACL SETUSER username [rule ...]
+		// ACL DELUSER username [username ...]
+		// ACL LIST
+		// ACL WHOAMI
+		return m.doACL(a, conn, cmd, nil)
 	case "exec":
 		return nil, errors.New("ERR EXEC without MULTI")
 	case "discard":
@@ -238,15 +475,41 @@ func (m *Machine) doTransactableCommand(a finn.Applier, conn redcon.Conn, cmd re
 	default:
 		return m.doScriptableCommand(a, conn, cmd, tx)
 	case "eval", "evalro", "evalsha", "evalsharo":
-		// EVAL script numkeys [key ...] [arg ...]
-		// EVALRO script numkeys [key ...] [arg ...]
-		// EVALSHA sha1 numkeys [key ...] [arg ...]
-		// EVALSHARO sha1 numkeys [key ...] [arg ...]
+		// EVAL [DEBUG] script numkeys [key ...] [arg ...]
+		// EVALRO [DEBUG] script numkeys [key ...] [arg ...]
+		// EVALSHA [DEBUG] sha1 numkeys [key ...] [arg ...]
+		// EVALSHARO [DEBUG] sha1 numkeys [key ...] [arg ...]
 		return m.doEval(a, conn, cmd, nil)
+	case "fcall", "fcall_ro":
+		// FCALL function numkeys [key ...] [arg ...]
+		// FCALL_RO function numkeys [key ...] [arg ...]
+		return m.doFcall(a, conn, cmd, nil)
+	case "scriptenv":
+		// SCRIPTENV now seed [USER name] command [arg ...]
+		i, _ := scriptEnvInner(cmd.Args)
+		if i == len(cmd.Args) {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		switch qcmdlower(cmd.Args[i]) {
+		case "eval", "evalro", "evalsha", "evalsharo":
+			return m.doEval(a, conn, cmd, nil)
+		case "fcall", "fcall_ro":
+			return m.doFcall(a, conn, cmd, nil)
+		}
+		return nil, finn.ErrUnknownCommand
 	case "script":
 		// SCRIPT LOAD script
 		// SCRIPT FLUSH
+		// SCRIPT KILL
+		// SCRIPT STATS
 		return m.doScript(a, conn, cmd, nil)
+	case "function":
+		// FUNCTION LOAD [REPLACE] code
+		// FUNCTION DELETE library
+		// FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+		// FUNCTION DUMP
+		// FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE]
+		return m.doFunction(a, conn, cmd, nil)
 	}
 }
 
@@ -295,8 +558,11 @@ func (m *Machine) doScriptableCommand(a finn.Applier, conn redcon.Conn, cmd redc
 	case "get":
 		// GET key
 		return m.doGet(a, conn, cmd, tx)
+	case "getver":
+		// GETVER key
+		return m.doGetver(a, conn, cmd, tx)
 	case "set", "setex", "setnx", "psetex":
-		// SET key value [EX seconds] [PX milliseconds] [NX|XX]
+		// SET key value [EX seconds] [PX milliseconds] [NX|XX] [IFEQ value] [IFVER version]
 		// SETEX key seconds value
 		// SETNX key value
 		// PSETEX key milliseconds value
@@ -339,6 +605,24 @@ func (m *Machine) doScriptableCommand(a finn.Applier, conn redcon.Conn, cmd redc
 	case "indexes":
 		// INDEXES pattern
 		return m.doIndexes(a, conn, cmd, tx)
+	case "setschema":
+		// SETSCHEMA name pattern schema
+		return m.doSetSchema(a, conn, cmd, tx)
+	case "delschema":
+		// DELSCHEMA name
+		return m.doDelSchema(a, conn, cmd, tx)
+	case "schemas":
+		// SCHEMAS pattern [DETAILS]
+		return m.doSchemas(a, conn, cmd, tx)
+	case "settrigger":
+		// SETTRIGGER name pattern ON set|del|expire|jset SCRIPT sha [USER name]
+		return m.doSetTrigger(a, conn, cmd, tx)
+	case "deltrigger":
+		// DELTRIGGER name
+		return m.doDelTrigger(a, conn, cmd, tx)
+	case "triggers":
+		// TRIGGERS pattern [DETAILS]
+		return m.doTriggers(a, conn, cmd, tx)
 	case "flushdb", "flushall":
 		// FLUSHDB
 		// FLUSHALL
@@ -389,14 +673,20 @@ func (m *Machine) doScriptableCommand(a finn.Applier, conn redcon.Conn, cmd redc
 		return m.doBackup(a, conn, cmd, tx)
 
 	case "jget":
-		// JGET key path
+		// JGET key path [path ...]
 		return m.doJget(a, conn, cmd, tx)
+	case "jmget":
+		// JMGET path key [key ...]
+		return m.doJmget(a, conn, cmd, tx)
 	case "jset":
-		// JSET key path value [RAW|STR]
+		// JSET key path value [RAW|STR] [IFEQ value] [IFVER version]
 		return m.doJset(a, conn, cmd, tx)
 	case "jdel":
 		// JDEL key path
 		return m.doJdel(a, conn, cmd, tx)
+	case "jpatch":
+		// JPATCH key patch
+		return m.doJpatch(a, conn, cmd, tx)
 
 	case "sadd":
 		return m.doSadd(a, conn, cmd, tx)
@@ -0,0 +1,282 @@
+package machine
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// The metrics are written in the Prometheus text format. The counters and
+// histograms are kept in a metricsRegistry, and the gauges are read when
+// the metrics are requested.
+
+// metricsBuckets are the upper bounds, in seconds, of the histograms.
+var metricsBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025,
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricsHelp is the help text of each metric.
+var metricsHelp = map[string]string{
+	"summitdb_commands_total":                 "Number of commands that were processed, by command.",
+	"summitdb_command_errors_total":           "Number of commands that returned an error, by command.",
+	"summitdb_command_duration_seconds":       "Latency of the commands, by command.",
+	"summitdb_expired_keys_total":             "Number of keys that were expired.",
+	"summitdb_evicted_keys_total":             "Number of keys that were evicted for maxmemory.",
+	"summitdb_script_duration_seconds":        "Runtime of the scripts, functions, and triggers.",
+	"summitdb_script_errors_total":            "Number of scripts, functions, and triggers that returned an error.",
+	"summitdb_raft_apply_duration_seconds":    "Latency of applying a log to the state machine.",
+	"summitdb_raft_commit_duration_seconds":   "Latency of committing a log on the leader.",
+	"summitdb_raft_snapshot_duration_seconds": "Duration of taking a snapshot.",
+	"summitdb_raft_restore_duration_seconds":  "Duration of restoring a snapshot.",
+	"summitdb_raft_leader_changes_total":      "Number of times this server became the leader.",
+	"summitdb_raft_elections_total":           "Number of elections that this server started.",
+	"summitdb_connected_clients":              "Number of client connections.",
+	"summitdb_uptime_seconds":                 "Number of seconds since the server started.",
+	"summitdb_keys":                           "Number of keys.",
+	"summitdb_expiring_keys":                  "Number of keys with an expiration.",
+	"summitdb_index_keys":                     "Number of keys in an index, by index.",
+}
+
+type metricsHistogram struct {
+	counts []uint64 // count for each bucket, and +Inf last
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry contains the counters and histograms. The labels of a
+// value are formatted, such as `command="get"`, or empty for no labels.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*metricsHistogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		counters:   make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*metricsHistogram),
+	}
+}
+
+func (r *metricsRegistry) incr(name, labels string, val float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := r.counters[name]
+	if values == nil {
+		values = make(map[string]float64)
+		r.counters[name] = values
+	}
+	values[labels] += val
+}
+
+func (r *metricsRegistry) observe(name, labels string, seconds float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := r.histograms[name]
+	if values == nil {
+		values = make(map[string]*metricsHistogram)
+		r.histograms[name] = values
+	}
+	h := values[labels]
+	if h == nil {
+		h = &metricsHistogram{counts: make([]uint64, len(metricsBuckets)+1)}
+		values[labels] = h
+	}
+	i := sort.SearchFloat64s(metricsBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// write writes the counters and histograms, ordered by name and labels.
+func (r *metricsRegistry) write(buf *bytes.Buffer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricsHeader(buf, name, "counter")
+		var labels []string
+		for label := range r.counters[name] {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			writeMetric(buf, name, label, r.counters[name][label])
+		}
+	}
+	names = names[:0]
+	for name := range r.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricsHeader(buf, name, "histogram")
+		var labels []string
+		for label := range r.histograms[name] {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			h := r.histograms[name][label]
+			var cum uint64
+			for i, count := range h.counts {
+				cum += count
+				le := "+Inf"
+				if i < len(metricsBuckets) {
+					le = strconv.FormatFloat(metricsBuckets[i], 'g', -1, 64)
+				}
+				writeMetric(buf, name+"_bucket",
+					joinLabels(label, `le="`+le+`"`), float64(cum))
+			}
+			writeMetric(buf, name+"_sum", label, h.sum)
+			writeMetric(buf, name+"_count", label, float64(h.count))
+		}
+	}
+}
+
+func writeMetricsHeader(buf *bytes.Buffer, name, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, metricsHelp[name], name, kind)
+}
+
+func writeMetric(buf *bytes.Buffer, name, labels string, val float64) {
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + strconv.FormatFloat(val, 'g', -1, 64) + "\n")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// metricsLabel returns a formatted label.
+func metricsLabel(name, value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return name + `="` + value + `"`
+}
+
+// metricsCommandName returns the name of a command for the command label.
+// The unknown commands share a label, so that clients cannot create any
+// number of labels.
+func metricsCommandName(name string) string {
+	name = strings.ToLower(name)
+	if _, ok := aclCommandCategories[name]; ok {
+		return name
+	}
+	switch name {
+	case "auth", "multi", "exec", "discard", "watch", "unwatch":
+		return name
+	}
+	return "other"
+}
+
+func (m *Machine) observeCommand(name string, elapsed time.Duration, err error) {
+	label := metricsLabel("command", metricsCommandName(name))
+	m.metrics.incr("summitdb_commands_total", label, 1)
+	if err != nil {
+		m.metrics.incr("summitdb_command_errors_total", label, 1)
+	}
+	m.metrics.observe("summitdb_command_duration_seconds", label, elapsed.Seconds())
+}
+
+func (m *Machine) observeScript(elapsed time.Duration, err error) {
+	if err != nil {
+		m.metrics.incr("summitdb_script_errors_total", "", 1)
+	}
+	m.metrics.observe("summitdb_script_duration_seconds", "", elapsed.Seconds())
+}
+
+// raftMetrics contains the metrics of raft. Raft sends its metrics to the
+// global go-metrics sink, so they are for the whole process.
+var raftMetrics = newMetricsRegistry()
+var raftMetricsOnce sync.Once
+
+// raftMetricNames maps the go-metrics keys of raft to the metric names.
+var raftMetricNames = map[string]string{
+	"raft.fsm.apply":             "summitdb_raft_apply_duration_seconds",
+	"raft.commitTime":            "summitdb_raft_commit_duration_seconds",
+	"raft.snapshot.takeSnapshot": "summitdb_raft_snapshot_duration_seconds",
+	"raft.fsm.restore":           "summitdb_raft_restore_duration_seconds",
+	"raft.state.leader":          "summitdb_raft_leader_changes_total",
+	"raft.state.candidate":       "summitdb_raft_elections_total",
+}
+
+// raftSink is the go-metrics sink of raft.
+type raftSink struct{}
+
+func (raftSink) SetGauge(key []string, val float32) {}
+func (raftSink) EmitKey(key []string, val float32)  {}
+func (raftSink) IncrCounter(key []string, val float32) {
+	if name, ok := raftMetricNames[strings.Join(key, ".")]; ok {
+		raftMetrics.incr(name, "", float64(val))
+	}
+}
+func (raftSink) AddSample(key []string, val float32) {
+	// the samples are in milliseconds
+	if name, ok := raftMetricNames[strings.Join(key, ".")]; ok {
+		raftMetrics.observe(name, "", float64(val)/1000)
+	}
+}
+
+// startRaftMetrics sends the raft metrics to raftMetrics. The counters start
+// at zero, so that they're written before the first event.
+func startRaftMetrics() {
+	raftMetricsOnce.Do(func() {
+		for _, name := range raftMetricNames {
+			if strings.HasSuffix(name, "_total") {
+				raftMetrics.incr(name, "", 0)
+			}
+		}
+		metrics.NewGlobal(&metrics.Config{TimerGranularity: time.Millisecond}, raftSink{})
+	})
+}
+
+// MetricsHandler returns a http handler that serves the metrics at /metrics
+// in the Prometheus text format.
+func (m *Machine) MetricsHandler() http.Handler {
+	startRaftMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serveMetrics)
+	return mux
+}
+
+func (m *Machine) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	ks, err := m.keyspaceStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	m.metrics.write(&buf)
+	raftMetrics.write(&buf)
+	gauge := func(name, labels string, val float64) {
+		writeMetricsHeader(&buf, name, "gauge")
+		writeMetric(&buf, name, labels, val)
+	}
+	gauge("summitdb_connected_clients", "", float64(m.clientCount()))
+	gauge("summitdb_uptime_seconds", "", float64(time.Now().Sub(m.start)/time.Second))
+	gauge("summitdb_keys", "", float64(ks.keys))
+	gauge("summitdb_expiring_keys", "", float64(ks.expires))
+	writeMetricsHeader(&buf, "summitdb_index_keys", "gauge")
+	for _, idx := range ks.indexes {
+		writeMetric(&buf, "summitdb_index_keys", metricsLabel("index", idx.name), float64(idx.keys))
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,182 @@
+package machine
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func subTestMetrics(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "commands", metrics_COMMANDS_test)
+	runStep(t, mc, "keyspace", metrics_KEYSPACE_test)
+	runStep(t, mc, "scripts", metrics_SCRIPTS_test)
+	runStep(t, mc, "expired", metrics_EXPIRED_test)
+	runStep(t, mc, "raft", metrics_RAFT_test)
+}
+
+// mockMetrics gets the metrics of a server with a http request, and returns
+// the values by their name and labels.
+func mockMetrics(s *mockServer) (map[string]float64, error) {
+	ts := httptest.NewServer(s.m.MetricsHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("expected '200', got '%v'", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		return nil, fmt.Errorf("expected the prometheus text format, got '%v'", ct)
+	}
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid line '%v'", line)
+		}
+		val, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, err
+		}
+		values[line[:i]] = val
+	}
+	return values, scanner.Err()
+}
+
+// metricsDelta runs commands on the current server, which is the leader
+// after the FLUSHDB of the step, and checks the change in the metrics.
+func metricsDelta(mc *mockCluster, commands [][]interface{}, expect map[string]float64) error {
+	s := mc.cs
+	before, err := mockMetrics(s)
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch(commands); err != nil {
+		return err
+	}
+	if mc.cs != s {
+		return fmt.Errorf("expected the commands to run on the same server")
+	}
+	after, err := mockMetrics(s)
+	if err != nil {
+		return err
+	}
+	for name, delta := range expect {
+		if _, ok := after[name]; !ok {
+			return fmt.Errorf("expected '%v' in the metrics", name)
+		}
+		if after[name]-before[name] != delta {
+			return fmt.Errorf("expected '%v' for '%v', got '%v'", delta, name, after[name]-before[name])
+		}
+	}
+	return nil
+}
+
+func metrics_COMMANDS_test(mc *mockCluster) error {
+	return metricsDelta(mc, [][]interface{}{
+		{"SET", "key1", "value"}, {"OK"},
+		{"SET", "key2", "value"}, {"OK"},
+		{"GET", "key1"}, {"value"},
+		{"INCR", "key1"}, {"ERR value is not an integer or out of range"},
+		{"NOTACOMMAND"}, {"ERR unknown command 'NOTACOMMAND'"},
+	}, map[string]float64{
+		`summitdb_commands_total{command="set"}`:                            2,
+		`summitdb_commands_total{command="get"}`:                            1,
+		`summitdb_command_errors_total{command="incr"}`:                     1,
+		`summitdb_commands_total{command="other"}`:                          1,
+		`summitdb_command_duration_seconds_count{command="set"}`:            2,
+		`summitdb_command_duration_seconds_bucket{command="set",le="+Inf"}`: 2,
+		`summitdb_command_duration_seconds_bucket{command="get",le="+Inf"}`: 1,
+		`summitdb_connected_clients`:                                        0,
+		`summitdb_raft_leader_changes_total`:                                0,
+	})
+}
+
+func metrics_KEYSPACE_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "user:1", "Tom"}, {"OK"},
+		{"SET", "user:2", "Jane", "EX", 100}, {"OK"},
+		{"SET", "item:1", "Pen"}, {"OK"},
+		{"SETINDEX", "users", "user:*", "TEXT"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	values, err := mockMetrics(mc.cs)
+	if err != nil {
+		return err
+	}
+	for name, expect := range map[string]float64{
+		`summitdb_keys`:                      3,
+		`summitdb_expiring_keys`:             1,
+		`summitdb_index_keys{index="users"}`: 2,
+	} {
+		if values[name] != expect {
+			return fmt.Errorf("expected '%v' for '%v', got '%v'", expect, name, values[name])
+		}
+	}
+	return mc.DoBatch([][]interface{}{
+		{"DELINDEX", "users"}, {1},
+	})
+}
+
+func metrics_SCRIPTS_test(mc *mockCluster) error {
+	return metricsDelta(mc, [][]interface{}{
+		{"EVAL", "return 1", 0}, {1},
+		{"EVALRO", "return 1", 0}, {1},
+		{"EVALRO", `return sdb.call("nocmd")`, 0}, {"ERR unknown command 'nocmd'"},
+	}, map[string]float64{
+		`summitdb_script_duration_seconds_count`: 3,
+		`summitdb_script_errors_total`:           1,
+	})
+}
+
+func metrics_EXPIRED_test(mc *mockCluster) error {
+	return metricsDelta(mc, [][]interface{}{
+		{"SET", "key1", "value", "PX", 100}, {"OK"},
+		{"SET", "key2", "value", "PX", 100}, {"OK"},
+		{time.Second * 2}, {},
+		{"GET", "key1"}, {nil},
+	}, map[string]float64{
+		`summitdb_expired_keys_total`: 2,
+	})
+}
+
+func metrics_RAFT_test(mc *mockCluster) error {
+	before, err := mockMetrics(mc.cs)
+	if err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key1", "value"}, {"OK"},
+		{"RAFTSNAPSHOT"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	after, err := mockMetrics(mc.cs)
+	if err != nil {
+		return err
+	}
+	// the raft metrics are for every server in the process.
+	for _, name := range []string{
+		"summitdb_raft_apply_duration_seconds_count",
+		"summitdb_raft_commit_duration_seconds_count",
+		"summitdb_raft_snapshot_duration_seconds_count",
+	} {
+		if after[name] <= before[name] {
+			return fmt.Errorf("expected '%v' to increase, got '%v'", name, after[name])
+		}
+	}
+	return nil
+}
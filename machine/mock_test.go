@@ -1,10 +1,12 @@
 package machine
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -35,6 +37,7 @@ type mockServer struct {
 	n    *finn.Node
 	m    *Machine
 	conn redis.Conn
+	tls  *tls.Config // client tls configuration, nil for tcp
 }
 
 func (s *mockServer) Close() {
@@ -60,7 +63,13 @@ func (s *mockServer) Do(commandName string, args ...interface{}) (interface{}, e
 func (s *mockServer) DoPipeline(cmds [][]interface{}) ([]interface{}, error) {
 	if s.conn == nil {
 		var err error
-		s.conn, err = redis.Dial("tcp", fmt.Sprintf(":%d", s.port))
+		s.conn, err = redis.Dial("tcp", s.addr(),
+			redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+				if s.tls != nil {
+					return tls.Dial(network, addr, s.tls)
+				}
+				return net.Dial(network, addr)
+			}))
 		if err != nil {
 			return nil, err
 		}
@@ -86,6 +95,15 @@ func (s *mockServer) DoPipeline(cmds [][]interface{}) ([]interface{}, error) {
 	return resps, nil
 }
 
+// addr returns the address of the server. The tls servers use the ip address
+// which is in their certificates.
+func (s *mockServer) addr() string {
+	if s.tls != nil {
+		return fmt.Sprintf("127.0.0.1:%d", s.port)
+	}
+	return fmt.Sprintf(":%d", s.port)
+}
+
 func (s *mockServer) waitForStartup() error {
 	var lerr error
 	start := time.Now()
@@ -126,9 +144,32 @@ func (s *mockServer) waitForStartup() error {
 	}
 }
 
+// mockClusterSecret is the cluster secret of the servers that are opened
+// with mockOpenServer.
+const mockClusterSecret = "mock-cluster-secret"
+
 func mockOpenServer(join *mockServer) (*mockServer, error) {
+	return mockOpenServerOptions(join, mockOptions{secret: mockClusterSecret})
+}
+
+// mockOptions are the options of a test server.
+type mockOptions struct {
+	port     int         // zero for a random port
+	tls      *tls.Config // accept tls connections, nil for tcp
+	peerTLS  *tls.Config // connect to peers with tls, nil for tcp
+	cipher   *Cipher     // encrypt the data at rest, nil for plaintext
+	nonvoter bool        // join the cluster as a nonvoter
+	secret   string      // the cluster secret of the raft RPCs
+}
+
+// mockOpenServerOptions opens a server with options. The data of the server
+// is kept when it's closed, so it can be opened again on the same port.
+func mockOpenServerOptions(join *mockServer, mopts mockOptions) (*mockServer, error) {
 	rand.Seed(time.Now().UnixNano())
-	port := rand.Int()%20000 + 20000
+	port := mopts.port
+	if port == 0 {
+		port = rand.Int()%20000 + 20000
+	}
 	dir := fmt.Sprintf("data-mock-%d", port)
 	fmt.Printf("Starting test server at port %d\n", port)
 	logOutput := ioutil.Discard
@@ -141,11 +182,25 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 	opts.Consistency = finn.High
 	opts.LogLevel = finn.Debug
 	opts.LogOutput = logOutput
-	addr := fmt.Sprintf(":%d", port)
+	opts.TLSConfig = mopts.tls
+	opts.PeerTLSConfig = mopts.peerTLS
+	opts.Nonvoter = mopts.nonvoter
+	opts.ClusterSecret = mopts.secret
+	s := &mockServer{port: port, tls: mopts.peerTLS}
+	addr := s.addr()
 	m, err := New(redlog.New(logOutput).Sub('M'), addr)
 	if err != nil {
 		return nil, err
 	}
+	m.sm.setLimits(time.Second/2, 1000000)
+	m.SetTLSConfig(mopts.peerTLS)
+	if mopts.cipher != nil {
+		if err := m.SetCipher(mopts.cipher); err != nil {
+			m.Close()
+			return nil, err
+		}
+		opts.Cipher = mopts.cipher
+	}
 	opts.ConnAccept = func(conn redcon.Conn) bool {
 		return m.ConnAccept(conn)
 	}
@@ -154,7 +209,7 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 	}
 	var joinAddr string
 	if join != nil {
-		joinAddr = fmt.Sprintf(":%d", join.port)
+		joinAddr = join.addr()
 	}
 	// open the raft machine
 	n, err := finn.Open(dir, addr, joinAddr, m, &opts)
@@ -162,7 +217,7 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 		m.Close()
 		return nil, err
 	}
-	s := &mockServer{port: port, n: n, m: m, join: joinAddr}
+	s.n, s.m, s.join = n, m, joinAddr
 	if err := s.waitForStartup(); err != nil {
 		s.Close()
 		return nil, err
@@ -170,6 +225,14 @@ func mockOpenServer(join *mockServer) (*mockServer, error) {
 	return s, nil
 }
 
+// mockAuthInternal authenticates the current connection, which is on the
+// leader after the FLUSHDB of the step, as the internal user.
+func mockAuthInternal(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"AUTH", aclInternalUser, mc.cs.m.internalPass}, {"OK"},
+	})
+}
+
 type mockCluster struct {
 	ss []*mockServer
 	cs *mockServer // current server
@@ -227,7 +290,7 @@ func (mc *mockCluster) Do(commandName string, args ...interface{}) (interface{},
 		}
 		if err != nil {
 			if strings.HasPrefix(err.Error(), "TRY ") {
-				n, err := strconv.ParseInt(err.Error()[5:], 10, 64)
+				n, err := strconv.ParseInt(err.Error()[strings.LastIndex(err.Error(), ":")+1:], 10, 64)
 				if err != nil {
 					return nil, err
 				}
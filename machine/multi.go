@@ -35,8 +35,10 @@ func (m *Machine) doExec(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		return nil, errors.New("missing connection")
 	}
 	ctx := conn.Context().(*connContext)
+	watch := ctx.watch
 	defer func() {
 		ctx.multi = nil
+		ctx.watch = nil
 	}()
 	if ctx.multi.errs {
 		return nil, errors.New("EXECABORT Transaction discarded because of previous errors.")
@@ -51,6 +53,11 @@ func (m *Machine) doExec(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	} else {
 		args = append(args, []byte("plrmulti"))
 	}
+	if len(watch) > 0 {
+		// the watched versions go first and are checked inside the
+		// transaction.
+		args = append(args, watchCommand(ctx.watchbase, watch).Raw)
+	}
 	for _, cmd := range ctx.multi.cmds {
 		args = append(args, cmd.Raw)
 	}
@@ -68,6 +75,7 @@ func (m *Machine) doDiscard(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 	}
 	ctx := conn.Context().(*connContext)
 	ctx.multi = nil
+	ctx.watch = nil
 	conn.WriteString("OK")
 	return nil, nil
 }
@@ -81,16 +89,31 @@ func (m *Machine) doPlmulti(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 
 	// read the commands
 	var cmds []redcon.Command
+	var watch *redcon.Command
 	for i := 1; i < len(cmd.Args); i++ {
 		cmd, err := parseCommand(cmd.Args[i])
 		if err != nil {
 			return nil, err
 		}
+		if i == 1 && qcmdlower(cmd.Args[0]) == "watch" {
+			watch = &cmd
+			continue
+		}
 		cmds = append(cmds, cmd)
 	}
 
 	dowr := func(tx *buntdb.Tx) (interface{}, error) {
-		var resps []interface{}
+		if watch != nil {
+			ok, err := watchedUnchanged(tx, *watch)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// a watched key has changed, abort.
+				return nil, nil
+			}
+		}
+		resps := []interface{}{}
 		for _, cmd := range cmds {
 			pconn := &passiveConn{}
 			_, err := m.doTransactableCommand(&passiveApplier{log: m.log}, pconn, cmd, tx)
@@ -104,6 +127,10 @@ func (m *Machine) doPlmulti(a finn.Applier, conn redcon.Conn, cmd redcon.Command
 	}
 
 	dord := func(v interface{}) error {
+		if v == nil {
+			conn.WriteNull()
+			return nil
+		}
 		conn.WriteArray(len(cmds))
 		for _, resp := range v.([]interface{}) {
 			switch v := resp.(type) {
@@ -0,0 +1,356 @@
+package machine
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+func init() {
+	// the local time of Date must be the same on every server, or write
+	// scripts would produce different values on each replica.
+	otto.DateLocation = time.UTC
+}
+
+// ottoEngine runs javascript with otto. Every runtime is a copy of the root
+// vm, which has the sdb api.
+//
+// Otto checks the interrupt channel before evaluating each statement and
+// expression, so an operation is a single statement or expression.
+type ottoEngine struct {
+	root *otto.Otto
+}
+
+// ottoPrelude makes Date use the script clock instead of the system clock.
+const ottoPrelude = `
+	Date = (function(GoDate){
+		var Date = function(y, m, d, h, min, s, ms){
+			if (!(this instanceof Date)) {
+				return new GoDate(sdb.now()).toString();
+			}
+			switch (arguments.length) {
+			case 0: return new GoDate(sdb.now());
+			case 1: return new GoDate(y);
+			case 2: return new GoDate(y, m);
+			case 3: return new GoDate(y, m, d);
+			case 4: return new GoDate(y, m, d, h);
+			case 5: return new GoDate(y, m, d, h, min);
+			case 6: return new GoDate(y, m, d, h, min, s);
+			}
+			return new GoDate(y, m, d, h, min, s, ms);
+		}
+		Date.prototype = GoDate.prototype;
+		Date.prototype.constructor = Date;
+		Date.now = function(){
+			return sdb.now();
+		}
+		Date.parse = GoDate.parse;
+		Date.UTC = GoDate.UTC;
+		return Date;
+	}(Date));
+`
+
+func newOttoEngine(host scriptHost) (*ottoEngine, error) {
+	vm := otto.New()
+	if _, err := vm.Run(scriptPrelude); err != nil {
+		return nil, err
+	}
+	if _, ok := host["sdb.now"]; ok {
+		if _, err := vm.Run(ottoPrelude); err != nil {
+			return nil, err
+		}
+	}
+	v, err := vm.Get("SummitDB")
+	if err != nil {
+		return nil, err
+	}
+	v, err = v.Object().Get("prototype")
+	if err != nil {
+		return nil, err
+	}
+	proto := v.Object()
+	rt := &ottoRuntime{vm: vm}
+	for path, fn := range host {
+		obj, name := splitHostName(path)
+		if obj == "sdb" {
+			if err := proto.Set(name, ottoFunc(fn)); err != nil {
+				return nil, err
+			}
+		} else {
+			rt.setFunc(obj, name, fn)
+		}
+	}
+	return &ottoEngine{root: vm}, nil
+}
+
+func (e *ottoEngine) newRuntime() (scriptRuntime, error) {
+	return &ottoRuntime{vm: e.root.Copy()}, nil
+}
+
+func (e *ottoEngine) compileLess(script string) (func(a, b string) bool, error) {
+	vm := otto.New()
+	val, err := vm.Eval("(" + script + ")")
+	if err != nil {
+		return nil, err
+	}
+	if !val.IsFunction() {
+		return nil, errExpectingFunction
+	}
+	// the index is used by concurrent read transactions.
+	var mu sync.Mutex
+	return func(a, b string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		res, _ := val.Call(otto.Value{}, a, b)
+		t, _ := res.ToBoolean()
+		return t
+	}, nil
+}
+
+// ottoFunc converts a host function into an otto function.
+func ottoFunc(fn hostFunc) func(call otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) otto.Value {
+		rt := &ottoRuntime{vm: call.Otto}
+		args := make([]scriptValue, len(call.ArgumentList))
+		for i, arg := range call.ArgumentList {
+			args[i] = rt.value(arg)
+		}
+		v := fn(rt, args)
+		if v == nil {
+			return otto.Value{}
+		}
+		return v.(*ottoValue).v
+	}
+}
+
+// ottoRuntime is an otto vm.
+type ottoRuntime struct {
+	vm *otto.Otto
+}
+
+func (rt *ottoRuntime) value(v otto.Value) *ottoValue {
+	return &ottoValue{vm: rt.vm, v: v}
+}
+
+func (rt *ottoRuntime) compile(src string) (scriptProgram, error) {
+	return rt.vm.Compile("", "(function(){"+src+"})()")
+}
+
+func (rt *ottoRuntime) run(prog scriptProgram) (scriptValue, error) {
+	v, err := rt.vm.Run(prog.(*otto.Script))
+	if err != nil {
+		return nil, err
+	}
+	return rt.value(v), nil
+}
+
+func (rt *ottoRuntime) exec(src string) error {
+	_, err := rt.vm.Run(src)
+	return err
+}
+
+func (rt *ottoRuntime) get(name string) scriptValue {
+	v, err := rt.vm.Get(name)
+	if err != nil {
+		return rt.value(otto.UndefinedValue())
+	}
+	return rt.value(v)
+}
+
+func (rt *ottoRuntime) set(name string, v interface{}) {
+	switch v := v.(type) {
+	case []string:
+		// a Go slice, as it has always been
+		rt.vm.Set(name, v)
+	default:
+		rt.vm.Set(name, rt.toValue(v).(*ottoValue).v)
+	}
+}
+
+func (rt *ottoRuntime) setFunc(obj, name string, fn hostFunc) {
+	v, err := rt.vm.Get(obj)
+	if err != nil || !v.IsObject() {
+		o, _ := rt.vm.Object(`({})`)
+		rt.vm.Set(obj, o)
+		v = o.Value()
+	}
+	v.Object().Set(name, ottoFunc(fn))
+}
+
+func (rt *ottoRuntime) toValue(v interface{}) scriptValue {
+	switch v := v.(type) {
+	case nil:
+		return rt.value(otto.NullValue())
+	case undefined:
+		return rt.value(otto.UndefinedValue())
+	case *ottoValue:
+		return v
+	case statusReply:
+		return rt.call("sdb.statusReply", string(v))
+	case errorReply:
+		return rt.call("sdb.errorReply", string(v))
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return rt.toValue(items)
+	case []interface{}:
+		arr, err := rt.vm.Object(`([])`)
+		if err != nil {
+			panic(scriptErrPrefix + err.Error())
+		}
+		for _, item := range v {
+			arr.Call("push", rt.toValue(item).(*ottoValue).v)
+		}
+		return rt.value(arr.Value())
+	case map[string]interface{}:
+		// the keys are sorted so that the objects are the same on every
+		// server.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		obj, err := rt.vm.Object(`({})`)
+		if err != nil {
+			panic(scriptErrPrefix + err.Error())
+		}
+		for _, key := range keys {
+			obj.Set(key, rt.toValue(v[key]).(*ottoValue).v)
+		}
+		return rt.value(obj.Value())
+	}
+	val, err := rt.vm.ToValue(v)
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	return rt.value(val)
+}
+
+// call calls a global function, such as sdb.errorReply.
+func (rt *ottoRuntime) call(name string, args ...interface{}) scriptValue {
+	v, err := rt.vm.Call(name, nil, args...)
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	return rt.value(v)
+}
+
+func (rt *ottoRuntime) parseJSON(s string) (scriptValue, error) {
+	v, err := rt.vm.Call("JSON.parse", nil, s)
+	if err != nil {
+		return nil, err
+	}
+	return rt.value(v), nil
+}
+
+func (rt *ottoRuntime) setRandom(fn func() float64) {
+	rt.vm.SetRandomSource(fn)
+}
+
+// setLimiter uses the interrupt channel. The interrupt puts itself back onto
+// the channel, so it's called once for every operation.
+func (rt *ottoRuntime) id() interface{} {
+	return rt.vm
+}
+
+func (rt *ottoRuntime) setLimiter(fn func()) {
+	if fn == nil {
+		rt.vm.Interrupt = nil
+		return
+	}
+	vm := rt.vm
+	var interrupt func()
+	interrupt = func() {
+		fn()
+		vm.Interrupt <- interrupt
+	}
+	vm.Interrupt = make(chan func(), 1)
+	vm.Interrupt <- interrupt
+}
+
+// ottoValue is an otto value.
+type ottoValue struct {
+	vm *otto.Otto
+	v  otto.Value
+}
+
+func (v *ottoValue) isUndefined() bool { return v.v.IsUndefined() }
+func (v *ottoValue) isNull() bool      { return v.v.IsNull() }
+func (v *ottoValue) isBoolean() bool   { return v.v.IsBoolean() }
+func (v *ottoValue) isNumber() bool    { return v.v.IsNumber() }
+func (v *ottoValue) isString() bool    { return v.v.IsString() }
+func (v *ottoValue) isObject() bool    { return v.v.IsObject() }
+func (v *ottoValue) isFunction() bool  { return v.v.IsFunction() }
+func (v *ottoValue) String() string    { return v.v.String() }
+
+func (v *ottoValue) isArray() bool {
+	if !v.v.IsObject() {
+		return false
+	}
+	res, _ := v.vm.Call(`Array.isArray`, nil, v.v)
+	t, _ := res.ToBoolean()
+	return t
+}
+
+func (v *ottoValue) toBoolean() bool {
+	t, _ := v.v.ToBoolean()
+	return t
+}
+
+func (v *ottoValue) toFloat() float64 {
+	f, _ := v.v.ToFloat()
+	return f
+}
+
+func (v *ottoValue) get(name string) scriptValue {
+	if !v.v.IsObject() {
+		return &ottoValue{vm: v.vm, v: otto.UndefinedValue()}
+	}
+	res, _ := v.v.Object().Get(name)
+	return &ottoValue{vm: v.vm, v: res}
+}
+
+func (v *ottoValue) length() int {
+	n, _ := v.get("length").(*ottoValue).v.ToInteger()
+	return int(n)
+}
+
+func (v *ottoValue) index(i int) scriptValue {
+	return v.get(strconv.FormatInt(int64(i), 10))
+}
+
+func (v *ottoValue) call(args ...interface{}) (scriptValue, error) {
+	rt := &ottoRuntime{vm: v.vm}
+	vals := make([]interface{}, len(args))
+	for i, arg := range args {
+		if s, ok := arg.([]string); ok {
+			// a Go slice, as it has always been
+			vals[i] = s
+		} else {
+			vals[i] = rt.toValue(arg).(*ottoValue).v
+		}
+	}
+	res, err := v.v.Call(otto.UndefinedValue(), vals...)
+	if err != nil {
+		return nil, err
+	}
+	return rt.value(res), nil
+}
+
+func (v *ottoValue) json() (string, error) {
+	res, err := v.vm.Call(`JSON.stringify`, nil, v.v)
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func (v *ottoValue) export() interface{} {
+	res, _ := v.v.Export()
+	return res
+}
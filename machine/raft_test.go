@@ -1,17 +1,22 @@
 package machine
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func subTestRaft(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "snapshot", raft_SNAPSHOT_test)
 	runStep(t, mc, "join", raft_JOIN_test)
+	runStep(t, mc, "nonvoter", raft_NONVOTER_test)
+	runStep(t, mc, "transfer", raft_TRANSFER_test)
 	runStep(t, mc, "remove", raft_REMOVE_test)
 }
 
@@ -31,6 +36,11 @@ func raft_SNAPSHOT_test(mc *mockCluster) error {
 	return nil
 }
 func raftWaitForNumPeers(mc *mockCluster, count int) error {
+	return raftWaitForStat(mc, "num_peers", count)
+}
+
+// raftWaitForStat waits for a numeric stat of RAFTSTATS on the leader.
+func raftWaitForStat(mc *mockCluster, stat string, count int) error {
 	for {
 		var numPeers int
 		var derr error
@@ -38,7 +48,7 @@ func raftWaitForNumPeers(mc *mockCluster, count int) error {
 			{"RAFTSTATS"}, {func(v interface{}) (r, e interface{}) {
 				parts := strings.Split(fmt.Sprintf("%v\n", v), " ")
 				for i := 0; i < len(parts); i += 2 {
-					if parts[i] == "num_peers" {
+					if parts[i] == stat {
 						n, err := strconv.ParseInt(parts[i+1], 10, 64)
 						if err != nil {
 							derr = err
@@ -112,3 +122,189 @@ func raft_REMOVE_test(mc *mockCluster) error {
 	return nil
 
 }
+
+func raft_NONVOTER_test(mc *mockCluster) error {
+	if err := raftWaitForNumPeers(mc, 3); err != nil {
+		return err
+	}
+	var leader *mockServer
+	for _, s := range mc.ss {
+		if v, _ := redis.String(s.Do("RAFTSTATE")); v == "Leader" {
+			leader = s
+		}
+	}
+	if leader == nil {
+		return errors.New("no leader")
+	}
+	s, err := mockOpenServerOptions(leader, mockOptions{nonvoter: true, secret: mockClusterSecret})
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	addr := s.addr()
+	if err := raftWaitForStat(mc, "num_nonvoters", 1); err != nil {
+		return err
+	}
+	// the nonvoter doesn't change the quorum.
+	if err := raftWaitForNumPeers(mc, 3); err != nil {
+		return err
+	}
+	err = mc.DoBatch([][]interface{}{
+		{"SET", "key", "value"}, {"OK"},
+		{time.Second * 2}, {}, // the peers are polled every second
+		{"RAFTPEERS"}, {func(v interface{}) (resp, expect interface{}) {
+			peers := v.([]string)
+			for i := 0; i+2 < len(peers); i += 3 {
+				if peers[i] == addr {
+					return peers[i+2], "Nonvoter"
+				}
+			}
+			return peers, addr
+		}},
+		{"RAFTADDPEER", addr, "NONVOTER"}, {"peer already known"},
+		{"RAFTADDPEER", addr, "OTHER"}, {"ERR syntax error"},
+		{"RAFTPROMOTE", ":1"}, {"peer is unknown"},
+		{"RAFTDEMOTE", leader.addr()}, {"leader can't be a nonvoter"},
+	})
+	if err != nil {
+		return err
+	}
+	// the nonvoter serves the reads that may be stale.
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if v, err := redis.String(conn.Do("READONLY")); err != nil || v != "OK" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "OK", v, err)
+	}
+	if err := followerGet(conn, "key", "value"); err != nil {
+		return err
+	}
+	if v, err := redis.String(conn.Do("INFO", "replication")); err != nil ||
+		!strings.Contains(v, "raft_suffrage:Nonvoter\r\n") {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "raft_suffrage:Nonvoter", v, err)
+	}
+	// promote and demote.
+	if err := mc.DoBatch([][]interface{}{{"RAFTPROMOTE", addr}, {"OK"}}); err != nil {
+		return err
+	}
+	if err := raftWaitForNumPeers(mc, 4); err != nil {
+		return err
+	}
+	if err := raftWaitForStat(mc, "num_nonvoters", 0); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{{"RAFTDEMOTE", addr}, {"OK"}}); err != nil {
+		return err
+	}
+	if err := raftWaitForNumPeers(mc, 3); err != nil {
+		return err
+	}
+	if err := raftWaitForStat(mc, "num_nonvoters", 1); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{{"RAFTREMOVEPEER", addr}, {"OK"}}); err != nil {
+		return err
+	}
+	return raftWaitForStat(mc, "num_nonvoters", 0)
+}
+
+// raftLeader returns the server that is the leader.
+func raftLeader(mc *mockCluster) *mockServer {
+	for _, s := range mc.ss {
+		if v, _ := redis.String(s.Do("RAFTSTATE")); v == "Leader" {
+			return s
+		}
+	}
+	return nil
+}
+
+// raftWaitForLeader waits until the server is the leader.
+func raftWaitForLeader(s *mockServer) error {
+	deadline := time.Now().Add(time.Second * 10)
+	for {
+		v, err := redis.String(s.Do("RAFTSTATE"))
+		if err == nil && v == "Leader" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected '%v', got '%v' (%v)", "Leader", v, err)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func raft_TRANSFER_test(mc *mockCluster) error {
+	if err := raftWaitForNumPeers(mc, 3); err != nil {
+		return err
+	}
+	leader := raftLeader(mc)
+	if leader == nil {
+		return errors.New("no leader")
+	}
+	var follower *mockServer
+	for _, s := range mc.ss {
+		if s != leader {
+			follower = s
+			break
+		}
+	}
+	if v, err := redis.String(leader.Do("RAFTTRANSFERLEADER", ":1")); err == nil ||
+		!strings.Contains(fmt.Sprint(v, err), "peer is unknown") {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "peer is unknown", v, err)
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SET", "key", "value"}, {"OK"},
+		{"RAFTTRANSFERLEADER", follower.addr()}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	if err := raftWaitForLeader(follower); err != nil {
+		return err
+	}
+	mc.ResetConn()
+	// the new leader has every write of the old leader.
+	if err := mc.DoBatch([][]interface{}{
+		{"GET", "key"}, {"value"},
+		{"RAFTTRANSFERLEADER"}, {"OK"},
+		{"RAFTTRANSFERLEADER", "a", "b"}, {"ERR wrong number of arguments for 'RAFTTRANSFERLEADER' command"},
+	}); err != nil {
+		return err
+	}
+	if v, err := redis.String(follower.Do("RAFTSTATE")); err != nil || v == "Leader" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "Follower", v, err)
+	}
+	return nil
+}
+
+func subTestSecret(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "reject", secret_REJECT_test)
+	// a server without a secret checks the raft RPCs with the ACL.
+	s, err := mockOpenServerOptions(nil, mockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := &mockCluster{ss: []*mockServer{s}}
+	defer nc.Close()
+	runStep(t, nc, "authorize", secret_AUTHORIZE_test)
+}
+
+func secret_REJECT_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"RAFTREQUESTVOTE", "{}"}, {"NOAUTH invalid peer secret"},
+		{"RAFTREQUESTVOTE", "{}", "wrong"}, {"NOAUTH invalid peer secret"},
+		{"RAFTAPPENDENTRIES", "", "wrong"}, {"NOAUTH invalid peer secret"},
+		{"RAFTTIMEOUTNOW", "{}"}, {"NOAUTH invalid peer secret"},
+		{"RAFTINSTALLSNAPSHOT", "{}"}, {"NOAUTH invalid peer secret"},
+	})
+}
+
+func secret_AUTHORIZE_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"ACL", "SETUSER", "bob", "on", ">pw", "+@all", "-@raft"}, {"OK"},
+		{"AUTH", "bob", "pw"}, {"OK"},
+		{"RAFTREQUESTVOTE", "{}"}, {"NOPERM this user has no permissions to run the 'raftrequestvote' command"},
+		{"RAFTINSTALLSNAPSHOT", "{}"}, {"NOPERM this user has no permissions to run the 'raftinstallsnapshot' command"},
+	})
+}
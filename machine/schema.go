@@ -0,0 +1,702 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+const schemaKeyPrefix = sdbMetaPrefix + "schema:"
+
+// schemaArgs is the stored representation of a schema.
+type schemaArgs struct {
+	Name    string          `json:"name,omitempty"`
+	Pattern string          `json:"pattern,omitempty"`
+	Schema  json.RawMessage `json:"schema,omitempty"`
+}
+
+// compiledSchema is a schema that is compiled from its stored definition.
+type compiledSchema struct {
+	name    string
+	pattern string
+	schema  *jsonSchema
+}
+
+// loadSchemas compiles the schemas that are stored in the database.
+func loadSchemas(tx *buntdb.Tx) (interface{}, error) {
+	var schemas []compiledSchema
+	var ierr error
+	if err := tx.AscendGreaterOrEqual("", schemaKeyPrefix, func(skey, sval string) bool {
+		if !strings.HasPrefix(skey, schemaKeyPrefix) {
+			return false
+		}
+		name := skey[len(schemaKeyPrefix):]
+		var sargs schemaArgs
+		if err := json.Unmarshal([]byte(sval), &sargs); err != nil {
+			ierr = fmt.Errorf("ERR parsing schema '%v': %v", name, err)
+			return false
+		}
+		schema, err := compileSchema(sargs.Schema)
+		if err != nil {
+			ierr = fmt.Errorf("ERR parsing schema '%v': %v", name, err)
+			return false
+		}
+		schemas = append(schemas, compiledSchema{name, sargs.Pattern, schema})
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if ierr != nil {
+		return nil, ierr
+	}
+	return schemas, nil
+}
+
+// txSet sets a user key after validating the value against all schemas
+// that match the key. The key is assigned a new version, and the set
+// triggers that match the key are fired.
+func (m *Machine) txSet(conn redcon.Conn, tx *buntdb.Tx, key, val string, opts *buntdb.SetOptions) error {
+	return m.txSetEvent(conn, tx, "set", key, val, opts)
+}
+
+// txSetJSON is like txSet, but fires the jset triggers.
+func (m *Machine) txSetJSON(conn redcon.Conn, tx *buntdb.Tx, key, val string, opts *buntdb.SetOptions) error {
+	return m.txSetEvent(conn, tx, "jset", key, val, opts)
+}
+
+func (m *Machine) txSetEvent(conn redcon.Conn, tx *buntdb.Tx, event, key, val string, opts *buntdb.SetOptions) error {
+	if err := m.checkSchemas(tx, key, val); err != nil {
+		return err
+	}
+	prev, replaced, err := tx.Set(key, val, opts)
+	if err != nil {
+		return err
+	}
+	if err := m.touchKey(tx, key); err != nil {
+		return err
+	}
+	var oldVal *string
+	if replaced {
+		oldVal = &prev
+	}
+	return m.fireTriggers(conn, tx, event, key, oldVal, &val)
+}
+
+// checkSchemas validates a value against every schema that has a pattern
+// matching the key.
+func (m *Machine) checkSchemas(tx *buntdb.Tx, key, val string) error {
+	if isMercMetaKey(key) {
+		return nil
+	}
+	v, err := m.schemas.get(tx, loadSchemas)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	var parsed bool
+	for _, s := range v.([]compiledSchema) {
+		if !match.Match(key, s.pattern) {
+			continue
+		}
+		name := s.name
+		if !parsed {
+			if err := json.Unmarshal([]byte(val), &doc); err != nil {
+				return fmt.Errorf("ERR schema '%s' violation: value is not valid JSON", name)
+			}
+			parsed = true
+		}
+		if err := s.schema.validate(doc, nil); err != nil {
+			serr := err.(*schemaError)
+			return fmt.Errorf("ERR schema '%s' violation at '%s': %s", name, serr.where(), serr.msg)
+		}
+	}
+	return nil
+}
+
+// schemaError is returned when a value does not validate.
+type schemaError struct {
+	path []string
+	msg  string
+}
+
+func (err *schemaError) Error() string {
+	return err.where() + ": " + err.msg
+}
+
+func (err *schemaError) where() string {
+	if len(err.path) == 0 {
+		return "(root)"
+	}
+	return strings.Join(err.path, ".")
+}
+
+// jsonSchema is a compiled JSON Schema. Only a subset of draft 7 is
+// supported: type, enum, const, the numeric, string, array and object
+// validation keywords, and the allOf, anyOf, oneOf and not combinators.
+type jsonSchema struct {
+	reject     bool // the "false" schema
+	types      []string
+	enum       []interface{}
+	hasConst   bool
+	constv     interface{}
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	multipleOf *float64
+	minLength  int
+	maxLength  int
+	pattern    *regexp.Regexp
+	items      *jsonSchema
+	tuple      []*jsonSchema
+	addlItems  *jsonSchema
+	minItems   int
+	maxItems   int
+	unique     bool
+	props      map[string]*jsonSchema
+	required   []string
+	addlProps  *jsonSchema
+	minProps   int
+	maxProps   int
+	allOf      []*jsonSchema
+	anyOf      []*jsonSchema
+	oneOf      []*jsonSchema
+	not        *jsonSchema
+}
+
+var errInvalidSchema = errors.New("ERR invalid schema")
+
+func compileSchema(data []byte) (*jsonSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, errInvalidSchema
+	}
+	s, err := compileSchemaValue(v)
+	if err != nil {
+		return nil, fmt.Errorf("ERR invalid schema: %v", err)
+	}
+	return s, nil
+}
+
+func compileSchemaValue(v interface{}) (*jsonSchema, error) {
+	s := &jsonSchema{minLength: -1, maxLength: -1, minItems: -1,
+		maxItems: -1, minProps: -1, maxProps: -1}
+	switch v := v.(type) {
+	case bool:
+		s.reject = !v
+		return s, nil
+	case map[string]interface{}:
+		for key, val := range v {
+			if err := s.compileKeyword(key, val); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return nil, errors.New("schema must be an object or boolean")
+}
+
+func (s *jsonSchema) compileKeyword(key string, val interface{}) error {
+	var err error
+	switch key {
+	default:
+		// unknown keywords are ignored
+	case "type":
+		switch val := val.(type) {
+		case string:
+			s.types = []string{val}
+		case []interface{}:
+			for _, t := range val {
+				ts, ok := t.(string)
+				if !ok {
+					return errors.New("'type' must be a string or array of strings")
+				}
+				s.types = append(s.types, ts)
+			}
+		default:
+			return errors.New("'type' must be a string or array of strings")
+		}
+		for _, t := range s.types {
+			switch t {
+			default:
+				return fmt.Errorf("unknown type '%s'", t)
+			case "null", "boolean", "object", "array", "number", "string", "integer":
+			}
+		}
+	case "enum":
+		arr, ok := val.([]interface{})
+		if !ok {
+			return errors.New("'enum' must be an array")
+		}
+		s.enum = arr
+	case "const":
+		s.hasConst = true
+		s.constv = val
+	case "minimum":
+		s.minimum, err = schemaNumber(key, val)
+	case "maximum":
+		s.maximum, err = schemaNumber(key, val)
+	case "exclusiveMinimum":
+		s.exclMin, err = schemaNumber(key, val)
+	case "exclusiveMaximum":
+		s.exclMax, err = schemaNumber(key, val)
+	case "multipleOf":
+		s.multipleOf, err = schemaNumber(key, val)
+		if err == nil && *s.multipleOf <= 0 {
+			err = errors.New("'multipleOf' must be greater than 0")
+		}
+	case "minLength":
+		s.minLength, err = schemaCount(key, val)
+	case "maxLength":
+		s.maxLength, err = schemaCount(key, val)
+	case "pattern":
+		str, ok := val.(string)
+		if !ok {
+			return errors.New("'pattern' must be a string")
+		}
+		s.pattern, err = regexp.Compile(str)
+	case "items":
+		if arr, ok := val.([]interface{}); ok {
+			s.tuple, err = schemaList(key, arr)
+		} else {
+			s.items, err = compileSchemaValue(val)
+		}
+	case "additionalItems":
+		s.addlItems, err = compileSchemaValue(val)
+	case "minItems":
+		s.minItems, err = schemaCount(key, val)
+	case "maxItems":
+		s.maxItems, err = schemaCount(key, val)
+	case "uniqueItems":
+		b, ok := val.(bool)
+		if !ok {
+			return errors.New("'uniqueItems' must be a boolean")
+		}
+		s.unique = b
+	case "properties":
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return errors.New("'properties' must be an object")
+		}
+		s.props = make(map[string]*jsonSchema)
+		for name, pval := range obj {
+			if s.props[name], err = compileSchemaValue(pval); err != nil {
+				return err
+			}
+		}
+	case "required":
+		arr, ok := val.([]interface{})
+		if !ok {
+			return errors.New("'required' must be an array of strings")
+		}
+		for _, r := range arr {
+			rs, ok := r.(string)
+			if !ok {
+				return errors.New("'required' must be an array of strings")
+			}
+			s.required = append(s.required, rs)
+		}
+	case "additionalProperties":
+		s.addlProps, err = compileSchemaValue(val)
+	case "minProperties":
+		s.minProps, err = schemaCount(key, val)
+	case "maxProperties":
+		s.maxProps, err = schemaCount(key, val)
+	case "allOf":
+		s.allOf, err = schemaArray(key, val)
+	case "anyOf":
+		s.anyOf, err = schemaArray(key, val)
+	case "oneOf":
+		s.oneOf, err = schemaArray(key, val)
+	case "not":
+		s.not, err = compileSchemaValue(val)
+	}
+	return err
+}
+
+func schemaNumber(key string, val interface{}) (*float64, error) {
+	n, ok := val.(float64)
+	if !ok {
+		return nil, fmt.Errorf("'%s' must be a number", key)
+	}
+	return &n, nil
+}
+
+func schemaCount(key string, val interface{}) (int, error) {
+	n, ok := val.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("'%s' must be a non-negative integer", key)
+	}
+	return int(n), nil
+}
+
+func schemaArray(key string, val interface{}) ([]*jsonSchema, error) {
+	arr, ok := val.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil, fmt.Errorf("'%s' must be a non-empty array", key)
+	}
+	return schemaList(key, arr)
+}
+
+func schemaList(key string, arr []interface{}) ([]*jsonSchema, error) {
+	var list []*jsonSchema
+	for _, v := range arr {
+		s, err := compileSchemaValue(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// jsonType returns the schema type name for a decoded json value.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func schemaFail(path []string, format string, args ...interface{}) error {
+	return &schemaError{
+		path: append([]string(nil), path...),
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+// validate checks the value against the schema. The path is the location
+// of the value in the document and is used for error reporting.
+func (s *jsonSchema) validate(v interface{}, path []string) error {
+	if s.reject {
+		return schemaFail(path, "value is not allowed")
+	}
+	if len(s.types) > 0 {
+		vt := jsonType(v)
+		var ok bool
+		for _, t := range s.types {
+			if t == vt || (t == "number" && vt == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return schemaFail(path, "expected %s, got %s",
+				strings.Join(s.types, " or "), strings.Replace(vt, "integer", "number", 1))
+		}
+	}
+	if s.enum != nil {
+		var ok bool
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return schemaFail(path, "value is not one of the enumerated values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constv, v) {
+		return schemaFail(path, "value does not match const")
+	}
+	switch v := v.(type) {
+	case float64:
+		if err := s.validateNumber(v, path); err != nil {
+			return err
+		}
+	case string:
+		if err := s.validateString(v, path); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(v, path); err != nil {
+			return err
+		}
+	case map[string]interface{}:
+		if err := s.validateObject(v, path); err != nil {
+			return err
+		}
+	}
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var ok bool
+		for _, sub := range s.anyOf {
+			if sub.validate(v, path) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return schemaFail(path, "value does not match any schema in anyOf")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		var n int
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return schemaFail(path, "value must match exactly one schema in oneOf, matched %d", n)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return schemaFail(path, "value must not match schema in not")
+	}
+	return nil
+}
+
+func formatSchemaNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func (s *jsonSchema) validateNumber(n float64, path []string) error {
+	if s.minimum != nil && n < *s.minimum {
+		return schemaFail(path, "must be >= %s", formatSchemaNumber(*s.minimum))
+	}
+	if s.maximum != nil && n > *s.maximum {
+		return schemaFail(path, "must be <= %s", formatSchemaNumber(*s.maximum))
+	}
+	if s.exclMin != nil && n <= *s.exclMin {
+		return schemaFail(path, "must be > %s", formatSchemaNumber(*s.exclMin))
+	}
+	if s.exclMax != nil && n >= *s.exclMax {
+		return schemaFail(path, "must be < %s", formatSchemaNumber(*s.exclMax))
+	}
+	if s.multipleOf != nil {
+		q := n / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			return schemaFail(path, "must be a multiple of %s", formatSchemaNumber(*s.multipleOf))
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateString(str string, path []string) error {
+	if s.minLength >= 0 || s.maxLength >= 0 {
+		n := utf8.RuneCountInString(str)
+		if s.minLength >= 0 && n < s.minLength {
+			return schemaFail(path, "length must be >= %d", s.minLength)
+		}
+		if s.maxLength >= 0 && n > s.maxLength {
+			return schemaFail(path, "length must be <= %d", s.maxLength)
+		}
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return schemaFail(path, "does not match pattern '%s'", s.pattern.String())
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(arr []interface{}, path []string) error {
+	if s.minItems >= 0 && len(arr) < s.minItems {
+		return schemaFail(path, "must have at least %d items", s.minItems)
+	}
+	if s.maxItems >= 0 && len(arr) > s.maxItems {
+		return schemaFail(path, "must have at most %d items", s.maxItems)
+	}
+	if s.unique {
+		for i := 0; i < len(arr); i++ {
+			for j := i + 1; j < len(arr); j++ {
+				if reflect.DeepEqual(arr[i], arr[j]) {
+					return schemaFail(path, "items must be unique")
+				}
+			}
+		}
+	}
+	for i, item := range arr {
+		var sub *jsonSchema
+		if s.tuple != nil {
+			if i < len(s.tuple) {
+				sub = s.tuple[i]
+			} else {
+				sub = s.addlItems
+			}
+		} else {
+			sub = s.items
+		}
+		if sub != nil {
+			if err := sub.validate(item, append(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(obj map[string]interface{}, path []string) error {
+	if s.minProps >= 0 && len(obj) < s.minProps {
+		return schemaFail(path, "must have at least %d properties", s.minProps)
+	}
+	if s.maxProps >= 0 && len(obj) > s.maxProps {
+		return schemaFail(path, "must have at most %d properties", s.maxProps)
+	}
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			return schemaFail(append(path, name), "property is required")
+		}
+	}
+	// iterate in a stable order so that errors are deterministic
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := s.props[name]
+		if !ok {
+			sub = s.addlProps
+		}
+		if sub != nil {
+			if err := sub.validate(obj[name], append(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseSchemaArgs(cmd redcon.Command) (sargs schemaArgs, err error) {
+	if len(cmd.Args) != 4 {
+		err = finn.ErrWrongNumberOfArguments
+		return
+	}
+	sargs.Name = string(cmd.Args[1])
+	sargs.Pattern = string(cmd.Args[2])
+	if _, err = compileSchema(cmd.Args[3]); err != nil {
+		return
+	}
+	// store the schema in a compact form
+	var data interface{}
+	if err = json.Unmarshal(cmd.Args[3], &data); err != nil {
+		return
+	}
+	sargs.Schema, err = json.Marshal(data)
+	return
+}
+
+func (m *Machine) doSetSchema(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SETSCHEMA name pattern schema
+	sargs, err := parseSchemaArgs(cmd)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(sargs)
+	if err != nil {
+		return nil, err
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, _, err := tx.Set(schemaKeyPrefix+sargs.Name, string(data), nil); err != nil {
+			return nil, err
+		}
+		m.schemas.reset(tx)
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doDelSchema(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// DELSCHEMA name
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := tx.Delete(schemaKeyPrefix + string(cmd.Args[1])); err != nil {
+			if err == buntdb.ErrNotFound {
+				return 0, nil
+			}
+			return nil, err
+		}
+		m.schemas.reset(tx)
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doSchemas(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SCHEMAS pattern [DETAILS]
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	pattern := string(cmd.Args[1])
+	var details bool
+	if len(cmd.Args) == 3 {
+		if strings.ToLower(string(cmd.Args[2])) != "details" {
+			return nil, errSyntaxError
+		}
+		details = true
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		var ierr error
+		var schemas []schemaArgs
+		if err := tx.AscendGreaterOrEqual("", schemaKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, schemaKeyPrefix) {
+				return false
+			}
+			name := key[len(schemaKeyPrefix):]
+			if match.Match(name, pattern) {
+				var sargs schemaArgs
+				if err := json.Unmarshal([]byte(val), &sargs); err != nil {
+					ierr = fmt.Errorf("ERR parsing schema '%v': %v", name, err)
+					return false
+				}
+				schemas = append(schemas, sargs)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if ierr != nil {
+			return ierr
+		}
+		if details {
+			conn.WriteArray(len(schemas) * 3)
+		} else {
+			conn.WriteArray(len(schemas))
+		}
+		for _, sargs := range schemas {
+			conn.WriteBulkString(sargs.Name)
+			if details {
+				conn.WriteBulkString(sargs.Pattern)
+				conn.WriteBulk(sargs.Schema)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,76 @@
+package machine
+
+import "testing"
+
+func subTestSchemas(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "SETSCHEMA", schemas_SETSCHEMA_test)
+	runStep(t, mc, "JSET", schemas_JSET_test)
+	runStep(t, mc, "SCHEMAS", schemas_SCHEMAS_test)
+}
+
+const schemasUserSchema = `{
+	"type": "object",
+	"required": ["name"],
+	"properties": {
+		"name": {"type": "object", "properties": {"first": {"type": "string", "minLength": 1}}},
+		"age": {"type": "integer", "minimum": 0},
+		"tags": {"type": "array", "items": {"enum": ["a", "b"]}}
+	}
+}`
+
+func schemas_SETSCHEMA_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SETSCHEMA", "user", "user:*", `{"type":"nope"}`}, {"ERR invalid schema: unknown type 'nope'"},
+		{"SETSCHEMA", "user", "user:*", `{`}, {"ERR invalid schema"},
+		{"SETSCHEMA", "user", "user:*", schemasUserSchema}, {"OK"},
+		{"SET", "user:1", `{"name":{"first":"Tom"},"age":46}`}, {"OK"},
+		{"SET", "user:2", `{"age":46}`}, {"ERR schema 'user' violation at 'name': property is required"},
+		{"SET", "user:2", `{"name":{"first":""}}`}, {"ERR schema 'user' violation at 'name.first': length must be >= 1"},
+		{"SET", "user:2", `{"name":{},"age":4.5}`}, {"ERR schema 'user' violation at 'age': expected integer, got number"},
+		{"SET", "user:2", `{"name":{},"tags":["a","c"]}`}, {"ERR schema 'user' violation at 'tags.1': value is not one of the enumerated values"},
+		{"SET", "user:2", `not json`}, {"ERR schema 'user' violation: value is not valid JSON"},
+		{"MSET", "user:2", `{"name":{}}`, "user:3", `[]`}, {"ERR schema 'user' violation at '(root)': expected object, got array"},
+		{"EXISTS", "user:2"}, {0},
+		{"RESTORE", "user:4", 0, `{"age":-1,"name":{}}`}, {"ERR schema 'user' violation at 'age': must be >= 0"},
+		{"SET", "other:1", `not json`}, {"OK"},
+		{"SETSCHEMA", "user", "user:*", `{"type":"array"}`}, {"OK"},
+		{"SET", "user:2", `{"name":{}}`}, {"ERR schema 'user' violation at '(root)': expected array, got object"},
+		{"SET", "user:2", `[]`}, {"OK"},
+		{"DELSCHEMA", "user"}, {1},
+		{"DELSCHEMA", "user"}, {0},
+		{"SET", "user:2", `{"age":46}`}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SETSCHEMA", "item", "item:*", `{"type":"array"}`}, {"QUEUED"},
+		{"SET", "item:1", `{}`}, {"QUEUED"},
+		{"EXEC"}, {"[OK ERR schema 'item' violation at '(root)': expected array, got object]"},
+		{"SET", "item:1", `{}`}, {"ERR schema 'item' violation at '(root)': expected array, got object"},
+		{"DELSCHEMA", "item"}, {1},
+		{"SET", "item:1", `{}`}, {"OK"},
+	})
+}
+
+func schemas_JSET_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SETSCHEMA", "user", "user:*", schemasUserSchema}, {"OK"},
+		{"JSET", "user:1", "name.first", "Tom"}, {"OK"},
+		{"JSET", "user:1", "age", "old"}, {"ERR schema 'user' violation at 'age': expected integer, got string"},
+		{"JSET", "user:1", "age", 46}, {"OK"},
+		{"JDEL", "user:1", "name"}, {"ERR schema 'user' violation at 'name': property is required"},
+		{"GET", "user:1"}, {`{"age":46,"name":{"first":"Tom"}}`},
+		{"FLUSHDB"}, {"OK"},
+		{"JSET", "user:1", "age", 46}, {"ERR schema 'user' violation at 'name': property is required"},
+		{"DELSCHEMA", "user"}, {1},
+	})
+}
+
+func schemas_SCHEMAS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SETSCHEMA", "user", "user:*", `{"type": "object"}`}, {"OK"},
+		{"SETSCHEMA", "item", "item:*", `{"type": "array"}`}, {"OK"},
+		{"SCHEMAS", "*"}, {"[item user]"},
+		{"SCHEMAS", "u*", "DETAILS"}, {`[user user:* {"type":"object"}]`},
+		{"DELSCHEMA", "user"}, {1},
+		{"DELSCHEMA", "item"}, {1},
+		{"SCHEMAS", "*"}, {"[]"},
+	})
+}
@@ -1,17 +1,21 @@
 package machine
 
 import (
-	"crypto/rand"
+	crand "crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/robertkrimen/otto"
 	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
 	"github.com/tidwall/redcon"
@@ -21,84 +25,91 @@ const scriptErrPrefix = "eval err:"
 const scriptKeyPrefix = sdbMetaPrefix + "script:"
 
 var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+var errScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL")
+var errNotBusy = errors.New("NOTBUSY No scripts in execution right now.")
+var errUnkillable = errors.New("UNKILLABLE The running script may write to the dataset and can't be killed. It will be aborted when it reaches the operation limit.")
 
-// scriptVM is is used to contain a compiled script and the parent otto VM.
+// The default script limits. Read-only scripts are aborted when they run
+// longer than the time limit. Write scripts run on every server in the
+// cluster and must be aborted at the exact same point on each, so they are
+// limited by the number of operations instead. With otto an operation is a
+// single statement or expression, and with goja it's a loop iteration or a
+// function call.
+const (
+	defaultScriptTimeLimit = time.Second * 5
+	defaultScriptOpLimit   = 10000000
+)
+
+// scriptVM is is used to contain a compiled script and the runtime that
+// runs it.
 type scriptVM struct {
-	mu     sync.Mutex
-	script *otto.Script
-	vm     *otto.Otto
+	mu    sync.Mutex
+	prog  scriptProgram
+	rt    scriptRuntime
+	stats scriptStats
+}
+
+// scriptStats are the runtime stats of a script on this server.
+type scriptStats struct {
+	mu      sync.Mutex
+	calls   int64
+	total   time.Duration
+	max     time.Duration
+	lastErr string
 }
 
-// scriptMachine represents a global javascript VM and
+func (st *scriptStats) record(elapsed time.Duration, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.calls++
+	st.total += elapsed
+	if elapsed > st.max {
+		st.max = elapsed
+	}
+	if err != nil {
+		st.lastErr = err.Error()
+	}
+}
+
+// scriptMachine represents a global javascript engine and
 // contains all of the runContexts.
 type scriptMachine struct {
 	mu      sync.Mutex
-	vm      *otto.Otto             // root vm
-	cache   map[string]*scriptVM   // cache scripts
-	runCtxs map[string]*runContext // run contexts
-	log     finn.Logger            // main logger
+	engine  scriptEngine                // javascript engine
+	name    string                      // name of the engine
+	host    scriptHost                  // host functions of the engine
+	cache   map[string]*scriptVM        // cache scripts
+	libs    map[string]*funcLib         // cache function libraries
+	trigs   map[string][]*scriptVM      // idle trigger scripts
+	wenv    scriptEnv                   // environment of the running write script
+	runCtxs map[interface{}]*runContext // run contexts by runtime id
+	log     finn.Logger                 // main logger
+
+	timeLimit time.Duration // time limit for read-only scripts
+	opLimit   int64         // operation limit for write scripts
 }
 
 // newScriptMachine creates a new scriptMachine that is shared
 // for all EVAL calls.
 func newScriptMachine(m *Machine) (*scriptMachine, error) {
 	sm := &scriptMachine{}
-	sm.vm = otto.New()
-	sm.runCtxs = make(map[string]*runContext)
+	sm.runCtxs = make(map[interface{}]*runContext)
 	sm.cache = make(map[string]*scriptVM)
+	sm.libs = make(map[string]*funcLib)
+	sm.trigs = make(map[string][]*scriptVM)
 	sm.log = m.log
-	_, err := sm.vm.Run(`
-			var SummitDB = (function(){
-				var ErrorReply = function(err){
-					this.err = err;
-				}
-				var StatusReply = function(ok){
-					this.ok = ok;
-				}
-				ErrorReply.prototype.toString = function(){
-					return this.err.toString();
-				}
-				StatusReply.prototype.toString = function(){
-					return this.ok.toString();
-				}
-				var SummitDB = function(){}
-				SummitDB.prototype.errorReply = function(err){
-					return new ErrorReply(err);
-				}
-				SummitDB.prototype.statusReply = function(ok){
-					return new StatusReply(ok);
-				}
-				SummitDB.prototype.toString = function(){
-					return "[object SummitDB]";
-				}
-				return SummitDB;
-			}())
-			var sdb = new SummitDB();
-			var redis = sdb;
-		`)
-	if err != nil {
-		return nil, err
-	}
-	v, err := sm.vm.Get("SummitDB")
-	if err != nil {
-		return nil, err
-	}
-	v, err = v.Object().Get("prototype")
-	if err != nil {
-		return nil, err
-	}
-	proto := v.Object()
-	sdbCall := func(name string, call otto.FunctionCall) otto.Value {
-		v, err := call.Otto.Get("runid")
-		if err != nil {
-			panic(scriptErrPrefix + err.Error())
-		}
-		runid := v.String()
-		sm.mu.Lock()
-		ctx := sm.runCtxs[runid]
-		sm.mu.Unlock()
-		cmd := cmdFromArgs(call.Otto, call.ArgumentList)
-		_, err = m.doScriptableCommand(ctx.a, ctx.conn, cmd, ctx.tx)
+	sm.timeLimit = defaultScriptTimeLimit
+	sm.opLimit = defaultScriptOpLimit
+	sdbCall := func(name string, rt scriptRuntime, args []scriptValue) scriptValue {
+		ctx := sm.callContext(rt, "sdb."+name)
+		cmd := cmdFromArgs(args)
+		var err error
+		if ctx.user != nil {
+			err = ctx.user.check(qcmdlower(cmd.Args[0]), cmd)
+		}
+		if err == nil {
+			_, err = m.doScriptableCommand(ctx.a, ctx.conn, cmd, ctx.tx)
+		}
 		if err != nil {
 			if err == finn.ErrUnknownCommand {
 				err = errors.New("ERR unknown command '" + string(cmd.Args[0]) + "'")
@@ -108,56 +119,115 @@ func newScriptMachine(m *Machine) (*scriptMachine, error) {
 			if name == "call" {
 				panic(scriptErrPrefix + err.Error())
 			}
-			val, err := call.Otto.Call(`sdb.errorReply`, nil, err.Error())
-			if err != nil {
-				panic(scriptErrPrefix + err.Error())
-			}
-			return val
+			return rt.toValue(errorReply(err.Error()))
 		}
-		return jsValue(ctx.conn, call.Otto)
+		return jsValue(ctx.conn, rt)
 	}
-	if err := proto.Set("call", func(call otto.FunctionCall) otto.Value {
-		return sdbCall("call", call)
-	}); err != nil {
-		return nil, err
+	// redirect the console.log
+	log := m.log
+	sm.host = scriptHost{
+		"sdb.call": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			return sdbCall("call", rt, args)
+		},
+		"sdb.pcall": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			return sdbCall("pcall", rt, args)
+		},
+		"sdb.now": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			ctx := sm.callContext(rt, "Date")
+			if !ctx.env.ok {
+				panic(scriptErrPrefix + "ERR Date is not available to a trigger that was fired outside of a script")
+			}
+			return rt.toValue(ctx.env.now)
+		},
+		"sdb.iter": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			return sm.scriptIter(m, rt, args)
+		},
+		"sdb.rect": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			return sm.scriptRect(m, rt, args)
+		},
+		"sdb.jget": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			return sm.scriptJget(rt, args)
+		},
+		"console.log": func(rt scriptRuntime, args []scriptValue) scriptValue {
+			if len(args) > 0 {
+				var out string
+				for i, arg := range args {
+					if i > 0 {
+						out += " "
+					}
+					val := arg.export()
+					if arg.isObject() {
+						data, err := json.Marshal(val)
+						if err == nil {
+							val = string(data)
+						}
+					}
+					out += fmt.Sprint(val)
+				}
+				log.Verbosef("eval: %s", out)
+				// capture the output for EVAL DEBUG
+				if ctx := sm.lookupContext(rt); ctx != nil && ctx.output != nil {
+					*ctx.output = append(*ctx.output, out)
+				}
+			}
+			return nil
+		},
 	}
-	if err := proto.Set("pcall", func(call otto.FunctionCall) otto.Value {
-		return sdbCall("pcall", call)
-	}); err != nil {
+	if err := sm.setEngine("otto"); err != nil {
 		return nil, err
 	}
+	return sm, nil
+}
 
-	// redirect the console.log
-	log := m.log
-	console, err := sm.vm.Get("console")
+// setEngine replaces the javascript engine. The compiled scripts and
+// libraries of the previous engine are dropped.
+func (sm *scriptMachine) setEngine(name string) error {
+	engine, err := newScriptEngine(name, sm.host)
+	if err != nil {
+		return err
+	}
+	sm.useEngine(name, engine)
+	return nil
+}
+
+// useEngine replaces the javascript engine with an engine that was created
+// by newScriptEngine.
+func (sm *scriptMachine) useEngine(name string, engine scriptEngine) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.engine = engine
+	sm.name = strings.ToLower(name)
+	sm.cache = make(map[string]*scriptVM)
+	sm.libs = make(map[string]*funcLib)
+	sm.trigs = make(map[string][]*scriptVM)
+}
+
+// getEngineName returns the name of the javascript engine.
+func (sm *scriptMachine) getEngineName() string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.name
+}
+
+// getEngine returns the javascript engine.
+func (sm *scriptMachine) getEngine() scriptEngine {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.engine
+}
+
+// newScriptVM returns a new runtime with the compiled script. The script is
+// the body of a function.
+func (sm *scriptMachine) newScriptVM(javascript string) (*scriptVM, error) {
+	rt, err := sm.engine.newRuntime()
 	if err != nil {
 		return nil, err
 	}
-	err = console.Object().Set("log", func(call otto.FunctionCall) otto.Value {
-		args := call.ArgumentList
-		if len(args) > 0 {
-			var out string
-			for i, arg := range args {
-				if i > 0 {
-					out += " "
-				}
-				val, _ := arg.Export()
-				if !arg.IsPrimitive() {
-					data, err := json.Marshal(val)
-					if err == nil {
-						val = string(data)
-					}
-				}
-				out += fmt.Sprint(val)
-			}
-			log.Verbosef("eval: %s", out)
-		}
-		return otto.Value{}
-	})
+	prog, err := rt.compile(javascript)
 	if err != nil {
 		return nil, err
 	}
-	return sm, nil
+	return &scriptVM{rt: rt, prog: prog}, nil
 }
 
 func (sm *scriptMachine) flushScripts() {
@@ -172,12 +242,11 @@ func (sm *scriptMachine) compileScript(javascript string) (sha string, script *s
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	var ok bool
-	script = sm.cache[sha]
+	script, ok = sm.cache[sha]
 	if ok {
 		return sha, script, nil
 	}
-	script = &scriptVM{vm: sm.vm.Copy()}
-	script.script, err = script.vm.Compile("", "(function(){"+javascript+"})()")
+	script, err = sm.newScriptVM(javascript)
 	if err != nil {
 		return "", script, err
 	}
@@ -191,60 +260,277 @@ func (sm *scriptMachine) getScript(sha string) *scriptVM {
 	return sm.cache[sha]
 }
 
-func (sm *scriptMachine) addRunContext(runid string, tx *buntdb.Tx) {
+func (sm *scriptMachine) addRunContext(rt scriptRuntime, tx *buntdb.Tx, writable bool, caller scriptCaller, user *aclUser, env scriptEnv, output *[]string) *runContext {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	sm.runCtxs[runid] = &runContext{
-		tx:   tx,
-		conn: &passiveConn{},
-		a:    &passiveApplier{log: sm.log},
-	}
+	ctx := &runContext{
+		tx:       tx,
+		conn:     &passiveConn{user: caller.user, triggerDepth: caller.depth},
+		a:        &passiveApplier{log: sm.log},
+		user:     user,
+		writable: writable,
+		env:      env,
+		rand:     rand.New(rand.NewSource(env.seed)),
+		output:   output,
+	}
+	sm.runCtxs[rt.id()] = ctx
+	return ctx
+}
+
+// callContext returns the run context for a call from javascript. Panics
+// when no script is running, such as while a function library is loading.
+func (sm *scriptMachine) callContext(rt scriptRuntime, name string) *runContext {
+	ctx := sm.lookupContext(rt)
+	if ctx == nil {
+		panic(scriptErrPrefix + "ERR " + name + " can only be used while a script is running")
+	}
+	return ctx
+}
+
+// lookupContext returns the run context for a call from javascript, or nil
+// when no script is running.
+func (sm *scriptMachine) lookupContext(rt scriptRuntime) *runContext {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.runCtxs[rt.id()]
+}
+
+func (sm *scriptMachine) removeRunContext(rt scriptRuntime) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.runCtxs, rt.id())
+}
+
+// setLimits sets the time limit for read-only scripts and the operation
+// limit for write scripts. Zero means no limit.
+func (sm *scriptMachine) setLimits(timeLimit time.Duration, opLimit int64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.timeLimit = timeLimit
+	sm.opLimit = opLimit
+}
+
+// limitScript installs a limiter on the script runtime which enforces the
+// script limits. The limiter is called once for every operation. Otto calls
+// it from its interrupt channel, which the vendored otto polls before each
+// statement and before each expression node, so a statement with nested
+// expressions counts as several operations. Goja calls it for each loop
+// iteration and function call.
+func (sm *scriptMachine) limitScript(rt scriptRuntime, ctx *runContext) {
+	sm.mu.Lock()
+	timeLimit, opLimit := sm.timeLimit, sm.opLimit
+	sm.mu.Unlock()
+	var deadline time.Time
+	if !ctx.writable && timeLimit > 0 {
+		deadline = time.Now().Add(timeLimit)
+	}
+	var ops int64
+	rt.setLimiter(func() {
+		ops++
+		if ctx.writable {
+			if opLimit > 0 && ops > opLimit {
+				panic(fmt.Sprintf("%sERR Script exceeded the limit of %d operations", scriptErrPrefix, opLimit))
+			}
+		} else {
+			if atomic.LoadInt32(&ctx.killed) != 0 {
+				panic(scriptErrPrefix + errScriptKilled.Error())
+			}
+			// checking the clock on every operation is too costly
+			if !deadline.IsZero() && ops%256 == 0 && time.Now().After(deadline) {
+				panic(fmt.Sprintf("%sERR Script exceeded the time limit of %v", scriptErrPrefix, timeLimit))
+			}
+		}
+	})
 }
-func (sm *scriptMachine) removeRunContext(runid string) {
+
+// killScripts kills all running read-only scripts.
+func (sm *scriptMachine) killScripts() error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	delete(sm.runCtxs, runid)
+	var killed, unkillable int
+	for _, ctx := range sm.runCtxs {
+		if ctx.writable {
+			unkillable++
+		} else {
+			atomic.StoreInt32(&ctx.killed, 1)
+			killed++
+		}
+	}
+	if killed == 0 {
+		if unkillable > 0 {
+			return errUnkillable
+		}
+		return errNotBusy
+	}
+	return nil
 }
 
 // runContext is used for unique values for each EVAL call.
 type runContext struct {
-	a    *passiveApplier
-	conn *passiveConn
-	tx   *buntdb.Tx
+	a        *passiveApplier
+	conn     *passiveConn
+	tx       *buntdb.Tx
+	user     *aclUser // the commands are checked as the user, nil when not checked
+	writable bool     // script is limited by operations, not time
+	killed   int32    // set by SCRIPT KILL
+	env      scriptEnv
+	rand     *rand.Rand // seeded from env, used by Math.random
+	output   *[]string  // captured console output, when not nil
 }
 
-// cmdFromArgs creates a redcon.Command from javascript values
-func cmdFromArgs(vm *otto.Otto, args []otto.Value) redcon.Command {
-	if len(args) == 0 {
-		v, err := otto.ToValue("")
-		if err != nil {
-			panic(err)
+// scriptCaller is who runs a script.
+type scriptCaller struct {
+	user  string // the user that the commands are checked as, empty when not checked
+	depth int    // number of triggers that are running
+}
+
+// callerOf returns the caller of a script that runs for a command on the
+// conn. The user is from the SCRIPTENV of the command, because the conn is
+// nil when a write is applied from the raft log.
+func callerOf(conn redcon.Conn, user string) scriptCaller {
+	return scriptCaller{user: user, depth: triggerDepth(conn)}
+}
+
+// check panics with a NOPERM error when the user of the script can't run
+// the command.
+func (ctx *runContext) check(args ...[]byte) {
+	if ctx.user == nil {
+		return
+	}
+	cmd := buildCommand(args)
+	if err := ctx.user.check(qcmdlower(cmd.Args[0]), cmd); err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+}
+
+// scriptEnv is the clock and random seed for a script. Scripts that are
+// replayed on the followers must see the exact same values as the leader,
+// so the leader picks them and they are stored in the raft log along with
+// the command.
+type scriptEnv struct {
+	ok   bool  // false when there is no clock or random source
+	now  int64 // unix time in milliseconds
+	seed int64
+}
+
+// writeEnv returns the environment of the running write script. Triggers
+// use this environment, and when a trigger is fired by a command that is not
+// a script then there is no environment.
+func (sm *scriptMachine) writeEnv() scriptEnv {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.wenv
+}
+
+// swapWriteEnv sets the environment of the running write script and
+// returns the previous environment.
+func (sm *scriptMachine) swapWriteEnv(env scriptEnv) scriptEnv {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	prev := sm.wenv
+	sm.wenv = env
+	return prev
+}
+
+// newScriptEnv returns an environment with the current time and a random seed.
+func newScriptEnv() scriptEnv {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic("random err: " + err.Error())
+	}
+	return scriptEnv{
+		ok:   true,
+		now:  time.Now().UnixNano() / int64(time.Millisecond),
+		seed: int64(binary.LittleEndian.Uint64(b[:])),
+	}
+}
+
+// scriptEnvCommand returns the environment for an EVAL or FCALL command.
+// The command may already be wrapped in a SCRIPTENV, which happens when it's
+// replayed from the raft log or from a MULTI. Otherwise a new environment is
+// created and the command is wrapped:
+//
+//	SCRIPTENV now seed [USER name] command [arg ...]
+//
+// The user is the user that the commands of the script are checked as, which
+// is empty when they're not checked. Returns the unwrapped command and the
+// wrapped command. The wrapped command is the one that must be applied.
+func scriptEnvCommand(cmd redcon.Command, user string) (env scriptEnv, scriptUser string, inner, wrapped redcon.Command, err error) {
+	if qcmdlower(cmd.Args[0]) != "scriptenv" {
+		env = newScriptEnv()
+		args := [][]byte{
+			[]byte("scriptenv"),
+			[]byte(strconv.FormatInt(env.now, 10)),
+			[]byte(strconv.FormatInt(env.seed, 10)),
+		}
+		if user != "" {
+			args = append(args, []byte("user"), []byte(user))
+		}
+		return env, user, cmd, buildCommand(append(args, cmd.Args...)), nil
+	}
+	i, user := scriptEnvInner(cmd.Args)
+	if i == len(cmd.Args) {
+		return env, "", inner, wrapped, finn.ErrWrongNumberOfArguments
+	}
+	env.ok = true
+	env.now, err = strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return env, "", inner, wrapped, errNotAnInt
+	}
+	env.seed, err = strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return env, "", inner, wrapped, errNotAnInt
+	}
+	return env, user, buildCommand(cmd.Args[i:]), cmd, nil
+}
+
+// scriptEnvInner returns the position of the command in the args of a
+// SCRIPTENV, which is the length of the args when there's no command, and
+// the user of the USER option.
+func scriptEnvInner(args [][]byte) (int, string) {
+	if len(args) > 3 && qcmdlower(args[3]) == "user" {
+		if len(args) < 6 {
+			return len(args), ""
 		}
-		args = append(args, v)
+		return 5, string(args[4])
 	}
+	if len(args) < 4 {
+		return len(args), ""
+	}
+	return 3, ""
+}
+
+// cmdFromArgs creates a redcon.Command from javascript values
+func cmdFromArgs(args []scriptValue) redcon.Command {
 	// construct the command
+	n := len(args)
+	if n == 0 {
+		n = 1
+	}
 	var poss []int
 	var buf []byte
 	buf = append(buf, '*')
-	buf = append(buf, strconv.FormatInt(int64(len(args)), 10)...)
+	buf = append(buf, strconv.FormatInt(int64(n), 10)...)
 	buf = append(buf, '\r', '\n')
-	for _, arg := range args {
+	for i := 0; i < n; i++ {
 		var s string
-		if !arg.IsPrimitive() {
-			narg, err := vm.Call(`JSON.stringify`, nil, arg)
-			if err != nil {
-				narg = arg
-			}
-			s = narg.String()
-		} else if arg.IsBoolean() {
-			t, _ := arg.ToBoolean()
-			if t {
-				s = "1"
+		if i < len(args) {
+			arg := args[i]
+			if arg.isObject() {
+				if js, err := arg.json(); err == nil {
+					s = js
+				} else {
+					s = arg.String()
+				}
+			} else if arg.isBoolean() {
+				if arg.toBoolean() {
+					s = "1"
+				} else {
+					s = "0"
+				}
 			} else {
-				s = "0"
+				s = arg.String()
 			}
-		} else {
-			s = arg.String()
 		}
 		buf = append(buf, '$')
 		buf = append(buf, strconv.FormatInt(int64(len(s)), 10)...)
@@ -263,32 +549,37 @@ func cmdFromArgs(vm *otto.Otto, args []otto.Value) redcon.Command {
 
 // jsValue reads through the scriptConn resps and generates a javascript value
 // that can be returned to EVAL call for further processing.
-func jsValue(conn *passiveConn, vm *otto.Otto) otto.Value {
+func jsValue(conn *passiveConn, rt scriptRuntime) scriptValue {
+	return rt.toValue(respValue(conn))
+}
+
+// respValue reads the next response from the scriptConn resps. Status and
+// error replies become statusReply and errorReply, arrays become slices, and
+// nulls are undefined.
+func respValue(conn *passiveConn) interface{} {
 	if len(conn.resps) == 0 {
-		return otto.Value{}
+		return undefined{}
 	}
 	resp := conn.resps[0]
 	conn.resps = conn.resps[1:]
-	var val otto.Value
 	switch v := resp.(type) {
 	case string:
-		val, _ = vm.Call("sdb.statusReply", nil, v)
+		return statusReply(v)
 	case int64:
-		val, _ = vm.ToValue(v)
+		return v
 	case []byte:
-		val, _ = vm.ToValue(string(v))
+		return string(v)
 	case error:
-		val, _ = vm.Call("sdb.errorReply", nil, v)
+		return errorReply(v.Error())
 	case []int:
 		n := v[0]
-		o, _ := vm.Object(`([])`)
+		items := make([]interface{}, n)
 		for i := 0; i < n; i++ {
-			val := jsValue(conn, vm)
-			o.Call("push", val)
+			items[i] = respValue(conn)
 		}
-		val = o.Value()
+		return items
 	}
-	return val
+	return undefined{}
 }
 
 func (m *Machine) doScript(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
@@ -305,6 +596,12 @@ func (m *Machine) doScript(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		case "flush":
 			// SCRIPT FLUSH
 			return m.doScriptFlush(a, conn, cmd, tx)
+		case "kill":
+			// SCRIPT KILL
+			return m.doScriptKill(a, conn, cmd, tx)
+		case "stats":
+			// SCRIPT STATS
+			return m.doScriptStats(a, conn, cmd, tx)
 		}
 	}()
 	if err != nil {
@@ -372,11 +669,187 @@ func (m *Machine) doScriptFlush(a finn.Applier, conn redcon.Conn, cmd redcon.Com
 	})
 }
 
+func (m *Machine) doScriptKill(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SCRIPT KILL
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	// The running scripts are local to this server, so the kill does not go
+	// through the raft log. Also it must not wait for the running scripts.
+	if err := m.sm.killScripts(); err != nil {
+		return nil, err
+	}
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// scriptStatsEntry is a snapshot of the stats for one script.
+type scriptStatsEntry struct {
+	sha     string
+	calls   int64
+	total   time.Duration
+	max     time.Duration
+	lastErr string
+}
+
+// allStats returns the stats for all of the cached scripts, ordered by sha.
+func (sm *scriptMachine) allStats() []scriptStatsEntry {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	entries := make([]scriptStatsEntry, 0, len(sm.cache))
+	for sha, script := range sm.cache {
+		script.stats.mu.Lock()
+		entries = append(entries, scriptStatsEntry{
+			sha:     sha,
+			calls:   script.stats.calls,
+			total:   script.stats.total,
+			max:     script.stats.max,
+			lastErr: script.stats.lastErr,
+		})
+		script.stats.mu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sha < entries[j].sha
+	})
+	return entries
+}
+
+func (m *Machine) doScriptStats(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SCRIPT STATS
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	// The stats are for the scripts that have run on this server, so they
+	// do not go through the raft log.
+	entries := m.sm.allStats()
+	conn.WriteArray(len(entries))
+	for _, e := range entries {
+		conn.WriteArray(10)
+		conn.WriteBulkString("sha")
+		conn.WriteBulkString(e.sha)
+		conn.WriteBulkString("calls")
+		conn.WriteInt64(e.calls)
+		conn.WriteBulkString("total_time_us")
+		conn.WriteInt64(int64(e.total / time.Microsecond))
+		conn.WriteBulkString("max_time_us")
+		conn.WriteInt64(int64(e.max / time.Microsecond))
+		conn.WriteBulkString("last_error")
+		if e.lastErr == "" {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(e.lastErr)
+		}
+	}
+	return nil, nil
+}
+
+// scriptKeysAndArgs returns the keys and args from an EVAL or FCALL command.
+// The second argument is the number of keys.
+func scriptKeysAndArgs(cmd redcon.Command) (keys, argv []string, err error) {
+	n, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if int(n) > len(cmd.Args)-3 {
+		return nil, nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	for i := 0; i < int(n); i++ {
+		keys = append(keys, string(cmd.Args[3+i]))
+	}
+	for i := 3 + int(n); i < len(cmd.Args); i++ {
+		argv = append(argv, string(cmd.Args[i]))
+	}
+	return keys, argv, nil
+}
+
+// runScript runs a script with a new run context. The run function is
+// called while the script vm is locked and the limits are in place. When
+// output is not nil, the console output of the script is appended to it.
+// The commands of the script are checked as the user of the caller, which
+// must exist in the transaction.
+func (m *Machine) runScript(script *scriptVM, tx *buntdb.Tx, limitAsWrite bool, caller scriptCaller, env scriptEnv, output *[]string, run func(rt scriptRuntime) (scriptValue, error)) (v scriptValue, err error) {
+	var user *aclUser
+	if caller.user != "" {
+		user, err = m.txUser(tx, caller.user)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil || !user.Enabled {
+			return nil, errNoAuth
+		}
+	}
+
+	// the stats are recorded after the error has been recovered.
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		script.stats.record(elapsed, err)
+		m.observeScript(elapsed, err)
+	}()
+
+	defer func() {
+		if v := recover(); v != nil {
+			if s, ok := v.(string); ok && strings.HasPrefix(s, scriptErrPrefix) {
+				err = errors.New(s[len(scriptErrPrefix):])
+				if strings.HasPrefix(err.Error(), "ERR unknown command '") {
+					commandName := strings.ToLower(strings.Split(strings.Split(err.Error(), "'")[1], "'")[0])
+					if scriptNotAllowedCommand(commandName) {
+						err = errors.New("ERR command not allowed from script '" + commandName + "'")
+					}
+				}
+			} else {
+				m.log.Warningf("script panic: %v", v)
+				panic(v)
+			}
+		}
+	}()
+	// lock the script. it can only run one at a time.
+	script.mu.Lock()
+	defer script.mu.Unlock()
+
+	// the run context is found by the runtime, so that the script can't
+	// see or change it.
+	ctx := m.sm.addRunContext(script.rt, tx, limitAsWrite, caller, user, env, output)
+	defer m.sm.removeRunContext(script.rt)
+	if env.ok {
+		script.rt.setRandom(ctx.rand.Float64)
+	} else {
+		script.rt.setRandom(func() float64 {
+			panic(scriptErrPrefix + "ERR Math.random is not available to a trigger that was fired outside of a script")
+		})
+	}
+	if limitAsWrite {
+		defer m.sm.swapWriteEnv(m.sm.swapWriteEnv(env))
+	}
+	m.sm.limitScript(script.rt, ctx)
+	defer script.rt.setLimiter(nil)
+	return run(script.rt)
+}
+
 func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	// EVAL script numkeys [key ...] [arg ...]
-	// EVALRO script numkeys [key ...] [arg ...]
-	// EVALSHA sha1 numkeys [key ...] [arg ...]
-	// EVALSHARO sha1 numkeys [key ...] [arg ...]
+	// EVAL [DEBUG] script numkeys [key ...] [arg ...]
+	// EVALRO [DEBUG] script numkeys [key ...] [arg ...]
+	// EVALSHA [DEBUG] sha1 numkeys [key ...] [arg ...]
+	// EVALSHARO [DEBUG] sha1 numkeys [key ...] [arg ...]
+	//
+	// With DEBUG the reply is an array of the result and the console output.
+	env, user, cmd, wrapped, err := scriptEnvCommand(cmd, connUserName(conn))
+	if err != nil {
+		return nil, err
+	}
+	var debug bool
+	if len(cmd.Args) > 1 && qcmdlower(cmd.Args[1]) == "debug" {
+		debug = true
+		cmd = buildCommand(append([][]byte{cmd.Args[0]}, cmd.Args[2:]...))
+	}
 	if len(cmd.Args) < 3 {
 		return nil, finn.ErrWrongNumberOfArguments
 	}
@@ -398,34 +871,10 @@ func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	}
 
 	// get keys and argv
-	keys, argv, err := func() (keys, argv []string, err error) {
-		var n uint64
-		n, err = strconv.ParseUint(string(cmd.Args[2]), 10, 64)
-		if err != nil {
-			err = errors.New("ERR value is not an integer or out of range")
-			return
-		}
-		if int(n) > len(cmd.Args)-3 {
-			err = errors.New("ERR Number of keys can't be greater than number of args")
-			return
-		}
-		for i := 0; i < int(n); i++ {
-			keys = append(keys, string(cmd.Args[3+i]))
-		}
-		for i := 3 + int(n); i < len(cmd.Args); i++ {
-			argv = append(argv, string(cmd.Args[i]))
-		}
-		return
-	}()
+	keys, argv, err := scriptKeysAndArgs(cmd)
 	if err != nil {
 		return nil, err
 	}
-	// create a run id
-	nsrc := make([]byte, 20)
-	if _, err := rand.Read(nsrc); err != nil {
-		panic("random err: " + err.Error())
-	}
-	runid := hex.EncodeToString(nsrc)
 
 	// get the script ahead of time
 	var sha string
@@ -447,6 +896,9 @@ func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		}
 		// we have a script and a sha.
 	}
+	// A script that is part of a larger transaction, such as a MULTI, may be
+	// replayed on the followers, so it's limited like a write.
+	limitAsWrite := writable || tx != nil
 	dowr := func(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
 		var err error
 		if script == nil {
@@ -469,54 +921,49 @@ func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 			// yay. we now have a sha, javascript and a compiled script.
 		}
 
-		// create a run context.
-		m.sm.addRunContext(runid, tx)
-		defer m.sm.removeRunContext(runid)
-
-		var v interface{}
-		func() {
-			defer func() {
-				if v := recover(); v != nil {
-					if s, ok := v.(string); ok && strings.HasPrefix(s, scriptErrPrefix) {
-						err = errors.New(s[len(scriptErrPrefix):])
-						if strings.HasPrefix(err.Error(), "ERR unknown command '") {
-							commandName := strings.ToLower(strings.Split(strings.Split(err.Error(), "'")[1], "'")[0])
-							if scriptNotAllowedCommand(commandName) {
-								err = errors.New("ERR command not allowed from script '" + commandName + "'")
-							}
-						}
-					} else {
-						m.log.Warningf("script panic: %v", v)
-						panic(v)
-					}
-				}
-			}()
-			// lock the script. it can only run one at a time.
-			script.mu.Lock()
-			defer script.mu.Unlock()
-			script.vm.Set("runid", runid)
-			script.vm.Set("sha", sha)
-			script.vm.Set("KEYS", keys)
-			script.vm.Set("ARGV", argv)
-			v, err = script.vm.Run(script.script)
-		}()
-		return v, err
+		var output *[]string
+		if debug {
+			output = new([]string)
+		}
+		v, err := m.runScript(script, tx, limitAsWrite, callerOf(conn, user), env, output, func(rt scriptRuntime) (scriptValue, error) {
+			rt.set("sha", sha)
+			rt.set("KEYS", keys)
+			rt.set("ARGV", argv)
+			return rt.run(script.prog)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if debug {
+			// the output is passed along with the value, because the write
+			// is applied from the raft log.
+			return &debugResult{val: v, output: *output}, nil
+		}
+		return v, nil
 	}
 	dord := func(v interface{}) error {
-		val, err := otto.ToValue(v)
-		if err != nil {
+		res, ok := v.(*debugResult)
+		if !ok {
+			return writeValToConn(v.(scriptValue), conn)
+		}
+		conn.WriteArray(2)
+		if err := writeValToConn(res.val, conn); err != nil {
 			return err
 		}
-		return writeValToConn(m.sm.vm, val, conn)
+		conn.WriteArray(len(res.output))
+		for _, line := range res.output {
+			conn.WriteBulkString(line)
+		}
+		return nil
 	}
 	if writable {
-		return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		return m.writeDoApply(a, conn, wrapped, tx, func(tx *buntdb.Tx) (interface{}, error) {
 			return dowr(a, conn, cmd, tx)
 		}, func(v interface{}) error {
 			return dord(v)
 		})
 	}
-	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+	return m.readDoApply(a, conn, wrapped, tx, func(tx *buntdb.Tx) error {
 		v, err := dowr(a, conn, cmd, tx)
 		if err != nil {
 			return err
@@ -525,59 +972,52 @@ func (m *Machine) doEval(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	})
 }
 
+// debugResult is the result of a script that was run with DEBUG.
+type debugResult struct {
+	val    scriptValue
+	output []string
+}
+
 // writeValToConn write a javascript value to the client connection
-func writeValToConn(vm *otto.Otto, val otto.Value, conn redcon.Conn) error {
-	if val.IsNull() || val.IsUndefined() {
+func writeValToConn(val scriptValue, conn redcon.Conn) error {
+	if val.isNull() || val.isUndefined() {
 		conn.WriteNull()
 		return nil
 	}
-	if val.IsString() {
-		s, _ := val.ToString()
-		conn.WriteBulkString(s)
+	if val.isString() {
+		conn.WriteBulkString(val.String())
 		return nil
 	}
-	if val.IsNumber() {
-		n, err := val.ToFloat()
-		if err != nil {
-			return err
-		}
-		conn.WriteInt(int(n))
+	if val.isNumber() {
+		conn.WriteInt(int(val.toFloat()))
 		return nil
 	}
-	if val.IsObject() {
+	if val.isObject() {
 		// When the return value has the signature {type:"string",value:"?"}
 		// then a simple string is written to the client with the value
-		obj := val.Object()
-		res, _ := vm.Call(`Array.isArray`, nil, val)
-		isarr, _ := res.ToBoolean()
-		if isarr {
-			res, _ := obj.Get("length")
-			length, _ := res.ToInteger()
-			conn.WriteArray(int(length))
-			for i := 0; i < int(length); i++ {
-				v, _ := obj.Get(strconv.FormatInt(int64(i), 10))
-				if err := writeValToConn(vm, v, conn); err != nil {
+		if val.isArray() {
+			length := val.length()
+			conn.WriteArray(length)
+			for i := 0; i < length; i++ {
+				if err := writeValToConn(val.index(i), conn); err != nil {
 					return err
 				}
 			}
 			return nil
 		}
 
-		if val, err := obj.Get("err"); err == nil && val.IsDefined() {
-			s, _ := val.ToString()
-			conn.WriteError(s)
+		if v := val.get("err"); !v.isUndefined() {
+			conn.WriteError(v.String())
 			return nil
 		}
 
-		if val, err := obj.Get("ok"); err == nil && val.IsDefined() {
-			s, _ := val.ToString()
-			conn.WriteString(s)
+		if v := val.get("ok"); !v.isUndefined() {
+			conn.WriteString(v.String())
 			return nil
 		}
 	}
 
-	vv, _ := val.Export()
-	data, _ := json.Marshal(vv)
+	data, _ := json.Marshal(val.export())
 	conn.WriteBulk(data)
 	return nil
 }
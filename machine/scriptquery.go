@@ -0,0 +1,228 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/gjson"
+)
+
+// The query helpers give scripts direct access to the indexes and to JSON
+// documents. Unlike sdb.call, which returns a flat array of keys and values,
+// they return arrays of {key, value} objects and parsed JSON:
+//
+//	sdb.iter(index, [options], [callback])
+//	sdb.rect(index, bounds, [options], [callback])
+//	sdb.jget(key, [path])
+//
+// The options are the same as the options of the ITER and RECT commands,
+// such as {pivot: 10, range: ["[10", "20)"], limit: 5, desc: true}. Adding
+// {json: true} parses each value as JSON. When a callback is provided it's
+// called with each item as the index is walked, and returning false stops
+// the walk, so the whole result set is never built. The user of the script
+// is checked like for the ITER, RECT, and JGET commands.
+
+// queryOptions returns the options object and the callback function which
+// may follow the required arguments. Both are optional.
+func queryOptions(rt scriptRuntime, args []scriptValue, i int) (opts, callback scriptValue) {
+	arg := argument(rt, args, i)
+	if arg.isFunction() {
+		return nil, arg
+	}
+	if arg.isObject() {
+		opts = arg
+		arg = argument(rt, args, i+1)
+	} else if !arg.isUndefined() && !arg.isNull() {
+		panic(scriptErrPrefix + "ERR options must be an object")
+	}
+	if arg.isFunction() {
+		callback = arg
+	} else if !arg.isUndefined() {
+		panic(scriptErrPrefix + "ERR callback must be a function")
+	}
+	return opts, callback
+}
+
+// optValue returns an option, or false when the option is missing.
+func optValue(opts scriptValue, name string) (scriptValue, bool) {
+	if opts == nil {
+		return nil, false
+	}
+	v := opts.get(name)
+	if v.isUndefined() || v.isNull() {
+		return nil, false
+	}
+	return v, true
+}
+
+// optBool returns a boolean option.
+func optBool(opts scriptValue, name string) bool {
+	v, ok := optValue(opts, name)
+	if !ok {
+		return false
+	}
+	return v.toBoolean()
+}
+
+// queryArgs converts the options into command arguments. Each name is both
+// the option name and the command argument. Boolean options are flags.
+func queryArgs(args [][]byte, opts scriptValue, names []string, flags []string) [][]byte {
+	for _, name := range names {
+		if v, ok := optValue(opts, name); ok {
+			args = append(args, []byte(name), []byte(v.String()))
+		}
+	}
+	for _, name := range flags {
+		if optBool(opts, name) {
+			args = append(args, []byte(name))
+		}
+	}
+	return args
+}
+
+func (sm *scriptMachine) scriptIter(m *Machine, rt scriptRuntime, fargs []scriptValue) scriptValue {
+	// sdb.iter(index, [{pivot, range, limit, desc, match, json}], [callback])
+	ctx := sm.callContext(rt, "sdb.iter")
+	opts, callback := queryOptions(rt, fargs, 1)
+	args := [][]byte{[]byte("iter"), []byte(argument(rt, fargs, 0).String())}
+	args = queryArgs(args, opts, []string{"pivot", "limit", "match"}, []string{"desc"})
+	if v, ok := optValue(opts, "range"); ok {
+		// the range is an array of [min, max]
+		if !v.isObject() || v.index(0).isUndefined() || v.index(1).isUndefined() {
+			panic(scriptErrPrefix + "ERR range must be an array of [min, max]")
+		}
+		args = append(args, []byte("range"), []byte(v.index(0).String()), []byte(v.index(1).String()))
+	}
+	ctx.check(args...)
+	rargs, err := parseIterArgs(args)
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	q := &queryResults{rt: rt, callback: callback, json: optBool(opts, "json")}
+	if err := m.walkIndex(&rargs, ctx.tx, q.add); err != nil && err != buntdb.ErrNotFound {
+		panic(scriptErrPrefix + err.Error())
+	}
+	return q.result()
+}
+
+func (sm *scriptMachine) scriptRect(m *Machine, rt scriptRuntime, fargs []scriptValue) scriptValue {
+	// sdb.rect(index, bounds, [{match, limit, skip, json}], [callback])
+	ctx := sm.callContext(rt, "sdb.rect")
+	opts, callback := queryOptions(rt, fargs, 2)
+	args := [][]byte{[]byte("rect"), []byte(argument(rt, fargs, 0).String()), []byte(argument(rt, fargs, 1).String())}
+	args = queryArgs(args, opts, []string{"match", "limit", "skip"}, nil)
+	ctx.check(args...)
+	rargs, err := parseRectSearchArgs(args)
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	q := &queryResults{rt: rt, callback: callback, json: optBool(opts, "json")}
+	if q.callback != nil {
+		if err := m.walkRect(&rargs, ctx.tx, q.add); err != nil && err != buntdb.ErrNotFound {
+			panic(scriptErrPrefix + err.Error())
+		}
+		return q.result()
+	}
+	// without a callback the items are sorted by key like the RECT command
+	var results []rectItem
+	if err := m.walkRect(&rargs, ctx.tx, func(key, val string) bool {
+		results = append(results, rectItem{key, val})
+		return true
+	}); err != nil && err != buntdb.ErrNotFound {
+		panic(scriptErrPrefix + err.Error())
+	}
+	sort.Sort(rectItemByKey(results))
+	for _, result := range results {
+		if !q.add(result.key, result.val) {
+			break
+		}
+	}
+	return q.result()
+}
+
+func (sm *scriptMachine) scriptJget(rt scriptRuntime, args []scriptValue) scriptValue {
+	// sdb.jget(key, [path])
+	ctx := sm.callContext(rt, "sdb.jget")
+	key := argument(rt, args, 0).String()
+	ctx.check([]byte("jget"), []byte(key))
+	doc, err := ctx.tx.Get(key)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return rt.toValue(nil)
+		}
+		panic(scriptErrPrefix + err.Error())
+	}
+	raw := doc
+	if len(args) > 1 {
+		res := gjson.Get(doc, args[1].String())
+		if !res.Exists() {
+			return rt.toValue(nil)
+		}
+		raw = res.Raw
+	}
+	v, err := parseJSONValue(rt, key, raw)
+	if err != nil {
+		panic(scriptErrPrefix + err.Error())
+	}
+	return v
+}
+
+// parseJSONValue parses the value of a key into a javascript value.
+func parseJSONValue(rt scriptRuntime, key, raw string) (scriptValue, error) {
+	v, err := rt.parseJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("ERR value of key '%s' is not valid json", key)
+	}
+	return v, nil
+}
+
+// queryResults collects the items of a query, or passes them to the
+// callback when there is one.
+type queryResults struct {
+	rt       scriptRuntime
+	callback scriptValue
+	json     bool
+	items    []interface{}
+	err      error
+}
+
+// add is called for each item of the walk. Returns false to stop the walk.
+func (q *queryResults) add(key, val string) bool {
+	item := map[string]interface{}{"key": key, "value": val}
+	if q.json {
+		v, err := parseJSONValue(q.rt, key, val)
+		if err != nil {
+			q.err = err
+			return false
+		}
+		item["value"] = v
+	}
+	if q.callback == nil {
+		q.items = append(q.items, item)
+		return true
+	}
+	res, err := q.callback.call(item)
+	if err != nil {
+		q.err = errors.New("ERR callback failed: " + err.Error())
+		return false
+	}
+	// only an explicit false stops the walk
+	if res.isBoolean() {
+		return res.toBoolean()
+	}
+	return true
+}
+
+// result returns the array of items, or undefined when there's a callback.
+// The error from the walk is thrown to the script.
+func (q *queryResults) result() scriptValue {
+	if q.err != nil {
+		panic(scriptErrPrefix + q.err.Error())
+	}
+	if q.callback != nil {
+		return nil
+	}
+	return q.rt.toValue(q.items)
+}
@@ -4,13 +4,25 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"testing"
+	"time"
 )
 
+func init() {
+	// the tests run in a time zone that isn't UTC, so that the local time
+	// of Date is checked to be UTC on every server.
+	time.Local = time.FixedZone("EST", -5*60*60)
+}
+
 func subTestScripts(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "basic", scripts_SIMPLE_test)
 	runStep(t, mc, "set data", scripts_SET_test)
 	runStep(t, mc, "readonly", scripts_READONLY_test)
 	runStep(t, mc, "sha", scripts_EVALSHA_test)
+	runStep(t, mc, "limits", scripts_LIMITS_test)
+	runStep(t, mc, "functions", scripts_FUNCTION_test)
+	runStep(t, mc, "deterministic", scripts_SCRIPTENV_test)
+	runStep(t, mc, "debug", scripts_DEBUG_test)
+	runStep(t, mc, "query helpers", scripts_QUERY_test)
 }
 func scripts_SIMPLE_test(mc *mockCluster) error {
 	return mc.DoBatch([][]interface{}{
@@ -52,3 +64,176 @@ func scripts_EVALSHA_test(mc *mockCluster) error {
 		{"EVALSHARO", shaGet, 0}, {"NOSCRIPT No matching script. Please use EVAL."},
 	})
 }
+func scripts_LIMITS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "1", "2"}, {"OK"},
+		{"SCRIPT", "KILL"}, {"NOTBUSY No scripts in execution right now."},
+		{"EVAL", `sdb.call("set", "1", "before");while(true){}`, 0}, {"ERR Script exceeded the limit of 1000000 operations"},
+		{"GET", "1"}, {"2"},
+		{"EVAL", `try{while(true){}}catch(e){};return 1`, 0}, {"ERR Script exceeded the limit of 1000000 operations"},
+		{"EVALRO", `while(true){}`, 0}, {"ERR Script exceeded the time limit of 500ms"},
+		{"EVAL", `var i=0;while(i<1000){i++};return i`, 0}, {1000},
+	})
+}
+func scripts_FUNCTION_test(mc *mockCluster) error {
+	lib := "#!js name=mylib\n" +
+		"sdb.registerFunction('myset', function(keys, args){\n" +
+		"	return sdb.call('set', keys[0], args[0]);\n" +
+		"});\n" +
+		"sdb.registerFunction({name: 'myget', flags: ['no-writes'], callback: function(keys, args){\n" +
+		"	return sdb.call('get', keys[0]);\n" +
+		"}});\n"
+	if err := mc.DoBatch([][]interface{}{
+		{"FUNCTION", "LOAD", lib}, {"mylib"},
+		{"FUNCTION", "LOAD", lib}, {"ERR Library 'mylib' already exists"},
+		{"FUNCTION", "LOAD", "REPLACE", lib}, {"mylib"},
+		{"FCALL", "myset", 1, "fkey", "fval"}, {"OK"},
+		{"FCALL_RO", "myget", 1, "fkey"}, {"fval"},
+		{"FCALL_RO", "myset", 1, "fkey", "fval"}, {"ERR Can not execute a function with write flag using FCALL_RO."},
+		{"FCALL", "nofunc", 0}, {"ERR Function not found"},
+		{"FUNCTION", "LOAD", "sdb.registerFunction('f', function(){})"}, {"ERR Missing library metadata"},
+		{"FUNCTION", "LOAD", "#!lua name=lualib\n"}, {"ERR Engine 'lua' not found"},
+		{"FUNCTION", "LOAD", "#!js name=other\nsdb.registerFunction('myget', function(){})"}, {"ERR Function myget already exists"},
+		{"FUNCTION", "LOAD", "#!js name=empty\nvar x = 1"}, {"ERR No functions registered"},
+		{"FUNCTION", "LOAD", "#!js name=bad\nsdb.call('set', 'a', 'b')"}, {"ERR sdb.call can only be used while a script is running"},
+		{"FUNCTION", "LIST"}, {"[[library_name mylib engine JS functions [[name myset flags []] [name myget flags [no-writes]]]]]"},
+		{"FUNCTION", "LIST", "LIBRARYNAME", "other*"}, {"[]"},
+	}); err != nil {
+		return err
+	}
+	payload, err := mc.Do("FUNCTION", "DUMP")
+	if err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"FUNCTION", "DELETE", "mylib"}, {"OK"},
+		{"FUNCTION", "DELETE", "mylib"}, {"ERR Library not found"},
+		{"FCALL", "myset", 1, "fkey", "fval"}, {"ERR Function not found"},
+		{"FUNCTION", "RESTORE", payload}, {"OK"},
+		{"FUNCTION", "RESTORE", payload}, {"ERR Library 'mylib' already exists"},
+		{"FUNCTION", "RESTORE", payload, "REPLACE"}, {"OK"},
+		{"FUNCTION", "RESTORE", payload, "FLUSH"}, {"OK"},
+		{"FCALL_RO", "myget", 1, "fkey"}, {"fval"},
+		{"FUNCTION", "RESTORE", "bad"}, {"ERR Invalid payload"},
+		{"FUNCTION", "DELETE", "mylib"}, {"OK"},
+	})
+}
+func scripts_SCRIPTENV_test(mc *mockCluster) error {
+	random := `return String(Math.random())+","+String(Math.random())`
+	// only the servers send SCRIPTENV
+	if err := mc.DoBatch([][]interface{}{
+		{"SCRIPTENV", 1000, 42, "EVAL", `return Date.now()`, 0}, {"ERR unknown command 'SCRIPTENV'"},
+	}); err != nil {
+		return err
+	}
+	if err := mockAuthInternal(mc); err != nil {
+		return err
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SCRIPTENV", 1000, 42, "EVAL", `return Date.now()`, 0}, {1000},
+		{"SCRIPTENV", 1000, 42, "EVAL", `return new Date().getTime()`, 0}, {1000},
+		{"SCRIPTENV", 1000, 42, "EVAL", `return new Date(5000).getTime()`, 0}, {5000},
+		{"SCRIPTENV", 1000, 42, "EVALRO", `return new Date() instanceof Date ? 1 : 0`, 0}, {1},
+		{"SCRIPTENV", 1000, 42, "EVAL", `var d = new Date();return [d.getDate(), d.getHours(), d.getTimezoneOffset()].join()`, 0}, {"1,0,0"},
+		{"SCRIPTENV", 1000, 42, "EVAL", `return new Date(1970, 0, 1, 5).getTime()`, 0}, {18000000},
+		{"SCRIPTENV", 1000, 42, "EVAL", `return typeof runid`, 0}, {"undefined"},
+		{"SCRIPTENV", 1000, 42, "EVAL", `sdb.call("set", "1", Date.now());return sdb.call("get", "1")`, 0}, {"1000"},
+		{"GET", "1"}, {"1000"},
+		{"SCRIPTENV", 1000, 42, "GET", "1"}, {"ERR unknown command 'SCRIPTENV'"},
+	}); err != nil {
+		return err
+	}
+	// the same seed gives the same random numbers
+	r1, err := mc.Do("SCRIPTENV", 1000, 42, "EVAL", random, 0)
+	if err != nil {
+		return err
+	}
+	r2, err := mc.Do("SCRIPTENV", 1000, 42, "EVAL", random, 0)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(normalize(r1)) != fmt.Sprint(normalize(r2)) {
+		return fmt.Errorf("expected '%v', got '%v'", normalize(r1), normalize(r2))
+	}
+	// without SCRIPTENV the leader clock is used
+	start := time.Now().UnixNano() / int64(time.Millisecond)
+	v, err := mc.Do("EVAL", `return Date.now()`, 0)
+	if err != nil {
+		return err
+	}
+	end := time.Now().UnixNano() / int64(time.Millisecond)
+	if n, ok := v.(int64); !ok || n < start || n > end {
+		return fmt.Errorf("expected a time between %d and %d, got '%v'", start, end, v)
+	}
+	return nil
+}
+func scripts_DEBUG_test(mc *mockCluster) error {
+	ok := `console.log("hello", 1, {a:1});return 1`
+	fail := `return sdb.call("nocmd")`
+	if err := mc.DoBatch([][]interface{}{
+		{"SCRIPT", "FLUSH"}, {"OK"},
+		{"EVAL", "DEBUG", ok, 0}, {"[1 [hello 1 {\"a\":1}]]"},
+		{"EVALRO", "DEBUG", `return "ro"`, 0}, {"[ro []]"},
+		{"EVAL", ok, 0}, {1},
+		{"EVAL", fail, 0}, {"ERR unknown command 'nocmd'"},
+		{"SCRIPT", "STATS", "extra"}, {"ERR Unknown SCRIPT subcommand or wrong # of args."},
+	}); err != nil {
+		return err
+	}
+	v, err := mc.Do("SCRIPT", "STATS")
+	if err != nil {
+		return err
+	}
+	stats := make(map[string]string)
+	for _, entry := range normalize(v).([]interface{}) {
+		entry := entry.([]interface{})
+		stats[entry[1].(string)] = fmt.Sprintf("%v %v", entry[3], entry[9])
+	}
+	for sha, expect := range map[string]string{
+		scriptSha(ok):   "2 <nil>",
+		scriptSha(fail): "1 ERR unknown command 'nocmd'",
+	} {
+		if stats[sha] != expect {
+			return fmt.Errorf("expected '%v', got '%v'", expect, stats[sha])
+		}
+	}
+	return nil
+}
+func scripts_QUERY_test(mc *mockCluster) error {
+	keys := `.map(function(item){return item.key})`
+	return mc.DoBatch([][]interface{}{
+		{"SET", "quser:1", `{"name":"Tom","age":30}`}, {"OK"},
+		{"SET", "quser:2", `{"name":"Jane","age":10}`}, {"OK"},
+		{"SET", "quser:3", `{"name":"Andy","age":20}`}, {"OK"},
+		{"SETINDEX", "qages", "quser:*", "JSON", "age"}, {"OK"},
+		{"EVALRO", `return sdb.iter("qages")` + keys, 0}, {"[quser:2 quser:3 quser:1]"},
+		{"EVALRO", `return sdb.iter("qages", {desc: true, limit: 2})` + keys, 0}, {"[quser:1 quser:3]"},
+		{"EVALRO", `return sdb.iter("qages", {range: ['({"age":10}', "+inf"]})` + keys, 0}, {"[quser:3 quser:1]"},
+		{"EVALRO", `return sdb.iter("qages", {pivot: '{"age":10}'})` + keys, 0}, {"[quser:3 quser:1]"},
+		{"EVALRO", `return sdb.iter("qages", {json: true}).map(function(item){return item.value.name})`, 0}, {"[Jane Andy Tom]"},
+		{"EVALRO", `return sdb.iter("qages")[0].value`, 0}, {`{"name":"Jane","age":10}`},
+		{"EVALRO", `var out = [];sdb.iter("qages", function(item){out.push(item.key);return out.length < 2});return out`, 0}, {"[quser:2 quser:3]"},
+		{"EVALRO", `return sdb.iter("noindex").length`, 0}, {0},
+		{"EVALRO", `return sdb.iter("qages", {range: 1})`, 0}, {"ERR range must be an array of [min, max]"},
+		{"EVALRO", `return sdb.iter("qages", {limit: "x"})`, 0}, {"strconv.ParseUint: parsing \"x\": invalid syntax"},
+		{"EVALRO", `return sdb.iter("qages", function(){throw "bad"})`, 0}, {"ERR callback failed: bad"},
+
+		{"SET", "qpoint:1", `{"name":"a","r":"[10 15]"}`}, {"OK"},
+		{"SET", "qpoint:2", `{"name":"b","r":"[21 12]"}`}, {"OK"},
+		{"SET", "qpoint:3", `{"name":"c","r":"[19 32]"}`}, {"OK"},
+		{"SETINDEX", "qpoints", "qpoint:*", "SPATIAL", "JSON", "r"}, {"OK"},
+		{"EVALRO", `return sdb.rect("qpoints", '{"r":"[12],[20]"}')` + keys, 0}, {"[qpoint:3]"},
+		{"EVALRO", `return sdb.rect("qpoints", '{"r":"[-inf],[+inf]"}', {json: true}).map(function(item){return item.value.name})`, 0}, {"[a b c]"},
+		{"EVALRO", `return sdb.rect("qpoints", '{"r":"[-inf],[+inf]"}', {limit: 2}).length`, 0}, {2},
+		{"EVALRO", `var n = 0;sdb.rect("qpoints", '{"r":"[-inf],[+inf]"}', {}, function(){n++;return false});return n`, 0}, {1},
+
+		{"EVALRO", `return sdb.jget("quser:1").age`, 0}, {30},
+		{"EVALRO", `return sdb.jget("quser:1", "name")`, 0}, {"Tom"},
+		{"EVALRO", `return sdb.jget("quser:1", "missing")`, 0}, {nil},
+		{"EVALRO", `return sdb.jget("quser:9")`, 0}, {nil},
+		{"SET", "qtext", "not json"}, {"OK"},
+		{"EVALRO", `return sdb.jget("qtext")`, 0}, {"ERR value of key 'qtext' is not valid json"},
+		{"DELINDEX", "qages"}, {1},
+		{"DELINDEX", "qpoints"}, {1},
+	})
+}
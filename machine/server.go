@@ -1,8 +1,10 @@
 package machine
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -37,10 +39,12 @@ func (m *Machine) doDbsize(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		if err != nil {
 			return err
 		}
-		if err := tx.AscendGreaterOrEqual("", sdbMetaPrefix, func(key, val string) bool {
-			if !strings.HasPrefix(key, sdbMetaPrefix) {
-				return false
-			}
+		nversions, err := versionKeysLen(tx)
+		if err != nil {
+			return err
+		}
+		n -= nversions
+		if err := ascendMeta(tx, func(key, val string) bool {
 			n--
 			return true
 		}); err != nil {
@@ -128,6 +132,36 @@ func (wr *backupWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// openBackup returns the data of a backup and its size. When the data at rest
+// is encrypted, the backup is encrypted too.
+func (m *Machine) openBackup() (io.ReadCloser, int64, error) {
+	if m.cipher != nil {
+		var buf bytes.Buffer
+		wr := m.cipher.NewWriter(&buf)
+		if err := m.db.Save(wr); err != nil {
+			return nil, 0, err
+		}
+		if err := wr.Close(); err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(&buf), int64(buf.Len()), nil
+	}
+	f, err := os.Open(m.file)
+	if err != nil {
+		return nil, 0, err
+	}
+	sz, err := f.Seek(0, 2)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, sz, nil
+}
+
 func (m *Machine) doBackup(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
 	// BACKUP
 	// BACKUP / HTTP/N
@@ -142,17 +176,8 @@ func (m *Machine) doBackup(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		}
 		http = true
 	}
-	f, err := os.Open(m.file)
-	if err != nil {
-		return nil, err
-	}
-	sz, err := f.Seek(0, 2)
+	f, sz, err := m.openBackup()
 	if err != nil {
-		f.Close()
-		return nil, err
-	}
-	if _, err := f.Seek(0, 0); err != nil {
-		f.Close()
 		return nil, err
 	}
 	go func(wr *backupWriter) {
@@ -63,7 +63,7 @@ func (m *Machine) doSadd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return 0, fmt.Errorf("ERR: %v", err)
 		}
-		_, _, err = tx.Set(key, string(jsonByte), nil)
+		err = m.txSet(conn, tx, key, string(jsonByte), nil)
 		if err != nil {
 			return 0, err
 		}
@@ -108,7 +108,7 @@ func (m *Machine) doSrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return counter, fmt.Errorf("ERR: %v", err)
 		}
-		_, _, err = tx.Set(key, string(jsonByte), nil)
+		err = m.txSet(conn, tx, key, string(jsonByte), nil)
 		if err != nil {
 			return counter, err
 		}
@@ -0,0 +1,73 @@
+package machine
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// shutdownState contains the SHUTDOWN hook and the connections that are
+// drained before the server exits.
+type shutdownState struct {
+	mu       sync.Mutex
+	fn       func(drain bool) // called by SHUTDOWN, nil when not supported
+	draining int32            // the commands of new connections are refused
+	inflight int64            // number of client commands that are running
+}
+
+// OnShutdown sets the function that stops the server with SHUTDOWN. The
+// drain param is true for SHUTDOWN DRAIN.
+func (m *Machine) OnShutdown(fn func(drain bool)) {
+	m.shutdown.mu.Lock()
+	defer m.shutdown.mu.Unlock()
+	m.shutdown.fn = fn
+}
+
+// Drain refuses the client commands of new connections and waits until the
+// running client commands are done, or until the timeout. The raft rpcs of
+// new connections from the peers still work.
+func (m *Machine) Drain(timeout time.Duration) {
+	atomic.StoreInt32(&m.shutdown.draining, 1)
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&m.shutdown.inflight) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// draining returns true when the server is being drained.
+func (m *Machine) draining() bool {
+	return atomic.LoadInt32(&m.shutdown.draining) != 0
+}
+
+func (m *Machine) doShutdown(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SHUTDOWN [DRAIN]
+	var drain bool
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 1:
+	case 2:
+		if strings.ToLower(string(cmd.Args[1])) != "drain" {
+			return nil, errSyntaxError
+		}
+		drain = true
+	}
+	if conn == nil {
+		return nil, nil
+	}
+	m.shutdown.mu.Lock()
+	fn := m.shutdown.fn
+	m.shutdown.mu.Unlock()
+	if fn == nil {
+		return nil, errors.New("ERR shutdown is not supported")
+	}
+	conn.WriteString("OK")
+	go fn(drain)
+	return nil, nil
+}
@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func subTestShutdown(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "SHUTDOWN", shutdown_SHUTDOWN_test)
+	runStep(t, mc, "DRAIN", shutdown_DRAIN_test)
+}
+
+func shutdown_SHUTDOWN_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SHUTDOWN"}, {"ERR shutdown is not supported"},
+	}); err != nil {
+		return err
+	}
+	ch := make(chan bool, 1)
+	m := mc.cs.m
+	m.OnShutdown(func(drain bool) { ch <- drain })
+	defer m.OnShutdown(nil)
+	if err := mc.DoBatch([][]interface{}{
+		{"SHUTDOWN", "DRAIN"}, {"OK"},
+		{"SHUTDOWN", "NOW"}, {"ERR syntax error"},
+		{"SHUTDOWN", "DRAIN", "NOW"}, {"ERR wrong number of arguments for 'SHUTDOWN' command"},
+	}); err != nil {
+		return err
+	}
+	select {
+	case drain := <-ch:
+		if !drain {
+			return fmt.Errorf("expected '%v', got '%v'", true, drain)
+		}
+	case <-time.After(time.Second):
+		return errors.New("shutdown was not called")
+	}
+	return nil
+}
+
+func shutdown_DRAIN_test(mc *mockCluster) error {
+	s, err := mockOpenServer(nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.m.Drain(time.Second)
+	// the connections that are open still work.
+	if v, err := redis.String(s.Do("PING")); err != nil || v != "PONG" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "PONG", v, err)
+	}
+	conn, err := redis.Dial("tcp", s.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the raft rpcs of a new connection still work, so the votes and logs
+	// of the peers reach the server until it exits.
+	vote, err := redis.String(conn.Do("RAFTREQUESTVOTE", "{}", mockClusterSecret))
+	if err != nil || !strings.Contains(vote, `"Granted":false`) {
+		return fmt.Errorf("expected a vote response, got '%v' (%v)", vote, err)
+	}
+	// the client commands of a new connection are refused.
+	if v, err := conn.Do("GET", "key"); err == nil || err.Error() != "ERR the server is shutting down" {
+		return fmt.Errorf("expected '%v', got '%v' (%v)", "ERR the server is shutting down", v, err)
+	}
+	if v, err := conn.Do("GET", "key"); err == nil {
+		return fmt.Errorf("expected a closed connection, got '%v'", v)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package machine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	defaultSlowlogSlowerThan = 10000 // microseconds
+	defaultSlowlogMaxLen     = 128
+
+	// the arguments of an entry are truncated like redis.
+	slowlogMaxArgs   = 32
+	slowlogMaxString = 128
+)
+
+// The path of a command, which is how the command reached the database.
+const (
+	slowlogPathApply = "apply" // a write through the raft log
+	slowlogPathRead  = "read"  // a read with readDoApply
+	slowlogPathLocal = "local" // answered by the server, such as INFO
+)
+
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	addr     string // client address
+	path     string
+}
+
+// slowlog contains the commands that took longer than a threshold on this
+// server, newest last.
+type slowlog struct {
+	mu         sync.Mutex
+	slowerThan int64 // microseconds, negative to disable
+	maxLen     int
+	nextID     int64
+	entries    []slowlogEntry
+}
+
+// SetSlowlogLimits sets the time, in microseconds, that a command must take
+// to be logged in the SLOWLOG, and the maximum number of entries. Zero logs
+// every command, and a negative time disables the log.
+func (m *Machine) SetSlowlogLimits(slowerThan int64, maxLen int) {
+	m.slowlog.mu.Lock()
+	defer m.slowlog.mu.Unlock()
+	m.slowlog.slowerThan = slowerThan
+	m.slowlog.maxLen = maxLen
+	m.slowlog.trim()
+}
+
+func (sl *slowlog) trim() {
+	if len(sl.entries) > sl.maxLen {
+		sl.entries = append([]slowlogEntry(nil), sl.entries[len(sl.entries)-sl.maxLen:]...)
+	}
+}
+
+// add logs a command when it's slower than the threshold.
+func (sl *slowlog) add(conn redcon.Conn, cmd redcon.Command, elapsed time.Duration, path string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if sl.slowerThan < 0 || int64(elapsed/time.Microsecond) < sl.slowerThan || sl.maxLen <= 0 {
+		return
+	}
+	name := qcmdlower(cmd.Args[0])
+	if name == "slowlog" {
+		return
+	}
+	sl.entries = append(sl.entries, slowlogEntry{
+		id:       sl.nextID,
+		time:     time.Now(),
+		duration: elapsed,
+		args:     slowlogArgs(cmd),
+		addr:     conn.RemoteAddr(),
+		path:     path,
+	})
+	sl.nextID++
+	sl.trim()
+}
+
+// slowlogArgs returns the arguments of a command for an entry. Long lists
+// and strings are truncated, and passwords are redacted.
+func slowlogArgs(cmd redcon.Command) []string {
+	redact := len(cmd.Args)
+	switch qcmdlower(cmd.Args[0]) {
+	case "auth":
+		redact = 1
+	case "acl":
+		if len(cmd.Args) > 1 && qcmdlower(cmd.Args[1]) == "setuser" {
+			redact = 3
+		}
+	}
+	var args []string
+	for i, arg := range cmd.Args {
+		if i == slowlogMaxArgs-1 && len(cmd.Args) > slowlogMaxArgs {
+			args = append(args, "... ("+strconv.Itoa(len(cmd.Args)-i)+" more arguments)")
+			break
+		}
+		if i >= redact {
+			args = append(args, "(redacted)")
+			continue
+		}
+		if len(arg) > slowlogMaxString {
+			args = append(args, string(arg[:slowlogMaxString])+
+				"... ("+strconv.Itoa(len(arg)-slowlogMaxString)+" more bytes)")
+			continue
+		}
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (m *Machine) doSlowlog(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SLOWLOG GET [count]
+	// SLOWLOG LEN
+	// SLOWLOG RESET
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		// this is not a replicated command.
+		return nil, nil
+	}
+	// The log is for the commands that have run on this server, so it does
+	// not go through the raft log.
+	sl := &m.slowlog
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		return nil, errors.New("ERR Unknown SLOWLOG subcommand or wrong # of args.")
+	case "get":
+		if len(cmd.Args) > 3 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		count := 10
+		if len(cmd.Args) == 3 {
+			n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+			if err != nil || n < -1 {
+				return nil, errors.New("ERR count should be greater than or equal to -1")
+			}
+			count = int(n)
+		}
+		sl.mu.Lock()
+		if count == -1 || count > len(sl.entries) {
+			count = len(sl.entries)
+		}
+		entries := make([]slowlogEntry, count)
+		for i := 0; i < count; i++ {
+			entries[i] = sl.entries[len(sl.entries)-1-i]
+		}
+		sl.mu.Unlock()
+		conn.WriteArray(len(entries))
+		for _, e := range entries {
+			conn.WriteArray(6)
+			conn.WriteInt64(e.id)
+			conn.WriteInt64(e.time.Unix())
+			conn.WriteInt64(int64(e.duration / time.Microsecond))
+			conn.WriteArray(len(e.args))
+			for _, arg := range e.args {
+				conn.WriteBulkString(arg)
+			}
+			conn.WriteBulkString(e.addr)
+			conn.WriteBulkString(e.path)
+		}
+	case "len":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		sl.mu.Lock()
+		n := len(sl.entries)
+		sl.mu.Unlock()
+		conn.WriteInt(n)
+	case "reset":
+		if len(cmd.Args) != 2 {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		sl.mu.Lock()
+		sl.entries = nil
+		sl.mu.Unlock()
+		conn.WriteString("OK")
+	}
+	return nil, nil
+}
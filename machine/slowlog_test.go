@@ -0,0 +1,172 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func subTestSlowlog(t *testing.T, mc *mockCluster) {
+	defer mockSlowlogLimits(mc, defaultSlowlogSlowerThan, defaultSlowlogMaxLen)
+	mockSlowlogLimits(mc, 0, defaultSlowlogMaxLen)
+	runStep(t, mc, "GET", slowlog_GET_test)
+	runStep(t, mc, "truncate", slowlog_TRUNCATE_test)
+	runStep(t, mc, "LEN", slowlog_LEN_test)
+	runStep(t, mc, "threshold", slowlog_THRESHOLD_test)
+}
+
+// mockSlowlogLimits sets the slowlog limits of every server.
+func mockSlowlogLimits(mc *mockCluster, slowerThan int64, maxLen int) {
+	for _, s := range mc.ss {
+		s.m.SetSlowlogLimits(slowerThan, maxLen)
+	}
+}
+
+// mockSlowlog returns the entries of SLOWLOG GET, newest first. Each entry
+// is the args of the command followed by the path.
+func mockSlowlog(mc *mockCluster, args ...interface{}) ([][]string, error) {
+	resp, err := mc.Do("SLOWLOG", append([]interface{}{"GET"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var entries [][]string
+	for _, v := range resp.([]interface{}) {
+		e := v.([]interface{})
+		if len(e) != 6 {
+			return nil, fmt.Errorf("expected '6' fields, got '%v'", len(e))
+		}
+		if len(e[4].([]byte)) == 0 {
+			return nil, errors.New("expected a client address")
+		}
+		var entry []string
+		for _, arg := range e[3].([]interface{}) {
+			entry = append(entry, string(arg.([]byte)))
+		}
+		entries = append(entries, append(entry, string(e[5].([]byte))))
+	}
+	return entries, nil
+}
+
+// slowlogExpect expects the entries of SLOWLOG GET, which are each written
+// as the args and path joined by spaces.
+func slowlogExpect(mc *mockCluster, expect ...string) error {
+	entries, err := mockSlowlog(mc)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, strings.Join(entry, " "))
+	}
+	if strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		return fmt.Errorf("expected '%v', got '%v'", expect, lines)
+	}
+	return nil
+}
+
+func slowlog_GET_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "RESET"}, {"OK"},
+		{"SET", "key", "value"}, {"OK"},
+		{"GET", "key"}, {"value"},
+		{"INFO", "unknown"}, {""},
+	}); err != nil {
+		return err
+	}
+	if err := slowlogExpect(mc,
+		"INFO unknown local",
+		"GET key read",
+		"SET key value apply",
+	); err != nil {
+		return err
+	}
+	if entries, err := mockSlowlog(mc, 1); err != nil || len(entries) != 1 {
+		return fmt.Errorf("expected '1' entry, got '%v' (%v)", len(entries), err)
+	}
+	if entries, err := mockSlowlog(mc, -1); err != nil || len(entries) != 3 {
+		return fmt.Errorf("expected '3' entries, got '%v' (%v)", len(entries), err)
+	}
+	return mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "GET", -2}, {"ERR count should be greater than or equal to -1"},
+		{"SLOWLOG", "UNKNOWN"}, {"ERR Unknown SLOWLOG subcommand or wrong # of args."},
+	})
+}
+
+func slowlog_TRUNCATE_test(mc *mockCluster) error {
+	long := strings.Repeat("x", 200)
+	mset := []interface{}{"MSET"}
+	for i := 0; i < 20; i++ {
+		mset = append(mset, fmt.Sprintf("key%d", i), i)
+	}
+	if err := mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "RESET"}, {"OK"},
+		{"SET", "key", long}, {"OK"},
+		mset, {"OK"},
+		{"AUTH", "default", "secret"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	entries, err := mockSlowlog(mc)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 3 {
+		return fmt.Errorf("expected '3' entries, got '%v'", len(entries))
+	}
+	if s := strings.Join(entries[0], " "); s != "AUTH (redacted) (redacted) local" {
+		return fmt.Errorf("expected '%v', got '%v'", "AUTH (redacted) (redacted) local", s)
+	}
+	if len(entries[1]) != 33 || entries[1][31] != "... (10 more arguments)" {
+		return fmt.Errorf("expected '32' args ending with '... (10 more arguments)', got '%v'", entries[1])
+	}
+	if expect := strings.Repeat("x", 128) + "... (72 more bytes)"; entries[2][2] != expect {
+		return fmt.Errorf("expected '%v', got '%v'", expect, entries[2][2])
+	}
+	return nil
+}
+
+func slowlog_LEN_test(mc *mockCluster) error {
+	if err := mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "RESET"}, {"OK"},
+		{"SLOWLOG", "LEN"}, {0},
+		{"SET", "key1", "value"}, {"OK"},
+		{"SET", "key2", "value"}, {"OK"},
+		{"SET", "key3", "value"}, {"OK"},
+		{"SLOWLOG", "LEN"}, {3},
+	}); err != nil {
+		return err
+	}
+	mockSlowlogLimits(mc, 0, 2)
+	defer mockSlowlogLimits(mc, 0, defaultSlowlogMaxLen)
+	if err := mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "LEN"}, {2},
+		{"SET", "key4", "value"}, {"OK"},
+	}); err != nil {
+		return err
+	}
+	if err := slowlogExpect(mc,
+		"SET key4 value apply",
+		"SET key3 value apply",
+	); err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "RESET"}, {"OK"},
+		{"SLOWLOG", "LEN"}, {0},
+	})
+}
+
+func slowlog_THRESHOLD_test(mc *mockCluster) error {
+	mockSlowlogLimits(mc, 5000, defaultSlowlogMaxLen)
+	defer mockSlowlogLimits(mc, 0, defaultSlowlogMaxLen)
+	slow := "for (var i = 0; i < 20000; i++) {} return 1"
+	if err := mc.DoBatch([][]interface{}{
+		{"SLOWLOG", "RESET"}, {"OK"},
+		{"INFO", "unknown"}, {""},
+		{"EVALRO", slow, 0}, {1},
+	}); err != nil {
+		return err
+	}
+	return slowlogExpect(mc, "EVALRO "+slow+" 0 read")
+}
@@ -1,11 +1,8 @@
 package machine
 
 import (
-	"encoding/json"
-	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"github.com/tidwall/buntdb"
 )
@@ -18,30 +15,25 @@ func (m *Machine) Restore(rd io.Reader) error {
 	// read the snapshot into a new machine.
 	// the new machine will have the entire keyspace, but will be missing
 	// indexes and scripts.
-	nm := &Machine{}
+	nm := &Machine{cipher: m.cipher}
 	if err := nm.reopenBlankDB(rd, func(keys []string) { m.onExpired(keys) }); err != nil {
 		return err
 	}
 
+	// apply the replicated config of the snapshot, which has the script
+	// engine of the eval indexes.
+	if err := m.loadConfig(nm.db); err != nil {
+		return err
+	}
+
 	// rebuild the indexes
 	if err := nm.db.Update(func(tx *buntdb.Tx) error {
-		var metas []string
-		if err := tx.AscendGreaterOrEqual("", indexKeyPrefix, func(key, val string) bool {
-			if !strings.HasPrefix(key, indexKeyPrefix) {
-				return false
-			}
-			metas = append(metas, key, val)
-			return true
-		}); err != nil {
+		defs, err := txIndexDefs(tx)
+		if err != nil {
 			return err
 		}
-		for i := 0; i < len(metas); i += 2 {
-			name := metas[i]
-			var rargs indexArgs
-			if err := json.Unmarshal([]byte(metas[i+1]), &rargs); err != nil {
-				return fmt.Errorf("parsing index '%v': %v", name, err)
-			}
-			if err := dbSetIndex(tx, rargs); err != nil {
+		for _, rargs := range defs {
+			if err := m.dbSetIndex(tx, rargs); err != nil {
 				return err
 			}
 		}
@@ -52,17 +44,31 @@ func (m *Machine) Restore(rd io.Reader) error {
 
 	// close and delete the previous file
 	m.db.Close()
-	os.RemoveAll(m.file)
+	if m.file != "" {
+		os.RemoveAll(m.file)
+	}
 
 	// set the important fields to the new machine, file, and script machine.
 	m.db = nm.db
 	m.file = nm.file
-
+	m.schemas.reset(nil)
+	m.triggers.reset(nil)
 	return nil
 }
 
 // Snapshot creates a snapshot
 func (m *Machine) Snapshot(wr io.Writer) error {
+	if m.cipher != nil {
+		// the database is in memory
+		m.mu.RLock()
+		db := m.db
+		m.mu.RUnlock()
+		ewr := m.cipher.NewWriter(wr)
+		if err := db.Save(ewr); err != nil {
+			return err
+		}
+		return ewr.Close()
+	}
 	var pos int64
 	var file string
 	err := func() error {
@@ -80,7 +80,7 @@ func (m *Machine) doZadd(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return result, err
 		}
-		_, _, err = tx.Set(key, string(jsonByte), nil)
+		err = m.txSet(conn, tx, key, string(jsonByte), nil)
 		if err != nil {
 			return result, err
 		}
@@ -126,7 +126,7 @@ func (m *Machine) doZrem(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		if err != nil {
 			return result, fmt.Errorf("ERR %v", err)
 		}
-		_, _, err = tx.Set(key, string(jsonByte), nil)
+		err = m.txSet(conn, tx, key, string(jsonByte), nil)
 		if err != nil {
 			return result, err
 		}
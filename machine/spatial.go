@@ -123,28 +123,10 @@ func (m *Machine) doRect(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	}
 	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
 		var results []rectItem
-		var skipcount int
-		limit := rargs.limit
-		err := tx.Intersects(rargs.index, rargs.value,
-			func(key, val string) bool {
-				if isMercMetaKey(key) {
-					return true
-				}
-				if rargs.limiton && len(results) >= limit {
-					return false
-				}
-				if rargs.matchon && !match.Match(key, rargs.match) {
-					return true
-				}
-				// within here
-				if rargs.skipon && skipcount < rargs.skip {
-					skipcount++
-					return true
-				}
-				results = append(results, rectItem{key, val})
-				return true
-			},
-		)
+		err := m.walkRect(&rargs, tx, func(key, val string) bool {
+			results = append(results, rectItem{key, val})
+			return true
+		})
 		if err != nil {
 			return err
 		}
@@ -157,3 +139,30 @@ func (m *Machine) doRect(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		return nil
 	})
 }
+
+// walkRect calls fn for each item of the spatial index that matches the
+// rect search args. The items are in the order of the index, not sorted by
+// key. Returning false from fn stops the search.
+func (m *Machine) walkRect(rargs *rectSearchArgs, tx *buntdb.Tx, fn func(key, val string) bool) error {
+	var n, skipcount int
+	return tx.Intersects(rargs.index, rargs.value,
+		func(key, val string) bool {
+			if isMercMetaKey(key) {
+				return true
+			}
+			if rargs.limiton && n >= rargs.limit {
+				return false
+			}
+			if rargs.matchon && !match.Match(key, rargs.match) {
+				return true
+			}
+			// within here
+			if rargs.skipon && skipcount < rargs.skip {
+				skipcount++
+				return true
+			}
+			n++
+			return fn(key, val)
+		},
+	)
+}
@@ -51,7 +51,7 @@ func (m *Machine) doStrlen(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 	})
 }
 func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
-	// SET key value [EX seconds] [PX milliseconds] [NX|XX]
+	// SET key value [EX seconds] [PX milliseconds] [NX|XX] [IFEQ value] [IFVER version]
 	// SETEX key seconds value
 	// SETNX key value
 	// PSETEX key milliseconds value
@@ -62,7 +62,7 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 	if len(cmd.Args) == 3 && commandName == "set" {
 		// fasttrack
 		return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
-			_, _, err := tx.Set(string(cmd.Args[1]), string(cmd.Args[2]), nil)
+			err := m.txSet(conn, tx, string(cmd.Args[1]), string(cmd.Args[2]), nil)
 			return nil, err
 		}, func(v interface{}) error {
 			conn.WriteString("OK")
@@ -72,6 +72,7 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 	var key, val string
 	var px, nx, xx bool
 	var pxi int
+	var cond writeCond
 	switch commandName {
 	default:
 		return nil, finn.ErrUnknownCommand
@@ -80,6 +81,12 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 		val = string(cmd.Args[2])
 		for i := 3; i < len(cmd.Args); i++ {
 			switch qcmdlower(cmd.Args[i]) {
+			case "ifeq", "ifver":
+				n, err := cond.parse(cmd.Args, i)
+				if err != nil {
+					return nil, err
+				}
+				i += n - 1
 			case "ex", "px":
 				if px {
 					return nil, errSyntaxError
@@ -135,6 +142,9 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 		nx = true
 	}
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if ok, err := cond.check(tx, key); err != nil || !ok {
+			return nil, err
+		}
 		if nx {
 			_, err := tx.Get(key)
 			if err == nil {
@@ -158,7 +168,7 @@ func (m *Machine) doSet(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx
 			opts.Expires = true
 			opts.TTL = time.Millisecond * time.Duration(pxi)
 		}
-		_, _, err := tx.Set(key, val, opts)
+		err := m.txSet(conn, tx, key, val, opts)
 		return "OK", err
 	}, func(v interface{}) error {
 		if v == nil {
@@ -177,7 +187,7 @@ func (m *Machine) doMset(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 	pipeline := qcmdlower(cmd.Args[0]) == "plset"
 	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
 		for i := 1; i < len(cmd.Args); i += 2 {
-			_, _, err := tx.Set(string(cmd.Args[i]), string(cmd.Args[i+1]), nil)
+			err := m.txSet(conn, tx, string(cmd.Args[i]), string(cmd.Args[i+1]), nil)
 			if err != nil {
 				return nil, err
 			}
@@ -210,7 +220,7 @@ func (m *Machine) doMsetnx(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			if err != buntdb.ErrNotFound {
 				return nil, err
 			}
-			_, _, err = tx.Set(key, string(cmd.Args[i+1]), nil)
+			err = m.txSet(conn, tx, key, string(cmd.Args[i+1]), nil)
 			if err != nil {
 				return nil, err
 			}
@@ -266,7 +276,7 @@ func (m *Machine) doAppend(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			return nil, err
 		}
 		val += string(cmd.Args[2])
-		_, _, err = tx.Set(key, val, nil)
+		err = m.txSet(conn, tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -321,7 +331,7 @@ func (m *Machine) doIncr(a finn.Applier, conn redcon.Conn, cmd redcon.Command, t
 		}
 		n += amt
 		val = strconv.FormatInt(n, 10)
-		_, _, err = tx.Set(key, val, nil)
+		err = m.txSet(conn, tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -358,7 +368,7 @@ func (m *Machine) doIncrbyfloat(a finn.Applier, conn redcon.Conn, cmd redcon.Com
 			return nil, errors.New("ERR increment would produce NaN or Infinity")
 		}
 		val = strconv.FormatFloat(n, 'f', -1, 64)
-		_, _, err = tx.Set(key, val, nil)
+		err = m.txSet(conn, tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -384,7 +394,7 @@ func (m *Machine) doGetset(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				return nil, err
 			}
 		}
-		_, _, err = tx.Set(key, string(cmd.Args[2]), nil)
+		err = m.txSet(conn, tx, key, string(cmd.Args[2]), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -488,7 +498,7 @@ func (m *Machine) doSetrange(a finn.Applier, conn redcon.Conn, cmd redcon.Comman
 		copy(bval[offset:], cmd.Args[3])
 
 		val = string(bval)
-		_, _, err = tx.Set(key, val, nil)
+		err = m.txSet(conn, tx, key, val, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -572,7 +582,7 @@ func (m *Machine) doBitop(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 			for i := 0; i < len(val); i++ {
 				nval[i] = ^val[i]
 			}
-			_, _, err = tx.Set(string(cmd.Args[2]), string(nval), nil)
+			err = m.txSet(conn, tx, string(cmd.Args[2]), string(nval), nil)
 			if err != nil {
 				return nil, err
 			}
@@ -611,7 +621,7 @@ func (m *Machine) doBitop(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 				}
 			}
 		}
-		_, _, err := tx.Set(string(cmd.Args[2]), string(nval), nil)
+		err := m.txSet(conn, tx, string(cmd.Args[2]), string(nval), nil)
 		if err != nil {
 			return nil, err
 		}
@@ -673,7 +683,7 @@ func (m *Machine) doSetbit(a finn.Applier, conn redcon.Conn, cmd redcon.Command,
 		if int(obit) != int(bit) {
 			bval[i] ^= 1 << pos
 		}
-		_, _, err = tx.Set(string(cmd.Args[1]), string(bval), nil)
+		err = m.txSet(conn, tx, string(cmd.Args[1]), string(bval), nil)
 		if err != nil {
 			return nil, err
 		}
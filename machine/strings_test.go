@@ -1,6 +1,7 @@
 package machine
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -9,6 +10,7 @@ func subTestStrings(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "INCRBYFLOAT", strings_INCRBYFLOAT_test)
 	runStep(t, mc, "GET", strings_GET_test)
 	runStep(t, mc, "SET", strings_SET_test)
+	runStep(t, mc, "GETVER", strings_GETVER_test)
 	runStep(t, mc, "STRLEN", strings_STRLEN_test)
 	runStep(t, mc, "BITPOS", strings_BITPOS_test)
 	runStep(t, mc, "SETBIT", strings_SETBIT_test)
@@ -157,6 +159,52 @@ func strings_SET_test(mc *mockCluster) error {
 	})
 }
 
+func strings_GETVER_test(mc *mockCluster) error {
+	err := mc.DoBatch([][]interface{}{
+		{"GETVER", "verkey"}, {0},
+		{"SET", "verkey", "value1", "IFVER", 1}, {nil},
+		{"SET", "verkey", "value1", "IFEQ", "value1"}, {nil},
+		{"SET", "verkey", "value1", "IFVER", 0}, {"OK"},
+		{"SET", "verkey", "value2", "IFEQ", "value0"}, {nil},
+		{"SET", "verkey", "value2", "IFEQ", "value1"}, {"OK"},
+		{"GET", "verkey"}, {"value2"},
+		{"SET", "verkey", "value3", "IFVER", "abc"}, {"ERR value is not an integer or out of range"},
+		{"SET", "verkey", "value3", "IFVER"}, {"ERR syntax error"},
+	})
+	if err != nil {
+		return err
+	}
+	v, err := mc.Do("GETVER", "verkey")
+	if err != nil {
+		return err
+	}
+	ver, ok := v.(int64)
+	if !ok || ver == 0 {
+		return fmt.Errorf("expected a version, got '%v'", v)
+	}
+	return mc.DoBatch([][]interface{}{
+		{"SET", "verkey", "value3", "IFVER", ver + 1}, {nil},
+		{"SET", "verkey", "value3", "IFVER", ver, "IFEQ", "value1"}, {nil},
+		{"SET", "verkey", "value3", "IFVER", ver, "IFEQ", "value2"}, {"OK"},
+		{"SET", "verkey", "value4", "IFVER", ver}, {nil},
+		{"GET", "verkey"}, {"value3"},
+		{"DEL", "verkey"}, {1},
+		{"GETVER", "verkey"}, {func(v interface{}) (resp, expect interface{}) {
+			// a deleted key keeps a newer version
+			n, _ := v.(int64)
+			return n > ver, true
+		}},
+		{"SET", "verkey", "value5", "IFVER", 0}, {nil},
+		{"SET", "otherkey", "value1"}, {"OK"},
+		{"FLUSHDB"}, {"OK"},
+		// a flush clears the versions
+		{"GETVER", "otherkey"}, {0},
+		{"GETVER", "verkey"}, {0},
+		{"GETVER", "newkey"}, {0},
+		{"DBSIZE"}, {0},
+	})
+}
+
 func strings_SETNX_test(mc *mockCluster) error {
 	return mc.DoBatch([][]interface{}{
 		{"SETNX", "mykey", "value"}, {"OK"},
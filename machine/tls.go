@@ -0,0 +1,51 @@
+package machine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// LoadTLSConfig loads the certificate and key of a server, and returns the
+// configuration for accepting connections and the configuration for
+// connecting to the other servers in the cluster. When caFile is not empty,
+// the certificates of the servers and the clients are verified with it, and
+// every connection must present a certificate, so the peer connections use
+// mutual TLS. The certificate is used as both a server and a client
+// certificate.
+func LoadTLSConfig(certFile, keyFile, caFile string) (config, peerConfig *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	peerConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, errors.New("no certificates found in " + caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		peerConfig.RootCAs = pool
+	}
+	return config, peerConfig, nil
+}
+
+// SetTLSConfig sets the tls configuration that the machine uses to connect
+// to its own server, which it does for expiring keys. It must be set when
+// the server accepts TLS connections.
+func (m *Machine) SetTLSConfig(config *tls.Config) {
+	m.tlsConfig = config
+}
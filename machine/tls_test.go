@@ -0,0 +1,179 @@
+package machine
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func subTestTLS(t *testing.T, _ *mockCluster) {
+	dir, err := ioutil.TempDir("", "summitdb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile, err := mockCertificates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, peerConfig, err := LoadTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := mockOpenTLSCluster(2, config, peerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	runStep(t, mc, "commands", tls_COMMANDS_test)
+	runStep(t, mc, "expire", tls_EXPIRE_test)
+	runStep(t, mc, "reject", tls_REJECT_test)
+}
+
+// mockOpenTLSCluster opens a cluster of servers that use mutual tls.
+func mockOpenTLSCluster(count int, config, peerConfig *tls.Config) (*mockCluster, error) {
+	fmt.Printf("Starting TLS Raft cluster of %d servers\n", count)
+	mc := &mockCluster{}
+	for i := 0; i < count; i++ {
+		var l *mockServer
+		if i > 0 {
+			l = mc.ss[0]
+		}
+		s, err := mockOpenServerOptions(l, mockOptions{tls: config, peerTLS: peerConfig})
+		if err != nil {
+			mc.Close()
+			return nil, err
+		}
+		mc.ss = append(mc.ss, s)
+	}
+	return mc, nil
+}
+
+// mockCertificates writes a CA, and a certificate signed by the CA for
+// 127.0.0.1 and localhost.
+func mockCertificates(dir string) (certFile, keyFile, caFile string, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "summitdb test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", "", err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "summitdb test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", "", err
+	}
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+	caFile = filepath.Join(dir, "ca.crt")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: certDER},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			return "", "", "", err
+		}
+	}
+	return certFile, keyFile, caFile, nil
+}
+
+func tls_COMMANDS_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "key", "value"}, {"OK"},
+		{"GET", "key"}, {"value"},
+		{time.Second * 2}, {}, // the peers are polled every second
+		{"RAFTPEERS"}, {func(v interface{}) (resp, expect interface{}) {
+			return len(v.([]string)), 6
+		}},
+	})
+}
+
+func tls_EXPIRE_test(mc *mockCluster) error {
+	// the server expires keys by connecting to itself
+	counter := `return sdb.call("incr", "count:" + TRIGGER.event)`
+	return mc.DoBatch([][]interface{}{
+		{"SCRIPT", "LOAD", counter}, {scriptSha(counter)},
+		{"SETTRIGGER", "counter", "temp:*", "ON", "expire", "SCRIPT", scriptSha(counter)}, {"OK"},
+		{"SET", "temp:1", "value", "PX", 100}, {"OK"},
+		{time.Second * 2}, {},
+		{"GET", "count:expire"}, {"1"},
+		{"DELTRIGGER", "counter"}, {1},
+	})
+}
+
+func tls_REJECT_test(mc *mockCluster) error {
+	s := mc.ss[0]
+	// plain tcp
+	conn, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Write([]byte("PING\r\n")); err != nil {
+		return err
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		return fmt.Errorf("expected an error, got '%v'", line)
+	}
+	// tls without a client certificate
+	tconn, err := tls.Dial("tcp", s.addr(), &tls.Config{RootCAs: s.tls.RootCAs})
+	if err == nil {
+		defer tconn.Close()
+		tconn.SetDeadline(time.Now().Add(time.Second * 5))
+		if _, err = tconn.Write([]byte("PING\r\n")); err == nil {
+			var line string
+			if line, err = bufio.NewReader(tconn).ReadString('\n'); err == nil {
+				return fmt.Errorf("expected an error, got '%v'", line)
+			}
+		}
+	}
+	// tls with an unknown CA
+	if _, err := tls.Dial("tcp", s.addr(), &tls.Config{Certificates: s.tls.Certificates}); err == nil {
+		return errors.New("expected a certificate error")
+	}
+	return nil
+}
@@ -13,6 +13,8 @@ func subTestTransactions(t *testing.T, mc *mockCluster) {
 	runStep(t, mc, "SET", transactions_SET_test)
 	runStep(t, mc, "GET", transactions_GET_test)
 	runStep(t, mc, "MULTI", transactions_MULTI_test)
+	runStep(t, mc, "WATCH", transactions_WATCH_test)
+	runStep(t, mc, "WATCH tombstones", transactions_WATCHTOMBSTONES_test)
 	runStep(t, mc, "FENCE", transactions_FENCE_test)
 }
 
@@ -56,6 +58,98 @@ func transactions_MULTI_test(mc *mockCluster) error {
 	})
 }
 
+func transactions_WATCH_test(mc *mockCluster) error {
+	return mc.DoBatch([][]interface{}{
+		{"SET", "mykey", "value1"}, {"OK"},
+		{"WATCH", "mykey"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "mykey", "value2"}, {"QUEUED"},
+		{"GET", "mykey"}, {"QUEUED"},
+		{"EXEC"}, {"[OK value2]"},
+
+		{"WATCH", "mykey", "otherkey"}, {"OK"},
+		{"SET", "mykey", "value3"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "mykey", "value4"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+		{"GET", "mykey"}, {"value3"},
+
+		{"WATCH", "mykey"}, {"OK"},
+		{"SET", "mykey", "value4"}, {"OK"},
+		{"UNWATCH"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "mykey", "value5"}, {"QUEUED"},
+		{"EXEC"}, {"[OK]"},
+
+		{"WATCH", "mykey"}, {"OK"},
+		{"DEL", "mykey"}, {1},
+		{"MULTI"}, {"OK"},
+		{"GET", "mykey"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+
+		{"WATCH", "newkey"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "newkey", "value1"}, {"QUEUED"},
+		{"EXEC"}, {"[OK]"},
+
+		{"WATCH", "abakey"}, {"OK"},
+		{"SET", "abakey", "value1"}, {"OK"},
+		{"DEL", "abakey"}, {1},
+		{"MULTI"}, {"OK"},
+		{"SET", "abakey", "value2"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+		{"EXISTS", "abakey"}, {0},
+
+		{"WATCH", "newkey"}, {"OK"},
+		{"FLUSHDB"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "newkey", "value2"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+
+		{"WATCH", "newkey"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"WATCH", "newkey"}, {"ERR WATCH inside MULTI is not allowed"},
+		{"DISCARD"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "newkey", "value3"}, {"QUEUED"},
+		{"EXEC"}, {"[OK]"},
+		{"DBSIZE"}, {1},
+		{"WATCH"}, {"ERR wrong number of arguments for 'WATCH' command"},
+	})
+}
+
+func transactions_WATCHTOMBSTONES_test(mc *mockCluster) error {
+	// deleting more than maxVersionTombstones keys clears the tombstones.
+	mset := []interface{}{"MSET"}
+	for i := 0; i <= maxVersionTombstones; i++ {
+		mset = append(mset, fmt.Sprintf("tmp:%d", i), "value")
+	}
+	return mc.DoBatch([][]interface{}{
+		{"SET", "oldkey", "value1"}, {"OK"},
+		{"DEL", "oldkey"}, {1},
+		{"WATCH", "abakey"}, {"OK"},
+		{"SET", "abakey", "value1"}, {"OK"},
+		{"DEL", "abakey"}, {1},
+		mset, {"OK"},
+		{"DBSIZE"}, {maxVersionTombstones + 1},
+		{"PDEL", "tmp:*"}, {maxVersionTombstones + 1},
+		{"DBSIZE"}, {0},
+		{"GETVER", "abakey"}, {0},
+		{"GETVER", "oldkey"}, {0},
+		// the tombstone of abakey is gone, but the key may have changed
+		// since the WATCH.
+		{"MULTI"}, {"OK"},
+		{"SET", "abakey", "value2"}, {"QUEUED"},
+		{"EXEC"}, {nil},
+		// a WATCH after the tombstones were cleared is not affected.
+		{"WATCH", "oldkey"}, {"OK"},
+		{"MULTI"}, {"OK"},
+		{"SET", "oldkey", "value2"}, {"QUEUED"},
+		{"EXEC"}, {"[OK]"},
+		{"DBSIZE"}, {1},
+	})
+}
+
 func transactions_SET_test(mc *mockCluster) error {
 	s := mc.ss[rand.Int()%len(mc.ss)]
 	for {
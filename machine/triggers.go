@@ -0,0 +1,304 @@
+package machine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// A trigger runs a stored script when a key that matches the trigger pattern
+// is changed. The script runs in the same transaction as the write, so it
+// can make more changes using sdb.call, and an error from the script aborts
+// the write. The trigger details are available to the script in the TRIGGER
+// global:
+//
+//	TRIGGER.name     - the name of the trigger
+//	TRIGGER.event    - set, del, expire, or jset
+//	TRIGGER.key      - the key that was changed
+//	TRIGGER.oldValue - the previous value, or null for expire events
+//	TRIGGER.newValue - the new value, or null
+//
+// The commands of the script are checked as the user that set the trigger,
+// not the user of the write that fired it.
+const triggerKeyPrefix = sdbMetaPrefix + "trigger:"
+
+// maxTriggerDepth is the number of triggers that can be nested, which
+// happens when a trigger writes to a key that fires another trigger.
+const maxTriggerDepth = 16
+
+var errTriggerDepth = errors.New("ERR trigger nesting is too deep")
+
+type triggerArgs struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Event   string `json:"event"`
+	Sha     string `json:"sha"`
+	Script  string `json:"script"`         // source, so SCRIPT FLUSH keeps the trigger working
+	User    string `json:"user,omitempty"` // the script runs as the user, unchecked when empty
+}
+
+func validTriggerEvent(event string) bool {
+	switch event {
+	case "set", "del", "expire", "jset":
+		return true
+	}
+	return false
+}
+
+// getTriggerScript returns an idle vm for a trigger script. A trigger may
+// fire while the same script is already running, so each run takes its own
+// vm, which is returned to the pool when done.
+func (sm *scriptMachine) getTriggerScript(sha, javascript string) (*scriptVM, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if n := len(sm.trigs[sha]); n > 0 {
+		script := sm.trigs[sha][n-1]
+		sm.trigs[sha] = sm.trigs[sha][:n-1]
+		return script, nil
+	}
+	return sm.newScriptVM(javascript)
+}
+
+// putTriggerScript returns a vm to the pool.
+func (sm *scriptMachine) putTriggerScript(sha string, script *scriptVM) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.trigs[sha] = append(sm.trigs[sha], script)
+}
+
+// loadTriggers parses the triggers that are stored in the database.
+func loadTriggers(tx *buntdb.Tx) (interface{}, error) {
+	var triggers []triggerArgs
+	var ierr error
+	if err := tx.AscendGreaterOrEqual("", triggerKeyPrefix, func(tkey, tval string) bool {
+		if !strings.HasPrefix(tkey, triggerKeyPrefix) {
+			return false
+		}
+		var targs triggerArgs
+		if err := json.Unmarshal([]byte(tval), &targs); err != nil {
+			ierr = fmt.Errorf("parsing trigger '%v': %v", tkey[len(triggerKeyPrefix):], err)
+			return false
+		}
+		triggers = append(triggers, targs)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if ierr != nil {
+		return nil, ierr
+	}
+	return triggers, nil
+}
+
+// fireTriggers runs the triggers that match the key and event.
+func (m *Machine) fireTriggers(conn redcon.Conn, tx *buntdb.Tx, event, key string, oldVal, newVal *string) error {
+	if isMercMetaKey(key) {
+		return nil
+	}
+	v, err := m.triggers.get(tx, loadTriggers)
+	if err != nil {
+		return err
+	}
+	var triggers []triggerArgs
+	for _, targs := range v.([]triggerArgs) {
+		if targs.Event == event && match.Match(key, targs.Pattern) {
+			triggers = append(triggers, targs)
+		}
+	}
+	for _, targs := range triggers {
+		if err := m.runTrigger(conn, tx, targs, key, oldVal, newVal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// triggerDepth returns the number of triggers that are running for a write
+// on the conn, which is only more than zero for writes from trigger scripts.
+func triggerDepth(conn redcon.Conn) int {
+	if pconn, ok := conn.(*passiveConn); ok {
+		return pconn.triggerDepth
+	}
+	return 0
+}
+
+func (m *Machine) runTrigger(conn redcon.Conn, tx *buntdb.Tx, targs triggerArgs, key string, oldVal, newVal *string) error {
+	depth := triggerDepth(conn)
+	if depth == maxTriggerDepth {
+		return errTriggerDepth
+	}
+	script, err := m.sm.getTriggerScript(targs.Sha, targs.Script)
+	if err != nil {
+		return err
+	}
+	defer m.sm.putTriggerScript(targs.Sha, script)
+
+	env := m.sm.writeEnv()
+	caller := scriptCaller{user: targs.User, depth: depth + 1}
+	_, err = m.runScript(script, tx, true, caller, env, nil, func(rt scriptRuntime) (scriptValue, error) {
+		trigger := map[string]interface{}{
+			"name":     targs.Name,
+			"event":    targs.Event,
+			"key":      key,
+			"oldValue": nil,
+			"newValue": nil,
+		}
+		if oldVal != nil {
+			trigger["oldValue"] = *oldVal
+		}
+		if newVal != nil {
+			trigger["newValue"] = *newVal
+		}
+		rt.set("sha", targs.Sha)
+		rt.set("TRIGGER", trigger)
+		rt.set("KEYS", []string{key})
+		rt.set("ARGV", []string{})
+		return rt.run(script.prog)
+	})
+	if err != nil {
+		if err.Error() == errTriggerDepth.Error() {
+			return errTriggerDepth
+		}
+		return fmt.Errorf("ERR trigger '%s' failed: %v", targs.Name, err)
+	}
+	return nil
+}
+
+func (m *Machine) doSetTrigger(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// SETTRIGGER name pattern ON set|del|expire|jset SCRIPT sha [USER name]
+	//
+	// The USER is added by the leader for the raft log. It's only accepted
+	// from the log, or from a MULTI or an unchecked script, which are
+	// applied from the log.
+	user := connUserName(conn)
+	switch len(cmd.Args) {
+	default:
+		return nil, finn.ErrWrongNumberOfArguments
+	case 7:
+		if _, ok := conn.(*passiveConn); !ok && user != "" {
+			cmd = buildCommand(append(cmd.Args[:7:7], []byte("user"), []byte(user)))
+		}
+	case 9:
+		if user != "" {
+			return nil, finn.ErrWrongNumberOfArguments
+		}
+		if qcmdlower(cmd.Args[7]) != "user" {
+			return nil, errSyntaxError
+		}
+		user = string(cmd.Args[8])
+	}
+	if qcmdlower(cmd.Args[3]) != "on" || qcmdlower(cmd.Args[5]) != "script" {
+		return nil, errSyntaxError
+	}
+	targs := triggerArgs{
+		Name:    string(cmd.Args[1]),
+		Pattern: string(cmd.Args[2]),
+		Event:   qcmdlower(cmd.Args[4]),
+		Sha:     strings.ToLower(string(cmd.Args[6])),
+		User:    user,
+	}
+	if !validTriggerEvent(targs.Event) {
+		return nil, errors.New("ERR invalid trigger event '" + string(cmd.Args[4]) + "'")
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		javascript, err := tx.Get(scriptKeyPrefix + targs.Sha)
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				return nil, errNoScript
+			}
+			return nil, err
+		}
+		targs.Script = javascript
+		data, err := json.Marshal(targs)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := tx.Set(triggerKeyPrefix+targs.Name, string(data), nil); err != nil {
+			return nil, err
+		}
+		m.triggers.reset(tx)
+		return nil, nil
+	}, func(v interface{}) error {
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doDelTrigger(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// DELTRIGGER name
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.writeDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) (interface{}, error) {
+		if _, err := tx.Delete(triggerKeyPrefix + string(cmd.Args[1])); err != nil {
+			if err == buntdb.ErrNotFound {
+				return 0, nil
+			}
+			return nil, err
+		}
+		m.triggers.reset(tx)
+		return 1, nil
+	}, func(v interface{}) error {
+		conn.WriteInt(v.(int))
+		return nil
+	})
+}
+
+func (m *Machine) doTriggers(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// TRIGGERS pattern [DETAILS]
+	if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	pattern := string(cmd.Args[1])
+	var details bool
+	if len(cmd.Args) == 3 {
+		if qcmdlower(cmd.Args[2]) != "details" {
+			return nil, errSyntaxError
+		}
+		details = true
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		var ierr error
+		var triggers []triggerArgs
+		if err := tx.AscendGreaterOrEqual("", triggerKeyPrefix, func(key, val string) bool {
+			if !strings.HasPrefix(key, triggerKeyPrefix) {
+				return false
+			}
+			name := key[len(triggerKeyPrefix):]
+			if match.Match(name, pattern) {
+				var targs triggerArgs
+				if err := json.Unmarshal([]byte(val), &targs); err != nil {
+					ierr = fmt.Errorf("parsing trigger '%v': %v", name, err)
+					return false
+				}
+				triggers = append(triggers, targs)
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+		if ierr != nil {
+			return ierr
+		}
+		if details {
+			conn.WriteArray(len(triggers) * 4)
+		} else {
+			conn.WriteArray(len(triggers))
+		}
+		for _, targs := range triggers {
+			conn.WriteBulkString(targs.Name)
+			if details {
+				conn.WriteBulkString(targs.Pattern)
+				conn.WriteBulkString(targs.Event)
+				conn.WriteBulkString(targs.Sha)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package machine
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func subTestTriggers(t *testing.T, mc *mockCluster) {
+	runStep(t, mc, "SETTRIGGER", triggers_SETTRIGGER_test)
+	runStep(t, mc, "events", triggers_EVENTS_test)
+	runStep(t, mc, "recursion", triggers_RECURSION_test)
+	runStep(t, mc, "TRIGGERS", triggers_TRIGGERS_test)
+}
+
+func scriptSha(script string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(script)))
+}
+
+func triggers_SETTRIGGER_test(mc *mockCluster) error {
+	counter := `return sdb.call("incr", "count:" + TRIGGER.event)`
+	audit := `return sdb.call("set", "audit:" + TRIGGER.key, TRIGGER.oldValue + ">" + TRIGGER.newValue)`
+	cascade := `return sdb.call("del", "profile:" + TRIGGER.key.split(":")[1])`
+	return mc.DoBatch([][]interface{}{
+		{"SETTRIGGER", "counter", "user:*", "ON", "set", "SCRIPT", scriptSha(counter)}, {"NOSCRIPT No matching script. Please use EVAL."},
+		{"SCRIPT", "LOAD", counter}, {scriptSha(counter)},
+		{"SCRIPT", "LOAD", audit}, {scriptSha(audit)},
+		{"SCRIPT", "LOAD", cascade}, {scriptSha(cascade)},
+		{"SETTRIGGER", "counter", "user:*", "ON", "update", "SCRIPT", scriptSha(counter)}, {"ERR invalid trigger event 'update'"},
+		{"SETTRIGGER", "counter", "user:*", "WHEN", "set", "SCRIPT", scriptSha(counter)}, {"ERR syntax error"},
+		{"SETTRIGGER", "counter", "user:*", "ON", "set", "SCRIPT", scriptSha(counter)}, {"OK"},
+		{"SETTRIGGER", "audit", "user:*", "ON", "set", "SCRIPT", scriptSha(audit)}, {"OK"},
+		{"SETTRIGGER", "cascade", "user:*", "ON", "del", "SCRIPT", scriptSha(cascade)}, {"OK"},
+
+		{"SET", "user:1", "Tom"}, {"OK"},
+		{"SET", "user:1", "Jane"}, {"OK"},
+		{"GET", "count:set"}, {"2"},
+		{"GET", "audit:user:1"}, {"Tom>Jane"},
+		{"SET", "profile:1", "data"}, {"OK"},
+		{"DEL", "user:1"}, {1},
+		{"GET", "profile:1"}, {nil},
+		{"GET", "count:set"}, {"2"},
+
+		// the triggers keep the script source
+		{"SCRIPT", "FLUSH"}, {"OK"},
+		{"SET", "user:2", "Ann"}, {"OK"},
+		{"GET", "count:set"}, {"3"},
+		{"GET", "audit:user:2"}, {"null>Ann"},
+
+		{"DELTRIGGER", "counter"}, {1},
+		{"DELTRIGGER", "counter"}, {0},
+		{"DELTRIGGER", "audit"}, {1},
+		{"DELTRIGGER", "cascade"}, {1},
+		{"SET", "user:1", "Tom"}, {"OK"},
+		{"GET", "count:set"}, {"3"},
+
+		// only the servers send EXPIRED
+		{"EXPIRED", "user:1"}, {"ERR unknown command 'EXPIRED'"},
+		{"EVAL", `return sdb.call("expired", "user:1")`, 0}, {"ERR command not allowed from script 'expired'"},
+		{"GET", "user:1"}, {"Tom"},
+	})
+}
+
+func triggers_EVENTS_test(mc *mockCluster) error {
+	counter := `return sdb.call("incr", "count:" + TRIGGER.event)`
+	clock := `return sdb.call("set", "time:" + TRIGGER.key, Date.now())`
+	if err := mockAuthInternal(mc); err != nil {
+		return err
+	}
+	return mc.DoBatch([][]interface{}{
+		{"SCRIPT", "LOAD", counter}, {scriptSha(counter)},
+		{"SCRIPT", "LOAD", clock}, {scriptSha(clock)},
+		{"SETTRIGGER", "jset", "doc:*", "ON", "jset", "SCRIPT", scriptSha(counter)}, {"OK"},
+		{"SETTRIGGER", "expire", "tmp:*", "ON", "expire", "SCRIPT", scriptSha(counter)}, {"OK"},
+		{"SETTRIGGER", "clock", "clock:*", "ON", "set", "SCRIPT", scriptSha(clock)}, {"OK"},
+
+		{"JSET", "doc:1", "name", "Tom"}, {"OK"},
+		{"SET", "doc:2", "{}"}, {"OK"},
+		{"GET", "count:jset"}, {"1"},
+
+		{"SET", "tmp:1", "value", "PX", 100}, {"OK"},
+		{time.Second * 2}, {},
+		{"GET", "count:expire"}, {"1"},
+		{"GET", "count:del"}, {nil},
+
+		{"SET", "clock:1", "value"}, {"ERR trigger 'clock' failed: ERR Date is not available to a trigger that was fired outside of a script"},
+		{"SCRIPTENV", 1000, 42, "EVAL", `return sdb.call("set", "clock:1", "value")`, 0}, {"OK"},
+		{"GET", "time:clock:1"}, {"1000"},
+
+		{"DELTRIGGER", "jset"}, {1},
+		{"DELTRIGGER", "expire"}, {1},
+		{"DELTRIGGER", "clock"}, {1},
+	})
+}
+
+func triggers_RECURSION_test(mc *mockCluster) error {
+	loop := `return sdb.call("incr", TRIGGER.key)`
+	chain := `var n = parseInt(TRIGGER.key.split(":")[1]); if (n < 10) { sdb.call("set", "chain:" + (n + 1), "x") }`
+	return mc.DoBatch([][]interface{}{
+		{"SCRIPT", "LOAD", loop}, {scriptSha(loop)},
+		{"SETTRIGGER", "loop", "loop:*", "ON", "set", "SCRIPT", scriptSha(loop)}, {"OK"},
+		{"SET", "loop:1", "1"}, {"ERR trigger nesting is too deep"},
+		{"GET", "loop:1"}, {nil},
+		{"EVAL", `return sdb.call("set", "loop:1", "1")`, 0}, {"ERR trigger nesting is too deep"},
+		{"GET", "loop:1"}, {nil},
+		{"DELTRIGGER", "loop"}, {1},
+
+		// each write counts its own nesting
+		{"SCRIPT", "LOAD", chain}, {scriptSha(chain)},
+		{"SETTRIGGER", "chain", "chain:*", "ON", "set", "SCRIPT", scriptSha(chain)}, {"OK"},
+		{"SET", "chain:1", "x"}, {"OK"},
+		{"GET", "chain:10"}, {"x"},
+		{"SET", "chain:5", "x"}, {"OK"},
+		{"DELTRIGGER", "chain"}, {1},
+	})
+}
+
+func triggers_TRIGGERS_test(mc *mockCluster) error {
+	counter := `return sdb.call("incr", "count:" + TRIGGER.event)`
+	sha := scriptSha(counter)
+	return mc.DoBatch([][]interface{}{
+		{"SCRIPT", "LOAD", counter}, {sha},
+		{"SETTRIGGER", "t1", "user:*", "ON", "set", "SCRIPT", sha}, {"OK"},
+		{"SETTRIGGER", "t2", "doc:*", "ON", "del", "SCRIPT", sha}, {"OK"},
+		{"TRIGGERS", "*"}, {"[t1 t2]"},
+		{"TRIGGERS", "t2", "DETAILS"}, {"[t2 doc:* del " + sha + "]"},
+		{"FLUSHDB"}, {"OK"},
+		{"TRIGGERS", "*"}, {"[t1 t2]"},
+		{"DELTRIGGER", "t1"}, {1},
+		{"DELTRIGGER", "t2"}, {1},
+		{"TRIGGERS", "*"}, {"[]"},
+	})
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/tidwall/buntdb"
 	"github.com/tidwall/finn"
 	"github.com/tidwall/redcon"
 	"net"
@@ -52,7 +54,7 @@ func pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command,
 	switch qcmdlower(cmd.Args[0]) {
 	default:
 		return 0, cmd, nil
-	case "plget", "plset":
+	case "plget", "plset", "pljget":
 		return 0, redcon.Command{}, finn.ErrUnknownCommand
 	case "get":
 		if len(cmd.Args) != 2 {
@@ -68,6 +70,20 @@ func pipelineCommand(conn redcon.Conn, cmd redcon.Command) (int, redcon.Command,
 		for _, pcmd := range append([]redcon.Command{cmd}, pcmds...) {
 			args = append(args, pcmd.Args[1])
 		}
+	case "jget":
+		if len(cmd.Args) != 3 {
+			return 0, cmd, nil
+		}
+		// convert to a PLJGET command which is similar to a PLGET
+		for _, pcmd := range pcmds {
+			if qcmdlower(pcmd.Args[0]) != "jget" || len(pcmd.Args) != 3 {
+				return 0, cmd, nil
+			}
+		}
+		args = append(args, []byte("pljget"))
+		for _, pcmd := range append([]redcon.Command{cmd}, pcmds...) {
+			args = append(args, pcmd.Args[1], pcmd.Args[2])
+		}
 	case "set":
 		if len(cmd.Args) != 3 {
 			return 0, cmd, nil
@@ -241,6 +257,44 @@ func qcmdlower(n []byte) string {
 	return strings.ToLower(string(n))
 }
 
+// defCache caches the parsed definitions that are stored in meta keys, such
+// as the schemas and the triggers, so that a write doesn't parse all of them
+// again. The cache is dropped when a definition changes. The transaction
+// that changed it keeps loading the definitions and doesn't fill the cache,
+// so the definitions of a transaction that is rolled back are never cached.
+type defCache struct {
+	mu     sync.Mutex
+	defs   interface{}
+	cached bool
+	dirty  *buntdb.Tx // the transaction that changed a definition
+}
+
+// get returns the cached definitions, or the definitions that are loaded
+// from the transaction.
+func (dc *defCache) get(tx *buntdb.Tx, load func(tx *buntdb.Tx) (interface{}, error)) (interface{}, error) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.cached {
+		return dc.defs, nil
+	}
+	defs, err := load(tx)
+	if err != nil {
+		return nil, err
+	}
+	if tx != dc.dirty {
+		dc.defs, dc.cached, dc.dirty = defs, true, nil
+	}
+	return defs, nil
+}
+
+// reset drops the cache when a definition is changed by the transaction,
+// or when the database is replaced and tx is nil.
+func (dc *defCache) reset(tx *buntdb.Tx) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.defs, dc.cached, dc.dirty = nil, false, tx
+}
+
 // passiveApplier is a custom applier that is used only during EVAL calls.
 type passiveApplier struct {
 	log finn.Logger
@@ -273,7 +327,9 @@ func (a *passiveApplier) Log() finn.Logger {
 // scriptConn is a custom redcon.Conn type that is only used
 // during EVAL calls.
 type passiveConn struct {
-	resps []interface{}
+	resps        []interface{}
+	user         string // user of the script, empty when not checked
+	triggerDepth int    // number of triggers running for the script
 }
 
 func (conn *passiveConn) RemoteAddr() string             { return "" }
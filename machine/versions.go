@@ -0,0 +1,462 @@
+package machine
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"github.com/tidwall/finn"
+	"github.com/tidwall/redcon"
+)
+
+// Every write to a user key assigns it a new version. The version is taken
+// from a single counter which is incremented as part of the write, and
+// because all writes go through the Raft log each replica assigns the exact
+// same versions. A key that has never been written has a version of zero.
+//
+// A deleted key keeps a tombstone with the version of the delete, otherwise
+// a key that is created and deleted between a WATCH and an EXEC would look
+// unchanged. The tombstones are cleared all at once when there are more than
+// maxVersionTombstones, and a flush clears all versions. The highest version
+// that has been cleared is kept, so a WATCH that was started before it knows
+// that an absent key may have changed.
+//
+// The versions of the keys are kept in their own range of the meta keys,
+// and are counted rather than iterated by DBSIZE and INFO.
+const versionsPrefix = sdbMetaPrefix + "versions:"
+const versionKeyPrefix = versionsPrefix + "key:"
+const tombstoneKeyPrefix = versionsPrefix + "deleted:"
+
+// versionsEnd is the first key after the versions range.
+const versionsEnd = sdbMetaPrefix + "versions;"
+
+const versionCounterKey = sdbMetaPrefix + "versioncounter"
+const versionClearedKey = sdbMetaPrefix + "versioncleared"
+const versionKeysLenKey = sdbMetaPrefix + "versionkeys"
+const tombstonesLenKey = sdbMetaPrefix + "versiontombstones"
+
+// maxVersionTombstones is the number of tombstones that are kept before
+// they are cleared.
+const maxVersionTombstones = 10000
+
+// getMetaUint returns the number stored in a meta key, or zero if the key
+// does not exist.
+func getMetaUint(tx *buntdb.Tx, key string) (uint64, error) {
+	val, err := tx.Get(key)
+	if err != nil {
+		if err == buntdb.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(val, 10, 64)
+}
+
+// addMetaUint adds to the number stored in a meta key and returns the new
+// number. The key is deleted when the number becomes zero.
+func addMetaUint(tx *buntdb.Tx, key string, delta int) (uint64, error) {
+	n, err := getMetaUint(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	n = uint64(int64(n) + int64(delta))
+	if n == 0 {
+		if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+			return 0, err
+		}
+		return 0, nil
+	}
+	if _, _, err := tx.Set(key, strconv.FormatUint(n, 10), nil); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// versionKeysLen returns the number of keys that hold the versions and
+// the tombstones of user keys.
+func versionKeysLen(tx *buntdb.Tx) (int, error) {
+	keys, err := getMetaUint(tx, versionKeysLenKey)
+	if err != nil {
+		return 0, err
+	}
+	tombstones, err := getMetaUint(tx, tombstonesLenKey)
+	if err != nil {
+		return 0, err
+	}
+	return int(keys + tombstones), nil
+}
+
+// ascendMeta iterates over the meta keys, except for the versions of the
+// user keys.
+func ascendMeta(tx *buntdb.Tx, iterator func(key, val string) bool) error {
+	more := true
+	if err := tx.AscendRange("", sdbMetaPrefix, versionsPrefix, func(key, val string) bool {
+		more = iterator(key, val)
+		return more
+	}); err != nil || !more {
+		return err
+	}
+	return tx.AscendGreaterOrEqual("", versionsEnd, func(key, val string) bool {
+		if !isMercMetaKey(key) {
+			return false
+		}
+		return iterator(key, val)
+	})
+}
+
+// keyVersion returns the current version of a key.
+func keyVersion(tx *buntdb.Tx, key string) (uint64, error) {
+	ver, _, err := keyVersionState(tx, key)
+	return ver, err
+}
+
+// keyVersionState returns the current version of a key, and true if the
+// version belongs to a key that exists, rather than to a deleted key.
+func keyVersionState(tx *buntdb.Tx, key string) (uint64, bool, error) {
+	val, err := tx.Get(versionKeyPrefix + key)
+	if err == nil {
+		ver, err := strconv.ParseUint(val, 10, 64)
+		return ver, true, err
+	}
+	if err != buntdb.ErrNotFound {
+		return 0, false, err
+	}
+	ver, err := getMetaUint(tx, tombstoneKeyPrefix+key)
+	return ver, false, err
+}
+
+// nextVersion increments the version counter and returns the new version.
+func nextVersion(tx *buntdb.Tx) (string, error) {
+	n, err := addMetaUint(tx, versionCounterKey, 1)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(n, 10), nil
+}
+
+// touchKey assigns a new version to a key.
+func (m *Machine) touchKey(tx *buntdb.Tx, key string) error {
+	if isMercMetaKey(key) {
+		return nil
+	}
+	val, err := nextVersion(tx)
+	if err != nil {
+		return err
+	}
+	_, replaced, err := tx.Set(versionKeyPrefix+key, val, nil)
+	if err != nil || replaced {
+		return err
+	}
+	if _, err := addMetaUint(tx, versionKeysLenKey, 1); err != nil {
+		return err
+	}
+	if _, err := tx.Delete(tombstoneKeyPrefix + key); err != nil {
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	_, err = addMetaUint(tx, tombstonesLenKey, -1)
+	return err
+}
+
+// tombstoneKey assigns a new version to a key that has been deleted.
+func (m *Machine) tombstoneKey(tx *buntdb.Tx, key string) error {
+	val, err := nextVersion(tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Delete(versionKeyPrefix + key); err != nil {
+		if err != buntdb.ErrNotFound {
+			return err
+		}
+	} else if _, err := addMetaUint(tx, versionKeysLenKey, -1); err != nil {
+		return err
+	}
+	_, replaced, err := tx.Set(tombstoneKeyPrefix+key, val, nil)
+	if err != nil || replaced {
+		return err
+	}
+	n, err := addMetaUint(tx, tombstonesLenKey, 1)
+	if err != nil {
+		return err
+	}
+	if n > maxVersionTombstones {
+		return clearTombstones(tx)
+	}
+	return nil
+}
+
+// clearTombstones deletes all tombstones and records the highest version
+// that was cleared.
+func clearTombstones(tx *buntdb.Tx) error {
+	var keys []string
+	var cleared uint64
+	if err := tx.AscendGreaterOrEqual("", tombstoneKeyPrefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, tombstoneKeyPrefix) {
+			return false
+		}
+		keys = append(keys, key)
+		if ver, err := strconv.ParseUint(val, 10, 64); err == nil && ver > cleared {
+			cleared = ver
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Delete(tombstonesLenKey); err != nil && err != buntdb.ErrNotFound {
+		return err
+	}
+	return setVersionCleared(tx, cleared)
+}
+
+// setVersionCleared records the highest version that has been cleared.
+func setVersionCleared(tx *buntdb.Tx, ver uint64) error {
+	prev, err := getMetaUint(tx, versionClearedKey)
+	if err != nil || ver <= prev {
+		return err
+	}
+	_, _, err = tx.Set(versionClearedKey, strconv.FormatUint(ver, 10), nil)
+	return err
+}
+
+// flushVersions is called after a flush has removed all the versions of the
+// user keys. It gives the flush a version and records it as cleared, so the
+// open WATCHes see that every key may have changed.
+func flushVersions(tx *buntdb.Tx) error {
+	val, err := nextVersion(tx)
+	if err != nil {
+		return err
+	}
+	ver, _ := strconv.ParseUint(val, 10, 64)
+	return setVersionCleared(tx, ver)
+}
+
+// txDelete deletes a user key, assigns it a tombstone version, and fires the del triggers
+// that match the key.
+func (m *Machine) txDelete(conn redcon.Conn, tx *buntdb.Tx, key string) (string, error) {
+	return m.txDeleteEvent(conn, tx, "del", key)
+}
+
+// txDeleteEvent is like txDelete, but fires the triggers for the event. The
+// expire event is used for keys that have expired. Delete does not return
+// the value of an expired key, and it's not known if each server will see
+// the key as expired, so the version of the key is used to tell if it
+// existed and the triggers do not get the old value.
+func (m *Machine) txDeleteEvent(conn redcon.Conn, tx *buntdb.Tx, event, key string) (string, error) {
+	val, err := tx.Delete(key)
+	if err != nil {
+		if err != buntdb.ErrNotFound || event != "expire" {
+			return "", err
+		}
+		_, live, verr := keyVersionState(tx, key)
+		if verr != nil {
+			return "", verr
+		}
+		if !live {
+			return "", err
+		}
+	}
+	if err := m.tombstoneKey(tx, key); err != nil {
+		return "", err
+	}
+	oldVal := &val
+	if event == "expire" {
+		oldVal = nil
+	}
+	if err := m.fireTriggers(conn, tx, event, key, oldVal, nil); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// writeCond is an optional condition for a write. A conditional write only
+// happens when the current value of the key is equal to an expected value,
+// or when the current version of the key is equal to an expected version.
+type writeCond struct {
+	ifeq  bool
+	eqval string
+	ifver bool
+	ver   uint64
+}
+
+// parse reads an IFEQ or IFVER option at the argument position. Returns
+// the number of arguments consumed, or zero if the argument is not a
+// condition.
+func (c *writeCond) parse(args [][]byte, i int) (int, error) {
+	switch qcmdlower(args[i]) {
+	case "ifeq":
+		if c.ifeq || i+1 >= len(args) {
+			return 0, errSyntaxError
+		}
+		c.ifeq = true
+		c.eqval = string(args[i+1])
+		return 2, nil
+	case "ifver":
+		if c.ifver || i+1 >= len(args) {
+			return 0, errSyntaxError
+		}
+		n, err := strconv.ParseUint(string(args[i+1]), 10, 64)
+		if err != nil {
+			return 0, errNotAnInt
+		}
+		c.ifver = true
+		c.ver = n
+		return 2, nil
+	}
+	return 0, nil
+}
+
+// check returns true if the key meets the condition. This must be called
+// from inside the write transaction so that the check and the write are
+// atomic.
+func (c *writeCond) check(tx *buntdb.Tx, key string) (bool, error) {
+	if c.ifeq {
+		val, err := tx.Get(key)
+		if err != nil {
+			if err == buntdb.ErrNotFound {
+				return false, nil
+			}
+			return false, err
+		}
+		if val != c.eqval {
+			return false, nil
+		}
+	}
+	if c.ifver {
+		ver, err := keyVersion(tx, key)
+		if err != nil {
+			return false, err
+		}
+		if ver != c.ver {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *Machine) doGetver(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// GETVER key
+	if len(cmd.Args) != 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		ver, err := keyVersion(tx, string(cmd.Args[1]))
+		if err != nil {
+			return err
+		}
+		conn.WriteInt64(int64(ver))
+		return nil
+	})
+}
+
+func (m *Machine) doWatch(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// WATCH key [key ...]
+	if len(cmd.Args) < 2 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		return nil, errors.New("missing connection")
+	}
+	ctx := conn.Context().(*connContext)
+	return m.readDoApply(a, conn, cmd, tx, func(tx *buntdb.Tx) error {
+		if ctx.watch == nil {
+			ctx.watch = make(map[string]uint64)
+			// the versions after this one were assigned after the watch.
+			base, err := getMetaUint(tx, versionCounterKey)
+			if err != nil {
+				return err
+			}
+			ctx.watchbase = base
+		}
+		for i := 1; i < len(cmd.Args); i++ {
+			key := string(cmd.Args[i])
+			if _, ok := ctx.watch[key]; ok {
+				// keep the version from the first WATCH
+				continue
+			}
+			ver, err := keyVersion(tx, key)
+			if err != nil {
+				return err
+			}
+			ctx.watch[key] = ver
+		}
+		conn.WriteString("OK")
+		return nil
+	})
+}
+
+func (m *Machine) doUnwatch(a finn.Applier, conn redcon.Conn, cmd redcon.Command, tx *buntdb.Tx) (interface{}, error) {
+	// UNWATCH
+	if len(cmd.Args) != 1 {
+		return nil, finn.ErrWrongNumberOfArguments
+	}
+	if conn == nil {
+		return nil, errors.New("missing connection")
+	}
+	ctx := conn.Context().(*connContext)
+	ctx.watch = nil
+	conn.WriteString("OK")
+	return nil, nil
+}
+
+// watchCommand returns an internal command which holds the version counter
+// at the first WATCH, and the watched keys and their versions. It's sent
+// along with an EXEC so that the versions can be checked inside the
+// transaction.
+func watchCommand(base uint64, watch map[string]uint64) redcon.Command {
+	keys := make([]string, 0, len(watch))
+	for key := range watch {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := [][]byte{[]byte("watch"), []byte(strconv.FormatUint(base, 10))}
+	for _, key := range keys {
+		args = append(args, []byte(key), []byte(strconv.FormatUint(watch[key], 10)))
+	}
+	return buildCommand(args)
+}
+
+// watchedUnchanged returns true if none of the keys in the internal watch
+// command have changed. A key without a version may have been changed and
+// deleted after the WATCH if its tombstone has since been cleared.
+func watchedUnchanged(tx *buntdb.Tx, cmd redcon.Command) (bool, error) {
+	if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+		return false, errSyntaxError
+	}
+	base, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return false, errSyntaxError
+	}
+	cleared, err := getMetaUint(tx, versionClearedKey)
+	if err != nil {
+		return false, err
+	}
+	for i := 2; i < len(cmd.Args); i += 2 {
+		expected, err := strconv.ParseUint(string(cmd.Args[i+1]), 10, 64)
+		if err != nil {
+			return false, errSyntaxError
+		}
+		ver, err := keyVersion(tx, string(cmd.Args[i]))
+		if err != nil {
+			return false, err
+		}
+		if ver == 0 {
+			if cleared > base {
+				return false, nil
+			}
+			continue
+		}
+		if ver != expected {
+			return false, nil
+		}
+	}
+	return true, nil
+}